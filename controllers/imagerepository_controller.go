@@ -17,23 +17,17 @@ limitations under the License.
 package controllers
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/authn/k8schain"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	corev1 "k8s.io/api/core/v1"
@@ -48,20 +42,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
-
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/runtime/events"
 	"github.com/fluxcd/pkg/runtime/metrics"
 	"github.com/fluxcd/pkg/runtime/predicates"
 
 	imagev1 "github.com/fluxcd/image-reflector-controller/api/v1beta1"
-	"github.com/fluxcd/image-reflector-controller/internal/azure"
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/login"
 )
 
 // These are intended to match the keys used in e.g.,
@@ -90,20 +78,18 @@ type ImageRepositoryReconciler struct {
 	AwsAutoLogin   bool // automatically attempt to get credentials for images in ECR
 	GcpAutoLogin   bool // automatically attempt to get credentials for images in GCP
 	AzureAutoLogin bool // automatically attempt to get credentials for images in ACR
+	ForceHTTP1     bool // use HTTP/1.1 only for the requests to registries and providers
+
+	// loginManager is kept for the lifetime of the reconciler, so
+	// that the credentials it caches outlive a single scan.
+	loginManager *login.Manager
 }
 
 type ImageRepositoryReconcilerOptions struct {
 	MaxConcurrentReconciles int
-}
-
-type dockerConfig struct {
-	Auths map[string]authn.AuthConfig
-}
-
-type gceToken struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	TokenType   string `json:"token_type"`
+	// CredentialExpiryMetrics, when set, records the expiry of the
+	// credentials cached by the login manager.
+	CredentialExpiryMetrics *registry.CredentialExpiryMetrics
 }
 
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagerepositories,verbs=get;list;watch;create;update;patch;delete
@@ -160,7 +146,7 @@ func (r *ImageRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	if s := strings.Split(imageRepo.Spec.Image, "://"); len(s) > 1 {
 		err = fmt.Errorf(".spec.image value should not start with URL scheme; remove '%s://'", s[0])
 	} else {
-		ref, err = name.ParseReference(imageRepo.Spec.Image)
+		ref, err = registry.ParseReference(imageRepo.Spec.Image)
 	}
 
 	if err != nil {
@@ -214,95 +200,6 @@ func (r *ImageRepositoryReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	return ctrl.Result{RequeueAfter: when}, nil
 }
 
-// parseAwsImage returns the AWS account ID and region and `true` if
-// the image repository is hosted in AWS's Elastic Container Registry,
-// otherwise empty strings and `false`.
-func parseAwsImage(image string) (accountId, awsEcrRegion string, ok bool) {
-	registryPartRe := regexp.MustCompile(`([0-9+]*).dkr.ecr.([^/.]*)\.(amazonaws\.com[.cn]*)/([^:]+):?(.*)`)
-	registryParts := registryPartRe.FindAllStringSubmatch(image, -1)
-	if len(registryParts) < 1 {
-		return "", "", false
-	}
-	return registryParts[0][1], registryParts[0][2], true
-}
-
-// getAwsEcrLoginAuth obtains authentication for ECR given the account
-// ID and region (taken from the image). This assumes that the pod has
-// IAM permissions to get an authentication token, which will usually
-// be the case if it's running in EKS, and may need additional setup
-// otherwise (visit
-// https://docs.aws.amazon.com/sdk-for-go/api/aws/session/ as a
-// starting point).
-func getAwsECRLoginAuth(accountId, awsEcrRegion string) (authn.AuthConfig, error) {
-	// No caching of tokens is attempted; the quota for getting an
-	// auth token is high enough that getting a token every time you
-	// scan an image is viable for O(1000) images per region. See
-	// https://docs.aws.amazon.com/general/latest/gr/ecr.html.
-	var authConfig authn.AuthConfig
-
-	accountIDs := []string{accountId}
-	ecrService := ecr.New(session.Must(session.NewSession(&aws.Config{Region: aws.String(awsEcrRegion)})))
-	ecrToken, err := ecrService.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
-		RegistryIds: aws.StringSlice(accountIDs),
-	})
-	if err != nil {
-		return authConfig, err
-	}
-
-	token, err := base64.StdEncoding.DecodeString(*ecrToken.AuthorizationData[0].AuthorizationToken)
-	if err != nil {
-		return authConfig, err
-	}
-
-	tokenSplit := strings.Split(string(token), ":")
-	authConfig = authn.AuthConfig{
-		Username: tokenSplit[0],
-		Password: tokenSplit[1],
-	}
-	return authConfig, nil
-}
-
-// getGCRLoginAuth obtains authentication for the image by
-// getting a token from the metadata API on GCP. This assumes that
-// the pod has right to pull the image which would be the case if it
-// is hosted on GCP. It works with both service account and workload identity
-// enabled clusters.
-func getGCRLoginAuth(ctx context.Context) (authn.AuthConfig, error) {
-	var authConfig authn.AuthConfig
-	const gcpDefaultTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
-
-	request, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpDefaultTokenURL, nil)
-	if err != nil {
-		return authConfig, err
-	}
-
-	request.Header.Add("Metadata-Flavor", "Google")
-
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return authConfig, err
-	}
-	defer io.Copy(io.Discard, response.Body)
-	defer response.Body.Close()
-
-	if response.StatusCode != http.StatusOK {
-		return authConfig, fmt.Errorf("unexpected status from metadata service: %s", response.Status)
-	}
-
-	var accessToken gceToken
-	decoder := json.NewDecoder(response.Body)
-	if err := decoder.Decode(&accessToken); err != nil {
-		return authConfig, err
-	}
-
-	authConfig = authn.AuthConfig{
-		Username: "oauth2accesstoken",
-		Password: accessToken.AccessToken,
-	}
-	return authConfig, nil
-}
-
 func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1.ImageRepository, ref name.Reference) error {
 	timeout := imageRepo.GetTimeout()
 	ctx, cancel := context.WithTimeout(ctx, timeout)
@@ -334,68 +231,16 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1
 			return err
 		}
 		options = append(options, remote.WithAuth(auth))
-	} else if accountId, awsEcrRegion, ok := parseAwsImage(imageRepo.Spec.Image); ok {
-		if r.AwsAutoLogin {
-			ctrl.LoggerFrom(ctx).Info("Logging in to AWS ECR for " + imageRepo.Spec.Image)
-
-			authConfig, err := getAwsECRLoginAuth(accountId, awsEcrRegion)
-			if err != nil {
-				imagev1.SetImageRepositoryReadiness(
-					imageRepo,
-					metav1.ConditionFalse,
-					imagev1.ReconciliationFailedReason,
-					err.Error(),
-				)
-				return err
-			}
-
-			auth := authn.FromConfig(authConfig)
-			options = append(options, remote.WithAuth(auth))
-		} else {
-			ctrl.LoggerFrom(ctx).Info("No image credentials secret referenced, and ECR authentication is not enabled. To enable, set the controller flag --aws-autologin-for-ecr")
-		}
-	} else if hostIsGoogleContainerRegistry(ref.Context().RegistryStr()) {
-		if r.GcpAutoLogin {
-			ctrl.LoggerFrom(ctx).Info("Logging in to GCP GCR for " + imageRepo.Spec.Image)
-			authConfig, err := getGCRLoginAuth(ctx)
-			if err != nil {
-				ctrl.LoggerFrom(ctx).Info("error logging into GCP " + err.Error())
-				imagev1.SetImageRepositoryReadiness(
-					imageRepo,
-					metav1.ConditionFalse,
-					imagev1.ReconciliationFailedReason,
-					err.Error(),
-				)
-				return err
-			}
-
-			auth := authn.FromConfig(authConfig)
-			options = append(options, remote.WithAuth(auth))
-		} else {
-			ctrl.LoggerFrom(ctx).Info("No image credentials secret referenced, and GCR authentication is not enabled. To enable, set the controller flag --gcp-autologin-for-gcr")
-		}
-	} else if hostIsAzureContainerRegistry(ref.Context().RegistryStr()) {
-		if r.AzureAutoLogin {
-			ctrl.LoggerFrom(ctx).Info("Logging in to Azure ACR for " + imageRepo.Spec.Image)
-			authConfig, err := getAzureLoginAuth(ctx, ref)
-			if err != nil {
-				ctrl.LoggerFrom(ctx).Info("error logging into ACR " + err.Error())
-				imagev1.SetImageRepositoryReadiness(
-					imageRepo,
-					metav1.ConditionFalse,
-					imagev1.ReconciliationFailedReason,
-					err.Error(),
-				)
-				return err
-			}
-
-			auth := authn.FromConfig(authConfig)
-			options = append(options, remote.WithAuth(auth))
-		} else {
-			ctrl.LoggerFrom(ctx).Info("No image credentials secret referenced, and ACR authentication is not enabled. To enable, set the controller flag --azure-autologin-for-acr")
-		}
 	}
 
+	// The transport is only used for the requests to the registry,
+	// including its token exchanges. The logins with the providers talk
+	// to their cloud APIs, which the client certificate of the registry
+	// isn't meant for, with their own transports, which ForceHTTP1
+	// restricts to HTTP/1.1 as well. This leaves out the CA certificate
+	// too, which the ACR token exchange, made with the registry host,
+	// then goes without.
+	var transport http.RoundTripper
 	if imageRepo.Spec.CertSecretRef != nil {
 		var certSecret corev1.Secret
 		if imageRepo.Spec.SecretRef != nil && imageRepo.Spec.SecretRef.Name == imageRepo.Spec.CertSecretRef.Name {
@@ -419,17 +264,17 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1
 		if err != nil {
 			return err
 		}
-		options = append(options, remote.WithTransport(tr))
+		transport = registry.NewTransportBuilder(tr).WithForceHTTP1(r.ForceHTTP1).Build()
+	} else if r.ForceHTTP1 {
+		transport = registry.NewTransportBuilder(nil).WithForceHTTP1(true).Build()
+	}
+	if transport != nil {
+		options = append(options, remote.WithTransport(transport))
 	}
 
-	if imageRepo.Spec.ServiceAccountName != "" {
-
-		serviceAccount := corev1.ServiceAccount{}
-		// lookup service account
-		if err := r.Get(ctx, types.NamespacedName{
-			Namespace: imageRepo.GetNamespace(),
-			Name:      imageRepo.Spec.ServiceAccountName,
-		}, &serviceAccount); err != nil {
+	if imageRepo.Spec.SecretRef == nil {
+		pullSecrets, err := r.serviceAccountPullSecrets(ctx, imageRepo)
+		if err != nil {
 			imagev1.SetImageRepositoryReadiness(
 				imageRepo,
 				metav1.ConditionFalse,
@@ -439,34 +284,28 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1
 			return err
 		}
 
-		if len(serviceAccount.ImagePullSecrets) > 0 {
-			imagePullSecrets := make([]corev1.Secret, len(serviceAccount.ImagePullSecrets))
-
-			for i, ips := range serviceAccount.ImagePullSecrets {
-				var saAuthSecret corev1.Secret
-
-				if err := r.Get(ctx, types.NamespacedName{
-					Namespace: imageRepo.GetNamespace(),
-					Name:      ips.Name,
-				}, &saAuthSecret); err != nil {
-					imagev1.SetImageRepositoryReadiness(
-						imageRepo,
-						metav1.ConditionFalse,
-						imagev1.ReconciliationFailedReason,
-						err.Error(),
-					)
-					return err
-				}
-
-				imagePullSecrets[i] = saAuthSecret
-			}
-
-			keychain, err := k8schain.NewFromPullSecrets(ctx, imagePullSecrets)
-			if err != nil {
-				return err
-			}
-
-			options = append(options, remote.WithAuthFromKeychain(keychain))
+		loginManager := r.loginManager
+		if loginManager == nil {
+			loginManager = login.NewManager()
+		}
+		auth, err := loginManager.Login(ctx, imageRepo.Spec.Image, ref, login.ProviderOptions{
+			AwsAutoLogin:   r.AwsAutoLogin,
+			GcpAutoLogin:   r.GcpAutoLogin,
+			AzureAutoLogin: r.AzureAutoLogin,
+			PullSecrets:    pullSecrets,
+			ForceHTTP1:     r.ForceHTTP1,
+		})
+		if err != nil && !errors.Is(err, registry.ErrUnconfiguredProvider) {
+			imagev1.SetImageRepositoryReadiness(
+				imageRepo,
+				metav1.ConditionFalse,
+				registry.ReasonFor(err),
+				err.Error(),
+			)
+			return err
+		}
+		if auth != nil {
+			options = append(options, remote.WithAuth(auth))
 		}
 	}
 
@@ -477,7 +316,7 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1
 		imagev1.SetImageRepositoryReadiness(
 			imageRepo,
 			metav1.ConditionFalse,
-			imagev1.ReconciliationFailedReason,
+			registry.ReasonFor(err),
 			err.Error(),
 		)
 		return err
@@ -530,6 +369,36 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo *imagev1
 	return nil
 }
 
+// serviceAccountPullSecrets returns the image pull secrets of the
+// service account of the image repository, if it has one.
+func (r *ImageRepositoryReconciler) serviceAccountPullSecrets(ctx context.Context, imageRepo *imagev1.ImageRepository) ([]corev1.Secret, error) {
+	if imageRepo.Spec.ServiceAccountName == "" {
+		return nil, nil
+	}
+
+	serviceAccount := corev1.ServiceAccount{}
+	// lookup service account
+	if err := r.Get(ctx, types.NamespacedName{
+		Namespace: imageRepo.GetNamespace(),
+		Name:      imageRepo.Spec.ServiceAccountName,
+	}, &serviceAccount); err != nil {
+		return nil, err
+	}
+
+	imagePullSecrets := make([]corev1.Secret, len(serviceAccount.ImagePullSecrets))
+	for i, ips := range serviceAccount.ImagePullSecrets {
+		var saAuthSecret corev1.Secret
+		if err := r.Get(ctx, types.NamespacedName{
+			Namespace: imageRepo.GetNamespace(),
+			Name:      ips.Name,
+		}, &saAuthSecret); err != nil {
+			return nil, err
+		}
+		imagePullSecrets[i] = saAuthSecret
+	}
+	return imagePullSecrets, nil
+}
+
 func transportFromSecret(certSecret *corev1.Secret) (*http.Transport, error) {
 	// It's possible the secret doesn't contain any certs after
 	// all and the default transport could be used; but it's
@@ -608,6 +477,10 @@ func (r *ImageRepositoryReconciler) shouldScan(repo imagev1.ImageRepository, now
 }
 
 func (r *ImageRepositoryReconciler) SetupWithManager(mgr ctrl.Manager, opts ImageRepositoryReconcilerOptions) error {
+	r.loginManager = login.NewManager()
+	if opts.CredentialExpiryMetrics != nil {
+		r.loginManager.WithCredentialExpiryMetrics(opts.CredentialExpiryMetrics)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&imagev1.ImageRepository{}).
 		WithEventFilter(predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{})).
@@ -621,27 +494,16 @@ func (r *ImageRepositoryReconciler) SetupWithManager(mgr ctrl.Manager, opts Imag
 // `remote` funcs, from a Kubernetes secret. If the secret doesn't
 // have the right format or data, it returns an error.
 func authFromSecret(secret corev1.Secret, ref name.Reference) (authn.Authenticator, error) {
-	switch secret.Type {
-	case "kubernetes.io/dockerconfigjson":
-		var dockerconfig dockerConfig
-		configData := secret.Data[".dockerconfigjson"]
-		if err := json.NewDecoder(bytes.NewBuffer(configData)).Decode(&dockerconfig); err != nil {
-			return nil, err
-		}
-
-		authMap, err := parseAuthMap(dockerconfig)
-		if err != nil {
-			return nil, err
-		}
-		registry := ref.Context().RegistryStr()
-		auth, ok := authMap[registry]
-		if !ok {
-			return nil, fmt.Errorf("auth for %q not found in secret %v", registry, types.NamespacedName{Name: secret.GetName(), Namespace: secret.GetNamespace()})
-		}
-		return authn.FromConfig(auth), nil
-	default:
-		return nil, fmt.Errorf("unknown secret type %q", secret.Type)
+	authMap, err := login.AuthConfigsFromSecret(secret)
+	if err != nil {
+		return nil, err
 	}
+	registry := ref.Context().RegistryStr()
+	auth, ok := authMap[registry]
+	if !ok {
+		return nil, fmt.Errorf("auth for %q not found in secret %v", registry, types.NamespacedName{Name: secret.GetName(), Namespace: secret.GetNamespace()})
+	}
+	return authn.FromConfig(auth), nil
 }
 
 // event emits a Kubernetes event and forwards the event to notification controller if configured
@@ -704,90 +566,3 @@ func (r *ImageRepositoryReconciler) patchStatus(ctx context.Context, req ctrl.Re
 
 	return r.Status().Patch(ctx, &res, patch)
 }
-
-func parseAuthMap(config dockerConfig) (map[string]authn.AuthConfig, error) {
-	auth := map[string]authn.AuthConfig{}
-	for url, entry := range config.Auths {
-		host, err := getURLHost(url)
-		if err != nil {
-			return nil, err
-		}
-
-		auth[host] = entry
-	}
-
-	return auth, nil
-}
-
-func getURLHost(urlStr string) (string, error) {
-	if urlStr == "http://" || urlStr == "https://" {
-		return "", errors.New("Empty url")
-	}
-
-	// ensure url has https:// or http:// prefix
-	// url.Parse won't parse the ip:port format very well without the prefix.
-	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
-		urlStr = fmt.Sprintf("https://%s/", urlStr)
-	}
-
-	// Some users were passing in credentials in the form of
-	// http://docker.io and http://docker.io/v1/, etc.
-	// So strip everything down to the host.
-	// Also, the registry might be local and on a different port.
-	u, err := url.Parse(urlStr)
-	if err != nil {
-		return "", err
-	}
-
-	if u.Host == "" {
-		return "", errors.New(fmt.Sprintf(
-			"Invalid registry auth key: %s. Expected an HTTPS URL (e.g. 'https://index.docker.io/v2/' or 'https://index.docker.io'), or the same without the 'https://' (e.g., 'index.docker.io/v2/' or 'index.docker.io')",
-			urlStr))
-	}
-
-	return u.Host, nil
-}
-
-// getAzureLoginAuth returns authentication for ACR. The details needed for authentication
-// are gotten from environment variable so there is not need to mount a host path.
-func getAzureLoginAuth(ctx context.Context, ref name.Reference) (authn.AuthConfig, error) {
-	var authConfig authn.AuthConfig
-
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return authConfig, err
-	}
-	armToken, err := cred.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{string(arm.AzurePublicCloud) + ".default"},
-	})
-	if err != nil {
-		return authConfig, err
-	}
-
-	ex := azure.NewExchanger(ref.Context().RegistryStr())
-	accessToken, err := ex.ExchangeACRAccessToken(string(armToken.Token))
-	if err != nil {
-		return authConfig, fmt.Errorf("error exchanging token: %w", err)
-	}
-
-	return authn.AuthConfig{
-		// this is the acr username used by Azure
-		// See documentation: https://docs.microsoft.com/en-us/azure/container-registry/container-registry-authentication?tabs=azure-cli#az-acr-login-with---expose-token
-		Username: "00000000-0000-0000-0000-000000000000",
-		Password: accessToken,
-	}, nil
-}
-
-// List from https://github.com/kubernetes/kubernetes/blob/v1.23.1/pkg/credentialprovider/azure/azure_credentials.go#L55
-func hostIsAzureContainerRegistry(host string) bool {
-	for _, v := range []string{".azurecr.io", ".azurecr.cn", ".azurecr.de", ".azurecr.us"} {
-		if strings.HasSuffix(host, v) {
-			return true
-		}
-	}
-	return false
-}
-
-func hostIsGoogleContainerRegistry(host string) bool {
-	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
-}
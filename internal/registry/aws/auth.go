@@ -0,0 +1,398 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// autoLoginFlag is the controller flag enabling the automatic login to
+// ECR.
+const autoLoginFlag = "--aws-autologin-for-ecr"
+
+var registryPartRe = regexp.MustCompile(`^([0-9+]*).dkr.ecr.([^/.]*)\.(amazonaws\.com[.cn]*)/([^:]+):?(.*)`)
+
+// hostRe matches the hosts of ECR registries.
+var hostRe = regexp.MustCompile(`^[0-9]+\.dkr\.ecr\.[^/.]+\.amazonaws\.com(\.cn)?$`)
+
+// ValidHost returns if a given host is an ECR registry host.
+func ValidHost(host string) bool {
+	return hostRe.MatchString(host)
+}
+
+// ParseImage returns the AWS account ID and region and `true` if
+// the image repository is hosted in AWS's Elastic Container Registry,
+// otherwise empty strings and `false`. The image may carry a tag, a
+// digest, or both. For an image hosted in ECR Public, the account ID
+// is PublicAccountID and the region PublicRegion.
+func ParseImage(image string) (accountId, awsEcrRegion string, ok bool) {
+	if _, _, ok := ParsePublicImage(image); ok {
+		return PublicAccountID, PublicRegion, true
+	}
+	registryParts := registryPartRe.FindAllStringSubmatch(image, -1)
+	if len(registryParts) < 1 {
+		return "", "", false
+	}
+	return registryParts[0][1], registryParts[0][2], true
+}
+
+// Client is a AWS ECR client which can log into the registry and
+// return authorization information.
+type Client struct {
+	config         *aws.Config
+	configV2       *awsv2.Config
+	cache          *TokenCache
+	credentials    credentialsFunc
+	endpoint       string
+	region         string
+	failoverRegion string
+
+	// regionCredentials holds the credentials of the sessions of the
+	// client, by region, so that the SDK resolves them again only once
+	// they expire rather than for every login. regionCredentialsV2
+	// holds the caches of those set on a client of aws-sdk-go-v2.
+	regionCredentials   sync.Map
+	regionCredentialsV2 sync.Map
+}
+
+// NewClient creates a new ECR client with default configurations.
+func NewClient() *Client {
+	return &Client{}
+}
+
+// WithConfig allows setting the client config. The region of the
+// image being logged into always takes precedence over the region of
+// the config.
+func (c *Client) WithConfig(cfg *aws.Config) *Client {
+	c.config = cfg
+	return c
+}
+
+// WithEndpoint makes the client send its ECR API requests, including
+// those getting authorization tokens, to the given endpoint (e.g. the
+// DNS name of an ECR interface VPC endpoint) whatever the region of the
+// image. It applies to clients of either SDK, and takes precedence over
+// the endpoint of the config. Unlike an endpoint set in the config, it
+// doesn't apply to the requests made to resolve the credentials.
+func (c *Client) WithEndpoint(endpoint string) *Client {
+	c.endpoint = endpoint
+	return c
+}
+
+// WithRegion makes the client get its authorization tokens in the
+// given region, in place of the region of the image. Along with
+// WithEndpoint, this targets an ECR interface VPC endpoint of that
+// region, e.g. to scan a repository replicated from it, since the
+// requests are signed for the region: signed for the region of the
+// image, they would be rejected by an endpoint of another region. The
+// tokens are still requested for the account of the image, which the
+// principal of the client must be allowed to pull from through the
+// endpoint, and are cached per account and pinned region. The failover
+// region, if any, is tried when the pinned region fails.
+func (c *Client) WithRegion(region string) *Client {
+	c.region = region
+	return c
+}
+
+// WithFailoverRegion makes the client get its authorization tokens in
+// the given region when getting them in the region of the image (or of
+// the config) fails, e.g. for disaster-recovery setups where the
+// registry is replicated to a secondary region.
+func (c *Client) WithFailoverRegion(region string) *Client {
+	c.failoverRegion = region
+	return c
+}
+
+// WithTokenCache allows caching the authorization tokens obtained by
+// the client until they expire. Tokens are cached per account,
+// region and credential identity, so a cache can be shared by clients
+// using different credentials.
+func (c *Client) WithTokenCache(cache *TokenCache) *Client {
+	c.cache = cache
+	return c
+}
+
+// getLoginAuth obtains authentication for ECR given the account ID
+// and region (taken from the image). This assumes that the pod has
+// IAM permissions to get an authentication token, which will usually
+// be the case if it's running in EKS, and may need additional setup
+// otherwise (visit
+// https://docs.aws.amazon.com/sdk-for-go/api/aws/session/ as a
+// starting point). An empty account ID or region falls back to the
+// default registry, and the region of the config, respectively; the
+// region set with WithRegion takes precedence. When that fails, the
+// failover region is tried, if any. The account ID PublicAccountID
+// logs into ECR Public instead, see getPublicLoginAuth.
+func (c *Client) getLoginAuth(ctx context.Context, accountId, awsEcrRegion string) (authn.AuthConfig, string, error) {
+	if accountId == PublicAccountID {
+		return c.getPublicLoginAuth(ctx)
+	}
+	if c.region != "" {
+		awsEcrRegion = c.region
+	}
+	authConfig, source, err := c.getRegionLoginAuth(ctx, accountId, awsEcrRegion)
+	if err == nil || c.failoverRegion == "" || c.failoverRegion == awsEcrRegion || ctx.Err() != nil {
+		return authConfig, source, err
+	}
+	ctrl.LoggerFrom(ctx).Info("could not get ECR authorization token, failing over to region " + c.failoverRegion + ": " + registry.Redact(err.Error()))
+	authConfig, source, failoverErr := c.getRegionLoginAuth(ctx, accountId, c.failoverRegion)
+	if failoverErr != nil {
+		return authConfig, "", fmt.Errorf("%w; failover region %s: %s", err, c.failoverRegion, failoverErr)
+	}
+	return authConfig, source, nil
+}
+
+// getRegionLoginAuth obtains authentication for ECR given the account
+// ID and region, with either SDK.
+func (c *Client) getRegionLoginAuth(ctx context.Context, accountId, awsEcrRegion string) (authn.AuthConfig, string, error) {
+	if c.configV2 != nil {
+		return c.getLoginAuthV2(ctx, accountId, awsEcrRegion)
+	}
+
+	// Without a token cache, a token is requested for every login;
+	// the quota for getting an auth token is high enough that this is
+	// viable for O(1000) images per region. See
+	// https://docs.aws.amazon.com/general/latest/gr/ecr.html.
+	var authConfig authn.AuthConfig
+
+	input := &ecr.GetAuthorizationTokenInput{}
+	if accountId != "" {
+		input.RegistryIds = aws.StringSlice([]string{accountId})
+	}
+
+	sess, err := c.newSession(ctx, awsEcrRegion)
+	if err != nil {
+		return authConfig, "", err
+	}
+
+	creds, err := sess.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return authConfig, "", err
+	}
+	source := credentialSource(creds.ProviderName)
+
+	var cacheKey string
+	if c.cache != nil {
+		// The identity of the credentials is part of the key, since a
+		// token obtained by one principal must not be handed out when
+		// the credentials have changed.
+		cacheKey = tokenCacheKey(accountId, aws.StringValue(sess.Config.Region), creds.AccessKeyID)
+		if authConfig, ok := c.cache.get(cacheKey, registry.MinValidityFromContext(ctx)); ok {
+			return authConfig, source, nil
+		}
+	}
+
+	var ecrCfgs []*aws.Config
+	if c.endpoint != "" {
+		ecrCfgs = append(ecrCfgs, aws.NewConfig().WithEndpoint(c.endpoint))
+	}
+	ecrService := ecr.New(sess, ecrCfgs...)
+	ecrToken, err := ecrService.GetAuthorizationTokenWithContext(ctx, input)
+	if err != nil {
+		return authConfig, "", classifyError(err, accountId)
+	}
+	if len(ecrToken.AuthorizationData) == 0 {
+		return authConfig, "", fmt.Errorf("no authorization data returned by ECR")
+	}
+
+	authConfig, err = decodeAuthToken(aws.StringValue(ecrToken.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return authConfig, "", err
+	}
+	if expiresAt := ecrToken.AuthorizationData[0].ExpiresAt; c.cache != nil && expiresAt != nil {
+		host := proxyHost(aws.StringValue(ecrToken.AuthorizationData[0].ProxyEndpoint))
+		c.cache.set(cacheKey, host, authConfig, *expiresAt)
+	}
+	return authConfig, source, nil
+}
+
+// newSession returns a session with the config of the client, in the
+// given region unless empty, and with the credentials of the client,
+// if any. Unless the config has credentials of its own, those of the
+// first session of a region are kept for the later ones.
+func (c *Client) newSession(ctx context.Context, region string) (*session.Session, error) {
+	cfg := aws.NewConfig()
+	if c.config != nil {
+		cfg = c.config.Copy()
+	}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	}
+	if rt := registry.TransportFor(ctx, httpClientTransport(cfg.HTTPClient)); rt != nil {
+		cfg.HTTPClient = &http.Client{Transport: rt}
+	}
+	if cfg.Retryer == nil {
+		cfg.Retryer = newThrottleRetryer(cfg)
+	}
+	key := aws.StringValue(cfg.Region)
+	if c.credentials != nil {
+		creds, err := c.clientCredentials(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Credentials = creds
+	} else if cfg.Credentials == nil {
+		if creds, ok := c.regionCredentials.Load(key); ok {
+			cfg.Credentials = creds.(*credentials.Credentials)
+		}
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Credentials == nil {
+		// These are the credentials of the default chain.
+		sess.Config.Credentials = c.keepCredentials(key, sess.Config.Credentials)
+	}
+	return sess, nil
+}
+
+// clientCredentials returns the credentials set on the client, resolved
+// with cfg for its region the first time, and kept for the later
+// sessions of the region.
+func (c *Client) clientCredentials(cfg *aws.Config) (*credentials.Credentials, error) {
+	key := aws.StringValue(cfg.Region)
+	if creds, ok := c.regionCredentials.Load(key); ok {
+		return creds.(*credentials.Credentials), nil
+	}
+	creds, err := c.credentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c.keepCredentials(key, creds), nil
+}
+
+// keepCredentials keeps the credentials for the sessions of the
+// region, unless some are already kept, which it returns instead.
+func (c *Client) keepCredentials(region string, creds *credentials.Credentials) *credentials.Credentials {
+	kept, _ := c.regionCredentials.LoadOrStore(region, creds)
+	return kept.(*credentials.Credentials)
+}
+
+// httpClientTransport returns the transport of the HTTP client of a
+// config of either SDK, nil if it has none of its own.
+func httpClientTransport(client interface{}) http.RoundTripper {
+	if c, ok := client.(*http.Client); ok && c != nil {
+		return c.Transport
+	}
+	return nil
+}
+
+// classifyError wraps registry.ErrInvalidImage around the error
+// returned by ECR when it rejects the registry ID as malformed, with
+// either SDK, so that it is reported as a configuration error rather
+// than an authentication failure. Other errors are returned as is.
+func classifyError(err error, accountId string) error {
+	var awsErr awserr.Error
+	var invalidParam *ecrtypes.InvalidParameterException
+	if (errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeInvalidParameterException) ||
+		errors.As(err, &invalidParam) {
+		return fmt.Errorf("%w: ECR rejected registry ID %q: %s", registry.ErrInvalidImage, accountId, err)
+	}
+	return err
+}
+
+// decodeAuthToken decodes an ECR authorization token, which is the
+// base64 encoding of "<username>:<password>". Tokens missing their
+// padding are tolerated. Decoding errors wrap
+// registry.ErrInvalidToken.
+func decodeAuthToken(authToken string) (authn.AuthConfig, error) {
+	if authToken == "" {
+		return authn.AuthConfig{}, fmt.Errorf("%w: ECR returned an empty authorization token", registry.ErrEmptyToken)
+	}
+	token, err := base64.StdEncoding.DecodeString(authToken)
+	if err != nil {
+		var rawErr error
+		token, rawErr = base64.RawStdEncoding.DecodeString(strings.TrimRight(authToken, "="))
+		if rawErr != nil {
+			return authn.AuthConfig{}, fmt.Errorf("%w: failed to decode ECR authorization token: %s", registry.ErrInvalidToken, err)
+		}
+	}
+
+	// The password may contain colons, but not the username.
+	tokenSplit := strings.SplitN(string(token), ":", 2)
+	if len(tokenSplit) != 2 {
+		return authn.AuthConfig{}, fmt.Errorf("%w: invalid ECR authorization token format", registry.ErrInvalidToken)
+	}
+	if tokenSplit[0] == "" && tokenSplit[1] == "" {
+		return authn.AuthConfig{}, fmt.Errorf("%w: ECR authorization token holds empty credentials", registry.ErrEmptyToken)
+	}
+	return authn.AuthConfig{
+		Username: tokenSplit[0],
+		Password: tokenSplit[1],
+	}, nil
+}
+
+// Login attempts to get the authentication material for ECR. It
+// extracts the account and region information from the image URI;
+// for an image which is not an ECR URI (e.g. when the host has been
+// explicitly mapped to AWS), the default registry of the configured
+// region is used. Images of ECR Public are logged into with the
+// ecr-public API; as they can be pulled anonymously, a failure to log
+// into ECR Public (e.g. without the IAM permission, or a route to
+// PublicRegion) falls back to authn.Anonymous. Login errors are
+// sanitized, see registry.Sanitize.
+func (c *Client) Login(ctx context.Context, autoLogin bool, image string) (authn.Authenticator, error) {
+	auth, _, err := c.LoginWithSource(ctx, autoLogin, image)
+	return auth, err
+}
+
+// LoginWithSource is like Login, but also returns the source of the
+// credentials the login was done with, i.e. the provider of the
+// credentials chain which supplied them (e.g. "env" or "web-identity").
+func (c *Client) LoginWithSource(ctx context.Context, autoLogin bool, image string) (authn.Authenticator, string, error) {
+	if autoLogin {
+		ctrl.LoggerFrom(ctx).Info("logging in to AWS ECR for "+image, "partition", c.Partition(image))
+		accountId, awsEcrRegion, _ := ParseImage(image)
+
+		authConfig, source, err := c.getLoginAuth(ctx, accountId, awsEcrRegion)
+		if err != nil && accountId == PublicAccountID && ctx.Err() == nil {
+			ctrl.LoggerFrom(ctx).Info("error logging into ECR Public, pulling anonymously: " + registry.Sanitize(err).Error())
+			return authn.Anonymous, "", nil
+		}
+		if err != nil {
+			err = registry.Sanitize(err)
+			ctrl.LoggerFrom(ctx).Info("error logging into ECR " + err.Error())
+			return nil, "", err
+		}
+
+		auth := authn.FromConfig(authConfig)
+		return auth, source, nil
+	}
+	disabled := &registry.AutoLoginDisabledError{Provider: registry.ProviderAWS, Flag: autoLoginFlag}
+	ctrl.LoggerFrom(ctx).Info("ECR authentication is not enabled. To enable, set the controller flag " + disabled.Flag)
+	return nil, "", fmt.Errorf("ECR authentication failed: %w", disabled)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	ecrv2 "github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// NewClientV2 creates a new ECR client backed by aws-sdk-go-v2, using
+// the given config, e.g. as returned by `config.LoadDefaultConfig`.
+// As with WithConfig, the region of the image being logged into takes
+// precedence over the region of the config. The credentials of the
+// config are cached, if they aren't already, so that they're only
+// retrieved again once they expire.
+func NewClientV2(cfg awsv2.Config) *Client {
+	if _, ok := cfg.Credentials.(*awsv2.CredentialsCache); cfg.Credentials != nil && !ok {
+		cfg.Credentials = awsv2.NewCredentialsCache(cfg.Credentials)
+	}
+	return &Client{configV2: &cfg}
+}
+
+// getLoginAuthV2 is the aws-sdk-go-v2 counterpart of getLoginAuth.
+func (c *Client) getLoginAuthV2(ctx context.Context, accountId, awsEcrRegion string) (authn.AuthConfig, string, error) {
+	var authConfig authn.AuthConfig
+
+	cfg := c.configV2.Copy()
+	if awsEcrRegion != "" {
+		cfg.Region = awsEcrRegion
+	}
+	if rt := registry.TransportFor(ctx, httpClientTransport(cfg.HTTPClient)); rt != nil {
+		cfg.HTTPClient = &http.Client{Transport: rt}
+	}
+	if c.credentials != nil {
+		provider, err := c.clientCredentialsV2(cfg)
+		if err != nil {
+			return authConfig, "", err
+		}
+		cfg.Credentials = provider
+	}
+
+	input := &ecrv2.GetAuthorizationTokenInput{}
+	if accountId != "" {
+		input.RegistryIds = []string{accountId}
+	}
+
+	var source, cacheKey string
+	if cfg.Credentials != nil {
+		creds, err := cfg.Credentials.Retrieve(ctx)
+		if err != nil {
+			return authConfig, "", err
+		}
+		source = credentialSource(creds.Source)
+		if c.cache != nil {
+			cacheKey = tokenCacheKey(accountId, cfg.Region, creds.AccessKeyID)
+			if authConfig, ok := c.cache.get(cacheKey, registry.MinValidityFromContext(ctx)); ok {
+				return authConfig, source, nil
+			}
+		}
+	}
+
+	ecrToken, err := ecrv2.NewFromConfig(cfg, func(o *ecrv2.Options) {
+		// The resolver keeps the region it first resolves for as the
+		// signing region, so it mustn't outlive this login.
+		if c.endpoint != "" {
+			o.EndpointResolver = ecrv2.EndpointResolverFromURL(c.endpoint)
+		}
+		o.Retryer = throttleRetryerV2{Retryer: o.Retryer, maxDelay: maxRetryAfterDelay}
+		if isRetryable := registry.RetryableFromContext(ctx); isRetryable != nil {
+			o.Retryer = classifiedRetryer{Retryer: o.Retryer, isRetryable: isRetryable}
+		}
+	}).GetAuthorizationToken(ctx, input)
+	if err != nil {
+		return authConfig, "", classifyError(err, accountId)
+	}
+	if len(ecrToken.AuthorizationData) == 0 {
+		return authConfig, "", fmt.Errorf("no authorization data returned by ECR")
+	}
+
+	authConfig, err = decodeAuthToken(awsv2.ToString(ecrToken.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return authConfig, "", err
+	}
+	if expiresAt := ecrToken.AuthorizationData[0].ExpiresAt; c.cache != nil && cfg.Credentials != nil && expiresAt != nil {
+		host := proxyHost(awsv2.ToString(ecrToken.AuthorizationData[0].ProxyEndpoint))
+		c.cache.set(cacheKey, host, authConfig, *expiresAt)
+	}
+	return authConfig, source, nil
+}
+
+// clientCredentialsV2 returns the cache of the credentials set on the
+// client, resolved with aws-sdk-go for the region of cfg the first
+// time, talking to their endpoints with the HTTP client of cfg, and
+// kept for the later logins of the region.
+func (c *Client) clientCredentialsV2(cfg awsv2.Config) (awsv2.CredentialsProvider, error) {
+	if provider, ok := c.regionCredentialsV2.Load(cfg.Region); ok {
+		return provider.(awsv2.CredentialsProvider), nil
+	}
+	v1Cfg := aws.NewConfig().WithRegion(cfg.Region)
+	if client, ok := cfg.HTTPClient.(*http.Client); ok {
+		v1Cfg.HTTPClient = client
+	}
+	creds, err := c.clientCredentials(v1Cfg)
+	if err != nil {
+		return nil, err
+	}
+	provider, _ := c.regionCredentialsV2.LoadOrStore(cfg.Region, awsv2.NewCredentialsCache(v1CredentialsProvider{creds: creds}))
+	return provider.(awsv2.CredentialsProvider), nil
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// testConfigV2 returns an aws-sdk-go-v2 config which talks to the
+// given fake ECR endpoint with static credentials.
+func testConfigV2(endpoint, accessKeyID string) awsv2.Config {
+	return awsv2.Config{
+		Region: "us-east-1",
+		Credentials: awsv2.CredentialsProviderFunc(func(context.Context) (awsv2.Credentials, error) {
+			return awsv2.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: "y", SessionToken: "z"}, nil
+		}),
+		EndpointResolverWithOptions: awsv2.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...interface{}) (awsv2.Endpoint, error) {
+				return awsv2.Endpoint{URL: endpoint, SigningRegion: region}, nil
+			}),
+	}
+}
+
+func TestGetLoginAuthV2(t *testing.T) {
+	tests := []struct {
+		name           string
+		responseBody   []byte
+		statusCode     int
+		wantErr        bool
+		wantAuthConfig authn.AuthConfig
+	}{
+		{
+			// NOTE: The authorizationToken is base64 encoded.
+			name: "success",
+			responseBody: []byte(`{
+	"authorizationData": [
+		{
+			"authorizationToken": "` + testAuthToken + `"
+		}
+	]
+}`),
+			statusCode: http.StatusOK,
+			wantAuthConfig: authn.AuthConfig{
+				Username: "some-key",
+				Password: "some-secret",
+			},
+		},
+		{
+			name:         "fail",
+			responseBody: []byte(`{}`),
+			statusCode:   http.StatusInternalServerError,
+			wantErr:      true,
+		},
+		{
+			name: "invalid token",
+			responseBody: []byte(`{
+	"authorizationData": [
+		{
+			"authorizationToken": "c29tZS10b2tlbg=="
+		}
+	]
+}`),
+			statusCode: http.StatusOK,
+			wantErr:    true,
+		},
+		{
+			name:         "no authorization data",
+			responseBody: []byte(`{"authorizationData": []}`),
+			statusCode:   http.StatusOK,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				w.Write(tt.responseBody)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			ec := NewClientV2(testConfigV2(srv.URL, "x"))
+			a, _, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			if tt.statusCode == http.StatusOK && !tt.wantErr {
+				g.Expect(a).To(Equal(tt.wantAuthConfig))
+			}
+		})
+	}
+}
+
+func TestGetLoginAuthV2_TokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls int
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(`{"authorizationData": [{"authorizationToken": "%s", "expiresAt": %d}]}`,
+			testAuthToken, time.Now().Add(time.Hour).Unix())))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	cache := NewTokenCache()
+	first := NewClientV2(testConfigV2(srv.URL, "key-a")).WithTokenCache(cache)
+	_, _, err := first.getLoginAuth(context.TODO(), "0123", "us-east-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	_, _, err = first.getLoginAuth(context.TODO(), "0123", "us-east-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+
+	_, _, err = NewClientV2(testConfigV2(srv.URL, "key-b")).WithTokenCache(cache).
+		getLoginAuth(context.TODO(), "0123", "us-east-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(2))
+}
+
+func TestGetLoginAuthV2_CachesConfigCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + testAuthToken + `"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	var retrievals int
+	cfg := testConfigV2(srv.URL, "")
+	cfg.Credentials = awsv2.CredentialsProviderFunc(func(context.Context) (awsv2.Credentials, error) {
+		retrievals++
+		return awsv2.Credentials{
+			AccessKeyID:     "x",
+			SecretAccessKey: "y",
+			CanExpire:       true,
+			Expires:         time.Now().Add(time.Hour),
+		}, nil
+	})
+	ec := NewClientV2(cfg)
+	for i := 0; i < 3; i++ {
+		_, _, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(retrievals).To(Equal(1))
+}
+
+func TestLoginV2(t *testing.T) {
+	tests := []struct {
+		name       string
+		autoLogin  bool
+		image      string
+		wantErr    error
+		wantCalled bool
+	}{
+		{
+			name:       "ecr image",
+			autoLogin:  true,
+			image:      testValidECRImage,
+			wantCalled: true,
+		},
+		{
+			name:       "non-ecr image",
+			autoLogin:  true,
+			image:      "registry.example.com/foo:v1",
+			wantCalled: true,
+		},
+		{
+			name:      "autologin disabled",
+			autoLogin: false,
+			image:     testValidECRImage,
+			wantErr:   registry.ErrUnconfiguredProvider,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var called bool
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + testAuthToken + `"}]}`))
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			ec := NewClientV2(testConfigV2(srv.URL, "x"))
+			_, err := ec.Login(context.TODO(), tt.autoLogin, tt.image)
+			if tt.wantErr != nil {
+				g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+			g.Expect(called).To(Equal(tt.wantCalled))
+		})
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// tokenExpirySkew is the default of how long before their expiry cached
+// tokens stop being handed out, so that they don't expire while in use.
+const tokenExpirySkew = 5 * time.Minute
+
+// TokenCache holds ECR authorization tokens until they expire. It is
+// safe for concurrent use, and may be shared between clients.
+type TokenCache struct {
+	entries   registry.LRU
+	now       func() time.Time
+	clockSkew time.Duration
+	metrics   *registry.CredentialExpiryMetrics
+}
+
+type cachedToken struct {
+	authConfig authn.AuthConfig
+	host       string
+	expiresAt  time.Time
+}
+
+// NewTokenCache creates an empty token cache.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		now:       time.Now,
+		clockSkew: tokenExpirySkew,
+	}
+}
+
+// WithClockSkew sets how long before their expiry, as given by ECR
+// along with them, cached tokens stop being handed out, five minutes
+// by default. A token is then requested again, well before ECR would
+// reject the cached one. Negative durations are the same as zero.
+func (c *TokenCache) WithClockSkew(d time.Duration) *TokenCache {
+	if d < 0 {
+		d = 0
+	}
+	c.clockSkew = d
+	return c
+}
+
+// WithMaxCacheEntries bounds the number of tokens held by the cache to
+// n, evicting the least recently used ones. Zero or less means no
+// bound, the default.
+func (c *TokenCache) WithMaxCacheEntries(n int) *TokenCache {
+	c.entries.SetMaxEntries(n)
+	return c
+}
+
+// WithExpiryMetrics makes the cache record the expiry of the tokens it
+// caches in the given metrics, by registry host, until it drops them.
+func (c *TokenCache) WithExpiryMetrics(m *registry.CredentialExpiryMetrics) *TokenCache {
+	c.metrics = m
+	c.entries.SetOnRemove(func(_ string, value interface{}) {
+		if m != nil {
+			entry := value.(cachedToken)
+			m.DeleteExpiry(registry.ProviderAWS, entry.host, entry.expiresAt)
+		}
+	})
+	return c
+}
+
+// tokenCacheKey returns the key under which the token for the given
+// account and region, obtained with the credentials identified by
+// accessKeyID, is cached. The identity is hashed so that the key
+// doesn't carry it in clear.
+func tokenCacheKey(accountId, region, accessKeyID string) string {
+	identity := sha256.Sum256([]byte(accessKeyID))
+	return accountId + "/" + region + "/" + hex.EncodeToString(identity[:])
+}
+
+// get returns the cached token for the key, if there is one which
+// remains valid for at least minValidity beyond the clock skew.
+func (c *TokenCache) get(key string, minValidity time.Duration) (authn.AuthConfig, bool) {
+	value, ok := c.entries.Get(key)
+	if !ok {
+		return authn.AuthConfig{}, false
+	}
+	entry := value.(cachedToken)
+	if !c.now().Add(c.clockSkew + minValidity).Before(entry.expiresAt) {
+		c.entries.Delete(key)
+		return authn.AuthConfig{}, false
+	}
+	return entry.authConfig, true
+}
+
+// set caches the token for the registry host under the key until
+// expiresAt, dropping the tokens which have expired, such as those of
+// hosts no longer logged in to.
+func (c *TokenCache) set(key, host string, authConfig authn.AuthConfig, expiresAt time.Time) {
+	now := c.now()
+	c.entries.Prune(func(value interface{}) bool {
+		return !now.Before(value.(cachedToken).expiresAt)
+	})
+	c.entries.Set(key, cachedToken{authConfig: authConfig, host: host, expiresAt: expiresAt})
+	if c.metrics != nil {
+		c.metrics.RecordExpiry(registry.ProviderAWS, host, expiresAt)
+	}
+}
+
+// proxyHost returns the registry host of the proxy endpoint given by
+// ECR along with a token.
+func proxyHost(proxyEndpoint string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(proxyEndpoint, "https://"), "http://")
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestTokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+
+	authConfig := authn.AuthConfig{Username: "AWS", Password: "token"}
+	key := tokenCacheKey("0123", "us-east-1", "key-a")
+	cache.set(key, "", authConfig, now.Add(time.Hour))
+
+	got, ok := cache.get(key, 0)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(got).To(Equal(authConfig))
+
+	_, ok = cache.get(tokenCacheKey("0123", "us-east-1", "key-b"), 0)
+	g.Expect(ok).To(BeFalse())
+
+	now = now.Add(time.Hour)
+	_, ok = cache.get(key, 0)
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestTokenCache_MinValidity(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+
+	key := tokenCacheKey("0123", "us-east-1", "key")
+	cache.set(key, "", authn.AuthConfig{Username: "AWS", Password: "token"}, now.Add(time.Hour))
+
+	// The token remains valid for ten minutes beyond the default
+	// clock skew.
+	now = now.Add(40 * time.Minute)
+	_, ok := cache.get(key, 5*time.Minute)
+	g.Expect(ok).To(BeTrue())
+	_, ok = cache.get(key, 15*time.Minute)
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestTokenCacheKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := tokenCacheKey("0123", "us-east-1", "AKIAEXAMPLE")
+	g.Expect(key).ToNot(ContainSubstring("AKIAEXAMPLE"))
+	g.Expect(key).To(Equal(tokenCacheKey("0123", "us-east-1", "AKIAEXAMPLE")))
+	g.Expect(key).ToNot(Equal(tokenCacheKey("0123", "us-west-2", "AKIAEXAMPLE")))
+}
+
+func TestTokenCache_WithMaxCacheEntries(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := NewTokenCache().WithMaxCacheEntries(2)
+	expiresAt := time.Now().Add(time.Hour)
+	for _, accountId := range []string{"0001", "0002", "0003"} {
+		cache.set(tokenCacheKey(accountId, "us-east-1", "key"), "", authn.AuthConfig{Username: accountId}, expiresAt)
+	}
+
+	_, ok := cache.get(tokenCacheKey("0001", "us-east-1", "key"), 0)
+	g.Expect(ok).To(BeFalse())
+	for _, accountId := range []string{"0002", "0003"} {
+		got, ok := cache.get(tokenCacheKey(accountId, "us-east-1", "key"), 0)
+		g.Expect(ok).To(BeTrue())
+		g.Expect(got.Username).To(Equal(accountId))
+	}
+}
+
+func TestTokenCache_ExpiryMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	metrics := registry.NewCredentialExpiryMetrics()
+	cache := NewTokenCache().WithMaxCacheEntries(2).WithExpiryMetrics(metrics)
+	cache.now = func() time.Time { return now }
+	reg := prometheus.NewPedanticRegistry()
+	g.Expect(reg.Register(metrics)).To(Succeed())
+	hosts := func() []string {
+		families, err := reg.Gather()
+		g.Expect(err).ToNot(HaveOccurred())
+		var hosts []string
+		for _, family := range families {
+			for _, metric := range family.Metric {
+				hosts = append(hosts, metric.Label[0].GetValue())
+			}
+		}
+		return hosts
+	}
+
+	set := func(accountId string, lifetime time.Duration) {
+		host := accountId + ".dkr.ecr.us-east-1.amazonaws.com"
+		cache.set(tokenCacheKey(accountId, "us-east-1", "key"), host, authn.AuthConfig{}, now.Add(lifetime))
+	}
+
+	set("0001", time.Hour)
+	set("0002", 12*time.Hour)
+	g.Expect(hosts()).To(ConsistOf("0001.dkr.ecr.us-east-1.amazonaws.com", "0002.dkr.ecr.us-east-1.amazonaws.com"))
+
+	// Evicting the token of a host drops its expiry.
+	set("0003", 12*time.Hour)
+	g.Expect(hosts()).To(ConsistOf("0002.dkr.ecr.us-east-1.amazonaws.com", "0003.dkr.ecr.us-east-1.amazonaws.com"))
+
+	// So does dropping it on expiry, whether looked up again or not.
+	now = now.Add(12 * time.Hour)
+	_, ok := cache.get(tokenCacheKey("0002", "us-east-1", "key"), 0)
+	g.Expect(ok).To(BeFalse())
+	g.Expect(hosts()).To(ConsistOf("0003.dkr.ecr.us-east-1.amazonaws.com"))
+	set("0004", 12*time.Hour)
+	g.Expect(hosts()).To(ConsistOf("0004.dkr.ecr.us-east-1.amazonaws.com"))
+}
+
+func TestTokenCache_ClockSkew(t *testing.T) {
+	// ECR issues tokens valid for twelve hours.
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(12 * time.Hour)
+
+	tests := []struct {
+		name      string
+		skew      time.Duration
+		elapsed   time.Duration
+		wantValid bool
+	}{
+		{
+			name:      "fresh token with default skew",
+			skew:      -1,
+			elapsed:   time.Hour,
+			wantValid: true,
+		},
+		{
+			name:      "token outside the default skew",
+			skew:      -1,
+			elapsed:   12*time.Hour - 6*time.Minute,
+			wantValid: true,
+		},
+		{
+			name:      "token within the default skew",
+			skew:      -1,
+			elapsed:   12*time.Hour - 4*time.Minute,
+			wantValid: false,
+		},
+		{
+			name:      "token within a larger skew",
+			skew:      30 * time.Minute,
+			elapsed:   12*time.Hour - 20*time.Minute,
+			wantValid: false,
+		},
+		{
+			name:      "token without skew",
+			skew:      0,
+			elapsed:   12*time.Hour - time.Minute,
+			wantValid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			now := issuedAt
+			cache := NewTokenCache()
+			if tt.skew >= 0 {
+				cache.WithClockSkew(tt.skew)
+			}
+			cache.now = func() time.Time { return now }
+			key := tokenCacheKey("0123", "us-east-1", "key")
+			cache.set(key, "", authn.AuthConfig{Username: "AWS", Password: "token"}, expiresAt)
+
+			now = issuedAt.Add(tt.elapsed)
+			_, ok := cache.get(key, 0)
+			g.Expect(ok).To(Equal(tt.wantValid))
+		})
+	}
+}
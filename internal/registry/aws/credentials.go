@@ -0,0 +1,246 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// Environment variables pointing at the container credentials
+// endpoint, as set by ECS and Fargate.
+const (
+	containerCredentialsRelativeURIEnvVar = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	containerCredentialsFullURIEnvVar     = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	// containerAuthorizationTokenFileEnvVar points at the file holding
+	// the token to authenticate to the EKS Pod Identity agent with.
+	containerAuthorizationTokenFileEnvVar = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+)
+
+// podIdentityProviderName is the provider name reported along with
+// credentials from the EKS Pod Identity agent.
+const podIdentityProviderName = "PodIdentityProvider"
+
+// credentialsFunc resolves the credentials to use with the given
+// config, in place of the SDK's default chain.
+type credentialsFunc func(cfg *aws.Config) (*credentials.Credentials, error)
+
+// WithContainerCredentials makes the client get its credentials from
+// the container credentials endpoint only (e.g. the task role on ECS
+// or Fargate), rather than from the first provider of the default
+// chain which has some; the default chain includes the endpoint anyway
+// when the environment points at it. With a client created with
+// NewClientV2, this takes precedence over the credentials of the
+// config.
+func (c *Client) WithContainerCredentials() *Client {
+	c.credentials = containerCredentials
+	return c
+}
+
+// containerCredentials resolves the credentials from the endpoint
+// given by AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI, the same way the default chain
+// does.
+func containerCredentials(cfg *aws.Config) (*credentials.Credentials, error) {
+	if os.Getenv(containerCredentialsRelativeURIEnvVar) == "" && os.Getenv(containerCredentialsFullURIEnvVar) == "" {
+		return nil, errors.New("no container credentials endpoint: neither " +
+			containerCredentialsRelativeURIEnvVar + " nor " + containerCredentialsFullURIEnvVar + " is set")
+	}
+	providerCfg := defaults.Config()
+	providerCfg.MergeIn(cfg)
+	return credentials.NewCredentials(defaults.RemoteCredProvider(*providerCfg, defaults.Handlers())), nil
+}
+
+// WithPodIdentity makes the client get its credentials from the EKS
+// Pod Identity agent, at the endpoint given by
+// AWS_CONTAINER_CREDENTIALS_FULL_URI, authenticating with the token in
+// the file given by AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE. Both are
+// set by EKS in the pods of service accounts associated with an IAM
+// role. The token file is read anew whenever the credentials are
+// retrieved, since the token is rotated. With a client created with NewClientV2, this takes
+// precedence over the credentials of the config.
+func (c *Client) WithPodIdentity() *Client {
+	c.credentials = podIdentityCredentials
+	return c
+}
+
+// podIdentityCredentials resolves the credentials from the EKS Pod
+// Identity agent.
+func podIdentityCredentials(cfg *aws.Config) (*credentials.Credentials, error) {
+	endpoint := os.Getenv(containerCredentialsFullURIEnvVar)
+	tokenFile := os.Getenv(containerAuthorizationTokenFileEnvVar)
+	if endpoint == "" || tokenFile == "" {
+		return nil, errors.New("no EKS Pod Identity agent: " +
+			containerCredentialsFullURIEnvVar + " and " + containerAuthorizationTokenFileEnvVar + " must be set")
+	}
+
+	providerCfg := defaults.Config()
+	providerCfg.MergeIn(cfg)
+	provider := endpointcreds.NewProviderClient(*providerCfg, defaults.Handlers(), endpoint)
+	return credentials.NewCredentials(podIdentityProvider{
+		Provider:  provider.(*endpointcreds.Provider),
+		tokenFile: tokenFile,
+	}), nil
+}
+
+// podIdentityProvider authenticates to the Pod Identity agent with the
+// token currently in the token file, and reports its credentials under
+// their own provider name, rather than that of the generic endpoint
+// provider. The credentials serialize the retrievals, so that the token
+// isn't set concurrently.
+type podIdentityProvider struct {
+	*endpointcreds.Provider
+	tokenFile string
+}
+
+func (p podIdentityProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(aws.BackgroundContext())
+}
+
+func (p podIdentityProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	token, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: podIdentityProviderName},
+			fmt.Errorf("failed to read EKS Pod Identity token: %w", err)
+	}
+	p.AuthorizationToken = strings.TrimSpace(string(token))
+	v, err := p.Provider.RetrieveWithContext(ctx)
+	v.ProviderName = podIdentityProviderName
+	return v, err
+}
+
+// WithCredentialProvider makes the client get its credentials from the
+// given provider, e.g. one fetching session tokens from an external
+// broker. The credentials are retrieved again whenever the provider
+// reports them as expired, so it can rotate them. With a client
+// created with NewClientV2, this takes precedence over the credentials
+// of the config.
+func (c *Client) WithCredentialProvider(provider credentials.Provider) *Client {
+	creds := credentials.NewCredentials(provider)
+	c.credentials = func(*aws.Config) (*credentials.Credentials, error) {
+		return creds, nil
+	}
+	return c
+}
+
+// WithCredentialChain makes the client get its credentials from the
+// first source of the chain providing some: their Username, Password
+// and Token are the access key ID, secret access key and session token.
+// The name of the source is reported as the credential source. The
+// credentials are retrieved again once they expire, and for every login
+// when they don't tell when they do. With a client created with
+// NewClientV2, this takes precedence over the credentials of the
+// config.
+func (c *Client) WithCredentialChain(chain *registry.CredentialChain) *Client {
+	return c.WithCredentialProvider(&chainProvider{chain: chain})
+}
+
+// chainProvider provides the credentials of a credential chain to the
+// SDK.
+type chainProvider struct {
+	credentials.Expiry
+	chain *registry.CredentialChain
+}
+
+func (p *chainProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(aws.BackgroundContext())
+}
+
+func (p *chainProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	creds, source, err := p.chain.Credentials(ctx)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	p.SetExpiration(creds.ExpiresAt, 0)
+	return credentials.Value{
+		AccessKeyID:     creds.Username,
+		SecretAccessKey: creds.Password,
+		SessionToken:    creds.Token,
+		ProviderName:    source,
+	}, nil
+}
+
+// v1CredentialsProvider provides the credentials of aws-sdk-go, as
+// resolved with a credentialsFunc, to aws-sdk-go-v2. Credentials
+// without a known expiry are reported as expiring right away, so that
+// an aws-sdk-go-v2 cache leaves it to the aws-sdk-go ones to tell when
+// to retrieve them again, e.g. as their provider reports them expired.
+type v1CredentialsProvider struct {
+	creds *credentials.Credentials
+}
+
+func (p v1CredentialsProvider) Retrieve(ctx context.Context) (awsv2.Credentials, error) {
+	v, err := p.creds.GetWithContext(ctx)
+	if err != nil {
+		return awsv2.Credentials{}, err
+	}
+	creds := awsv2.Credentials{
+		AccessKeyID:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		SessionToken:    v.SessionToken,
+		Source:          v.ProviderName,
+	}
+	creds.CanExpire = true
+	creds.Expires = time.Now()
+	if expiresAt, err := p.creds.ExpiresAt(); err == nil {
+		creds.Expires = expiresAt
+	}
+	return creds, nil
+}
+
+// credentialSources maps the provider names reported by the SDKs
+// along with credentials, or their prefixes, to credential sources.
+var credentialSources = []struct {
+	providerName string
+	source       string
+}{
+	{"EnvProvider", "env"},
+	{"EnvConfigCredentials", "env"},
+	{"SharedCredentialsProvider", "shared-config"},
+	{"SharedConfigCredentials", "shared-config"},
+	{"WebIdentityCredentials", "web-identity"},
+	{"AssumeRoleProvider", "assume-role"},
+	{"CredentialsEndpointProvider", "container"},
+	{podIdentityProviderName, "pod-identity"},
+	{"EC2RoleProvider", "ec2-role"},
+	{"StaticProvider", "static"},
+	{"StaticCredentials", "static"},
+}
+
+// credentialSource returns the credential source for the name of the
+// provider which supplied the credentials, or the name itself if it's
+// not a known one.
+func credentialSource(providerName string) string {
+	for _, s := range credentialSources {
+		if strings.HasPrefix(providerName, s.providerName) {
+			return s.source
+		}
+	}
+	return providerName
+}
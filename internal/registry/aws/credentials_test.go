@@ -0,0 +1,428 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// isolateCredentialsEnv unsets the environment variables the default
+// credentials chain would otherwise pick up before the container
+// credentials endpoint.
+func isolateCredentialsEnv(t *testing.T) {
+	for _, env := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY",
+		"AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN",
+		containerCredentialsRelativeURIEnvVar, containerCredentialsFullURIEnvVar,
+		containerAuthorizationTokenFileEnvVar,
+	} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+}
+
+// fakeContainerCredentialsEndpoint serves the given access key ID as
+// container credentials.
+func fakeContainerCredentialsEndpoint(t *testing.T, accessKeyID string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"AccessKeyId": "%s", "SecretAccessKey": "secret", "Token": "token", "Expiration": "%s"}`,
+			accessKeyID, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	return srv
+}
+
+// fakeECR returns a fake ECR endpoint, which records the access key
+// IDs the requests are signed with.
+func fakeECR(t *testing.T, accessKeyIDs *[]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var accessKeyID string
+		fmt.Sscanf(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=%s", &accessKeyID)
+		*accessKeyIDs = append(*accessKeyIDs, accessKeyID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + testAuthToken + `"}]}`))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	return srv
+}
+
+func TestWithContainerCredentials(t *testing.T) {
+	tests := []struct {
+		name            string
+		setEndpoint     bool
+		forceContainer  bool
+		staticCreds     bool
+		wantErr         bool
+		wantAccessKeyID string
+	}{
+		{
+			name:            "forced over static credentials",
+			setEndpoint:     true,
+			forceContainer:  true,
+			staticCreds:     true,
+			wantAccessKeyID: "container-key",
+		},
+		{
+			name:            "picked up by the default chain",
+			setEndpoint:     true,
+			wantAccessKeyID: "container-key",
+		},
+		{
+			name:           "forced without endpoint",
+			forceContainer: true,
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			isolateCredentialsEnv(t)
+
+			if tt.setEndpoint {
+				credsSrv := fakeContainerCredentialsEndpoint(t, "container-key")
+				t.Setenv(containerCredentialsFullURIEnvVar, credsSrv.URL+"/v2/credentials")
+			}
+			var accessKeyIDs []string
+			ecrSrv := fakeECR(t, &accessKeyIDs)
+
+			cfg := aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1")
+			if tt.staticCreds {
+				cfg = testConfig(ecrSrv.URL)
+			}
+			ec := NewClient().WithConfig(cfg)
+			if tt.forceContainer {
+				ec.WithContainerCredentials()
+			}
+
+			_, source, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(accessKeyIDs).To(BeEmpty())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(accessKeyIDs).To(HaveLen(1))
+			g.Expect(accessKeyIDs[0]).To(HavePrefix(tt.wantAccessKeyID + "/"))
+			g.Expect(source).To(Equal("container"))
+		})
+	}
+}
+
+func TestGetLoginAuth_KeepsCredentials(t *testing.T) {
+	g := NewWithT(t)
+	isolateCredentialsEnv(t)
+
+	var retrievals int32
+	credsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&retrievals, 1)
+		fmt.Fprintf(w, `{"AccessKeyId": "container-key", "SecretAccessKey": "secret", "Token": "token", "Expiration": "%s"}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(credsSrv.Close)
+	t.Setenv(containerCredentialsFullURIEnvVar, credsSrv.URL+"/v2/credentials")
+
+	var accessKeyIDs []string
+	ecrSrv := fakeECR(t, &accessKeyIDs)
+
+	for _, newClient := range []func() *Client{
+		func() *Client {
+			return NewClient().WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1"))
+		},
+		func() *Client {
+			return NewClient().WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1")).
+				WithContainerCredentials()
+		},
+		func() *Client {
+			return NewClientV2(testConfigV2(ecrSrv.URL, "config-key")).WithContainerCredentials()
+		},
+	} {
+		atomic.StoreInt32(&retrievals, 0)
+		ec := newClient()
+		for i := 0; i < 3; i++ {
+			_, _, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		// The credentials are resolved once per region.
+		g.Expect(atomic.LoadInt32(&retrievals)).To(Equal(int32(1)))
+		_, _, err := ec.getLoginAuth(context.TODO(), "0123", "eu-west-1")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(atomic.LoadInt32(&retrievals)).To(Equal(int32(2)))
+	}
+}
+
+func TestWithPodIdentity(t *testing.T) {
+	g := NewWithT(t)
+	isolateCredentialsEnv(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "eks-pod-identity-token")
+	g.Expect(os.WriteFile(tokenFile, []byte("first-token\n"), 0o600)).To(Succeed())
+
+	var tokens []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"AccessKeyId": "pod-identity-key", "SecretAccessKey": "secret", "Token": "token", "Expiration": "%s"}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(agent.Close)
+
+	var accessKeyIDs []string
+	ecrSrv := fakeECR(t, &accessKeyIDs)
+	ec := NewClient().WithConfig(testConfig(ecrSrv.URL)).WithPodIdentity()
+
+	// Without the agent environment, the login fails rather than
+	// falling back to other credentials.
+	_, _, err := ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(accessKeyIDs).To(BeEmpty())
+
+	t.Setenv(containerCredentialsFullURIEnvVar, agent.URL+"/v1/credentials")
+	t.Setenv(containerAuthorizationTokenFileEnvVar, tokenFile)
+	_, source, err := ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal("pod-identity"))
+	g.Expect(accessKeyIDs).To(HaveLen(1))
+	g.Expect(accessKeyIDs[0]).To(HavePrefix("pod-identity-key/"))
+
+	// The credentials are kept until they expire, and then retrieved
+	// with the rotated token.
+	g.Expect(os.WriteFile(tokenFile, []byte("second-token"), 0o600)).To(Succeed())
+	_, _, err = ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens).To(Equal([]string{"first-token"}))
+	creds, ok := ec.regionCredentials.Load("us-east-1")
+	g.Expect(ok).To(BeTrue())
+	creds.(*credentials.Credentials).Expire()
+	_, _, err = ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens).To(Equal([]string{"first-token", "second-token"}))
+}
+
+func TestLoginWithSource(t *testing.T) {
+	g := NewWithT(t)
+	isolateCredentialsEnv(t)
+
+	var accessKeyIDs []string
+	ecrSrv := fakeECR(t, &accessKeyIDs)
+
+	// The chain of the session is environment first, then the
+	// container credentials endpoint.
+	credsSrv := fakeContainerCredentialsEndpoint(t, "container-key")
+	t.Setenv(containerCredentialsFullURIEnvVar, credsSrv.URL)
+	ec := NewClient().WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1"))
+	_, source, err := ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal("container"))
+
+	// The credentials of the chain are kept by the client, so a new
+	// one is needed to pick up those of the environment.
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	ec = NewClient().WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1"))
+	_, source, err = ec.LoginWithSource(context.TODO(), true, testValidECRImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal("env"))
+	g.Expect(accessKeyIDs[1]).To(HavePrefix("env-key/"))
+}
+
+func TestCredentialSource(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(credentialSource("EnvConfigCredentials")).To(Equal("env"))
+	g.Expect(credentialSource("SharedConfigCredentials: /home/user/.aws/credentials")).To(Equal("shared-config"))
+	g.Expect(credentialSource("WebIdentityCredentials")).To(Equal("web-identity"))
+	g.Expect(credentialSource("CustomProvider")).To(Equal("CustomProvider"))
+}
+
+// rotatingProvider hands out a new access key on every retrieval, and
+// reports its credentials as expired when told to.
+type rotatingProvider struct {
+	retrievals int
+	expired    bool
+}
+
+func (p *rotatingProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	p.expired = false
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("broker-key-%d", p.retrievals),
+		SecretAccessKey: "secret",
+		SessionToken:    "session",
+		ProviderName:    "BrokerProvider",
+	}, nil
+}
+
+func (p *rotatingProvider) IsExpired() bool {
+	return p.expired
+}
+
+func TestWithCredentialProvider(t *testing.T) {
+	g := NewWithT(t)
+	isolateCredentialsEnv(t)
+
+	var accessKeyIDs []string
+	ecrSrv := fakeECR(t, &accessKeyIDs)
+
+	provider := &rotatingProvider{}
+	ec := NewClient().
+		WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1")).
+		WithCredentialProvider(provider)
+
+	for i := 1; i <= 3; i++ {
+		_, source, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(source).To(Equal("BrokerProvider"))
+		if i == 2 {
+			provider.expired = true
+		}
+	}
+	g.Expect(accessKeyIDs).To(HaveLen(3))
+	// The credentials are only retrieved again once expired.
+	g.Expect(accessKeyIDs[0]).To(HavePrefix("broker-key-1/"))
+	g.Expect(accessKeyIDs[1]).To(HavePrefix("broker-key-1/"))
+	g.Expect(accessKeyIDs[2]).To(HavePrefix("broker-key-2/"))
+}
+
+func TestWithCredentialChain(t *testing.T) {
+	g := NewWithT(t)
+	isolateCredentialsEnv(t)
+
+	var accessKeyIDs []string
+	ecrSrv := fakeECR(t, &accessKeyIDs)
+
+	chain := registry.NewCredentialChain(
+		registry.EnvCredentialSource("FLUX_TEST_ACCESS_KEY_ID", "FLUX_TEST_SECRET_ACCESS_KEY", ""),
+		registry.StaticCredentialSource(registry.Credentials{
+			Username:  "chain-key",
+			Password:  "chain-secret",
+			ExpiresAt: time.Now().Add(time.Hour),
+		}),
+	)
+	ec := NewClient().
+		WithConfig(aws.NewConfig().WithEndpoint(ecrSrv.URL).WithRegion("us-east-1")).
+		WithCredentialChain(chain)
+
+	for i := 0; i < 2; i++ {
+		_, source, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(source).To(Equal("static"))
+	}
+	g.Expect(accessKeyIDs).To(HaveLen(2))
+	for _, id := range accessKeyIDs {
+		g.Expect(id).To(HavePrefix("chain-key/"))
+	}
+}
+
+func TestCredentialOptions_V2(t *testing.T) {
+	tests := []struct {
+		name            string
+		configure       func(t *testing.T, ec *Client)
+		wantAccessKeyID string
+		wantSource      string
+	}{
+		{
+			name: "container credentials",
+			configure: func(t *testing.T, ec *Client) {
+				credsSrv := fakeContainerCredentialsEndpoint(t, "container-key")
+				t.Setenv(containerCredentialsFullURIEnvVar, credsSrv.URL+"/v2/credentials")
+				ec.WithContainerCredentials()
+			},
+			wantAccessKeyID: "container-key",
+			wantSource:      "container",
+		},
+		{
+			name: "pod identity",
+			configure: func(t *testing.T, ec *Client) {
+				credsSrv := fakeContainerCredentialsEndpoint(t, "pod-identity-key")
+				tokenFile := filepath.Join(t.TempDir(), "eks-pod-identity-token")
+				if err := os.WriteFile(tokenFile, []byte("token"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(containerCredentialsFullURIEnvVar, credsSrv.URL+"/v1/credentials")
+				t.Setenv(containerAuthorizationTokenFileEnvVar, tokenFile)
+				ec.WithPodIdentity()
+			},
+			wantAccessKeyID: "pod-identity-key",
+			wantSource:      "pod-identity",
+		},
+		{
+			name: "credential provider",
+			configure: func(t *testing.T, ec *Client) {
+				ec.WithCredentialProvider(&rotatingProvider{})
+			},
+			wantAccessKeyID: "broker-key-1",
+			wantSource:      "BrokerProvider",
+		},
+		{
+			name: "credential chain",
+			configure: func(t *testing.T, ec *Client) {
+				ec.WithCredentialChain(registry.NewCredentialChain(registry.StaticCredentialSource(registry.Credentials{
+					Username: "chain-key",
+					Password: "chain-secret",
+				})))
+			},
+			wantAccessKeyID: "chain-key",
+			wantSource:      "static",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			isolateCredentialsEnv(t)
+
+			var accessKeyIDs []string
+			ecrSrv := fakeECR(t, &accessKeyIDs)
+
+			// The credentials set on the client take precedence over
+			// those of the config.
+			ec := NewClientV2(testConfigV2(ecrSrv.URL, "config-key"))
+			tt.configure(t, ec)
+
+			_, source, err := ec.getLoginAuth(context.TODO(), "0123", "us-east-1")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(source).To(Equal(tt.wantSource))
+			g.Expect(accessKeyIDs).To(HaveLen(1))
+			g.Expect(accessKeyIDs[0]).To(HavePrefix(tt.wantAccessKeyID + "/"))
+		})
+	}
+}
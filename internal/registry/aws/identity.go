@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// defaultSTSRegion is the region STS is called in when the client has
+// none, from WithRegion or its config. Any region tells the identity.
+const defaultSTSRegion = "us-east-1"
+
+// Identity returns the ARN of the principal the client logs in as
+// (e.g. the IAM role assumed with web identity), as told by STS for
+// the credentials of the client. STS is called in the region set with
+// WithRegion, if any, else that of the config, else defaultSTSRegion.
+// It doesn't log into any registry.
+func (c *Client) Identity(ctx context.Context) (string, error) {
+	var sess *session.Session
+	var err error
+	if c.configV2 != nil {
+		region := c.configV2.Region
+		if c.region != "" {
+			region = c.region
+		}
+		// "STS" is the service ID of STS in aws-sdk-go-v2.
+		sess, err = c.newSessionFromV2(ctx, region, "STS")
+	} else {
+		sess, err = c.newSession(ctx, c.region)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	stsCfg := aws.NewConfig()
+	if aws.StringValue(sess.Config.Region) == "" {
+		stsCfg.Region = aws.String(defaultSTSRegion)
+	}
+	out, err := sts.New(sess, stsCfg).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("error getting caller identity from STS: %w", err)
+	}
+	return aws.StringValue(out.Arn), nil
+}
+
+// newSessionFromV2 returns an aws-sdk-go session in the given region
+// with the current credentials of the aws-sdk-go-v2 config of the
+// client, or those set on the client if any, talking to the endpoint
+// the config resolves for the service with the given aws-sdk-go-v2
+// service ID, if any.
+func (c *Client) newSessionFromV2(ctx context.Context, region, serviceID string) (*session.Session, error) {
+	cfg := aws.NewConfig().WithRegion(region)
+	if rt := registry.TransportFor(ctx, httpClientTransport(c.configV2.HTTPClient)); rt != nil {
+		cfg.HTTPClient = &http.Client{Transport: rt}
+	} else if client, ok := c.configV2.HTTPClient.(*http.Client); ok {
+		cfg.HTTPClient = client
+	}
+	if c.credentials != nil {
+		creds, err := c.clientCredentials(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Credentials = creds
+	} else if c.configV2.Credentials != nil {
+		creds, err := c.configV2.Credentials.Retrieve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Credentials = credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)
+	}
+	if resolver := c.configV2.EndpointResolverWithOptions; resolver != nil {
+		if endpoint, err := resolver.ResolveEndpoint(serviceID, region); err == nil {
+			cfg.Endpoint = aws.String(endpoint.URL)
+		}
+	}
+	return session.NewSession(cfg)
+}
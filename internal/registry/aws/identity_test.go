@@ -0,0 +1,150 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+const testCallerIdentityResponse = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:sts::012345678901:assumed-role/flux-image-reflector/session</Arn>
+    <UserId>AROAEXAMPLE:session</UserId>
+    <Account>012345678901</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata>
+    <RequestId>01234567-89ab-cdef-0123-456789abcdef</RequestId>
+  </ResponseMetadata>
+</GetCallerIdentityResponse>`
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		newClient  func(endpoint string) *Client
+		statusCode int
+		wantErr    bool
+	}{
+		{
+			name:       "v1",
+			newClient:  func(endpoint string) *Client { return NewClient().WithConfig(testConfig(endpoint)) },
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "v2",
+			newClient:  func(endpoint string) *Client { return NewClientV2(testConfigV2(endpoint, "x")) },
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "access denied",
+			newClient:  func(endpoint string) *Client { return NewClient().WithConfig(testConfig(endpoint)) },
+			statusCode: http.StatusForbidden,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.ParseForm()).To(Succeed())
+				g.Expect(r.PostForm.Get("Action")).To(Equal("GetCallerIdentity"))
+				w.WriteHeader(tt.statusCode)
+				if tt.statusCode == http.StatusOK {
+					w.Write([]byte(testCallerIdentityResponse))
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			identity, err := tt.newClient(srv.URL).Identity(context.TODO())
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(identity).To(Equal("arn:aws:sts::012345678901:assumed-role/flux-image-reflector/session"))
+		})
+	}
+}
+
+func TestIdentity_Region(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_SDK_LOAD_CONFIG", "")
+
+	tests := []struct {
+		name       string
+		newClient  func(endpoint string) *Client
+		wantRegion string
+	}{
+		{
+			name: "pinned region",
+			newClient: func(endpoint string) *Client {
+				return NewClient().WithConfig(testConfig(endpoint)).WithRegion("eu-west-1")
+			},
+			wantRegion: "eu-west-1",
+		},
+		{
+			name: "pinned region with v2",
+			newClient: func(endpoint string) *Client {
+				return NewClientV2(testConfigV2(endpoint, "x")).WithRegion("eu-west-1")
+			},
+			wantRegion: "eu-west-1",
+		},
+		{
+			name: "no region",
+			newClient: func(endpoint string) *Client {
+				return NewClient().WithConfig(testConfig(endpoint).WithRegion(""))
+			},
+			wantRegion: defaultSTSRegion,
+		},
+		{
+			name: "no region with v2",
+			newClient: func(endpoint string) *Client {
+				cfg := testConfigV2(endpoint, "x")
+				cfg.Region = ""
+				return NewClientV2(cfg)
+			},
+			wantRegion: defaultSTSRegion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var region string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The credential scope of the signature is
+				// <key>/<date>/<region>/<service>/aws4_request.
+				if scope := strings.Split(r.Header.Get("Authorization"), "/"); len(scope) > 2 {
+					region = scope[2]
+				}
+				w.Write([]byte(testCallerIdentityResponse))
+			}))
+			t.Cleanup(srv.Close)
+
+			_, err := tt.newClient(srv.URL).Identity(context.TODO())
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(region).To(Equal(tt.wantRegion))
+		})
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// KnownPartitions returns the IDs of the AWS partitions the client
+// knows the regions of, e.g. "aws", "aws-cn" and "aws-us-gov".
+func KnownPartitions() []string {
+	var ids []string
+	for _, p := range endpoints.DefaultPartitions() {
+		ids = append(ids, p.ID())
+	}
+	return ids
+}
+
+// EndpointFor returns the URL of the ECR API endpoint of the region,
+// e.g. "https://api.ecr.us-east-1.amazonaws.com", or an empty string if
+// the region isn't known to be one of those of the known partitions.
+func EndpointFor(region string) string {
+	endpoint, err := endpoints.DefaultResolver().EndpointFor(ecr.EndpointsID, region, endpoints.StrictMatchingOption)
+	if err != nil {
+		return ""
+	}
+	return endpoint.URL
+}
+
+// PartitionFor returns the ID of the AWS partition of the region, e.g.
+// "aws-us-gov" for "us-gov-west-1", or an empty string if the region
+// isn't known to be one of those of the known partitions.
+func PartitionFor(region string) string {
+	p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return ""
+	}
+	return p.ID()
+}
+
+// Partition returns the ID of the AWS partition the client logs into
+// the image in: that of the region set with WithRegion, if any, else
+// that of the region of the image. ECR Public images are always logged
+// into in the partition of PublicRegion. It is empty if the region
+// isn't known to be one of those of the known partitions.
+func (c *Client) Partition(image string) string {
+	accountId, region, _ := ParseImage(image)
+	if c.region != "" && accountId != PublicAccountID {
+		region = c.region
+	}
+	return PartitionFor(region)
+}
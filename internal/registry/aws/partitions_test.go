@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestKnownPartitions(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(KnownPartitions()).To(ContainElements("aws", "aws-cn", "aws-us-gov"))
+}
+
+func TestEndpointFor(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{region: "us-east-1", want: "https://api.ecr.us-east-1.amazonaws.com"},
+		{region: "us-gov-west-1", want: "https://api.ecr.us-gov-west-1.amazonaws.com"},
+		{region: "cn-north-1", want: "https://api.ecr.cn-north-1.amazonaws.com.cn"},
+		{region: "us-east-99"},
+		{region: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(EndpointFor(tt.region)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestPartitionFor(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{region: "us-east-1", want: "aws"},
+		{region: "us-gov-west-1", want: "aws-us-gov"},
+		{region: "cn-north-1", want: "aws-cn"},
+		{region: "us-east-99", want: "aws"},
+		{region: "mars-1"},
+		{region: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(PartitionFor(tt.region)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestClient_Partition(t *testing.T) {
+	g := NewWithT(t)
+
+	image := "012345678901.dkr.ecr.us-gov-west-1.amazonaws.com/foo:v1"
+	g.Expect(NewClient().Partition(image)).To(Equal("aws-us-gov"))
+	g.Expect(NewClient().WithRegion("us-east-1").Partition(image)).To(Equal("aws"))
+	g.Expect(NewClient().Partition("ghcr.io/foo/bar:v1")).To(BeEmpty())
+	// ECR Public is always logged into in us-east-1.
+	g.Expect(NewClient().WithRegion("cn-north-1").Partition("public.ecr.aws/nginx/nginx:1.21")).To(Equal("aws"))
+}
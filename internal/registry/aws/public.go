@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// PublicRegistryHost is the host of the ECR Public registry.
+const PublicRegistryHost = "public.ecr.aws"
+
+// PublicAccountID is the account ID ParseImage returns for ECR Public
+// images, which aren't hosted in the registry of an account.
+const PublicAccountID = "public"
+
+// PublicRegion is the only region ECR Public issues its authorization
+// tokens in, whatever the region of the client.
+const PublicRegion = "us-east-1"
+
+// publicImageRe matches ECR Public images, whose path starts with the
+// registry alias: lowercase alphanumerics, hyphens and underscores.
+var publicImageRe = regexp.MustCompile(`^public\.ecr\.aws/([a-z0-9][a-z0-9_-]*)/([^:@]+)`)
+
+// ParsePublicImage returns the registry alias and the repository name
+// within the alias, and `true` if the image is hosted in ECR Public
+// (e.g. "public.ecr.aws/<alias>/<repository>:<tag>"), otherwise empty
+// strings and `false`.
+func ParsePublicImage(image string) (alias, repository string, ok bool) {
+	parts := publicImageRe.FindStringSubmatch(image)
+	if parts == nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// getPublicLoginAuth obtains authentication for ECR Public, with the
+// ecr-public API of PublicRegion. The region set with WithRegion and
+// the failover region don't apply. Tokens are cached per credential
+// identity, as those of ECR are. The clients of aws-sdk-go-v2 call the
+// API with the credentials and the "ECR PUBLIC" endpoint of their
+// config.
+func (c *Client) getPublicLoginAuth(ctx context.Context) (authn.AuthConfig, string, error) {
+	var authConfig authn.AuthConfig
+
+	var sess *session.Session
+	var err error
+	if c.configV2 != nil {
+		// "ECR PUBLIC" is the service ID of ECR Public in aws-sdk-go-v2.
+		sess, err = c.newSessionFromV2(ctx, PublicRegion, "ECR PUBLIC")
+	} else {
+		sess, err = c.newSession(ctx, PublicRegion)
+	}
+	if err != nil {
+		return authConfig, "", err
+	}
+
+	creds, err := sess.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return authConfig, "", err
+	}
+	source := credentialSource(creds.ProviderName)
+
+	var cacheKey string
+	if c.cache != nil {
+		cacheKey = tokenCacheKey(PublicAccountID, PublicRegion, creds.AccessKeyID)
+		if authConfig, ok := c.cache.get(cacheKey, registry.MinValidityFromContext(ctx)); ok {
+			return authConfig, source, nil
+		}
+	}
+
+	var publicCfgs []*aws.Config
+	if c.endpoint != "" {
+		publicCfgs = append(publicCfgs, aws.NewConfig().WithEndpoint(c.endpoint))
+	}
+	publicService := ecrpublic.New(sess, publicCfgs...)
+	publicToken, err := publicService.GetAuthorizationTokenWithContext(ctx, &ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return authConfig, "", err
+	}
+	if publicToken.AuthorizationData == nil {
+		return authConfig, "", fmt.Errorf("no authorization data returned by ECR Public")
+	}
+
+	authConfig, err = decodeAuthToken(aws.StringValue(publicToken.AuthorizationData.AuthorizationToken))
+	if err != nil {
+		return authConfig, "", err
+	}
+	if expiresAt := publicToken.AuthorizationData.ExpiresAt; c.cache != nil && expiresAt != nil {
+		c.cache.set(cacheKey, PublicRegistryHost, authConfig, *expiresAt)
+	}
+	return authConfig, source, nil
+}
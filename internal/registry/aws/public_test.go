@@ -0,0 +1,255 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestParsePublicImage(t *testing.T) {
+	tests := []struct {
+		image          string
+		wantAlias      string
+		wantRepository string
+		wantOK         bool
+	}{
+		{
+			image:          "public.ecr.aws/nginx/nginx:1.21",
+			wantAlias:      "nginx",
+			wantRepository: "nginx",
+			wantOK:         true,
+		},
+		{
+			image:          "public.ecr.aws/eks-distro/kubernetes/pause:v1.21.5-eks-1-21-8",
+			wantAlias:      "eks-distro",
+			wantRepository: "kubernetes/pause",
+			wantOK:         true,
+		},
+		{
+			image:          "public.ecr.aws/aws_samples/app@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b",
+			wantAlias:      "aws_samples",
+			wantRepository: "app",
+			wantOK:         true,
+		},
+		{
+			image:          "public.ecr.aws/a1b2c3d4/foo/bar",
+			wantAlias:      "a1b2c3d4",
+			wantRepository: "foo/bar",
+			wantOK:         true,
+		},
+		{
+			// No repository after the alias.
+			image:  "public.ecr.aws/nginx",
+			wantOK: false,
+		},
+		{
+			image:  "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+			wantOK: false,
+		},
+		{
+			image:  "example.com/public.ecr.aws/nginx/nginx",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			g := NewWithT(t)
+
+			alias, repository, ok := ParsePublicImage(tt.image)
+			g.Expect(ok).To(Equal(tt.wantOK))
+			g.Expect(alias).To(Equal(tt.wantAlias))
+			g.Expect(repository).To(Equal(tt.wantRepository))
+		})
+	}
+}
+
+// publicCredentialScopeRe matches the region of the credential scope
+// of a signature of an ECR Public API request.
+var publicCredentialScopeRe = regexp.MustCompile(`Credential=[^/]+/[0-9]+/([^/]+)/ecr-public/`)
+
+func TestGetPublicLoginAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		responseBody   []byte
+		statusCode     int
+		wantErr        bool
+		wantErrIs      error
+		wantAuthConfig authn.AuthConfig
+	}{
+		{
+			// NOTE: The authorizationToken is base64 encoded.
+			name: "success",
+			responseBody: []byte(`{
+	"authorizationData": {
+		"authorizationToken": "` + testAuthToken + `"
+	}
+}`),
+			statusCode: http.StatusOK,
+			wantAuthConfig: authn.AuthConfig{
+				Username: "some-key",
+				Password: "some-secret",
+			},
+		},
+		{
+			name:         "fail",
+			responseBody: []byte(`{}`),
+			statusCode:   http.StatusInternalServerError,
+			wantErr:      true,
+		},
+		{
+			name:         "invalid token",
+			responseBody: []byte(`{"authorizationData": {"authorizationToken": "c29tZS10b2tlbg=="}}`),
+			statusCode:   http.StatusOK,
+			wantErr:      true,
+		},
+		{
+			name:         "no authorization data",
+			responseBody: []byte(`{}`),
+			statusCode:   http.StatusOK,
+			wantErr:      true,
+		},
+		{
+			name:         "empty token",
+			responseBody: []byte(`{"authorizationData": {"authorizationToken": ""}}`),
+			statusCode:   http.StatusOK,
+			wantErr:      true,
+			wantErrIs:    registry.ErrEmptyToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var targets, signedRegions, bodies []string
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				targets = append(targets, r.Header.Get("X-Amz-Target"))
+				if m := publicCredentialScopeRe.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+					signedRegions = append(signedRegions, m[1])
+				}
+				body, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				w.WriteHeader(tt.statusCode)
+				w.Write(tt.responseBody)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			// The pinned region doesn't apply to ECR Public.
+			ec := NewClient().WithConfig(testConfig(srv.URL).WithMaxRetries(0)).WithRegion("eu-west-1")
+			a, _, err := ec.getLoginAuth(context.TODO(), PublicAccountID, PublicRegion)
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			if tt.wantErrIs != nil {
+				g.Expect(errors.Is(err, tt.wantErrIs)).To(BeTrue())
+			}
+			if tt.statusCode == http.StatusOK && !tt.wantErr {
+				g.Expect(a).To(Equal(tt.wantAuthConfig))
+			}
+
+			g.Expect(targets).To(HaveLen(1))
+			g.Expect(targets[0]).To(Equal("SpencerFrontendService.GetAuthorizationToken"))
+			g.Expect(signedRegions).To(Equal([]string{PublicRegion}))
+			g.Expect(bodies).To(Equal([]string{"{}"}))
+		})
+	}
+}
+
+func TestLogin_Public(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": {"authorizationToken": "` + testAuthToken + `", "expiresAt": 4102444800}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	ec := NewClient().WithConfig(testConfig(srv.URL)).WithTokenCache(NewTokenCache())
+	for i := 0; i < 2; i++ {
+		auth, err := ec.Login(context.TODO(), true, "public.ecr.aws/nginx/nginx:1.21")
+		g.Expect(err).ToNot(HaveOccurred())
+		authConfig, err := auth.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(authConfig.Username).To(Equal("some-key"))
+	}
+	// The token is cached.
+	g.Expect(calls).To(Equal(1))
+
+	// aws-sdk-go-v2 clients log in with the endpoint of their config.
+	auth, err := NewClientV2(testConfigV2(srv.URL, "x")).Login(context.TODO(), true, "public.ecr.aws/nginx/nginx:1.21")
+	g.Expect(err).ToNot(HaveOccurred())
+	authConfig, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authConfig.Username).To(Equal("some-key"))
+	g.Expect(calls).To(Equal(2))
+}
+
+func TestLogin_PublicFallsBackToAnonymous(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "AccessDeniedException", "message": "not authorized to perform: ecr-public:GetAuthorizationToken"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name   string
+		client *Client
+	}{
+		{
+			name:   "aws-sdk-go",
+			client: NewClient().WithConfig(testConfig(srv.URL).WithMaxRetries(0)),
+		},
+		{
+			name:   "aws-sdk-go-v2",
+			client: NewClientV2(testConfigV2(srv.URL, "x")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			auth, source, err := tt.client.LoginWithSource(context.TODO(), true, "public.ecr.aws/nginx/nginx:1.21")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth).To(Equal(authn.Anonymous))
+			g.Expect(source).To(BeEmpty())
+
+			// Only ECR Public falls back.
+			_, err = tt.client.Login(context.TODO(), true, "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1")
+			g.Expect(err).To(HaveOccurred())
+
+			// A canceled login doesn't.
+			ctx, cancel := context.WithCancel(context.TODO())
+			cancel()
+			_, err = tt.client.Login(ctx, true, "public.ecr.aws/nginx/nginx:1.21")
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// maxRetryAfterDelay caps the delay asked for by a throttled ECR API
+// response, so that a login is never held up for long.
+const maxRetryAfterDelay = 30 * time.Second
+
+// throttleRetryer is the default retryer of the SDK, except that it
+// waits for as long as a throttled response asks for in its
+// Retry-After header, up to maxDelay. The default retryer only reads
+// the header of 429 and 503 responses, while ECR throttles with a 400
+// ThrottlingException. It also retries the errors deemed retryable by
+// the classifier carried by the context of the request, if any (see
+// registry.ContextWithRetryable).
+type throttleRetryer struct {
+	client.DefaultRetryer
+	maxDelay time.Duration
+}
+
+// newThrottleRetryer returns a throttleRetryer retrying as many times
+// as set in the config, or the default number of times.
+func newThrottleRetryer(cfg *aws.Config) throttleRetryer {
+	maxRetries := client.DefaultRetryerMaxNumRetries
+	if cfg.MaxRetries != nil && *cfg.MaxRetries != aws.UseServiceDefaultRetries {
+		maxRetries = *cfg.MaxRetries
+	}
+	return throttleRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: maxRetries},
+		maxDelay:       maxRetryAfterDelay,
+	}
+}
+
+// RetryRules returns the delay before retrying the request.
+func (r throttleRetryer) RetryRules(req *request.Request) time.Duration {
+	if req.IsErrorThrottle() {
+		if delay, ok := retryAfterDelay(req.HTTPResponse, time.Now()); ok {
+			if delay > r.maxDelay {
+				delay = r.maxDelay
+			}
+			return delay
+		}
+	}
+	return r.DefaultRetryer.RetryRules(req)
+}
+
+// ShouldRetry returns whether the request is to be retried: when the
+// default retryer would, or when the classifier carried by its context
+// deems its error retryable.
+func (r throttleRetryer) ShouldRetry(req *request.Request) bool {
+	if r.DefaultRetryer.ShouldRetry(req) {
+		return true
+	}
+	if isRetryable := registry.RetryableFromContext(req.Context()); isRetryable != nil && req.Error != nil {
+		return isRetryable(req.Error)
+	}
+	return false
+}
+
+// throttleRetryerV2 is the SDK v2 counterpart of throttleRetryer: the
+// given retryer, except that it waits for as long as a throttled
+// response asks for in its Retry-After header, up to maxDelay, which
+// the standard retryer of the SDK ignores.
+type throttleRetryerV2 struct {
+	awsv2.Retryer
+	maxDelay time.Duration
+}
+
+// RetryDelay returns the delay before retrying the request which
+// failed with the error.
+func (r throttleRetryerV2) RetryDelay(attempt int, err error) (time.Duration, error) {
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == awsv2.TrueTernary {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) && respErr.Response != nil {
+			if delay, ok := retryAfterDelay(respErr.Response.Response, time.Now()); ok {
+				if delay > r.maxDelay {
+					delay = r.maxDelay
+				}
+				return delay, nil
+			}
+		}
+	}
+	return r.Retryer.RetryDelay(attempt, err)
+}
+
+// classifiedRetryer is an SDK v2 retryer, which also retries the
+// errors deemed retryable by the classifier.
+type classifiedRetryer struct {
+	awsv2.Retryer
+	isRetryable func(error) bool
+}
+
+// IsErrorRetryable returns whether the retryer or the classifier deem
+// the error retryable.
+func (r classifiedRetryer) IsErrorRetryable(err error) bool {
+	return r.Retryer.IsErrorRetryable(err) || r.isRetryable(err)
+}
+
+// retryAfterDelay returns the delay asked for by the Retry-After header
+// of the response, given either in seconds or as an HTTP date, and
+// whether there is a valid one.
+func retryAfterDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestGetLoginAuth_RetryAfter(t *testing.T) {
+	tests := []struct {
+		name      string
+		newClient func(endpoint string) *Client
+	}{
+		{
+			name:      "v1",
+			newClient: func(endpoint string) *Client { return NewClient().WithConfig(testConfig(endpoint)) },
+		},
+		{
+			// The backoff of the SDK before the first retry is less
+			// than two seconds.
+			name:      "v2",
+			newClient: func(endpoint string) *Client { return NewClientV2(testConfigV2(endpoint, "x")) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var calls int
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+					w.Header().Set("Retry-After", "2")
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"__type": "ThrottlingException", "message": "Rate exceeded"}`))
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + testAuthToken + `"}]}`))
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			c := tt.newClient(srv.URL)
+			start := time.Now()
+			auth, _, err := c.getLoginAuth(context.TODO(), "0123", "us-east-1")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth.Username).To(Equal("some-key"))
+			g.Expect(calls).To(Equal(2))
+			g.Expect(time.Since(start)).To(BeNumerically(">=", 2*time.Second))
+		})
+	}
+}
+
+func TestGetLoginAuth_IsRetryable(t *testing.T) {
+	tests := []struct {
+		name        string
+		newClient   func(endpoint string) *Client
+		isRetryable func(error) bool
+		wantErr     bool
+		wantCalls   int
+	}{
+		{
+			name:      "v1 fatal error",
+			newClient: func(endpoint string) *Client { return NewClient().WithConfig(testConfig(endpoint)) },
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:        "v1 error retryable by the classifier",
+			newClient:   func(endpoint string) *Client { return NewClient().WithConfig(testConfig(endpoint)) },
+			isRetryable: isVendorBusy,
+			wantCalls:   2,
+		},
+		{
+			name:      "v2 fatal error",
+			newClient: func(endpoint string) *Client { return NewClientV2(testConfigV2(endpoint, "x")) },
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:        "v2 error retryable by the classifier",
+			newClient:   func(endpoint string) *Client { return NewClientV2(testConfigV2(endpoint, "x")) },
+			isRetryable: isVendorBusy,
+			wantCalls:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var calls int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"__type": "VendorBusyException", "message": "try again later"}`))
+					return
+				}
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + testAuthToken + `"}]}`))
+			}))
+			t.Cleanup(srv.Close)
+
+			ctx := context.TODO()
+			if tt.isRetryable != nil {
+				ctx = registry.ContextWithRetryable(ctx, tt.isRetryable)
+			}
+			_, _, err := tt.newClient(srv.URL).getLoginAuth(ctx, "0123", "us-east-1")
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			g.Expect(calls).To(Equal(tt.wantCalls))
+		})
+	}
+}
+
+// isVendorBusy is a retry classifier for a vendor-specific error.
+func isVendorBusy(err error) bool {
+	return strings.Contains(err.Error(), "VendorBusyException")
+}
+
+func TestThrottleRetryer_RetryRules(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{
+			name:       "throttled with Retry-After",
+			code:       "ThrottlingException",
+			retryAfter: "2",
+			want:       2 * time.Second,
+		},
+		{
+			name:       "throttled with Retry-After over the cap",
+			code:       "ThrottlingException",
+			retryAfter: "3600",
+			want:       5 * time.Second,
+		},
+		{
+			name:       "Retry-After ignored when not throttled",
+			code:       "ServerException",
+			retryAfter: "2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := throttleRetryer{maxDelay: 5 * time.Second}
+			r.NumMaxRetries = 3
+			req := &request.Request{
+				Error: awserr.New(tt.code, "", nil),
+				HTTPResponse: &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Header:     http.Header{"Retry-After": []string{tt.retryAfter}},
+				},
+			}
+			delay := r.RetryRules(req)
+			if tt.want != 0 {
+				g.Expect(delay).To(Equal(tt.want))
+			} else {
+				// The default retryer waits for at most 300ms on the
+				// first retry.
+				g.Expect(delay).To(BeNumerically("<", time.Second))
+			}
+		})
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{name: "seconds", value: "5", want: 5 * time.Second, wantOk: true},
+		{name: "HTTP date", value: "Wed, 01 Jun 2022 12:00:10 GMT", want: 10 * time.Second, wantOk: true},
+		{name: "past HTTP date", value: "Wed, 01 Jun 2022 11:00:00 GMT", want: 0, wantOk: true},
+		{name: "missing", value: ""},
+		{name: "negative", value: "-1"},
+		{name: "invalid", value: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			resp := &http.Response{Header: http.Header{}}
+			if tt.value != "" {
+				resp.Header.Set("Retry-After", tt.value)
+			}
+			delay, ok := retryAfterDelay(resp, now)
+			g.Expect(ok).To(Equal(tt.wantOk))
+			g.Expect(delay).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// tokenExpirySkew is the default of how long before their expiry cached
+// tokens stop being handed out, so that they don't expire while in use.
+const tokenExpirySkew = time.Minute
+
+// TokenCache holds the two kinds of ACR tokens until they expire: the
+// long-lived refresh tokens, which are obtained from AAD tokens, per
+// login server; and the short-lived access tokens, which are minted
+// with refresh tokens, per login server and repository scope. It is
+// safe for concurrent use. Since refresh tokens are only keyed by login
+// server, a cache must not be shared between clients using different
+// credentials.
+type TokenCache struct {
+	refreshTokens registry.LRU
+	accessTokens  registry.LRU
+	now           func() time.Time
+	clockSkew     time.Duration
+	metrics       *registry.CredentialExpiryMetrics
+}
+
+type cachedToken struct {
+	token     string
+	source    string
+	expiresAt time.Time
+}
+
+// NewTokenCache creates an empty token cache.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		now:       time.Now,
+		clockSkew: tokenExpirySkew,
+	}
+}
+
+// WithClockSkew sets how long before their expiry, as read from their
+// claims, cached tokens stop being handed out, one minute by default.
+// It is the tolerance for the clock of the node running behind that of
+// the registry, which would otherwise have the registry reject tokens
+// the cache still considers valid. Negative durations are the same as
+// zero.
+func (c *TokenCache) WithClockSkew(d time.Duration) *TokenCache {
+	if d < 0 {
+		d = 0
+	}
+	c.clockSkew = d
+	return c
+}
+
+// WithMaxCacheEntries bounds the number of tokens of each kind held by
+// the cache to n, evicting the least recently used ones. Zero or less
+// means no bound, the default.
+func (c *TokenCache) WithMaxCacheEntries(n int) *TokenCache {
+	c.refreshTokens.SetMaxEntries(n)
+	c.accessTokens.SetMaxEntries(n)
+	return c
+}
+
+// WithExpiryMetrics makes the cache record the expiry of the refresh
+// tokens it caches in the given metrics, by login server. Access
+// tokens are minted from the refresh tokens as needed, so their expiry
+// isn't recorded. The expiry of a refresh token is recorded until the
+// cache drops it.
+func (c *TokenCache) WithExpiryMetrics(m *registry.CredentialExpiryMetrics) *TokenCache {
+	c.metrics = m
+	c.refreshTokens.SetOnRemove(func(loginServer string, value interface{}) {
+		if m != nil {
+			m.DeleteExpiry(registry.ProviderAzure, loginServer, value.(cachedToken).expiresAt)
+		}
+	})
+	return c
+}
+
+// accessTokenKey returns the key under which the access token for the
+// scope at the login server is cached.
+func accessTokenKey(loginServer, scope string) string {
+	return loginServer + " " + scope
+}
+
+// get returns the token cached in entries for the key, along with its
+// credential source, if there is one which isn't about to expire and
+// remains valid for at least minValidity.
+func (c *TokenCache) get(entries *registry.LRU, key string, minValidity time.Duration) (cachedToken, bool) {
+	value, ok := entries.Get(key)
+	if !ok {
+		return cachedToken{}, false
+	}
+	entry := value.(cachedToken)
+	if !c.now().Add(c.clockSkew + minValidity).Before(entry.expiresAt) {
+		entries.Delete(key)
+		return cachedToken{}, false
+	}
+	return entry, true
+}
+
+// set caches the token in entries for the key, until the expiry given
+// by its claims. Tokens without a readable expiry aren't cached. The
+// tokens in entries which have expired are dropped, such as those of
+// login servers no longer logged in to.
+func (c *TokenCache) set(entries *registry.LRU, key, token, source string) {
+	expiresAt, ok := tokenExpiry(token)
+	if !ok {
+		return
+	}
+	now := c.now()
+	entries.Prune(func(value interface{}) bool {
+		return !now.Before(value.(cachedToken).expiresAt)
+	})
+	entries.Set(key, cachedToken{token: token, source: source, expiresAt: expiresAt})
+	// Refresh tokens are keyed by login server.
+	if c.metrics != nil && entries == &c.refreshTokens {
+		c.metrics.RecordExpiry(registry.ProviderAzure, key, expiresAt)
+	}
+}
+
+// tokenClaims are the claims of the JWTs issued by AAD and ACR which
+// are of interest.
+type tokenClaims struct {
+	Exp int64 `json:"exp"`
+	// AppID and AZP are the client ID of the application the token was
+	// issued to, in v1 and v2 AAD tokens respectively.
+	AppID string `json:"appid"`
+	AZP   string `json:"azp"`
+	// OID is the object ID of the principal.
+	OID string `json:"oid"`
+	// Access is what an ACR access token grants.
+	Access []tokenAccess `json:"access"`
+}
+
+// tokenAccess is an entry of the access claim of an ACR access token,
+// granting actions on a resource.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// grantsPull returns whether the access claim grants pulling from the
+// repository.
+func (c tokenClaims) grantsPull(repository string) bool {
+	for _, access := range c.Access {
+		if access.Type != "repository" || access.Name != repository {
+			continue
+		}
+		for _, action := range access.Actions {
+			if action == "pull" || action == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseTokenClaims returns the claims of the JWT, and whether it could
+// be read. The signature isn't verified.
+func parseTokenClaims(token string) (tokenClaims, bool) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, false
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, false
+	}
+	return claims, true
+}
+
+// tokenExpiry returns the expiry of an ACR token, read from the "exp"
+// claim of the JWT, and whether there is one. The signature isn't
+// verified: the token is only ever handed back to the registry which
+// issued it.
+func tokenExpiry(token string) (time.Time, bool) {
+	claims, ok := parseTokenClaims(token)
+	if !ok || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// testJWT returns an unsigned JWT with the given subject, expiring at
+// expiresAt.
+func testJWT(subject string, expiresAt time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg": "none", "typ": "JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub": %q, "exp": %d}`, subject, expiresAt.Unix())))
+	return header + "." + payload + ".sig"
+}
+
+func TestTokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+
+	token := testJWT("refresh", now.Add(time.Hour))
+	cache.set(&cache.refreshTokens, "foo.azurecr.io", token, "managed-identity")
+
+	entry, ok := cache.get(&cache.refreshTokens, "foo.azurecr.io", 0)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(entry.token).To(Equal(token))
+	g.Expect(entry.source).To(Equal("managed-identity"))
+
+	// The kinds of tokens are kept apart.
+	_, ok = cache.get(&cache.accessTokens, "foo.azurecr.io", 0)
+	g.Expect(ok).To(BeFalse())
+
+	// Tokens stop being handed out shortly before they expire.
+	now = now.Add(time.Hour - tokenExpirySkew)
+	_, ok = cache.get(&cache.refreshTokens, "foo.azurecr.io", 0)
+	g.Expect(ok).To(BeFalse())
+
+	// Tokens without an expiry aren't cached.
+	cache.set(&cache.refreshTokens, "foo.azurecr.io", "opaque", "managed-identity")
+	_, ok = cache.get(&cache.refreshTokens, "foo.azurecr.io", 0)
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestTokenCache_ClockSkew(t *testing.T) {
+	// The node's clock runs three minutes behind the registry's, which
+	// issued a token valid for ten minutes.
+	registryNow := time.Now()
+	nodeNow := registryNow.Add(-3 * time.Minute)
+	token := testJWT("access", registryNow.Add(10*time.Minute))
+
+	tests := []struct {
+		name      string
+		skew      time.Duration
+		elapsed   time.Duration
+		wantValid bool
+	}{
+		{
+			name:      "fresh token with default skew",
+			skew:      -1,
+			elapsed:   5 * time.Minute,
+			wantValid: true,
+		},
+		{
+			name:      "token expired for the registry, default skew too small",
+			skew:      -1,
+			elapsed:   11 * time.Minute,
+			wantValid: true,
+		},
+		{
+			name:      "token expired for the registry, within the skew",
+			skew:      5 * time.Minute,
+			elapsed:   11 * time.Minute,
+			wantValid: false,
+		},
+		{
+			name:      "token about to expire for the registry, within the skew",
+			skew:      5 * time.Minute,
+			elapsed:   9 * time.Minute,
+			wantValid: false,
+		},
+		{
+			name:      "fresh token, outside the skew",
+			skew:      5 * time.Minute,
+			elapsed:   7 * time.Minute,
+			wantValid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			now := nodeNow
+			cache := NewTokenCache()
+			if tt.skew >= 0 {
+				cache.WithClockSkew(tt.skew)
+			}
+			cache.now = func() time.Time { return now }
+			cache.set(&cache.accessTokens, "foo.azurecr.io", token, "managed-identity")
+
+			now = nodeNow.Add(tt.elapsed)
+			_, ok := cache.get(&cache.accessTokens, "foo.azurecr.io", 0)
+			g.Expect(ok).To(Equal(tt.wantValid))
+		})
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expiresAt := time.Unix(1654084800, 0)
+
+	tests := []struct {
+		name   string
+		token  string
+		want   time.Time
+		wantOk bool
+	}{
+		{name: "JWT", token: testJWT("foo", expiresAt), want: expiresAt, wantOk: true},
+		{name: "not a JWT", token: "bbbbb"},
+		{name: "invalid payload", token: "a.!!!.c"},
+		{name: "no exp claim", token: "a." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "foo"}`)) + ".c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, ok := tokenExpiry(tt.token)
+			g.Expect(ok).To(Equal(tt.wantOk))
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
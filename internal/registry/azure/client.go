@@ -0,0 +1,339 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// autoLoginFlag is the controller flag enabling the automatic login to
+// ACR.
+const autoLoginFlag = "--azure-autologin-for-acr"
+
+// Client is an Azure ACR client which can log into the registry and
+// return authorization information.
+type Client struct {
+	credential        azcore.TokenCredential
+	chain             credentialChain
+	scheme            string
+	anonymousFallback bool
+	parentLoginServer string
+	cache             *TokenCache
+	adminUsername     string
+	adminPassword     string
+	requirePullScope  bool
+}
+
+// NewClient creates a new ACR client with default configurations.
+func NewClient() *Client {
+	return &Client{scheme: "https"}
+}
+
+// WithTokenCredential sets the token credential used by the ACR
+// client.
+func (c *Client) WithTokenCredential(tc azcore.TokenCredential) *Client {
+	c.credential = tc
+	return c
+}
+
+// WithCredentialChain makes the ACR client get its token from the first
+// of the given credentials which provides one, and report the name of
+// that credential as the credential source of the login. It takes
+// precedence over WithTokenCredential.
+func (c *Client) WithCredentialChain(creds ...NamedCredential) *Client {
+	c.chain = creds
+	return c
+}
+
+// WithAnonymousPullFallback makes the ACR client fall back to anonymous
+// access when it can't get an AAD token, provided the repository of the
+// image allows anonymous pulls. Without it, failing to get a token
+// fails the login.
+func (c *Client) WithAnonymousPullFallback() *Client {
+	c.anonymousFallback = true
+	return c
+}
+
+// WithParentLoginServer makes the ACR client exchange its AAD token
+// with the given login server (e.g. "myregistry.azurecr.io") rather
+// than with the registry host of the image. This is for ACR connected
+// registries, whose tokens come from their parent registry. Since the
+// host of a connected registry isn't recognized as an ACR host, it
+// needs to be mapped to the Azure provider for the Manager to use this
+// client.
+func (c *Client) WithParentLoginServer(server string) *Client {
+	c.parentLoginServer = server
+	return c
+}
+
+// WithTokenCache makes the ACR client cache the refresh tokens it gets
+// from AAD tokens, and mint repository-scoped access tokens with them
+// rather than going through AAD for every login; the access tokens are
+// cached as well, per scope. With a cache, logins give an access token
+// (as the registry token) for pulling from the repository of the image,
+// rather than the refresh token.
+func (c *Client) WithTokenCache(cache *TokenCache) *Client {
+	c.cache = cache
+	return c
+}
+
+// WithRequirePullScope makes the ACR client fail logins giving an
+// access token which doesn't grant pulling from the repository of the
+// image, rather than only logging a warning about it, so that the
+// login fails with a clear error instead of the registry answering a
+// confusing 403 later on. It only applies with a token cache, which
+// makes logins give access tokens, and to tokens telling what they
+// grant.
+func (c *Client) WithRequirePullScope() *Client {
+	c.requirePullScope = true
+	return c
+}
+
+// WithAdminCredentials makes the ACR client log in with the username
+// and password of the admin user of the registry, for registries which
+// have it enabled, rather than exchanging an AAD token. No AAD token is
+// requested then, and the token cache isn't used.
+func (c *Client) WithAdminCredentials(username, password string) *Client {
+	c.adminUsername = username
+	c.adminPassword = password
+	return c
+}
+
+// WithScheme sets the scheme of the http request that the client
+// makes.
+func (c *Client) WithScheme(scheme string) *Client {
+	c.scheme = scheme
+	return c
+}
+
+// getLoginAuth returns authentication for ACR, and the source of the
+// credential used to get it; the source is "anonymous" when falling
+// back to anonymous access. The details needed for authentication are
+// gotten from environment variable so there is no need to mount a host
+// path.
+func (c *Client) getLoginAuth(ctx context.Context, ref name.Reference) (authn.AuthConfig, string, error) {
+	var authConfig authn.AuthConfig
+
+	if c.adminUsername != "" {
+		return authn.AuthConfig{Username: c.adminUsername, Password: c.adminPassword}, adminSource, nil
+	}
+
+	rt := registry.TransportFor(ctx, nil)
+	loginServer := ref.Context().RegistryStr()
+	if c.parentLoginServer != "" {
+		loginServer = c.parentLoginServer
+	}
+	scope := ref.Context().Scope(transport.PullScope)
+
+	if c.cache != nil {
+		if entry, ok := c.cache.get(&c.cache.accessTokens, accessTokenKey(loginServer, scope), registry.MinValidityFromContext(ctx)); ok {
+			return authn.AuthConfig{RegistryToken: entry.token}, entry.source, nil
+		}
+		// The refresh token is only used to mint the access token, so
+		// it need only be valid now.
+		if entry, ok := c.cache.get(&c.cache.refreshTokens, loginServer, 0); ok {
+			authConfig, source, err := c.mintAccessToken(ctx, loginServer, scope, entry.token, entry.source, rt)
+			if err == nil {
+				return authConfig, source, nil
+			}
+			// The refresh token may have been revoked; get a new one.
+			ctrl.LoggerFrom(ctx).Info("could not mint access token with cached refresh token: " + registry.Redact(err.Error()))
+			c.cache.refreshTokens.Delete(loginServer)
+		}
+	}
+
+	refreshToken, source, err := c.getRefreshToken(ctx, ref, loginServer, rt)
+	if err != nil || source == anonymousSource {
+		return authConfig, source, err
+	}
+
+	if c.cache != nil {
+		c.cache.set(&c.cache.refreshTokens, loginServer, refreshToken, source)
+		return c.mintAccessToken(ctx, loginServer, scope, refreshToken, source, rt)
+	}
+	return authn.AuthConfig{
+		// this is the acr username used by Azure
+		// See documentation: https://docs.microsoft.com/en-us/azure/container-registry/container-registry-authentication?tabs=azure-cli#az-acr-login-with---expose-token
+		Username: "00000000-0000-0000-0000-000000000000",
+		Password: refreshToken,
+	}, source, nil
+}
+
+// getRefreshToken gets an AAD token and exchanges it for an ACR refresh
+// token with the login server. It returns the source of the credential
+// which provided the AAD token, which is "anonymous", along with an
+// empty token, when falling back to anonymous access.
+func (c *Client) getRefreshToken(ctx context.Context, ref name.Reference, loginServer string, rt http.RoundTripper) (string, string, error) {
+	armToken, source, err := c.getARMToken(ctx, rt)
+	if err != nil {
+		if c.anonymousFallback {
+			if ok, probeErr := c.anonymousPullAllowed(ctx, ref); probeErr == nil && ok {
+				ctrl.LoggerFrom(ctx).Info("could not get AAD token, falling back to anonymous pull: " + registry.Redact(err.Error()))
+				return "", anonymousSource, nil
+			}
+		}
+		return "", "", err
+	}
+
+	ex := NewExchanger(fmt.Sprintf("%s://%s", c.scheme, loginServer)).WithTransport(rt).WithContext(ctx)
+	refreshToken, err := ex.ExchangeACRAccessToken(string(armToken.Token))
+	if err != nil {
+		return "", "", fmt.Errorf("error exchanging token: %w", err)
+	}
+	return refreshToken, source, nil
+}
+
+// getARMToken gets an AAD token for Azure Resource Manager from the
+// credentials of the client, along with the source of the credential
+// which provided it. Without credentials, the default Azure credential
+// is used.
+func (c *Client) getARMToken(ctx context.Context, rt http.RoundTripper) (*azcore.AccessToken, string, error) {
+	chain := c.chain
+	if len(chain) == 0 {
+		credential, source := c.credential, tokenCredentialSource
+		if credential == nil {
+			var opts *azidentity.DefaultAzureCredentialOptions
+			if rt != nil {
+				opts = &azidentity.DefaultAzureCredentialOptions{}
+				opts.Transport = &http.Client{Transport: rt}
+			}
+			cred, err := azidentity.NewDefaultAzureCredential(opts)
+			if err != nil {
+				return nil, "", err
+			}
+			credential, source = cred, defaultCredentialSource
+		}
+		chain = credentialChain{{Name: source, Credential: credential}}
+	}
+
+	return chain.getToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{string(arm.AzurePublicCloud) + ".default"},
+	})
+}
+
+// mintAccessToken mints an access token for the scope with the refresh
+// token, and caches it.
+func (c *Client) mintAccessToken(ctx context.Context, loginServer, scope, refreshToken, source string, rt http.RoundTripper) (authn.AuthConfig, string, error) {
+	ex := NewExchanger(fmt.Sprintf("%s://%s", c.scheme, loginServer)).WithTransport(rt).WithContext(ctx)
+	accessToken, err := ex.ExchangeACRRefreshToken(refreshToken, scope)
+	if err != nil {
+		return authn.AuthConfig{}, "", fmt.Errorf("error minting access token: %w", err)
+	}
+	if err := c.checkPullScope(ctx, accessToken, scope); err != nil {
+		return authn.AuthConfig{}, "", err
+	}
+	c.cache.set(&c.cache.accessTokens, accessTokenKey(loginServer, scope), accessToken, source)
+	return authn.AuthConfig{RegistryToken: accessToken}, source, nil
+}
+
+// checkPullScope warns when the access token minted for the pull scope
+// of a repository doesn't grant pulling from it, as told by its access
+// claim, and fails when pull scope is required. Tokens without an
+// access claim are taken at their word.
+func (c *Client) checkPullScope(ctx context.Context, accessToken, scope string) error {
+	// The scope is "repository:<name>:pull".
+	repository := strings.TrimSuffix(strings.TrimPrefix(scope, "repository:"), ":"+transport.PullScope)
+	claims, ok := parseTokenClaims(accessToken)
+	if !ok || claims.Access == nil || claims.grantsPull(repository) {
+		return nil
+	}
+	msg := fmt.Sprintf("ACR access token doesn't grant pull on repository %s", repository)
+	if c.requirePullScope {
+		return fmt.Errorf("%w: %s", registry.ErrAuthenticationFailed, msg)
+	}
+	ctrl.LoggerFrom(ctx).Info("warning: " + msg + ", pulling from it will likely be denied")
+	return nil
+}
+
+// anonymousPullAllowed returns whether the tags of the repository of
+// the image can be listed without credentials.
+func (c *Client) anonymousPullAllowed(ctx context.Context, ref name.Reference) (bool, error) {
+	repo := ref.Context()
+	base := registry.TransportFor(ctx, http.DefaultTransport)
+	rt, err := transport.NewWithContext(ctx, repo.Registry, authn.Anonymous, base, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return false, err
+	}
+
+	url := fmt.Sprintf("%s://%s/v2/%s/tags/list", c.scheme, repo.RegistryStr(), repo.RepositoryStr())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// ValidHost returns if a given host is a Azure container registry.
+// List from https://github.com/kubernetes/kubernetes/blob/v1.23.1/pkg/credentialprovider/azure/azure_credentials.go#L55
+func ValidHost(host string) bool {
+	for _, v := range []string{".azurecr.io", ".azurecr.cn", ".azurecr.de", ".azurecr.us"} {
+		if strings.HasSuffix(host, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Login attempts to get the authentication material for ACR. The
+// caller can ensure that the passed image is a valid ACR image using
+// ValidHost(). Login errors are sanitized, see registry.Sanitize.
+func (c *Client) Login(ctx context.Context, autoLogin bool, image string, ref name.Reference) (authn.Authenticator, error) {
+	auth, _, err := c.LoginWithSource(ctx, autoLogin, image, ref)
+	return auth, err
+}
+
+// LoginWithSource is like Login, but also returns the source of the
+// credential the login was done with.
+func (c *Client) LoginWithSource(ctx context.Context, autoLogin bool, image string, ref name.Reference) (authn.Authenticator, string, error) {
+	if autoLogin {
+		ctrl.LoggerFrom(ctx).Info("logging in to Azure ACR for " + image)
+		authConfig, source, err := c.getLoginAuth(ctx, ref)
+		if err != nil {
+			err = registry.Sanitize(err)
+			ctrl.LoggerFrom(ctx).Info("error logging into ACR " + err.Error())
+			return nil, "", err
+		}
+
+		if source == anonymousSource {
+			return authn.Anonymous, source, nil
+		}
+		auth := authn.FromConfig(authConfig)
+		return auth, source, nil
+	}
+	disabled := &registry.AutoLoginDisabledError{Provider: registry.ProviderAzure, Flag: autoLoginFlag}
+	ctrl.LoggerFrom(ctx).Info("ACR authentication is not enabled. To enable, set the controller flag " + disabled.Flag)
+	return nil, "", fmt.Errorf("ACR authentication failed: %w", disabled)
+}
@@ -0,0 +1,563 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/go-logr/logr/funcr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// fakeTokenCredential implements azcore.TokenCredential.
+type fakeTokenCredential struct {
+	token     string
+	expiresOn time.Time
+	err       error
+}
+
+var _ azcore.TokenCredential = &fakeTokenCredential{}
+
+func (tc *fakeTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	if tc.err != nil {
+		return nil, tc.err
+	}
+	return &azcore.AccessToken{Token: tc.token, ExpiresOn: tc.expiresOn}, nil
+}
+
+func TestGetAzureLoginAuth(t *testing.T) {
+	tests := []struct {
+		name            string
+		tokenCredential azcore.TokenCredential
+		responseBody    string
+		statusCode      int
+		wantErr         bool
+		wantAuthConfig  authn.AuthConfig
+	}{
+		{
+			name:            "success",
+			tokenCredential: &fakeTokenCredential{token: "foo"},
+			responseBody:    `{"refresh_token": "bbbbb"}`,
+			statusCode:      http.StatusOK,
+			wantAuthConfig: authn.AuthConfig{
+				Username: "00000000-0000-0000-0000-000000000000",
+				Password: "bbbbb",
+			},
+		},
+		{
+			name:            "fail to get access token",
+			tokenCredential: &fakeTokenCredential{err: errors.New("no access token")},
+			wantErr:         true,
+		},
+		{
+			name:            "error from exchange service",
+			tokenCredential: &fakeTokenCredential{token: "foo"},
+			responseBody:    `[{"code": "111","message": "error message 1"}]`,
+			statusCode:      http.StatusInternalServerError,
+			wantErr:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.URL.Path).To(Equal("/oauth2/exchange"))
+				g.Expect(r.ParseForm()).To(Succeed())
+				g.Expect(r.PostForm.Get("access_token")).To(Equal("foo"))
+				w.WriteHeader(tt.statusCode)
+				w.Write([]byte(tt.responseBody))
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			// Construct an image repo name against the test server.
+			u, err := url.Parse(srv.URL)
+			g.Expect(err).ToNot(HaveOccurred())
+			ref, err := name.ParseReference(u.Host + "/foo/bar:v1")
+			g.Expect(err).ToNot(HaveOccurred())
+
+			c := NewClient().WithTokenCredential(tt.tokenCredential).WithScheme("http")
+			auth, source, err := c.getLoginAuth(context.TODO(), ref)
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			if tt.statusCode == http.StatusOK {
+				g.Expect(auth).To(Equal(tt.wantAuthConfig))
+				g.Expect(source).To(Equal(tokenCredentialSource))
+			}
+		})
+	}
+}
+
+func TestLoginWithSource_CredentialChain(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.ParseForm()).To(Succeed())
+		g.Expect(r.PostForm.Get("access_token")).To(Equal("from-managed-identity"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	image := u.Host + "/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	c := NewClient().WithScheme("http").WithCredentialChain(
+		NamedCredential{Name: "env", Credential: &fakeTokenCredential{err: errors.New("no environment")}},
+		NamedCredential{Name: "managed-identity", Credential: &fakeTokenCredential{token: "from-managed-identity"}},
+		NamedCredential{Name: "cli", Credential: &fakeTokenCredential{token: "from-cli"}},
+	)
+	auth, source, err := c.LoginWithSource(context.TODO(), true, image, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).ToNot(BeNil())
+	g.Expect(source).To(Equal("managed-identity"))
+}
+
+func TestLoginWithSource_CredentialChainFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	ref, err := name.ParseReference("foo.azurecr.io/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	c := NewClient().WithCredentialChain(
+		NamedCredential{Name: "env", Credential: &fakeTokenCredential{err: errors.New("no environment")}},
+		NamedCredential{Name: "cli", Credential: &fakeTokenCredential{err: errors.New("no cli")}},
+	)
+	_, _, err = c.LoginWithSource(context.TODO(), true, "foo.azurecr.io/bar:v1", ref)
+	g.Expect(err).To(MatchError(ContainSubstring("env: no environment; cli: no cli")))
+}
+
+func TestLoginWithSource_SourceCredential(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.ParseForm()).To(Succeed())
+		g.Expect(r.PostForm.Get("access_token")).To(Equal("from-static"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	image := u.Host + "/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	c := NewClient().WithScheme("http").WithCredentialChain(
+		SourceCredential(registry.EnvCredentialSource("", "", "FLUX_TEST_AZURE_TOKEN")),
+		// A source without a token doesn't provide one.
+		SourceCredential(registry.CredentialSourceFunc("password-only", func(context.Context) (registry.Credentials, error) {
+			return registry.Credentials{Password: "pass"}, nil
+		})),
+		SourceCredential(registry.StaticCredentialSource(registry.Credentials{Token: "from-static"})),
+	)
+	_, source, err := c.LoginWithSource(context.TODO(), true, image, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal("static"))
+}
+
+func TestLoginWithSource_AdminCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected token exchange: %s", r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	image := u.Host + "/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	cred := &countingTokenCredential{}
+	c := NewClient().WithScheme("http").
+		WithTokenCredential(cred).
+		WithTokenCache(NewTokenCache()).
+		WithAdminCredentials("myregistry", "admin-pass")
+	auth, source, err := c.LoginWithSource(context.TODO(), true, image, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal(adminSource))
+	authConfig, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(*authConfig).To(Equal(authn.AuthConfig{Username: "myregistry", Password: "admin-pass"}))
+	g.Expect(cred.calls).To(BeZero())
+
+	identity, err := c.Identity(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identity).To(Equal("myregistry"))
+}
+
+func TestLoginWithSource_InteractiveRequired(t *testing.T) {
+	g := NewWithT(t)
+
+	ref, err := name.ParseReference("foo.azurecr.io/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	promptErr := InteractiveRequiredPrompt(context.TODO(), azidentity.DeviceCodeMessage{
+		UserCode:        "ABCD-1234",
+		VerificationURL: "https://microsoft.com/devicelogin",
+		Message:         "To sign in, enter the code ABCD-1234 at https://microsoft.com/devicelogin",
+	})
+	cli := &countingTokenCredential{token: "from-cli"}
+	c := NewClient().WithCredentialChain(
+		NamedCredential{Name: "env", Credential: &fakeTokenCredential{err: errors.New("no environment")}},
+		NamedCredential{Name: "device-code", Credential: &fakeTokenCredential{err: promptErr}},
+		NamedCredential{Name: "cli", Credential: cli},
+	)
+	_, _, err = c.LoginWithSource(context.TODO(), true, "foo.azurecr.io/bar:v1", ref)
+	g.Expect(errors.Is(err, registry.ErrInteractiveRequired)).To(BeTrue())
+	var ierr *registry.InteractiveRequiredError
+	g.Expect(errors.As(err, &ierr)).To(BeTrue())
+	g.Expect(ierr.Challenge).To(Equal(registry.AuthChallenge{
+		URL:     "https://microsoft.com/devicelogin",
+		Code:    "ABCD-1234",
+		Message: "To sign in, enter the code ABCD-1234 at https://microsoft.com/devicelogin",
+	}))
+	// The chain stops at the credential needing interaction.
+	g.Expect(cli.calls).To(Equal(0))
+}
+
+func TestLoginWithSource_AnonymousPullFallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		fallback      bool
+		anonymousRepo bool
+		wantAnonymous bool
+	}{
+		{
+			name:          "anonymous repository",
+			fallback:      true,
+			anonymousRepo: true,
+			wantAnonymous: true,
+		},
+		{
+			name:          "repository requiring auth",
+			fallback:      true,
+			anonymousRepo: false,
+		},
+		{
+			name:          "fallback disabled",
+			fallback:      false,
+			anonymousRepo: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var tagsListed bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v2/":
+					w.WriteHeader(http.StatusOK)
+				case "/v2/foo/bar/tags/list":
+					tagsListed = true
+					g.Expect(r.Header.Get("Authorization")).To(BeEmpty())
+					if !tt.anonymousRepo {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(`{"name": "foo/bar", "tags": ["v1"]}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			u, err := url.Parse(srv.URL)
+			g.Expect(err).ToNot(HaveOccurred())
+			image := u.Host + "/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			c := NewClient().WithScheme("http").
+				WithTokenCredential(&fakeTokenCredential{err: errors.New("no AAD token")})
+			if tt.fallback {
+				c.WithAnonymousPullFallback()
+			}
+			auth, source, err := c.LoginWithSource(context.TODO(), true, image, ref)
+			if !tt.wantAnonymous {
+				g.Expect(err).To(MatchError(ContainSubstring("no AAD token")))
+				g.Expect(tagsListed).To(Equal(tt.fallback))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth).To(Equal(authn.Anonymous))
+			g.Expect(source).To(Equal(anonymousSource))
+		})
+	}
+}
+
+func TestGetLoginAuth_ParentLoginServer(t *testing.T) {
+	g := NewWithT(t)
+
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.URL.Path).To(Equal("/oauth2/exchange"))
+		g.Expect(r.ParseForm()).To(Succeed())
+		g.Expect(r.PostForm.Get("access_token")).To(Equal("foo"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	defer parent.Close()
+	var connectedCalled bool
+	connected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connectedCalled = true
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer connected.Close()
+
+	parentURL, err := url.Parse(parent.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	connectedURL, err := url.Parse(connected.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	ref, err := name.ParseReference(connectedURL.Host + "/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	c := NewClient().
+		WithTokenCredential(&fakeTokenCredential{token: "foo"}).
+		WithParentLoginServer(parentURL.Host).
+		WithScheme("http")
+	auth, _, err := c.getLoginAuth(context.TODO(), ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth.Password).To(Equal("bbbbb"))
+	g.Expect(connectedCalled).To(BeFalse())
+}
+
+func TestLogin(t *testing.T) {
+	g := NewWithT(t)
+
+	ref, err := name.ParseReference("foo.azurecr.io/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	_, err = NewClient().Login(context.TODO(), false, "foo.azurecr.io/bar:v1", ref)
+	g.Expect(errors.Is(err, registry.ErrUnconfiguredProvider)).To(BeTrue())
+}
+
+func TestValidHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		result bool
+	}{
+		{"foo.azurecr.io", true},
+		{"foo.azurecr.cn", true},
+		{"foo.azurecr.de", true},
+		{"foo.azurecr.us", true},
+		{"gcr.io", false},
+		{"docker.io", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(ValidHost(tt.host)).To(Equal(tt.result))
+		})
+	}
+}
+
+func TestGetLoginAuth_TokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	var exchanges int
+	var scopes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.ParseForm()).To(Succeed())
+		switch r.URL.Path {
+		case "/oauth2/exchange":
+			exchanges++
+			g.Expect(r.PostForm.Get("grant_type")).To(Equal("access_token"))
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"refresh_token": %q}`, testJWT("refresh", time.Now().Add(3*time.Hour)))
+		case "/oauth2/token":
+			g.Expect(r.PostForm.Get("grant_type")).To(Equal("refresh_token"))
+			g.Expect(r.PostForm.Get("refresh_token")).ToNot(BeEmpty())
+			scope := r.PostForm.Get("scope")
+			scopes = append(scopes, scope)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"access_token": %q}`, testJWT(scope, time.Now().Add(time.Hour)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	credential := &countingTokenCredential{token: "foo"}
+	c := NewClient().WithScheme("http").
+		WithCredentialChain(NamedCredential{Name: "managed-identity", Credential: credential}).
+		WithTokenCache(NewTokenCache())
+
+	for _, repo := range []string{"foo/bar", "foo/baz", "foo/bar"} {
+		ref, err := name.ParseReference(u.Host + "/" + repo + ":v1")
+		g.Expect(err).ToNot(HaveOccurred())
+		auth, source, err := c.getLoginAuth(context.TODO(), ref)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(source).To(Equal("managed-identity"))
+		g.Expect(auth.Password).To(BeEmpty())
+		g.Expect(auth.RegistryToken).ToNot(BeEmpty())
+	}
+
+	// The refresh token is only fetched once, and used to mint an
+	// access token for each of the scopes; the access token for a scope
+	// is reused.
+	g.Expect(credential.calls).To(Equal(1))
+	g.Expect(exchanges).To(Equal(1))
+	g.Expect(scopes).To(Equal([]string{"repository:foo/bar:pull", "repository:foo/baz:pull"}))
+}
+
+// countingTokenCredential implements azcore.TokenCredential, and counts
+// the tokens it provides.
+type countingTokenCredential struct {
+	token string
+	calls int
+}
+
+func (tc *countingTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	tc.calls++
+	return &azcore.AccessToken{Token: tc.token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// testAccessJWT returns an unsigned ACR access token granting the
+// actions on the repository, expiring in an hour.
+func testAccessJWT(repository string, actions ...string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg": "none", "typ": "JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"access": []map[string]interface{}{
+			{"type": "repository", "name": repository, "actions": actions},
+		},
+	})
+	return header + "." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func TestGetLoginAuth_PullScope(t *testing.T) {
+	tests := []struct {
+		name             string
+		grantedRepo      string
+		grantedActions   []string
+		requirePullScope bool
+		wantWarning      bool
+		wantErr          bool
+	}{
+		{
+			name:           "pull granted",
+			grantedRepo:    "foo/bar",
+			grantedActions: []string{"pull"},
+		},
+		{
+			name:           "all actions granted",
+			grantedRepo:    "foo/bar",
+			grantedActions: []string{"*"},
+		},
+		{
+			name:           "token scoped to another repository",
+			grantedRepo:    "other/repo",
+			grantedActions: []string{"pull"},
+			wantWarning:    true,
+		},
+		{
+			name:             "token scoped to another repository, pull scope required",
+			grantedRepo:      "other/repo",
+			grantedActions:   []string{"pull"},
+			requirePullScope: true,
+			wantErr:          true,
+		},
+		{
+			name:             "push only, pull scope required",
+			grantedRepo:      "foo/bar",
+			grantedActions:   []string{"push"},
+			requirePullScope: true,
+			wantErr:          true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/oauth2/exchange":
+					fmt.Fprintf(w, `{"refresh_token": %q}`, testJWT("refresh", time.Now().Add(3*time.Hour)))
+				case "/oauth2/token":
+					fmt.Fprintf(w, `{"access_token": %q}`, testAccessJWT(tt.grantedRepo, tt.grantedActions...))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			t.Cleanup(srv.Close)
+			u, err := url.Parse(srv.URL)
+			g.Expect(err).ToNot(HaveOccurred())
+			ref, err := name.ParseReference(u.Host + "/foo/bar:v1")
+			g.Expect(err).ToNot(HaveOccurred())
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			c := NewClient().WithScheme("http").
+				WithTokenCredential(&fakeTokenCredential{token: "foo"}).
+				WithTokenCache(NewTokenCache())
+			if tt.requirePullScope {
+				c.WithRequirePullScope()
+			}
+			auth, _, err := c.getLoginAuth(ctx, ref)
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(registry.ErrAuthenticationFailed))
+				g.Expect(err.Error()).To(ContainSubstring("doesn't grant pull on repository foo/bar"))
+				_, cached := c.cache.get(&c.cache.accessTokens, accessTokenKey(u.Host, "repository:foo/bar:pull"), 0)
+				g.Expect(cached).To(BeFalse())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth.RegistryToken).ToNot(BeEmpty())
+			if tt.wantWarning {
+				g.Expect(logs).To(ContainElement(ContainSubstring("doesn't grant pull on repository foo/bar")))
+			} else {
+				g.Expect(logs).ToNot(ContainElement(ContainSubstring("doesn't grant pull")))
+			}
+		})
+	}
+}
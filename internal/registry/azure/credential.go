@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// Credential sources reported when the credential isn't part of a
+// chain set with WithCredentialChain.
+const (
+	defaultCredentialSource = "default-azure-credential"
+	tokenCredentialSource   = "token-credential"
+	// anonymousSource is reported when falling back to anonymous
+	// access.
+	anonymousSource = "anonymous"
+	// adminSource is reported when logging in with the admin user set
+	// with WithAdminCredentials.
+	adminSource = "admin-user"
+)
+
+// NamedCredential is a token credential along with the name reported as
+// the credential source when it provides the token, e.g.
+// "managed-identity", "env" or "cli".
+type NamedCredential struct {
+	Name       string
+	Credential azcore.TokenCredential
+}
+
+// SourceCredential returns a credential, named after the source, whose
+// token is the Token of the credentials of the source, e.g. an AAD
+// token for Azure Resource Manager read from a file. The scopes of the
+// token requests are ignored: the source is to provide tokens for
+// Azure Resource Manager.
+func SourceCredential(source registry.CredentialSource) NamedCredential {
+	return NamedCredential{Name: source.Name(), Credential: sourceCredential{source}}
+}
+
+type sourceCredential struct {
+	source registry.CredentialSource
+}
+
+func (c sourceCredential) GetToken(ctx context.Context, _ policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	creds, err := c.source.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds.Token == "" {
+		return nil, fmt.Errorf("%w: credential source %s provided no token", registry.ErrEmptyToken, c.source.Name())
+	}
+	return &azcore.AccessToken{Token: creds.Token, ExpiresOn: creds.ExpiresAt}, nil
+}
+
+// credentialChain tries its credentials in order, the same as
+// azidentity.ChainedTokenCredential, but tells which one provided the
+// token.
+type credentialChain []NamedCredential
+
+// getToken returns the token of the first credential providing one,
+// and the name of that credential. A credential needing user
+// interaction stops the chain, and its error is returned as is.
+func (c credentialChain) getToken(ctx context.Context, opts policy.TokenRequestOptions) (*azcore.AccessToken, string, error) {
+	sources := make([]registry.CredentialSource, 0, len(c))
+	for _, nc := range c {
+		credential := nc.Credential
+		sources = append(sources, registry.CredentialSourceFunc(nc.Name, func(ctx context.Context) (registry.Credentials, error) {
+			token, err := credential.GetToken(ctx, opts)
+			if err != nil {
+				return registry.Credentials{}, err
+			}
+			return registry.Credentials{Token: token.Token, ExpiresAt: token.ExpiresOn}, nil
+		}))
+	}
+	creds, source, err := registry.NewCredentialChain(sources...).
+		WithStopOn(func(err error) bool {
+			return errors.Is(err, registry.ErrInteractiveRequired)
+		}).
+		Credentials(ctx)
+	if err != nil {
+		var chainErr *registry.CredentialChainError
+		switch {
+		case errors.As(err, &chainErr):
+			return nil, "", fmt.Errorf("no credential in the chain provided a token: %s", chainErr.Reasons())
+		case len(c) == 1 && !errors.Is(err, registry.ErrInteractiveRequired):
+			// The chain gives the error of its only credential as is.
+			return nil, "", fmt.Errorf("no credential in the chain provided a token: %s: %s", c[0].Name, err)
+		default:
+			return nil, "", err
+		}
+	}
+	return &azcore.AccessToken{Token: creds.Token, ExpiresOn: creds.ExpiresAt}, source, nil
+}
+
+// InteractiveRequiredPrompt is a device code prompt for
+// azidentity.DeviceCodeCredentialOptions, which makes the credential
+// fail with a registry.InteractiveRequiredError carrying the device code
+// rather than wait for the user, e.g.:
+//
+//	azidentity.NewDeviceCodeCredential(&azidentity.DeviceCodeCredentialOptions{
+//		UserPrompt: azure.InteractiveRequiredPrompt,
+//	})
+func InteractiveRequiredPrompt(ctx context.Context, msg azidentity.DeviceCodeMessage) error {
+	return &registry.InteractiveRequiredError{
+		Challenge: registry.AuthChallenge{
+			URL:     msg.VerificationURL,
+			Code:    msg.UserCode,
+			Message: msg.Message,
+		},
+	}
+}
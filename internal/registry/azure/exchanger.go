@@ -0,0 +1,245 @@
+/*
+MIT License
+
+Copyright (c) Microsoft Corporation.
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE
+*/
+
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+This package exchanges an ARM access token for an ACR access token on Azure
+It has been derived from
+https://github.com/Azure/msi-acrpull/blob/main/pkg/authorizer/token_exchanger.go
+since the project isn't actively maintained.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// maxResponseSize bounds the size of the responses read from the
+// registry.
+const maxResponseSize = 1 << 20
+
+// maxSnippetLength is the length, in characters, of the snippets of
+// unexpected responses quoted in errors.
+const maxSnippetLength = 200
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Resource     string `json:"resource"`
+	TokenType    string `json:"token_type"`
+}
+
+type acrError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Exchanger struct {
+	endpoint  string
+	transport http.RoundTripper
+	ctx       context.Context
+}
+
+// NewExchanger returns an Exchanger for the ACR at the given endpoint,
+// which includes the URL scheme, e.g. https://foo.azurecr.io.
+func NewExchanger(endpoint string) *Exchanger {
+	return &Exchanger{
+		endpoint: endpoint,
+		ctx:      context.Background(),
+	}
+}
+
+// WithTransport sets the transport used for the exchange request.
+func (e *Exchanger) WithTransport(rt http.RoundTripper) *Exchanger {
+	e.transport = rt
+	return e
+}
+
+// WithContext sets the context of the exchange requests, which bounds
+// them when it has a deadline.
+func (e *Exchanger) WithContext(ctx context.Context) *Exchanger {
+	e.ctx = ctx
+	return e
+}
+
+// postForm posts the parameters to the URL as a form.
+func (e *Exchanger) postForm(rawURL string, parameters url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, rawURL, strings.NewReader(parameters.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{Transport: e.transport}
+	return client.Do(req)
+}
+
+func (e *Exchanger) ExchangeACRAccessToken(armToken string) (string, error) {
+	exchangeUrl := fmt.Sprintf("%s/oauth2/exchange", e.endpoint)
+	parsedURL, err := url.Parse(exchangeUrl)
+	if err != nil {
+		return "", err
+	}
+
+	parameters := url.Values{}
+	parameters.Add("grant_type", "access_token")
+	parameters.Add("service", parsedURL.Hostname())
+	parameters.Add("access_token", armToken)
+
+	resp, err := e.postForm(exchangeUrl, parameters)
+	if err != nil {
+		return "", fmt.Errorf("failed to send token exchange request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token exchange response: %w", err)
+	}
+	if isHTML(resp) {
+		return "", unexpectedResponse(resp, body)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, body, "exchange")
+	}
+
+	var tokenResp tokenResponse
+	if err = json.Unmarshal(body, &tokenResp); err != nil {
+		return "", unexpectedResponse(resp, body)
+	}
+	return tokenResp.RefreshToken, nil
+}
+
+// ExchangeACRRefreshToken mints an ACR access token for the given scope
+// (e.g. "repository:foo/bar:pull") with a refresh token obtained by
+// ExchangeACRAccessToken, without going through AAD again.
+func (e *Exchanger) ExchangeACRRefreshToken(refreshToken, scope string) (string, error) {
+	tokenUrl := fmt.Sprintf("%s/oauth2/token", e.endpoint)
+	parsedURL, err := url.Parse(tokenUrl)
+	if err != nil {
+		return "", err
+	}
+
+	parameters := url.Values{}
+	parameters.Add("grant_type", "refresh_token")
+	parameters.Add("service", parsedURL.Hostname())
+	parameters.Add("scope", scope)
+	parameters.Add("refresh_token", refreshToken)
+
+	resp, err := e.postForm(tokenUrl, parameters)
+	if err != nil {
+		return "", fmt.Errorf("failed to send token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read token response: %w", err)
+	}
+	if isHTML(resp) {
+		return "", unexpectedResponse(resp, body)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, body, "token")
+	}
+
+	var tokenResp tokenResponse
+	if err = json.Unmarshal(body, &tokenResp); err != nil {
+		return "", unexpectedResponse(resp, body)
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// statusError returns the error of a non-200 response to the given
+// kind of request, with the ACR errors of its body if it has any.
+func statusError(resp *http.Response, body []byte, request string) error {
+	var errors []acrError
+	if err := json.Unmarshal(body, &errors); err == nil {
+		return fmt.Errorf("unexpected status code %d from %s request: errors:%s",
+			resp.StatusCode, request, errors)
+	}
+	return fmt.Errorf("unexpected status code %d from %s request", resp.StatusCode, request)
+}
+
+// isHTML returns whether the response is an HTML page, as returned
+// e.g. by a gateway in front of the registry.
+func isHTML(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/html"
+}
+
+// unexpectedResponse returns an error wrapping
+// registry.ErrUnexpectedResponse, with the status of the response and
+// a snippet of its body.
+func unexpectedResponse(resp *http.Response, body []byte) error {
+	return fmt.Errorf("%w: status code %d, content type %q: %s", registry.ErrUnexpectedResponse,
+		resp.StatusCode, resp.Header.Get("Content-Type"), bodySnippet(body))
+}
+
+// tagRe matches the tags of an HTML page.
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+
+// bodySnippet returns the start of the text of a response body, fit
+// for an error message: stripped of HTML tags and control characters,
+// with its whitespace collapsed, and truncated to maxSnippetLength
+// characters.
+func bodySnippet(body []byte) string {
+	text := tagRe.ReplaceAllString(string(body), " ")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxSnippetLength {
+		text = string(runes[:maxSnippetLength]) + "..."
+	}
+	return text
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+const testGatewayPage = `<html>
+<head><title>502 Bad Gateway</title></head>
+<body>
+<center><h1>502 Bad Gateway</h1></center>
+<script>alert("x")</script>
+</body>
+</html>`
+
+func TestExchanger_UnexpectedResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		statusCode  int
+		body        string
+		wantSnippet string
+	}{
+		{
+			name:        "HTML error page",
+			contentType: "text/html; charset=utf-8",
+			statusCode:  http.StatusBadGateway,
+			body:        testGatewayPage,
+			wantSnippet: `502 Bad Gateway 502 Bad Gateway alert("x")`,
+		},
+		{
+			name:        "HTML page with success status",
+			contentType: "text/html",
+			statusCode:  http.StatusOK,
+			body:        "<p>Maintenance</p>",
+			wantSnippet: "Maintenance",
+		},
+		{
+			name:        "body not JSON",
+			contentType: "text/plain",
+			statusCode:  http.StatusOK,
+			body:        "not a token",
+			wantSnippet: "not a token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.statusCode)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			ex := NewExchanger(srv.URL)
+			_, err := ex.ExchangeACRAccessToken("foo")
+			g.Expect(errors.Is(err, registry.ErrUnexpectedResponse)).To(BeTrue())
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantSnippet))
+			g.Expect(err.Error()).ToNot(ContainSubstring("<"))
+
+			_, err = ex.ExchangeACRRefreshToken("refresh", "repository:foo/bar:pull")
+			g.Expect(errors.Is(err, registry.ErrUnexpectedResponse)).To(BeTrue())
+		})
+	}
+}
+
+func TestExchanger_StatusError(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "ACR errors",
+			body:    `[{"code": "UNAUTHORIZED", "message": "authentication required"}]`,
+			wantErr: "unexpected status code 401 from %s request: errors:[{UNAUTHORIZED authentication required}]",
+		},
+		{
+			name:    "no ACR errors",
+			body:    `{}`,
+			wantErr: "unexpected status code 401 from %s request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			ex := NewExchanger(srv.URL)
+			_, err := ex.ExchangeACRAccessToken("foo")
+			g.Expect(err).To(MatchError(fmt.Sprintf(tt.wantErr, "exchange")))
+
+			_, err = ex.ExchangeACRRefreshToken("refresh", "repository:foo/bar:pull")
+			g.Expect(err).To(MatchError(fmt.Sprintf(tt.wantErr, "token")))
+		})
+	}
+}
+
+func TestBodySnippet(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(bodySnippet([]byte("a\x00b\r\n\tc"))).To(Equal("a b c"))
+	snippet := bodySnippet([]byte(strings.Repeat("é", 300)))
+	g.Expect(snippet).To(Equal(strings.Repeat("é", maxSnippetLength) + "..."))
+}
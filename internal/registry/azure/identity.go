@@ -0,0 +1,50 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// Identity returns the client ID of the application the client logs
+// in as (e.g. that of the managed identity), read from the claims of
+// the AAD token its credentials provide; the object ID of the
+// principal is returned for tokens without one. With admin
+// credentials, the admin username is returned instead. It doesn't log
+// into any registry.
+func (c *Client) Identity(ctx context.Context) (string, error) {
+	if c.adminUsername != "" {
+		return c.adminUsername, nil
+	}
+	token, _, err := c.getARMToken(ctx, registry.TransportFor(ctx, nil))
+	if err != nil {
+		return "", err
+	}
+	claims, ok := parseTokenClaims(token.Token)
+	if !ok {
+		return "", errors.New("AAD token is not a readable JWT")
+	}
+	for _, id := range []string{claims.AppID, claims.AZP, claims.OID} {
+		if id != "" {
+			return id, nil
+		}
+	}
+	return "", errors.New("AAD token doesn't identify its principal")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// testClaimsJWT returns an unsigned JWT with the given claims.
+func testClaimsJWT(claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg": "none", "typ": "JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		credential *fakeTokenCredential
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "v1 token",
+			credential: &fakeTokenCredential{token: testClaimsJWT(`{"appid": "11111111-1111-1111-1111-111111111111", "oid": "22222222-2222-2222-2222-222222222222"}`)},
+			want:       "11111111-1111-1111-1111-111111111111",
+		},
+		{
+			name:       "v2 token",
+			credential: &fakeTokenCredential{token: testClaimsJWT(`{"azp": "33333333-3333-3333-3333-333333333333"}`)},
+			want:       "33333333-3333-3333-3333-333333333333",
+		},
+		{
+			name:       "object ID only",
+			credential: &fakeTokenCredential{token: testClaimsJWT(`{"oid": "22222222-2222-2222-2222-222222222222"}`)},
+			want:       "22222222-2222-2222-2222-222222222222",
+		},
+		{
+			name:       "opaque token",
+			credential: &fakeTokenCredential{token: "opaque"},
+			wantErr:    true,
+		},
+		{
+			name:       "no token",
+			credential: &fakeTokenCredential{err: errors.New("no managed identity")},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			identity, err := NewClient().WithTokenCredential(tt.credential).Identity(context.TODO())
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(identity).To(Equal(tt.want))
+		})
+	}
+}
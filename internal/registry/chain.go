@@ -0,0 +1,208 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Names of the credential sources of this package.
+const (
+	envCredentialSource    = "env"
+	fileCredentialSource   = "file"
+	staticCredentialSource = "static"
+)
+
+// Credentials are the credentials provided by a CredentialSource. What
+// they hold depends on the client using them: e.g. an access key ID,
+// secret access key and session token for AWS, an access token for GCP
+// or Azure.
+type Credentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// ExpiresAt is when the credentials expire, zero when they don't,
+	// or when it isn't known.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// CredentialSource is a source of credentials, e.g. the environment, a
+// file, a metadata server or static credentials.
+type CredentialSource interface {
+	// Name is the name reported as the credential source when it
+	// provides the credentials, e.g. "env" or "metadata".
+	Name() string
+	// Credentials returns the credentials of the source, or an error
+	// if it has none to provide.
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialSourceFunc returns a credential source with the given name,
+// whose credentials are those returned by fn, e.g. credentials from a
+// metadata server.
+func CredentialSourceFunc(name string, fn func(context.Context) (Credentials, error)) CredentialSource {
+	return credentialSourceFunc{name: name, fn: fn}
+}
+
+type credentialSourceFunc struct {
+	name string
+	fn   func(context.Context) (Credentials, error)
+}
+
+func (s credentialSourceFunc) Name() string {
+	return s.name
+}
+
+func (s credentialSourceFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return s.fn(ctx)
+}
+
+// StaticCredentialSource returns a credential source named "static",
+// always providing the given credentials.
+func StaticCredentialSource(creds Credentials) CredentialSource {
+	return CredentialSourceFunc(staticCredentialSource, func(context.Context) (Credentials, error) {
+		return creds, nil
+	})
+}
+
+// EnvCredentialSource returns a credential source named "env",
+// providing the username, password and token held by the given
+// environment variables, an empty name meaning that part of the
+// credentials isn't looked up. The variables are read anew every time,
+// and the source has no credentials when none of them is set.
+func EnvCredentialSource(usernameVar, passwordVar, tokenVar string) CredentialSource {
+	return CredentialSourceFunc(envCredentialSource, func(context.Context) (Credentials, error) {
+		var creds Credentials
+		var names []string
+		for _, v := range []struct {
+			name  string
+			value *string
+		}{{usernameVar, &creds.Username}, {passwordVar, &creds.Password}, {tokenVar, &creds.Token}} {
+			if v.name == "" {
+				continue
+			}
+			names = append(names, v.name)
+			*v.value = os.Getenv(v.name)
+		}
+		if creds == (Credentials{}) {
+			return Credentials{}, fmt.Errorf("none of %s is set", strings.Join(names, ", "))
+		}
+		return creds, nil
+	})
+}
+
+// FileCredentialSource returns a credential source named "file",
+// providing the credentials of the JSON document in the file at the
+// given path, e.g. `{"username": "...", "password": "..."}`, with the
+// fields of Credentials. The file is read anew every time, so that the
+// credentials it holds can be rotated.
+func FileCredentialSource(path string) CredentialSource {
+	return CredentialSourceFunc(fileCredentialSource, func(context.Context) (Credentials, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Credentials{}, err
+		}
+		var creds Credentials
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return Credentials{}, fmt.Errorf("invalid credentials in %s: %w", path, err)
+		}
+		if creds == (Credentials{}) {
+			return Credentials{}, fmt.Errorf("no credentials in %s", path)
+		}
+		return creds, nil
+	})
+}
+
+// CredentialChain tries its credential sources in order, and gives the
+// credentials of the first one providing some, along with its name.
+type CredentialChain struct {
+	sources []CredentialSource
+	stopOn  func(error) bool
+}
+
+// NewCredentialChain returns a chain of the given sources.
+func NewCredentialChain(sources ...CredentialSource) *CredentialChain {
+	return &CredentialChain{sources: sources}
+}
+
+// WithStopOn makes the chain stop at the first source failing with an
+// error for which stop returns true, and return that error as is, e.g.
+// for errors which later sources aren't to make up for.
+func (c *CredentialChain) WithStopOn(stop func(error) bool) *CredentialChain {
+	c.stopOn = stop
+	return c
+}
+
+// Credentials returns the credentials of the first source providing
+// some, along with its name. When no source does, the error of the
+// source is returned as is if the chain has only one, and a
+// *CredentialChainError otherwise.
+func (c *CredentialChain) Credentials(ctx context.Context) (Credentials, string, error) {
+	if len(c.sources) == 0 {
+		return Credentials{}, "", errors.New("no credential source in the chain")
+	}
+	chainErr := &CredentialChainError{}
+	var err error
+	for _, source := range c.sources {
+		var creds Credentials
+		creds, err = source.Credentials(ctx)
+		if err == nil {
+			return creds, source.Name(), nil
+		}
+		if c.stopOn != nil && c.stopOn(err) {
+			return Credentials{}, "", err
+		}
+		chainErr.Failures = append(chainErr.Failures, CredentialSourceFailure{Source: source.Name(), Err: err})
+	}
+	if len(c.sources) == 1 {
+		return Credentials{}, "", err
+	}
+	return Credentials{}, "", chainErr
+}
+
+// CredentialChainError is returned by a CredentialChain when none of
+// its sources provided credentials.
+type CredentialChainError struct {
+	// Failures are those of the sources, in order.
+	Failures []CredentialSourceFailure
+}
+
+// CredentialSourceFailure is the failure of a source of a chain.
+type CredentialSourceFailure struct {
+	Source string
+	Err    error
+}
+
+func (e *CredentialChainError) Error() string {
+	return "no credential source provided credentials: " + e.Reasons()
+}
+
+// Reasons returns the errors of the sources, each prefixed with the
+// name of its source, e.g. "env: none of FOO is set; file: ...".
+func (e *CredentialChainError) Reasons() string {
+	reasons := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		reasons = append(reasons, f.Source+": "+f.Err.Error())
+	}
+	return strings.Join(reasons, "; ")
+}
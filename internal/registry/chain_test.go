@@ -0,0 +1,197 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// failingSource returns a credential source with the given name, which
+// fails with the given error and counts its calls.
+func failingSource(name string, err error, calls *int) CredentialSource {
+	return CredentialSourceFunc(name, func(context.Context) (Credentials, error) {
+		*calls++
+		return Credentials{}, err
+	})
+}
+
+func TestCredentialChain(t *testing.T) {
+	errMetadata := errors.New("metadata server unreachable")
+	staticCreds := Credentials{Username: "user", Password: "pass"}
+
+	tests := []struct {
+		name       string
+		sources    func(calls *int) []CredentialSource
+		stopOn     func(error) bool
+		wantCreds  Credentials
+		wantSource string
+		wantCalls  int
+		wantErr    string
+		wantErrIs  error
+	}{
+		{
+			name: "later source wins",
+			sources: func(calls *int) []CredentialSource {
+				return []CredentialSource{
+					EnvCredentialSource("FLUX_TEST_USERNAME", "FLUX_TEST_PASSWORD", ""),
+					FileCredentialSource(filepath.Join(t.TempDir(), "missing.json")),
+					failingSource("metadata", errMetadata, calls),
+					StaticCredentialSource(staticCreds),
+					failingSource("unreached", errMetadata, calls),
+				}
+			},
+			wantCreds:  staticCreds,
+			wantSource: "static",
+			wantCalls:  1,
+		},
+		{
+			name: "all sources fail",
+			sources: func(calls *int) []CredentialSource {
+				return []CredentialSource{
+					EnvCredentialSource("FLUX_TEST_USERNAME", "", "FLUX_TEST_TOKEN"),
+					failingSource("metadata", errMetadata, calls),
+				}
+			},
+			wantCalls: 1,
+			wantErr:   "no credential source provided credentials: env: none of FLUX_TEST_USERNAME, FLUX_TEST_TOKEN is set; metadata: metadata server unreachable",
+		},
+		{
+			name: "single source fails",
+			sources: func(calls *int) []CredentialSource {
+				return []CredentialSource{failingSource("metadata", errMetadata, calls)}
+			},
+			wantCalls: 1,
+			wantErrIs: errMetadata,
+		},
+		{
+			name: "stop on error",
+			sources: func(calls *int) []CredentialSource {
+				return []CredentialSource{
+					failingSource("metadata", errMetadata, calls),
+					StaticCredentialSource(staticCreds),
+				}
+			},
+			stopOn:    func(err error) bool { return errors.Is(err, errMetadata) },
+			wantCalls: 1,
+			wantErrIs: errMetadata,
+		},
+		{
+			name:    "no sources",
+			sources: func(*int) []CredentialSource { return nil },
+			wantErr: "no credential source in the chain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			t.Setenv("FLUX_TEST_USERNAME", "")
+			t.Setenv("FLUX_TEST_PASSWORD", "")
+			t.Setenv("FLUX_TEST_TOKEN", "")
+
+			var calls int
+			chain := NewCredentialChain(tt.sources(&calls)...)
+			if tt.stopOn != nil {
+				chain.WithStopOn(tt.stopOn)
+			}
+			creds, source, err := chain.Credentials(context.TODO())
+			g.Expect(calls).To(Equal(tt.wantCalls))
+			switch {
+			case tt.wantErr != "":
+				g.Expect(err).To(MatchError(tt.wantErr))
+			case tt.wantErrIs != nil:
+				g.Expect(errors.Is(err, tt.wantErrIs)).To(BeTrue())
+				g.Expect(err).To(Equal(tt.wantErrIs))
+			default:
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(creds).To(Equal(tt.wantCreds))
+				g.Expect(source).To(Equal(tt.wantSource))
+			}
+		})
+	}
+}
+
+func TestEnvCredentialSource(t *testing.T) {
+	g := NewWithT(t)
+	t.Setenv("FLUX_TEST_USERNAME", "user")
+	t.Setenv("FLUX_TEST_PASSWORD", "pass")
+
+	source := EnvCredentialSource("FLUX_TEST_USERNAME", "FLUX_TEST_PASSWORD", "")
+	g.Expect(source.Name()).To(Equal("env"))
+	creds, err := source.Credentials(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(creds).To(Equal(Credentials{Username: "user", Password: "pass"}))
+
+	// The variables are read anew.
+	t.Setenv("FLUX_TEST_PASSWORD", "rotated")
+	creds, err = source.Credentials(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(creds.Password).To(Equal("rotated"))
+}
+
+func TestFileCredentialSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Credentials
+		wantErr string
+	}{
+		{
+			name:    "token",
+			content: `{"token": "tok"}`,
+			want:    Credentials{Token: "tok"},
+		},
+		{
+			name:    "username and password",
+			content: `{"username": "user", "password": "pass"}`,
+			want:    Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:    "invalid JSON",
+			content: `user:pass`,
+			wantErr: "invalid credentials in",
+		},
+		{
+			name:    "no credentials",
+			content: `{}`,
+			wantErr: "no credentials in",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			path := filepath.Join(t.TempDir(), "creds.json")
+			g.Expect(os.WriteFile(path, []byte(tt.content), 0o600)).To(Succeed())
+			source := FileCredentialSource(path)
+			g.Expect(source.Name()).To(Equal("file"))
+			creds, err := source.Credentials(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(creds).To(Equal(tt.want))
+		})
+	}
+}
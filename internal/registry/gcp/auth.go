@@ -0,0 +1,479 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// GCP_TOKEN_URL is the default GCP metadata endpoint used for
+// authentication.
+const GCP_TOKEN_URL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// defaultMetadataDialTimeout is the default timeout for connecting to
+// the metadata server. The server is link-local, so it answers quickly
+// when there is one; a short timeout makes logins fail fast when not
+// running on GCP.
+const defaultMetadataDialTimeout = 2 * time.Second
+
+// jsonKeyUsername is the username Artifact Registry and GCR expect
+// when the password is a raw JSON service account key.
+// See https://cloud.google.com/artifact-registry/docs/docker/authentication#json-key
+const jsonKeyUsername = "_json_key"
+
+// accessTokenUsername is the username to use when the password is an
+// OAuth2 access token.
+const accessTokenUsername = "oauth2accesstoken"
+
+// autoLoginFlag is the controller flag enabling the automatic login to
+// GCR.
+const autoLoginFlag = "--gcp-autologin-for-gcr"
+
+// cloudPlatformScope is the OAuth2 scope requested when exchanging
+// external credentials for an access token.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Credential sources reported by LoginWithSource.
+const (
+	jsonKeySource  = "json-key"
+	metadataSource = "metadata"
+	wifSource      = "workload-identity-federation"
+)
+
+// mirrorHosts are the hosts under gcr.io serving public mirrors,
+// which are pulled anonymously rather than with GCP credentials.
+var mirrorHosts = map[string]bool{
+	"mirror.gcr.io": true,
+}
+
+// ValidHost returns if a given host is a valid GCR host. Google's public
+// mirrors, such as the Docker Hub mirror mirror.gcr.io, aren't.
+func ValidHost(host string) bool {
+	if mirrorHosts[host] {
+		return false
+	}
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+type gceToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// Client is a GCP GCR client which can log into the registry and
+// return authorization information.
+type Client struct {
+	tokenURL          string
+	jsonKey           []byte
+	wifConfig         []byte
+	metadataTransport http.RoundTripper
+	metadataIP        string
+	strictMetadata    bool
+	metadataAttempts  int
+	metadataBaseDelay time.Duration
+	after             func(time.Duration) <-chan time.Time
+	cache             *TokenCache
+	chain             *registry.CredentialChain
+}
+
+// NewClient creates a new GCR client with default configurations.
+func NewClient() *Client {
+	return &Client{
+		tokenURL:          GCP_TOKEN_URL,
+		metadataTransport: newMetadataTransport(defaultMetadataDialTimeout),
+		metadataAttempts:  defaultMetadataAttempts,
+		metadataBaseDelay: defaultMetadataBaseDelay,
+		after:             time.After,
+	}
+}
+
+// newMetadataTransport returns a transport for talking to the metadata
+// server, which gives up connecting after the given timeout.
+func newMetadataTransport(dialTimeout time.Duration) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	return t
+}
+
+// WithTokenURL sets the token URL used by the GCR client.
+func (c *Client) WithTokenURL(url string) *Client {
+	c.tokenURL = url
+	return c
+}
+
+// WithMetadataDialTimeout sets the timeout for connecting to the
+// metadata server, 2s by default. It doesn't apply to logins given a
+// transport to use.
+func (c *Client) WithMetadataDialTimeout(timeout time.Duration) *Client {
+	c.metadataTransport = newMetadataTransport(timeout)
+	return c
+}
+
+// WithMetadataIP makes the client send its requests to the metadata
+// server to the given IP (e.g. "169.254.169.254") rather than to the
+// host of the token URL, for clusters where metadata.google.internal
+// can't be resolved. The requests still carry the host of the token URL
+// in their Host header.
+func (c *Client) WithMetadataIP(ip string) *Client {
+	c.metadataIP = ip
+	return c
+}
+
+// WithStrictMetadata makes the client fail closed on answers from the
+// metadata server which a real one wouldn't give, to catch tests whose
+// fake metadata server is set up wrong: a 400 or 404 status (e.g. for a
+// path the fake doesn't serve), a response without the Metadata-Flavor
+// header, or a token response without a token. Such answers give an
+// error wrapping registry.ErrUnexpectedResponse which names the path
+// requested, and the other credential sources aren't tried. It is
+// meant for tests.
+func (c *Client) WithStrictMetadata(strict bool) *Client {
+	c.strictMetadata = strict
+	return c
+}
+
+// WithJSONKey makes the client fall back to authenticating with the
+// given JSON service account key, using the `_json_key` username, when
+// no access token can be obtained otherwise.
+func (c *Client) WithJSONKey(key []byte) *Client {
+	c.jsonKey = key
+	return c
+}
+
+// WithWorkloadIdentityFederation makes the client fall back to
+// exchanging external credentials for an access token, as described by
+// the given workload identity federation configuration (a JSON
+// credential configuration file of type "external_account"), when the
+// metadata server fails. It is tried before the JSON key.
+func (c *Client) WithWorkloadIdentityFederation(config []byte) *Client {
+	c.wifConfig = config
+	return c
+}
+
+// WithTokenCache allows caching the access tokens obtained by the
+// client from the metadata server or with workload identity
+// federation, until shortly before they expire. Tokens are cached per
+// token URL (or federation configuration), scopes and username.
+func (c *Client) WithTokenCache(cache *TokenCache) *Client {
+	c.cache = cache
+	return c
+}
+
+// WithCredentialChain makes the client log in with the credentials of
+// the first source of the chain providing some, in place of the
+// metadata server, workload identity federation and the JSON key, and
+// report that source as the credential source. The Token of the
+// credentials is an access token; credentials without one are used as
+// a username and password, e.g. `_json_key` and a JSON key. The
+// credentials aren't cached.
+func (c *Client) WithCredentialChain(chain *registry.CredentialChain) *Client {
+	c.chain = chain
+	return c
+}
+
+// loginAttempt is a way of obtaining authentication, along with the
+// credential source it is reported as. The login gives the lifetime of
+// the credentials, zero when they don't expire. The tokens obtained
+// by attempts with a cache key are cached.
+type loginAttempt struct {
+	source   string
+	cacheKey string
+	login    func(context.Context) (authn.AuthConfig, time.Duration, error)
+}
+
+// getLoginAuth obtains authentication for the image by getting a
+// token from the metadata API on GCP. This assumes that the pod has
+// right to pull the image which would be the case if it is hosted on
+// GCP. It works with both service account and workload identity
+// enabled clusters. When the metadata server fails, workload identity
+// federation and then the JSON key are tried in turn, if configured.
+// The host is the registry host being logged into.
+func (c *Client) getLoginAuth(ctx context.Context, host string) (authn.AuthConfig, string, error) {
+	if c.chain != nil {
+		creds, source, err := c.chain.Credentials(ctx)
+		if err != nil {
+			return authn.AuthConfig{}, "", err
+		}
+		if creds.Token != "" {
+			return authn.AuthConfig{Username: accessTokenUsername, Password: creds.Token}, source, nil
+		}
+		return authn.AuthConfig{Username: creds.Username, Password: creds.Password}, source, nil
+	}
+
+	attempts := []loginAttempt{{
+		source:   metadataSource,
+		cacheKey: tokenCacheKey(c.tokenURL, nil, accessTokenUsername),
+		login:    c.metadataLoginAuth,
+	}}
+	if len(c.wifConfig) > 0 {
+		config := sha256.Sum256(c.wifConfig)
+		attempts = append(attempts, loginAttempt{
+			source:   wifSource,
+			cacheKey: tokenCacheKey("wif:"+hex.EncodeToString(config[:]), []string{cloudPlatformScope}, accessTokenUsername),
+			login:    c.wifLoginAuth,
+		})
+	}
+	if len(c.jsonKey) > 0 {
+		attempts = append(attempts, loginAttempt{source: jsonKeySource, login: c.jsonKeyLoginAuth})
+	}
+
+	if c.cache != nil {
+		for _, attempt := range attempts {
+			if attempt.cacheKey == "" {
+				continue
+			}
+			if authConfig, ok := c.cache.get(attempt.cacheKey, registry.MinValidityFromContext(ctx)); ok {
+				return authConfig, attempt.source, nil
+			}
+		}
+	}
+
+	sources := make([]registry.CredentialSource, 0, len(attempts))
+	for _, attempt := range attempts {
+		sources = append(sources, c.attemptSource(host, attempt))
+	}
+	chain := registry.NewCredentialChain(sources...)
+	if c.strictMetadata {
+		chain.WithStopOn(func(err error) bool {
+			return errors.Is(err, registry.ErrUnexpectedResponse)
+		})
+	}
+	creds, source, err := chain.Credentials(ctx)
+	if err != nil {
+		var chainErr *registry.CredentialChainError
+		if errors.As(err, &chainErr) {
+			return authn.AuthConfig{}, "", fmt.Errorf("no GCP credential source provided a token: %s", chainErr.Reasons())
+		}
+		return authn.AuthConfig{}, "", err
+	}
+	return authn.AuthConfig{Username: creds.Username, Password: creds.Password}, source, nil
+}
+
+// attemptSource returns the credential source of the login attempt,
+// which logs the attempt, and caches the tokens it obtains for the
+// host.
+func (c *Client) attemptSource(host string, attempt loginAttempt) registry.CredentialSource {
+	return registry.CredentialSourceFunc(attempt.source, func(ctx context.Context) (registry.Credentials, error) {
+		ctrl.LoggerFrom(ctx).Info("attempting GCP login with " + attempt.source)
+		authConfig, lifetime, err := attempt.login(ctx)
+		if err != nil {
+			ctrl.LoggerFrom(ctx).Info("GCP login with " + attempt.source + " failed: " + registry.Redact(err.Error()))
+			return registry.Credentials{}, err
+		}
+		creds := registry.Credentials{Username: authConfig.Username, Password: authConfig.Password}
+		if lifetime > 0 {
+			creds.ExpiresAt = time.Now().Add(lifetime)
+			if c.cache != nil && attempt.cacheKey != "" {
+				c.cache.set(attempt.cacheKey, host, authConfig, lifetime)
+			}
+		}
+		return creds, nil
+	})
+}
+
+// metadataLoginAuth obtains authentication with an access token from
+// the metadata server. Failing to reach the server gives an error
+// wrapping registry.ErrMetadataUnreachable, and the server refusing to
+// give a token one wrapping registry.ErrAuthenticationFailed.
+func (c *Client) metadataLoginAuth(ctx context.Context) (authn.AuthConfig, time.Duration, error) {
+	var authConfig authn.AuthConfig
+
+	response, err := c.metadataGet(ctx, c.tokenURL)
+	if err != nil {
+		return authConfig, 0, err
+	}
+	defer io.Copy(io.Discard, response.Body)
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return authConfig, 0, fmt.Errorf("%w: unexpected status from metadata service: %s", registry.ErrAuthenticationFailed, response.Status)
+	}
+
+	var accessToken gceToken
+	decoder := json.NewDecoder(response.Body)
+	if err := decoder.Decode(&accessToken); err != nil {
+		return authConfig, 0, err
+	}
+	if c.strictMetadata && accessToken.AccessToken == "" {
+		return authConfig, 0, fmt.Errorf("%w: metadata server gave no access token for %s", registry.ErrUnexpectedResponse, response.Request.URL.Path)
+	}
+
+	authConfig = authn.AuthConfig{
+		Username: accessTokenUsername,
+		Password: accessToken.AccessToken,
+	}
+	return authConfig, time.Duration(accessToken.ExpiresIn) * time.Second, nil
+}
+
+// metadataGet sends a GET request for the URL to the metadata server,
+// retrying it as set with WithMetadataRetry. Failing to reach the
+// server gives an error wrapping registry.ErrMetadataUnreachable.
+func (c *Client) metadataGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Metadata-Flavor", "Google")
+	if c.metadataIP != "" {
+		request.Host = request.URL.Host
+		if port := request.URL.Port(); port != "" {
+			request.URL.Host = net.JoinHostPort(c.metadataIP, port)
+		} else {
+			request.URL.Host = c.metadataIP
+		}
+	}
+
+	client := &http.Client{Transport: registry.TransportFor(ctx, c.metadataTransport)}
+	response, err := c.doMetadataRequest(ctx, client, request)
+	if err != nil {
+		// The error carries the URL, which makes its way to the logs;
+		// its query may hold parameters not meant to be shown.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = withoutQuery(urlErr.URL)
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w (the controller may not be running on GCP): %s", registry.ErrMetadataUnreachable, err)
+	}
+	if c.strictMetadata {
+		if err := checkMetadataResponse(response); err != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// checkMetadataResponse returns an error wrapping
+// registry.ErrUnexpectedResponse if the response isn't one a real
+// metadata server would give; see WithStrictMetadata.
+func checkMetadataResponse(response *http.Response) error {
+	path := response.Request.URL.Path
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound:
+		return fmt.Errorf("%w: metadata server answered %s for %s, which it may not serve", registry.ErrUnexpectedResponse, response.Status, path)
+	}
+	if response.Header.Get("Metadata-Flavor") != "Google" {
+		return fmt.Errorf("%w: response for %s lacks the Metadata-Flavor header of a metadata server", registry.ErrUnexpectedResponse, path)
+	}
+	return nil
+}
+
+// withoutQuery returns the URL stripped of its query and fragment, for
+// logging.
+func withoutQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// wifLoginAuth obtains authentication with an access token exchanged
+// for the external credentials of the workload identity federation
+// configuration.
+func (c *Client) wifLoginAuth(ctx context.Context) (authn.AuthConfig, time.Duration, error) {
+	if rt := registry.TransportFor(ctx, nil); rt != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: rt})
+	}
+	creds, err := google.CredentialsFromJSON(ctx, c.wifConfig, cloudPlatformScope)
+	if err != nil {
+		return authn.AuthConfig{}, 0, err
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return authn.AuthConfig{}, 0, err
+	}
+	var lifetime time.Duration
+	if !token.Expiry.IsZero() {
+		lifetime = time.Until(token.Expiry)
+	}
+	return authn.AuthConfig{
+		Username: accessTokenUsername,
+		Password: token.AccessToken,
+	}, lifetime, nil
+}
+
+// jsonKeyLoginAuth returns authentication with the raw JSON key.
+func (c *Client) jsonKeyLoginAuth(context.Context) (authn.AuthConfig, time.Duration, error) {
+	return authn.AuthConfig{
+		Username: jsonKeyUsername,
+		Password: string(c.jsonKey),
+	}, 0, nil
+}
+
+// Login attempts to get the authentication material for GCR. The
+// caller can ensure that the passed image is a valid GCR image using
+// ValidHost(). Login errors are sanitized, see registry.Sanitize.
+func (c *Client) Login(ctx context.Context, autoLogin bool, image string, ref name.Reference) (authn.Authenticator, error) {
+	auth, _, err := c.LoginWithSource(ctx, autoLogin, image, ref)
+	return auth, err
+}
+
+// LoginWithSource is like Login, but also returns the source of the
+// credentials the login was done with, "metadata",
+// "workload-identity-federation" or "json-key".
+func (c *Client) LoginWithSource(ctx context.Context, autoLogin bool, image string, ref name.Reference) (authn.Authenticator, string, error) {
+	if autoLogin {
+		ctrl.LoggerFrom(ctx).Info("logging in to GCP GCR for " + image)
+		var host string
+		if ref != nil {
+			host = ref.Context().RegistryStr()
+		}
+		authConfig, source, err := c.getLoginAuth(ctx, host)
+		if err != nil {
+			err = registry.Sanitize(err)
+			ctrl.LoggerFrom(ctx).Info("error logging into GCP " + err.Error())
+			return nil, "", err
+		}
+
+		auth := authn.FromConfig(authConfig)
+		return auth, source, nil
+	}
+	disabled := &registry.AutoLoginDisabledError{Provider: registry.ProviderGCP, Flag: autoLoginFlag}
+	ctrl.LoggerFrom(ctx).Info("GCR authentication is not enabled. To enable, set the controller flag " + disabled.Flag)
+	return nil, "", fmt.Errorf("GCR authentication failed: %w", disabled)
+}
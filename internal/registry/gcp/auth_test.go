@@ -0,0 +1,503 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+const testValidGCRImage = "gcr.io/foo/bar:v1"
+
+func TestGetLoginAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		responseBody   string
+		statusCode     int
+		wantErr        bool
+		wantAuthConfig authn.AuthConfig
+	}{
+		{
+			name: "success",
+			responseBody: `{
+	"access_token": "some-token",
+	"expires_in": 10,
+	"token_type": "foo"
+}`,
+			statusCode: http.StatusOK,
+			wantAuthConfig: authn.AuthConfig{
+				Username: "oauth2accesstoken",
+				Password: "some-token",
+			},
+		},
+		{
+			name:       "fail",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+		{
+			name:         "invalid response",
+			responseBody: "foo",
+			statusCode:   http.StatusOK,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.Header.Get("Metadata-Flavor")).To(Equal("Google"))
+				w.WriteHeader(tt.statusCode)
+				w.Write([]byte(tt.responseBody))
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			gc := NewClient().WithTokenURL(srv.URL)
+			a, source, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			if tt.statusCode == http.StatusOK {
+				g.Expect(a).To(Equal(tt.wantAuthConfig))
+			}
+			if !tt.wantErr {
+				g.Expect(source).To(Equal(metadataSource))
+			}
+		})
+	}
+}
+
+func TestGetLoginAuthWithJSONKey(t *testing.T) {
+	g := NewWithT(t)
+
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	key := []byte(`{"type": "service_account", "project_id": "foo"}`)
+	gc := NewClient().WithTokenURL(srv.URL).WithJSONKey(key)
+	a, source, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal(jsonKeySource))
+	g.Expect(a).To(Equal(authn.AuthConfig{
+		Username: "_json_key",
+		Password: string(key),
+	}))
+	g.Expect(called).To(BeTrue(), "metadata server should be tried first")
+}
+
+// rerouteTransport sends all requests to the server at addr, whatever
+// their host.
+type rerouteTransport struct {
+	addr string
+}
+
+func (rt rerouteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = rt.addr
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGetLoginAuthWithWorkloadIdentityFederation(t *testing.T) {
+	var stsCalled bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/token":
+			stsCalled = true
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "wif-token", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": 3600}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	subjectToken := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(subjectToken, []byte("subject-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(`{
+	"type": "external_account",
+	"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+	"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+	"token_url": "https://sts.googleapis.com/v1/token",
+	"credential_source": {"file": "` + subjectToken + `"}
+}`)
+	key := []byte(`{"type": "service_account", "project_id": "foo"}`)
+
+	tests := []struct {
+		name       string
+		wifConfig  []byte
+		jsonKey    []byte
+		wantSource string
+		wantErr    string
+	}{
+		{
+			name:       "workload identity federation",
+			wifConfig:  config,
+			jsonKey:    key,
+			wantSource: wifSource,
+		},
+		{
+			name:       "invalid configuration falls back to JSON key",
+			wifConfig:  []byte(`{`),
+			jsonKey:    key,
+			wantSource: jsonKeySource,
+		},
+		{
+			name:      "all sources fail",
+			wifConfig: []byte(`{`),
+			wantErr:   "no GCP credential source provided a token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			stsCalled = false
+
+			gc := NewClient().WithTokenURL(srv.URL + "/metadata").
+				WithWorkloadIdentityFederation(tt.wifConfig)
+			if tt.jsonKey != nil {
+				gc = gc.WithJSONKey(tt.jsonKey)
+			}
+			ctx := registry.ContextWithTransport(context.TODO(), rerouteTransport{addr: srv.Listener.Addr().String()})
+			a, source, err := gc.getLoginAuth(ctx, "gcr.io")
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				g.Expect(err.Error()).To(ContainSubstring(metadataSource + ": "))
+				g.Expect(err.Error()).To(ContainSubstring(wifSource + ": "))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(source).To(Equal(tt.wantSource))
+			g.Expect(stsCalled).To(Equal(tt.wantSource == wifSource))
+			if tt.wantSource == wifSource {
+				g.Expect(a).To(Equal(authn.AuthConfig{Username: "oauth2accesstoken", Password: "wif-token"}))
+			}
+		})
+	}
+}
+
+func TestGetLoginAuth_MetadataDialTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	// A non-routable address, on which connecting hangs rather than
+	// being refused.
+	gc := NewClient().
+		WithTokenURL("http://10.255.255.1/computeMetadata/v1/instance/service-accounts/default/token").
+		WithMetadataDialTimeout(200 * time.Millisecond)
+
+	start := time.Now()
+	_, _, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+	// Setting a User-Agent keeps the timeout.
+	start = time.Now()
+	_, _, err = gc.getLoginAuth(registry.ContextWithUserAgent(context.TODO(), "image-reflector-controller"), "gcr.io")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+}
+
+func TestGetLoginAuth_ErrorClassification(t *testing.T) {
+	tests := []struct {
+		name    string
+		closed  bool
+		status  int
+		wantErr error
+	}{
+		{
+			name:    "metadata server unreachable",
+			closed:  true,
+			wantErr: registry.ErrMetadataUnreachable,
+		},
+		{
+			name:    "token denied",
+			status:  http.StatusForbidden,
+			wantErr: registry.ErrAuthenticationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			if tt.closed {
+				// Nothing listens on the address anymore, so dialing it
+				// fails.
+				srv.Close()
+			}
+
+			_, _, err := NewClient().WithTokenURL(srv.URL).getLoginAuth(context.TODO(), "gcr.io")
+			g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue(), err.Error())
+		})
+	}
+}
+
+func TestGetLoginAuth_StrictMetadata(t *testing.T) {
+	const tokenPath = "/computeMetadata/v1/instance/service-accounts/default/token"
+
+	tests := []struct {
+		name       string
+		path       string
+		noFlavor   bool
+		noToken    bool
+		strict     bool
+		wantErr    string
+		wantSource string
+	}{
+		{
+			name:       "expected path",
+			path:       tokenPath,
+			strict:     true,
+			wantSource: metadataSource,
+		},
+		{
+			name:    "unexpected path",
+			path:    "/computeMetadata/v1/instance/service-accounts/default/tokens",
+			strict:  true,
+			wantErr: "metadata server answered 400 Bad Request for /computeMetadata/v1/instance/service-accounts/default/tokens",
+		},
+		{
+			name:     "missing Metadata-Flavor header",
+			path:     tokenPath,
+			noFlavor: true,
+			strict:   true,
+			wantErr:  "lacks the Metadata-Flavor header",
+		},
+		{
+			name:    "missing token",
+			path:    tokenPath,
+			noToken: true,
+			strict:  true,
+			wantErr: "metadata server gave no access token",
+		},
+		{
+			name:       "unexpected path without strict mode",
+			path:       "/computeMetadata/v1/instance/service-accounts/default/tokens",
+			wantSource: jsonKeySource,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.noFlavor {
+					w.Header().Set("Metadata-Flavor", "Google")
+				}
+				if r.URL.Path != tokenPath {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if tt.noToken {
+					w.Write([]byte(`{"expires_in": 10, "token_type": "Bearer"}`))
+					return
+				}
+				w.Write([]byte(`{"access_token": "some-token", "expires_in": 10, "token_type": "Bearer"}`))
+			}))
+			defer srv.Close()
+
+			gc := NewClient().WithTokenURL(srv.URL + tt.path).
+				WithJSONKey([]byte(`{"type": "service_account"}`)).
+				WithStrictMetadata(tt.strict)
+			_, source, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+			if tt.wantErr != "" {
+				g.Expect(errors.Is(err, registry.ErrUnexpectedResponse)).To(BeTrue())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(source).To(Equal(tt.wantSource))
+		})
+	}
+}
+
+func TestGetLoginAuth_TokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "some-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+	cache.jitter = func() float64 { return 0 }
+	gc := NewClient().WithTokenURL(srv.URL).WithTokenCache(cache)
+
+	for i := 0; i < 2; i++ {
+		a, source, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(a.Password).To(Equal("some-token"))
+		g.Expect(source).To(Equal(metadataSource))
+	}
+	g.Expect(calls).To(Equal(1))
+
+	// Once the token expires, a new one is requested.
+	now = now.Add(time.Hour)
+	_, _, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(2))
+}
+
+func TestGetLoginAuth_MetadataIP(t *testing.T) {
+	g := NewWithT(t)
+
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		g.Expect(r.Header.Get("Metadata-Flavor")).To(Equal("Google"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "some-token", "expires_in": 10, "token_type": "foo"}`))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The host of the token URL isn't resolvable; the requests go to
+	// the IP of the fake server instead, on the port of the URL.
+	tokenURL := "http://metadata.google.internal:" + u.Port() + "/computeMetadata/v1/instance/service-accounts/default/token"
+	gc := NewClient().WithTokenURL(tokenURL).WithMetadataIP(u.Hostname())
+	a, _, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(a.Password).To(Equal("some-token"))
+	g.Expect(host).To(Equal("metadata.google.internal:" + u.Port()))
+}
+
+func TestGetLoginAuth_CredentialChain(t *testing.T) {
+	g := NewWithT(t)
+
+	var metadataCalls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadataCalls++
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	g.Expect(os.WriteFile(tokenFile, []byte(`{"token": "file-token"}`), 0o600)).To(Succeed())
+
+	gc := NewClient().WithTokenURL(srv.URL).WithCredentialChain(registry.NewCredentialChain(
+		registry.EnvCredentialSource("", "", "FLUX_TEST_GCP_ACCESS_TOKEN"),
+		registry.FileCredentialSource(tokenFile),
+	))
+	a, source, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(source).To(Equal("file"))
+	g.Expect(a).To(Equal(authn.AuthConfig{Username: accessTokenUsername, Password: "file-token"}))
+	// The chain replaces the metadata server.
+	g.Expect(metadataCalls).To(BeZero())
+}
+
+func TestLogin_TokenURLQueryNotLogged(t *testing.T) {
+	const scope = "https://www.googleapis.com/auth/secret-scope"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "unreachable metadata server",
+		},
+		{
+			name: "error status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(tt.handler)
+			tokenURL := srv.URL + "/token?scopes=" + url.QueryEscape(scope)
+			if tt.handler == nil {
+				srv.Close()
+			} else {
+				defer srv.Close()
+			}
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, prefix+" "+args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			_, err := NewClient().WithTokenURL(tokenURL).Login(ctx, true, testValidGCRImage, nil)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).ToNot(ContainSubstring("secret-scope"))
+			g.Expect(logs).ToNot(BeEmpty())
+			for _, line := range logs {
+				g.Expect(line).ToNot(ContainSubstring("secret-scope"))
+			}
+		})
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		result bool
+	}{
+		{"gcr.io", true},
+		{"foo.gcr.io", true},
+		{"foo-docker.pkg.dev", true},
+		{"mirror.gcr.io", false},
+		{"docker.io", false},
+		{"gcr.io.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(ValidHost(tt.host)).To(Equal(tt.result))
+		})
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// maxRefreshJitter is the largest fraction of the lifetime of a token
+// by which it is refreshed early. Refreshing at a random point spreads
+// out the token requests of logins which cached their tokens at the
+// same time.
+const maxRefreshJitter = 0.1
+
+// TokenCache holds GCP access tokens until shortly before they expire.
+// It is safe for concurrent use, and may be shared between clients.
+type TokenCache struct {
+	entries registry.LRU
+	now     func() time.Time
+	jitter  func() float64
+	metrics *registry.CredentialExpiryMetrics
+}
+
+type cachedToken struct {
+	authConfig authn.AuthConfig
+	// expiresAt is when the token is due for refresh, and
+	// recordedExpiry its actual expiry, as recorded for host in the
+	// metrics.
+	expiresAt      time.Time
+	host           string
+	recordedExpiry time.Time
+}
+
+// NewTokenCache creates an empty token cache.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		now:    time.Now,
+		jitter: rand.Float64,
+	}
+}
+
+// WithMaxCacheEntries bounds the number of tokens held by the cache to
+// n, evicting the least recently used ones. Zero or less means no
+// bound, the default.
+func (c *TokenCache) WithMaxCacheEntries(n int) *TokenCache {
+	c.entries.SetMaxEntries(n)
+	return c
+}
+
+// WithExpiryMetrics makes the cache record the expiry of the tokens it
+// caches in the given metrics, by registry host, until it drops them.
+func (c *TokenCache) WithExpiryMetrics(m *registry.CredentialExpiryMetrics) *TokenCache {
+	c.metrics = m
+	c.entries.SetOnRemove(func(_ string, value interface{}) {
+		if m != nil {
+			entry := value.(cachedToken)
+			m.DeleteExpiry(registry.ProviderGCP, entry.host, entry.recordedExpiry)
+		}
+	})
+	return c
+}
+
+// tokenCacheKey returns the key under which the token obtained from
+// the given token URL, for the scopes and to be used with the
+// username, is cached.
+func tokenCacheKey(tokenURL string, scopes []string, username string) string {
+	return tokenURL + " " + strings.Join(scopes, ",") + " " + username
+}
+
+// get returns the cached token for the key, if there is one which is
+// not due for refresh within minValidity.
+func (c *TokenCache) get(key string, minValidity time.Duration) (authn.AuthConfig, bool) {
+	value, ok := c.entries.Get(key)
+	if !ok {
+		return authn.AuthConfig{}, false
+	}
+	entry := value.(cachedToken)
+	if !c.now().Add(minValidity).Before(entry.expiresAt) {
+		c.entries.Delete(key)
+		return authn.AuthConfig{}, false
+	}
+	return entry.authConfig, true
+}
+
+// set caches the token for the key, for its lifetime shortened by a
+// random fraction of up to maxRefreshJitter. The host is the registry
+// host of the login which obtained the token, which the expiry is
+// recorded for. The tokens due for refresh are dropped, such as those
+// of hosts no longer logged in to.
+func (c *TokenCache) set(key, host string, authConfig authn.AuthConfig, lifetime time.Duration) {
+	now := c.now()
+	c.entries.Prune(func(value interface{}) bool {
+		return !now.Before(value.(cachedToken).expiresAt)
+	})
+	early := time.Duration(float64(lifetime) * maxRefreshJitter * c.jitter())
+	c.entries.Set(key, cachedToken{
+		authConfig:     authConfig,
+		expiresAt:      now.Add(lifetime - early),
+		host:           host,
+		recordedExpiry: now.Add(lifetime),
+	})
+	if c.metrics != nil {
+		c.metrics.RecordExpiry(registry.ProviderGCP, host, now.Add(lifetime))
+	}
+}
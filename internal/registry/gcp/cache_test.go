@@ -0,0 +1,53 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+)
+
+func TestTokenCache(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+	cache.jitter = func() float64 { return 0.5 }
+
+	authConfig := authn.AuthConfig{Username: accessTokenUsername, Password: "token"}
+	key := tokenCacheKey(GCP_TOKEN_URL, nil, accessTokenUsername)
+	cache.set(key, "gcr.io", authConfig, time.Hour)
+
+	got, ok := cache.get(key, 0)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(got).To(Equal(authConfig))
+
+	_, ok = cache.get(tokenCacheKey(GCP_TOKEN_URL, []string{cloudPlatformScope}, accessTokenUsername), 0)
+	g.Expect(ok).To(BeFalse())
+
+	// With half of the maximum jitter, the token is refreshed 3m early.
+	now = now.Add(56 * time.Minute)
+	_, ok = cache.get(key, 0)
+	g.Expect(ok).To(BeTrue())
+	now = now.Add(time.Minute)
+	_, ok = cache.get(key, 0)
+	g.Expect(ok).To(BeFalse())
+}
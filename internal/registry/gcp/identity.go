@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// maxEmailSize bounds how much of the email answered by the metadata
+// server is read.
+const maxEmailSize = 1024
+
+// impersonationURLPrefix precedes the email of the service account in
+// the impersonation URL of a workload identity federation
+// configuration.
+const impersonationURLPrefix = "/serviceAccounts/"
+
+// Identity returns the principal the client logs in as, trying its
+// credential sources in the same order as a login: the email of the
+// service account of the metadata server; the service account
+// impersonated with workload identity federation, or the audience of
+// the federation when none is; the email of the JSON key. It doesn't
+// log into any registry.
+func (c *Client) Identity(ctx context.Context) (string, error) {
+	type identitySource struct {
+		source   string
+		identity func(context.Context) (string, error)
+	}
+	sources := []identitySource{{source: metadataSource, identity: c.metadataIdentity}}
+	if len(c.wifConfig) > 0 {
+		sources = append(sources, identitySource{source: wifSource, identity: c.wifIdentity})
+	}
+	if len(c.jsonKey) > 0 {
+		sources = append(sources, identitySource{source: jsonKeySource, identity: c.jsonKeyIdentity})
+	}
+
+	var errs []string
+	var err error
+	for _, s := range sources {
+		var identity string
+		identity, err = s.identity(ctx)
+		if err == nil {
+			return identity, nil
+		}
+		if c.strictMetadata && errors.Is(err, registry.ErrUnexpectedResponse) {
+			return "", err
+		}
+		errs = append(errs, s.source+": "+err.Error())
+	}
+	if len(errs) == 1 {
+		return "", err
+	}
+	return "", fmt.Errorf("no GCP credential source provided an identity: %s", strings.Join(errs, "; "))
+}
+
+// metadataIdentity returns the email of the service account of the
+// metadata server, which is found next to its token.
+func (c *Client) metadataIdentity(ctx context.Context) (string, error) {
+	u, err := url.Parse(c.tokenURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "email")
+	u.RawQuery = ""
+
+	response, err := c.metadataGet(ctx, u.String())
+	if err != nil {
+		return "", err
+	}
+	defer io.Copy(io.Discard, response.Body)
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: unexpected status from metadata service: %s", registry.ErrAuthenticationFailed, response.Status)
+	}
+	email, err := io.ReadAll(io.LimitReader(response.Body, maxEmailSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(email)), nil
+}
+
+// wifIdentity returns the email of the service account impersonated
+// with the workload identity federation configuration, or its audience
+// when none is.
+func (c *Client) wifIdentity(context.Context) (string, error) {
+	var config struct {
+		Audience                       string `json:"audience"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(c.wifConfig, &config); err != nil {
+		return "", err
+	}
+	if u := config.ServiceAccountImpersonationURL; u != "" {
+		i := strings.LastIndex(u, impersonationURLPrefix)
+		if i < 0 {
+			return "", fmt.Errorf("malformed service account impersonation URL %q", u)
+		}
+		return strings.TrimSuffix(u[i+len(impersonationURLPrefix):], ":generateAccessToken"), nil
+	}
+	if config.Audience == "" {
+		return "", errors.New("workload identity federation configuration has no audience")
+	}
+	return config.Audience, nil
+}
+
+// jsonKeyIdentity returns the email of the service account of the JSON
+// key.
+func (c *Client) jsonKeyIdentity(context.Context) (string, error) {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(c.jsonKey, &key); err != nil {
+		return "", err
+	}
+	if key.ClientEmail == "" {
+		return "", errors.New("JSON key has no client email")
+	}
+	return key.ClientEmail, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name         string
+		metadataDown bool
+		wifConfig    string
+		jsonKey      string
+		want         string
+		wantErr      error
+	}{
+		{
+			name: "metadata server",
+			want: "flux@my-project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "impersonated service account",
+			metadataDown: true,
+			wifConfig: `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/aws",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/wif@my-project.iam.gserviceaccount.com:generateAccessToken"
+}`,
+			want: "wif@my-project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "federated principal",
+			metadataDown: true,
+			wifConfig:    `{"type": "external_account", "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/aws"}`,
+			want:         "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/aws",
+		},
+		{
+			name:         "JSON key",
+			metadataDown: true,
+			jsonKey:      `{"type": "service_account", "client_email": "key@my-project.iam.gserviceaccount.com"}`,
+			want:         "key@my-project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "metadata server unreachable",
+			metadataDown: true,
+			wantErr:      registry.ErrMetadataUnreachable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.Header.Get("Metadata-Flavor")).To(Equal("Google"))
+				g.Expect(r.URL.Path).To(Equal("/computeMetadata/v1/instance/service-accounts/default/email"))
+				w.Write([]byte("flux@my-project.iam.gserviceaccount.com\n"))
+			}))
+			defer srv.Close()
+			if tt.metadataDown {
+				srv.Close()
+			}
+
+			gc := NewClient().WithTokenURL(srv.URL + "/computeMetadata/v1/instance/service-accounts/default/token")
+			if tt.wifConfig != "" {
+				gc.WithWorkloadIdentityFederation([]byte(tt.wifConfig))
+			}
+			if tt.jsonKey != "" {
+				gc.WithJSONKey([]byte(tt.jsonKey))
+			}
+			identity, err := gc.Identity(context.TODO())
+			if tt.wantErr != nil {
+				g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue(), err.Error())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(identity).To(Equal(tt.want))
+		})
+	}
+}
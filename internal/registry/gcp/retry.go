@@ -0,0 +1,106 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// defaultMetadataAttempts is the default number of times a request to
+// the metadata server is sent before giving up.
+const defaultMetadataAttempts = 3
+
+// defaultMetadataBaseDelay is the default delay before the first retry
+// of a request to the metadata server, doubled for each further retry.
+const defaultMetadataBaseDelay = 100 * time.Millisecond
+
+// WithMetadataRetry sets how many times in all a request to the
+// metadata server is sent, and how long to wait before retrying it the
+// first time, the delay doubling for each further retry; 3 attempts
+// and 100ms by default. Requests are retried while the server refuses
+// connections or answers with a status telling it is unavailable, as
+// when the GKE metadata server of a new pod isn't ready yet. Failing to
+// resolve its host or timing out connecting to it, as when not running
+// on GCP, isn't retried, unless the classifier of the errors to retry
+// carried by the context of the login, if any, tells otherwise (see
+// registry.ContextWithRetryable). Attempts less than one are the same
+// as one, i.e. no retries, and negative delays the same as zero.
+func (c *Client) WithMetadataRetry(attempts int, baseDelay time.Duration) *Client {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if baseDelay < 0 {
+		baseDelay = 0
+	}
+	c.metadataAttempts = attempts
+	c.metadataBaseDelay = baseDelay
+	return c
+}
+
+// doMetadataRequest sends the request to the metadata server with the
+// client, retrying it as set with WithMetadataRetry. The response or
+// error of the last attempt is returned.
+func (c *Client) doMetadataRequest(ctx context.Context, client *http.Client, request *http.Request) (*http.Response, error) {
+	isRetryable := registry.RetryableFromContext(ctx)
+	delay := c.metadataBaseDelay
+	for attempt := 1; ; attempt++ {
+		response, err := client.Do(request)
+		retryable := retryableMetadataAnswer(response, err) || (err != nil && isRetryable != nil && isRetryable(err))
+		if attempt >= c.metadataAttempts || ctx.Err() != nil || !retryable {
+			return response, err
+		}
+		if response != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		ctrl.LoggerFrom(ctx).Info("metadata server unavailable, retrying", "attempt", attempt, "delay", delay.String())
+		select {
+		case <-c.after(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryableMetadataAnswer returns whether the answer of the metadata
+// server to a request may be transient.
+func retryableMetadataAnswer(response *http.Response, err error) bool {
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return false
+		}
+		var netErr net.Error
+		return !errors.As(err, &netErr) || !netErr.Timeout()
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestWithMetadataRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		baseDelay    time.Duration
+		defaults     bool
+		closed       bool
+		statuses     []int
+		wantRequests int
+		wantDelays   []time.Duration
+		wantErr      error
+	}{
+		{
+			name:         "defaults",
+			defaults:     true,
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantRequests: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			wantErr:      registry.ErrAuthenticationFailed,
+		},
+		{
+			name:         "more attempts",
+			attempts:     5,
+			baseDelay:    time.Second,
+			statuses:     []int{http.StatusInternalServerError},
+			wantRequests: 5,
+			wantDelays:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+			wantErr:      registry.ErrAuthenticationFailed,
+		},
+		{
+			name:         "ready after retries",
+			attempts:     5,
+			baseDelay:    time.Second,
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 3,
+			wantDelays:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:         "token denied",
+			attempts:     5,
+			baseDelay:    time.Second,
+			statuses:     []int{http.StatusForbidden},
+			wantRequests: 1,
+			wantErr:      registry.ErrAuthenticationFailed,
+		},
+		{
+			name:         "no retries",
+			attempts:     0,
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantRequests: 1,
+			wantErr:      registry.ErrAuthenticationFailed,
+		},
+		{
+			name:       "connection refused",
+			attempts:   4,
+			baseDelay:  time.Second,
+			closed:     true,
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+			wantErr:    registry.ErrMetadataUnreachable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[len(tt.statuses)-1]
+				if requests < len(tt.statuses) {
+					status = tt.statuses[requests]
+				}
+				requests++
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write([]byte(`{"access_token": "some-token", "expires_in": 10}`))
+				}
+			}))
+			defer srv.Close()
+			if tt.closed {
+				srv.Close()
+			}
+
+			gc := NewClient().WithTokenURL(srv.URL)
+			if !tt.defaults {
+				gc.WithMetadataRetry(tt.attempts, tt.baseDelay)
+			}
+			var delays []time.Duration
+			gc.after = func(d time.Duration) <-chan time.Time {
+				delays = append(delays, d)
+				c := make(chan time.Time, 1)
+				c <- time.Time{}
+				return c
+			}
+
+			a, _, err := gc.getLoginAuth(context.TODO(), "gcr.io")
+			if tt.wantErr != nil {
+				g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue(), "unexpected error: %v", err)
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(a.Password).To(Equal("some-token"))
+			}
+			g.Expect(requests).To(Equal(tt.wantRequests))
+			g.Expect(delays).To(Equal(tt.wantDelays))
+		})
+	}
+}
+
+func TestWithMetadataRetry_Cancel(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	gc := NewClient().WithTokenURL(srv.URL).WithMetadataRetry(3, time.Hour)
+	gc.after = func(time.Duration) <-chan time.Time {
+		// The login is canceled while waiting to retry.
+		cancel()
+		return make(chan time.Time)
+	}
+
+	_, _, err := gc.getLoginAuth(ctx, "gcr.io")
+	g.Expect(errors.Is(err, context.Canceled)).To(BeTrue(), "unexpected error: %v", err)
+}
+
+// metadataTimeoutError is a dial timeout to the metadata server, which
+// isn't retried by default.
+type metadataTimeoutError struct{}
+
+func (metadataTimeoutError) Error() string   { return "dial timeout" }
+func (metadataTimeoutError) Timeout() bool   { return true }
+func (metadataTimeoutError) Temporary() bool { return false }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithMetadataRetry_Classifier(t *testing.T) {
+	tests := []struct {
+		name         string
+		classify     bool
+		wantRequests int
+	}{
+		{
+			name:         "without classifier",
+			wantRequests: 1,
+		},
+		{
+			name:         "classified as retryable",
+			classify:     true,
+			wantRequests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var requests int
+			ctx := registry.ContextWithTransport(context.TODO(), roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				requests++
+				return nil, metadataTimeoutError{}
+			}))
+			if tt.classify {
+				ctx = registry.ContextWithRetryable(ctx, func(err error) bool {
+					return errors.As(err, &metadataTimeoutError{})
+				})
+			}
+			gc := NewClient().WithMetadataRetry(3, 0)
+			gc.after = func(time.Duration) <-chan time.Time {
+				c := make(chan time.Time, 1)
+				c <- time.Time{}
+				return c
+			}
+
+			_, _, err := gc.getLoginAuth(ctx, "gcr.io")
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(requests).To(Equal(tt.wantRequests))
+		})
+	}
+}
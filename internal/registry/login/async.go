@@ -0,0 +1,52 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// LoginAsync is like Resolve, but logs in on a goroutine of its own
+// and returns at once; the callback is called with the result of the
+// login once it completes, exactly once, on that goroutine. When the
+// context is done before the login completes, the callback is called
+// right away with an error wrapping that of the context, and the
+// result of the login is discarded.
+func (m *Manager) LoginAsync(ctx context.Context, image string, ref name.Reference, opts ProviderOptions, callback func(LoginResult, error)) {
+	go func() {
+		type login struct {
+			result LoginResult
+			err    error
+		}
+		// Buffered, so that the login doesn't leak when abandoned.
+		done := make(chan login, 1)
+		go func() {
+			result, err := m.Resolve(ctx, image, ref, opts)
+			done <- login{result: result, err: err}
+		}()
+
+		select {
+		case l := <-done:
+			callback(l.result, l.err)
+		case <-ctx.Done():
+			callback(LoginResult{}, fmt.Errorf("login for %s interrupted: %w", image, ctx.Err()))
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+func TestManager_LoginAsync(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+
+	image := "gcr.io/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	type login struct {
+		result LoginResult
+		err    error
+	}
+	done := make(chan login, 2)
+	mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+	mgr.LoginAsync(context.TODO(), image, ref, ProviderOptions{GcpAutoLogin: true}, func(result LoginResult, err error) {
+		done <- login{result: result, err: err}
+	})
+
+	var l login
+	g.Eventually(done).Should(Receive(&l))
+	g.Expect(l.err).ToNot(HaveOccurred())
+	g.Expect(l.result.Provider).To(Equal(registry.ProviderGCP))
+	g.Expect(l.result.CredentialSource).To(Equal("metadata"))
+	authConfig, err := l.result.Authenticator.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(*authConfig).To(Equal(authn.AuthConfig{Username: "oauth2accesstoken", Password: "gcp-token"}))
+	// The callback is called only once.
+	g.Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+func TestManager_LoginAsyncCancel(t *testing.T) {
+	g := NewWithT(t)
+
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	image := "gcr.io/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	errs := make(chan error, 2)
+	ctx, cancel := context.WithCancel(context.TODO())
+	mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+	mgr.LoginAsync(ctx, image, ref, ProviderOptions{GcpAutoLogin: true}, func(result LoginResult, err error) {
+		errs <- err
+	})
+	g.Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+
+	cancel()
+	var loginErr error
+	g.Eventually(errs).Should(Receive(&loginErr))
+	g.Expect(errors.Is(loginErr, context.Canceled)).To(BeTrue(), loginErr.Error())
+	g.Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// maxBatchConcurrency is the maximum number of logins LoginBatch runs
+// at the same time.
+const maxBatchConcurrency = 4
+
+// maxBatchLoginDuration bounds the time a login of LoginBatch may take.
+// The login is shared with the other batches logging into the same
+// host, so it isn't bound by the context of any of them.
+const maxBatchLoginDuration = 5 * time.Minute
+
+// ImageRequest is an image to log into in a batch.
+type ImageRequest struct {
+	Image string
+	Ref   name.Reference
+}
+
+// LoginBatch logs into the registries of several images, and returns
+// the results in the same order as the requests. Logins are done once
+// per registry host, the images of a host sharing the result, and run
+// concurrently; concurrent logins for the same host and options, even
+// from other batches, are also done only once. A failing login doesn't
+// fail the batch: the results of the images of the failing host carry
+// the error in their Err field, and the other results are still
+// returned. The error returned is only for the batch as a whole, when
+// the context is done before all the logins completed, failing those
+// which didn't, in which case the results are returned as well. Canceling a batch doesn't cancel
+// the logins it shares with other batches.
+func (m *Manager) LoginBatch(ctx context.Context, reqs []ImageRequest, opts ProviderOptions) ([]LoginResult, error) {
+	type hostLogin struct {
+		result LoginResult
+		err    error
+		// interrupted is whether the batch gave up on the login, its
+		// context being done.
+		interrupted bool
+	}
+
+	optsKey := opts.CacheKey()
+	sem := make(chan struct{}, maxBatchConcurrency)
+	logins := map[string]*hostLogin{}
+	var wg sync.WaitGroup
+	for _, req := range reqs {
+		host := req.Ref.Context().RegistryStr()
+		if _, ok := logins[host]; ok {
+			continue
+		}
+		login := &hostLogin{}
+		logins[host] = login
+
+		wg.Add(1)
+		go func(req ImageRequest, login *hostLogin) {
+			defer wg.Done()
+			interrupt := func() {
+				login.err, login.interrupted = ctx.Err(), true
+			}
+			if ctx.Err() != nil {
+				interrupt()
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				interrupt()
+				return
+			}
+			defer func() { <-sem }()
+
+			// The login runs detached from ctx, so that canceling this
+			// batch doesn't fail the others waiting for it; this one
+			// only waits for as long as ctx allows.
+			ch := m.flights.DoChan(req.Ref.Context().RegistryStr()+"/"+optsKey, func() (interface{}, error) {
+				flightCtx, cancel := context.WithTimeout(detachedContext{parent: ctx}, maxBatchLoginDuration)
+				defer cancel()
+				return m.Resolve(flightCtx, req.Image, req.Ref, opts)
+			})
+			select {
+			case res := <-ch:
+				login.result, login.err = res.Val.(LoginResult), res.Err
+			case <-ctx.Done():
+				interrupt()
+			}
+		}(req, login)
+	}
+	wg.Wait()
+
+	results := make([]LoginResult, len(reqs))
+	var interrupted error
+	for i, req := range reqs {
+		login := logins[req.Ref.Context().RegistryStr()]
+		if login.err != nil {
+			results[i] = LoginResult{Err: fmt.Errorf("login for %s failed: %w", req.Image, login.err)}
+			if login.interrupted {
+				interrupted = login.err
+			}
+			continue
+		}
+		results[i] = login.result
+	}
+	if interrupted != nil {
+		return results, fmt.Errorf("login batch interrupted: %w", interrupted)
+	}
+	return results, nil
+}
+
+// detachedContext carries the values of its parent context, e.g. its
+// logger, but neither its deadline nor its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
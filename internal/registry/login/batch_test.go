@@ -0,0 +1,175 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/azure"
+)
+
+func TestManager_LoginBatch(t *testing.T) {
+	g := NewWithT(t)
+
+	var exchanges int32
+	newACR := func(refreshToken string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&exchanges, 1)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"refresh_token": "` + refreshToken + `"}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	first := strings.TrimPrefix(newACR("first-token").URL, "http://")
+	second := strings.TrimPrefix(newACR("second-token").URL, "http://")
+
+	mgr := NewManager().WithACRClient(azure.NewClient().
+		WithTokenCredential(&fakeTokenCredential{token: "foo"}).
+		WithScheme("http"))
+	mgr.WithHostProviderOverride(first, registry.ProviderAzure)
+	mgr.WithHostProviderOverride(second, registry.ProviderAzure)
+
+	var reqs []ImageRequest
+	for _, image := range []string{first + "/foo:v1", second + "/bar:v1", first + "/baz:v1"} {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		reqs = append(reqs, ImageRequest{Image: image, Ref: ref})
+	}
+
+	results, err := mgr.LoginBatch(context.TODO(), reqs, ProviderOptions{AzureAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exchanges).To(Equal(int32(2)))
+	g.Expect(results).To(HaveLen(3))
+
+	wantPasswords := []string{"first-token", "second-token", "first-token"}
+	for i, result := range results {
+		g.Expect(result.Provider).To(Equal(registry.ProviderAzure))
+		authConfig, err := result.Authenticator.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(authConfig.Password).To(Equal(wantPasswords[i]))
+	}
+}
+
+func TestManager_LoginBatchPartialFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	var reqs []ImageRequest
+	for _, image := range []string{"ghcr.io/foo/bar:v1", "foo.azurecr.io/bar:v1", "ghcr.io/foo/baz:v1"} {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		reqs = append(reqs, ImageRequest{Image: image, Ref: ref})
+	}
+
+	// Auto-login isn't enabled for the ACR image.
+	results, err := NewManager().LoginBatch(context.TODO(), reqs, ProviderOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(results).To(HaveLen(3))
+
+	for _, i := range []int{0, 2} {
+		g.Expect(results[i].Err).ToNot(HaveOccurred())
+		g.Expect(results[i].Provider).To(Equal(registry.ProviderGeneric))
+	}
+	g.Expect(errors.Is(results[1].Err, registry.ErrUnconfiguredProvider)).To(BeTrue())
+	g.Expect(results[1].Err.Error()).To(ContainSubstring("foo.azurecr.io/bar:v1"))
+	// The other fields of a failed result are unset.
+	g.Expect(results[1]).To(Equal(LoginResult{Err: results[1].Err}))
+}
+
+func TestManager_LoginBatchCanceled(t *testing.T) {
+	g := NewWithT(t)
+
+	ref, err := name.ParseReference("ghcr.io/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	results, err := NewManager().LoginBatch(ctx, []ImageRequest{{Image: "ghcr.io/foo/bar:v1", Ref: ref}}, ProviderOptions{})
+	g.Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	g.Expect(results).To(HaveLen(1))
+}
+
+func TestManager_LoginBatchSharedWithCanceledBatch(t *testing.T) {
+	g := NewWithT(t)
+
+	arrived := make(chan struct{})
+	var arrivedOnce sync.Once
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrivedOnce.Do(func() { close(arrived) })
+		<-unblock
+		w.Write([]byte(`{"refresh_token": "shared-token"}`))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	mgr := NewManager().WithACRClient(azure.NewClient().
+		WithTokenCredential(&fakeTokenCredential{token: "foo"}).
+		WithScheme("http"))
+	mgr.WithHostProviderOverride(host, registry.ProviderAzure)
+
+	image := host + "/foo:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	reqs := []ImageRequest{{Image: image, Ref: ref}}
+	opts := ProviderOptions{AzureAutoLogin: true}
+
+	type batch struct {
+		results []LoginResult
+		err     error
+	}
+	run := func(ctx context.Context) <-chan batch {
+		done := make(chan batch, 1)
+		go func() {
+			results, err := mgr.LoginBatch(ctx, reqs, opts)
+			done <- batch{results: results, err: err}
+		}()
+		return done
+	}
+
+	// Batch A starts the login, which batch B then shares.
+	ctxA, cancelA := context.WithCancel(context.TODO())
+	doneA := run(ctxA)
+	<-arrived
+	doneB := run(context.TODO())
+
+	// Canceling A fails A, without waiting for the login...
+	cancelA()
+	a := <-doneA
+	g.Expect(errors.Is(a.err, context.Canceled)).To(BeTrue())
+	g.Expect(errors.Is(a.results[0].Err, context.Canceled)).To(BeTrue())
+
+	// ...which still completes for B.
+	close(unblock)
+	b := <-doneB
+	g.Expect(b.err).ToNot(HaveOccurred())
+	g.Expect(b.results[0].Err).ToNot(HaveOccurred())
+	authConfig, err := b.results[0].Authenticator.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authConfig.Password).To(Equal("shared-token"))
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// maxRawResponseSize bounds how much of the body of a response is
+// captured.
+const maxRawResponseSize = 64 * 1024
+
+// responseCapture is a transport recording the status and body of the
+// last response it received, for debugging the token exchanges of the
+// provider logins. The responses are otherwise passed on untouched.
+type responseCapture struct {
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	last string
+}
+
+func newResponseCapture(next http.RoundTripper) *responseCapture {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &responseCapture{next: next}
+}
+
+func (c *responseCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRawResponseSize))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+
+	c.mu.Lock()
+	c.last = resp.Status + "\n" + string(body)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// String returns the last response captured, stripped of what looks
+// like secret content, or an empty string if none was.
+func (c *responseCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return registry.Redact(c.last)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+func TestManager_CaptureRawResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		capture bool
+		status  int
+		wantErr bool
+	}{
+		{
+			name:    "capture",
+			capture: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "capture failure",
+			capture: true,
+			status:  http.StatusForbidden,
+			wantErr: true,
+		},
+		{
+			name:   "no capture",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"access_token": "ya29.super-secret", "expires_in": 3600, "token_type": "Bearer"}`))
+			}))
+			defer srv.Close()
+
+			image := "gcr.io/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+			result, err := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{
+				GcpAutoLogin:       true,
+				CaptureRawResponse: tt.capture,
+			})
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			if !tt.capture {
+				g.Expect(result.RawResponse).To(BeEmpty())
+				return
+			}
+			g.Expect(result.RawResponse).To(HavePrefix(fmt.Sprintf("%d %s\n", tt.status, http.StatusText(tt.status))))
+			g.Expect(result.RawResponse).To(ContainSubstring(`"access_token": "REDACTED"`))
+			g.Expect(result.RawResponse).To(ContainSubstring(`"expires_in": 3600`))
+			g.Expect(result.RawResponse).ToNot(ContainSubstring("super-secret"))
+		})
+	}
+}
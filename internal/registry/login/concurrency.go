@@ -0,0 +1,59 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// WithProviderConcurrency bounds the number of logins with the given
+// provider in flight at once to max, whatever the hosts they are for,
+// to protect fragile provider endpoints. Logins beyond the bound wait
+// for one to complete, for as long as their context allows, which
+// includes the timeout of the options. Zero or less means no bound,
+// the default. It is safe to call while logins are in progress, which
+// remain bound by the previous setting.
+func (m *Manager) WithProviderConcurrency(provider registry.Provider, max int) *Manager {
+	m.concurrencyMu.Lock()
+	defer m.concurrencyMu.Unlock()
+	if max <= 0 {
+		delete(m.concurrency, provider)
+		return m
+	}
+	m.concurrency[provider] = make(chan struct{}, max)
+	return m
+}
+
+// acquireProviderSlot waits for a login with the provider to be allowed
+// to proceed, and returns the function to call once it is done.
+func (m *Manager) acquireProviderSlot(ctx context.Context, provider registry.Provider) (func(), error) {
+	m.concurrencyMu.RLock()
+	sem := m.concurrency[provider]
+	m.concurrencyMu.RUnlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a login with provider %s to complete: %w", provider, ctx.Err())
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+func TestManager_WithProviderConcurrency(t *testing.T) {
+	tests := []struct {
+		name         string
+		max          int
+		wantInFlight int32
+	}{
+		{name: "one", max: 1, wantInFlight: 1},
+		{name: "two", max: 2, wantInFlight: 2},
+		{name: "unbounded", max: 0, wantInFlight: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var inFlight, maxInFlight int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					max := atomic.LoadInt32(&maxInFlight)
+					if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+						break
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+			}))
+			defer srv.Close()
+
+			// The client doesn't cache tokens, so that every login
+			// hits the provider.
+			mgr := NewManager().
+				WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL)).
+				WithProviderConcurrency(registry.ProviderGCP, tt.max)
+
+			image := "gcr.io/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = mgr.Resolve(context.TODO(), image, ref, ProviderOptions{GcpAutoLogin: true})
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+			g.Expect(atomic.LoadInt32(&maxInFlight)).To(Equal(tt.wantInFlight))
+		})
+	}
+}
+
+func TestManager_WithProviderConcurrencyTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	// The server holds the first login, which takes the only slot,
+	// until the second one has timed out waiting for it.
+	arrived := make(chan struct{})
+	var arrivedOnce sync.Once
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrivedOnce.Do(func() { close(arrived) })
+		<-unblock
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	mgr := NewManager().
+		WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL)).
+		WithProviderConcurrency(registry.ProviderGCP, 1)
+
+	image := "gcr.io/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	go func() {
+		mgr.Resolve(context.TODO(), image, ref, ProviderOptions{GcpAutoLogin: true})
+	}()
+	<-arrived
+
+	_, err = mgr.Resolve(context.TODO(), image, ref, ProviderOptions{GcpAutoLogin: true, Timeout: 100 * time.Millisecond})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue(), err.Error())
+	g.Expect(err.Error()).To(ContainSubstring("waiting for a login with provider gcp"))
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"os"
+	"strconv"
+)
+
+// Environment variables enabling auto-login, named after the
+// controller flags they stand for.
+const (
+	AwsAutoLoginEnvVar   = "AWS_AUTOLOGIN_FOR_ECR"
+	GcpAutoLoginEnvVar   = "GCP_AUTOLOGIN_FOR_GCR"
+	AzureAutoLoginEnvVar = "AZURE_AUTOLOGIN_FOR_ACR"
+)
+
+// ProviderOptionsFromEnv returns the options with auto-login enabled
+// for the providers whose environment variable is set to true (as
+// understood by strconv.ParseBool): AWS_AUTOLOGIN_FOR_ECR for
+// --aws-autologin-for-ecr, GCP_AUTOLOGIN_FOR_GCR for
+// --gcp-autologin-for-gcr and AZURE_AUTOLOGIN_FOR_ACR for
+// --azure-autologin-for-acr. Unset or invalid values leave auto-login
+// disabled.
+func ProviderOptionsFromEnv() ProviderOptions {
+	return ProviderOptions{
+		AwsAutoLogin:   boolFromEnv(AwsAutoLoginEnvVar),
+		GcpAutoLogin:   boolFromEnv(GcpAutoLoginEnvVar),
+		AzureAutoLogin: boolFromEnv(AzureAutoLoginEnvVar),
+	}
+}
+
+// boolFromEnv returns the boolean value of the environment variable,
+// false if it is unset or invalid.
+func boolFromEnv(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestProviderOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want ProviderOptions
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "all enabled",
+			env: map[string]string{
+				AwsAutoLoginEnvVar:   "true",
+				GcpAutoLoginEnvVar:   "1",
+				AzureAutoLoginEnvVar: "TRUE",
+			},
+			want: ProviderOptions{AwsAutoLogin: true, GcpAutoLogin: true, AzureAutoLogin: true},
+		},
+		{
+			name: "some enabled",
+			env: map[string]string{
+				AwsAutoLoginEnvVar:   "true",
+				AzureAutoLoginEnvVar: "false",
+			},
+			want: ProviderOptions{AwsAutoLogin: true},
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{GcpAutoLoginEnvVar: "yes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			for _, key := range []string{AwsAutoLoginEnvVar, GcpAutoLoginEnvVar, AzureAutoLoginEnvVar} {
+				t.Setenv(key, tt.env[key])
+			}
+			g.Expect(ProviderOptionsFromEnv()).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// execPluginSource is the credential source of logins done with
+// credentials from an exec plugin.
+const execPluginSource = "exec-plugin"
+
+// execPluginTimeout bounds how long an exec plugin may run.
+const execPluginTimeout = 30 * time.Second
+
+// maxExecPluginOutput bounds how much of the output of an exec plugin
+// is read.
+const maxExecPluginOutput = 1 << 20
+
+// maxExecPluginStderr is how much of the standard error of a failed
+// exec plugin is included in the error.
+const maxExecPluginStderr = 512
+
+// ExecPlugin is an external command resolving the credentials for
+// registry hosts, like the exec credential plugins of kubectl. The
+// command is given the registry host in the REGISTRY_HOST environment
+// variable, and as `{"host": "<host>"}` on its standard input. It is to
+// write the credentials for the host to its standard output as the
+// JSON of an authn.AuthConfig (e.g. `{"username": "...", "password":
+// "..."}`), or `{}` when it has none. Only the commands allowed with
+// Manager.WithExecPlugins are run.
+type ExecPlugin struct {
+	// Command is the absolute path of the executable.
+	Command string
+	// Args are the arguments passed to the command.
+	Args []string
+	// Env are the variables, as "KEY=value", of the environment of
+	// the command. The command doesn't inherit the environment of the
+	// controller.
+	Env []string
+}
+
+// execPluginInput is written to the standard input of exec plugins.
+type execPluginInput struct {
+	Host string `json:"host"`
+}
+
+// WithExecPlugins allows the Manager to run the exec plugins, and the
+// kubelet credential providers, with the given commands, which must be
+// absolute paths. Options calling for other commands fail the login
+// with an error wrapping registry.ErrExecPluginNotAllowed. No command
+// is allowed by default.
+func (m *Manager) WithExecPlugins(commands ...string) *Manager {
+	m.execPlugins = map[string]bool{}
+	for _, command := range commands {
+		m.execPlugins[filepath.Clean(command)] = true
+	}
+	return m
+}
+
+// checkExecPlugin returns an error wrapping
+// registry.ErrExecPluginNotAllowed if the command may not be run.
+func (m *Manager) checkExecPlugin(command string) error {
+	if !filepath.IsAbs(command) || !m.execPlugins[filepath.Clean(command)] {
+		return fmt.Errorf("%w: %s", registry.ErrExecPluginNotAllowed, command)
+	}
+	return nil
+}
+
+// fromExecPlugin sets the Authenticator of the result to the
+// credentials the plugin resolves for the host, and returns whether it
+// resolved some.
+func (m *Manager) fromExecPlugin(ctx context.Context, plugin *ExecPlugin, host string, result *LoginResult) (bool, error) {
+	if err := m.checkExecPlugin(plugin.Command); err != nil {
+		return false, err
+	}
+	authConfig, err := runExecPlugin(ctx, plugin, host)
+	if err != nil {
+		return false, fmt.Errorf("exec plugin %s failed to resolve credentials for %s: %w", plugin.Command, host, err)
+	}
+	if authConfig == (authn.AuthConfig{}) {
+		return false, nil
+	}
+	result.Authenticator = authn.FromConfig(authConfig)
+	result.CredentialSource = execPluginSource
+	return true, nil
+}
+
+// runExecPlugin runs the plugin for the host and returns the
+// credentials it writes.
+func runExecPlugin(ctx context.Context, plugin *ExecPlugin, host string) (authn.AuthConfig, error) {
+	var authConfig authn.AuthConfig
+
+	input, err := json.Marshal(execPluginInput{Host: host})
+	if err != nil {
+		return authConfig, err
+	}
+	env := append(append([]string{}, plugin.Env...), "REGISTRY_HOST="+host)
+	output, err := runPluginCommand(ctx, plugin.Command, plugin.Args, env, input)
+	if err != nil {
+		return authConfig, err
+	}
+
+	if err := json.Unmarshal(output, &authConfig); err != nil {
+		return authConfig, fmt.Errorf("invalid output: %w", err)
+	}
+	return authConfig, nil
+}
+
+// runPluginCommand runs the command of a credential plugin with the
+// arguments and only the given environment, writing the input to its
+// standard input, and returns what it writes to its standard output.
+// The command is bounded in time and output, and its standard error is
+// included in the error when it fails.
+func runPluginCommand(ctx context.Context, command string, args, env []string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, execPluginTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = env
+	if cmd.Env == nil {
+		cmd.Env = []string{}
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &limitedWriter{w: &stdout, n: maxExecPluginOutput}
+	cmd.Stderr = &limitedWriter{w: &stderr, n: maxExecPluginStderr}
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitedWriter writes up to n bytes to w, and discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	if len(p) > 0 {
+		n, err := l.w.Write(p)
+		l.n -= n
+		if err != nil {
+			return n, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// testExecPlugin is a stub exec plugin which gives credentials for
+// registry.example.com only, checking that the host on its standard
+// input matches that of its environment.
+const testExecPlugin = `#!/bin/sh
+input=$(cat)
+if [ "$input" != "{\"host\":\"$REGISTRY_HOST\"}" ]; then
+  echo "unexpected input: $input" >&2
+  exit 1
+fi
+case "$REGISTRY_HOST" in
+registry.example.com)
+  echo "{\"username\": \"$PLUGIN_USER\", \"password\": \"$1\"}" ;;
+broken.example.com)
+  echo "not json" ;;
+failing.example.com)
+  echo "no credentials for you" >&2
+  exit 2 ;;
+*)
+  echo "{}" ;;
+esac
+`
+
+func writeTestExecPlugin(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub exec plugin is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "creds-plugin")
+	if err := os.WriteFile(path, []byte(testExecPlugin), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestManager_ExecPlugin(t *testing.T) {
+	command := writeTestExecPlugin(t)
+	plugin := &ExecPlugin{
+		Command: command,
+		Args:    []string{"s3cr3t"},
+		Env:     []string{"PLUGIN_USER=robot"},
+	}
+
+	tests := []struct {
+		name       string
+		image      string
+		allowed    []string
+		wantAuth   *authn.AuthConfig
+		wantSource string
+		wantErr    string
+		wantErrIs  error
+	}{
+		{
+			name:       "credentials for the host",
+			image:      "registry.example.com/foo/bar:v1",
+			allowed:    []string{command},
+			wantAuth:   &authn.AuthConfig{Username: "robot", Password: "s3cr3t"},
+			wantSource: execPluginSource,
+		},
+		{
+			name:    "no credentials for the host",
+			image:   "other.example.com/foo/bar:v1",
+			allowed: []string{command},
+		},
+		{
+			name:    "invalid output",
+			image:   "broken.example.com/foo/bar:v1",
+			allowed: []string{command},
+			wantErr: "invalid output",
+		},
+		{
+			name:    "failing plugin",
+			image:   "failing.example.com/foo/bar:v1",
+			allowed: []string{command},
+			wantErr: "no credentials for you",
+		},
+		{
+			name:      "plugin not allowed",
+			image:     "registry.example.com/foo/bar:v1",
+			wantErrIs: registry.ErrExecPluginNotAllowed,
+		},
+		{
+			name:      "other plugin allowed",
+			image:     "registry.example.com/foo/bar:v1",
+			allowed:   []string{"/usr/local/bin/other-plugin"},
+			wantErrIs: registry.ErrExecPluginNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager()
+			if tt.allowed != nil {
+				mgr.WithExecPlugins(tt.allowed...)
+			}
+			result, err := mgr.Resolve(context.TODO(), tt.image, ref, ProviderOptions{ExecPlugin: plugin})
+			if tt.wantErrIs != nil {
+				g.Expect(errors.Is(err, tt.wantErrIs)).To(BeTrue())
+				return
+			}
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.CredentialSource).To(Equal(tt.wantSource))
+			if tt.wantAuth == nil {
+				g.Expect(result.Authenticator).To(BeNil())
+				return
+			}
+			authConfig, err := result.Authenticator.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*authConfig).To(Equal(*tt.wantAuth))
+		})
+	}
+}
+
+func TestManager_ExecPluginRelativeCommand(t *testing.T) {
+	g := NewWithT(t)
+
+	ref, err := name.ParseReference("registry.example.com/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// A relative command would be looked up in the working directory
+	// or the PATH, so it is never run.
+	mgr := NewManager().WithExecPlugins("creds-plugin")
+	_, err = mgr.Resolve(context.TODO(), ref.String(), ref, ProviderOptions{ExecPlugin: &ExecPlugin{Command: "creds-plugin"}})
+	g.Expect(errors.Is(err, registry.ErrExecPluginNotAllowed)).To(BeTrue())
+}
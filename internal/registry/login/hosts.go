@@ -0,0 +1,46 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// hostMatches returns whether the registry host matches any of the
+// patterns. A pattern is either a glob, as understood by path.Match
+// (e.g. "*.example.com"), or a suffix starting with a dot (e.g.
+// ".example.com", which matches any subdomain of example.com). A host
+// with a port matches patterns both with and without the port.
+func hostMatches(patterns []string, host string) bool {
+	candidates := []string{host}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		candidates = append(candidates, hostname)
+	}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if strings.HasPrefix(pattern, ".") && strings.HasSuffix(candidate, pattern) {
+				return true
+			}
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/aws"
+)
+
+func TestHostMatches(t *testing.T) {
+	patterns := []string{"ghcr.io", "*.gcr.io", ".amazonaws.com", "registry.example.com:5000"}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "ghcr.io", want: true},
+		{host: "ghcr.io:443", want: true},
+		{host: "eu.gcr.io", want: true},
+		// A star matches across dots.
+		{host: "foo.eu.gcr.io", want: true},
+		{host: "gcr.io", want: false},
+		{host: "012345678901.dkr.ecr.us-east-1.amazonaws.com", want: true},
+		{host: "amazonaws.com", want: false},
+		{host: "registry.example.com:5000", want: true},
+		{host: "registry.example.com", want: false},
+		{host: "docker.io", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(hostMatches(patterns, tt.host)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestManager_WithHostAllowlist(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		wantErr   bool
+	}{
+		{
+			name:      "allowed host",
+			allowlist: []string{"*.dkr.ecr.us-east-1.amazonaws.com"},
+		},
+		{
+			name: "empty allowlist",
+		},
+		{
+			name:      "denied host",
+			allowlist: []string{"ghcr.io", ".azurecr.io"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			calls = 0
+
+			image := "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().
+				WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+					WithEndpoint(srv.URL).
+					WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+				WithHostAllowlist(tt.allowlist)
+
+			auth, err := mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(registry.ErrHostNotAllowed))
+				g.Expect(auth).To(BeNil())
+				g.Expect(calls).To(Equal(0))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth).ToNot(BeNil())
+			g.Expect(calls).To(Equal(1))
+		})
+	}
+}
+
+func TestManager_WithHostDenylist(t *testing.T) {
+	tests := []struct {
+		name      string
+		image     string
+		allowlist []string
+		denylist  []string
+		wantErr   bool
+	}{
+		{
+			name:     "denied metadata endpoint",
+			image:    "169.254.169.254/latest/meta-data:v1",
+			denylist: []string{"169.254.169.254", "metadata.google.internal"},
+			wantErr:  true,
+		},
+		{
+			name:     "denied host with port",
+			image:    "169.254.169.254:80/latest/meta-data:v1",
+			denylist: []string{"169.254.169.254"},
+			wantErr:  true,
+		},
+		{
+			name:      "denylist takes precedence over allowlist",
+			image:     "internal.example.com/foo/bar:v1",
+			allowlist: []string{".example.com"},
+			denylist:  []string{"internal.example.com"},
+			wantErr:   true,
+		},
+		{
+			name:      "host not denylisted",
+			image:     "registry.example.com/foo/bar:v1",
+			allowlist: []string{".example.com"},
+			denylist:  []string{"internal.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithHostAllowlist(tt.allowlist).WithHostDenylist(tt.denylist)
+			_, err = mgr.Login(context.TODO(), tt.image, ref, ProviderOptions{})
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(registry.ErrHostNotAllowed))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
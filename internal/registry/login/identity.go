@@ -0,0 +1,44 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// EffectiveIdentity returns the principal the Manager logs in as with
+// the given provider, for display: the ARN of the IAM principal for
+// AWS, the email of the service account for GCP, and the client ID of
+// the application for Azure. It resolves the principal from the
+// credential source of the provider client, whether or not auto-login
+// is enabled for the provider, and doesn't log into any registry. The
+// generic provider has no identity.
+func (m *Manager) EffectiveIdentity(ctx context.Context, provider registry.Provider) (string, error) {
+	ctx = m.withClientOptions(ctx, ProviderOptions{})
+	switch provider {
+	case registry.ProviderAWS:
+		return m.ecrClient().Identity(ctx)
+	case registry.ProviderGCP:
+		return m.gcrClient().Identity(ctx)
+	case registry.ProviderAzure:
+		return m.acrClient().Identity(ctx)
+	}
+	return "", fmt.Errorf("provider %s has no identity", provider)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/aws"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/azure"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+func TestManager_EffectiveIdentity(t *testing.T) {
+	stsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::012345678901:role/flux</Arn>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`))
+	}))
+	defer stsSrv.Close()
+	metadataSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("flux@my-project.iam.gserviceaccount.com"))
+	}))
+	defer metadataSrv.Close()
+	aadToken := base64.RawURLEncoding.EncodeToString([]byte(`{"alg": "none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"appid": "11111111-1111-1111-1111-111111111111"}`)) + ".sig"
+
+	mgr := NewManager().
+		WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+			WithEndpoint(stsSrv.URL).
+			WithRegion("us-east-1").
+			WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+		WithGCRClient(gcp.NewClient().WithTokenURL(metadataSrv.URL + "/computeMetadata/v1/instance/service-accounts/default/token")).
+		WithACRClient(azure.NewClient().WithTokenCredential(&fakeTokenCredential{token: aadToken}))
+
+	tests := []struct {
+		provider registry.Provider
+		want     string
+		wantErr  bool
+	}{
+		{provider: registry.ProviderAWS, want: "arn:aws:iam::012345678901:role/flux"},
+		{provider: registry.ProviderGCP, want: "flux@my-project.iam.gserviceaccount.com"},
+		{provider: registry.ProviderAzure, want: "11111111-1111-1111-1111-111111111111"},
+		{provider: registry.ProviderGeneric, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider.String(), func(t *testing.T) {
+			g := NewWithT(t)
+
+			identity, err := mgr.EffectiveIdentity(context.TODO(), tt.provider)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(identity).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// kubeletCredentialProviderSource is the credential source of logins
+// done with credentials from a kubelet credential provider.
+const kubeletCredentialProviderSource = "kubelet-credential-provider"
+
+// defaultKubeletCredentialProviderAPIVersion is the version of the
+// kubelet credential provider protocol spoken by default.
+const defaultKubeletCredentialProviderAPIVersion = "credentialprovider.kubelet.k8s.io/v1"
+
+// KubeletCredentialProvider is a kubelet image credential provider
+// plugin (e.g. ecr-credential-provider), run the way the kubelet runs
+// it: it is given a CredentialProviderRequest for the image on its
+// standard input, and is to write a CredentialProviderResponse to its
+// standard output. The credentials of the response are those of its
+// auth entry matching the image most specifically, the same way the
+// kubelet matches them; a response without a matching entry means the
+// plugin has no credentials for the image. The cache key type and
+// duration of the response are ignored. Only the commands allowed with
+// Manager.WithExecPlugins are run.
+type KubeletCredentialProvider struct {
+	// Command is the absolute path of the executable.
+	Command string
+	// Args are the arguments passed to the command.
+	Args []string
+	// Env are the variables, as "KEY=value", of the environment of
+	// the command. The command doesn't inherit the environment of the
+	// controller.
+	Env []string
+	// APIVersion is the version of the protocol spoken by the plugin,
+	// "credentialprovider.kubelet.k8s.io/v1" by default.
+	APIVersion string
+}
+
+// credentialProviderRequest is the CredentialProviderRequest of the
+// kubelet credential provider protocol.
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+// credentialProviderResponse is the CredentialProviderResponse of the
+// kubelet credential provider protocol, without the fields of no use
+// here.
+type credentialProviderResponse struct {
+	APIVersion string                            `json:"apiVersion"`
+	Kind       string                            `json:"kind"`
+	Auth       map[string]credentialProviderAuth `json:"auth"`
+}
+
+type credentialProviderAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// fromKubeletCredentialProvider sets the Authenticator of the result
+// to the credentials the provider gives for the image, and returns
+// whether it gave some.
+func (m *Manager) fromKubeletCredentialProvider(ctx context.Context, provider *KubeletCredentialProvider, image string, ref name.Reference, result *LoginResult) (bool, error) {
+	if err := m.checkExecPlugin(provider.Command); err != nil {
+		return false, err
+	}
+	authConfig, ok, err := runKubeletCredentialProvider(ctx, provider, image, ref.Context().Name())
+	if err != nil {
+		return false, fmt.Errorf("kubelet credential provider %s failed to resolve credentials for %s: %w", provider.Command, image, err)
+	}
+	if !ok {
+		return false, nil
+	}
+	result.Authenticator = authn.FromConfig(authConfig)
+	result.CredentialSource = kubeletCredentialProviderSource
+	return true, nil
+}
+
+// runKubeletCredentialProvider runs the provider for the image, and
+// returns the credentials of the auth entry of its response matching
+// the repository, if any.
+func runKubeletCredentialProvider(ctx context.Context, provider *KubeletCredentialProvider, image, repository string) (authn.AuthConfig, bool, error) {
+	apiVersion := provider.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultKubeletCredentialProviderAPIVersion
+	}
+	input, err := json.Marshal(credentialProviderRequest{
+		APIVersion: apiVersion,
+		Kind:       "CredentialProviderRequest",
+		Image:      image,
+	})
+	if err != nil {
+		return authn.AuthConfig{}, false, err
+	}
+	output, err := runPluginCommand(ctx, provider.Command, provider.Args, provider.Env, input)
+	if err != nil {
+		return authn.AuthConfig{}, false, err
+	}
+
+	var response credentialProviderResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		return authn.AuthConfig{}, false, fmt.Errorf("invalid output: %w", err)
+	}
+	if response.Kind != "CredentialProviderResponse" || response.APIVersion != apiVersion {
+		return authn.AuthConfig{}, false, fmt.Errorf("invalid output: expected a CredentialProviderResponse of %s, got a %q of %q",
+			apiVersion, response.Kind, response.APIVersion)
+	}
+
+	var match string
+	for key := range response.Auth {
+		if len(key) > len(match) || (len(key) == len(match) && key < match) {
+			if kubeletImageMatches(key, repository) {
+				match = key
+			}
+		}
+	}
+	if match == "" {
+		return authn.AuthConfig{}, false, nil
+	}
+	auth := response.Auth[match]
+	return authn.AuthConfig{Username: auth.Username, Password: auth.Password}, true, nil
+}
+
+// kubeletImageMatches returns whether the repository matches the key
+// of an auth entry, as the kubelet matches them: the hosts have the
+// same number of labels, each label of the key being a glob matching
+// that of the repository; the ports, if any, are the same; the path of
+// the key, if any, is a prefix of that of the repository.
+func kubeletImageMatches(key, repository string) bool {
+	k, err := url.Parse("https://" + strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"))
+	if err != nil {
+		return false
+	}
+	r, err := url.Parse("https://" + repository)
+	if err != nil {
+		return false
+	}
+
+	keyLabels := strings.Split(k.Hostname(), ".")
+	repoLabels := strings.Split(r.Hostname(), ".")
+	if len(keyLabels) != len(repoLabels) {
+		return false
+	}
+	for i := range keyLabels {
+		if ok, err := path.Match(keyLabels[i], repoLabels[i]); err != nil || !ok {
+			return false
+		}
+	}
+	if k.Port() != r.Port() {
+		return false
+	}
+	return strings.HasPrefix(r.Path, k.Path)
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// testKubeletCredentialProvider is a stub kubelet credential provider
+// which speaks the v1 protocol only, and answers with credentials for
+// the hosts under example.com, and more specific ones for the private
+// repositories of registry.example.com.
+const testKubeletCredentialProvider = `#!/bin/sh
+input=$(cat)
+case "$input" in
+*'"kind":"CredentialProviderRequest"'*) ;;
+*)
+  echo "unexpected input: $input" >&2
+  exit 1 ;;
+esac
+cat <<RESPONSE
+{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Registry",
+  "cacheDuration": "6h",
+  "auth": {
+    "*.example.com": {"username": "$PROVIDER_USER", "password": "wildcard-pass"},
+    "registry.example.com/private": {"username": "$PROVIDER_USER", "password": "private-pass"}
+  }
+}
+RESPONSE
+`
+
+func writeTestKubeletCredentialProvider(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub kubelet credential provider is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "kubelet-provider")
+	if err := os.WriteFile(path, []byte(testKubeletCredentialProvider), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestManager_KubeletCredentialProvider(t *testing.T) {
+	command := writeTestKubeletCredentialProvider(t)
+
+	tests := []struct {
+		name       string
+		image      string
+		apiVersion string
+		allowed    bool
+		wantAuth   *authn.AuthConfig
+		wantErr    string
+		wantErrIs  error
+	}{
+		{
+			name:     "wildcard entry",
+			image:    "registry.example.com/public/app:v1",
+			allowed:  true,
+			wantAuth: &authn.AuthConfig{Username: "robot", Password: "wildcard-pass"},
+		},
+		{
+			name:     "most specific entry",
+			image:    "registry.example.com/private/app:v1",
+			allowed:  true,
+			wantAuth: &authn.AuthConfig{Username: "robot", Password: "private-pass"},
+		},
+		{
+			name:    "no matching entry",
+			image:   "registry.example.org/foo/bar:v1",
+			allowed: true,
+		},
+		{
+			name:       "protocol version mismatch",
+			image:      "registry.example.com/public/app:v1",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1alpha1",
+			allowed:    true,
+			wantErr:    "expected a CredentialProviderResponse of credentialprovider.kubelet.k8s.io/v1alpha1",
+		},
+		{
+			name:      "provider not allowed",
+			image:     "registry.example.com/public/app:v1",
+			wantErrIs: registry.ErrExecPluginNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager()
+			if tt.allowed {
+				mgr.WithExecPlugins(command)
+			}
+			result, err := mgr.Resolve(context.TODO(), tt.image, ref, ProviderOptions{
+				KubeletCredentialProvider: &KubeletCredentialProvider{
+					Command:    command,
+					Env:        []string{"PROVIDER_USER=robot"},
+					APIVersion: tt.apiVersion,
+				},
+			})
+			if tt.wantErrIs != nil {
+				g.Expect(err).To(MatchError(tt.wantErrIs))
+				return
+			}
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.wantAuth == nil {
+				g.Expect(result.Authenticator).To(BeNil())
+				g.Expect(result.CredentialSource).To(BeEmpty())
+				return
+			}
+			g.Expect(result.CredentialSource).To(Equal(kubeletCredentialProviderSource))
+			authConfig, err := result.Authenticator.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*authConfig).To(Equal(*tt.wantAuth))
+		})
+	}
+}
+
+func TestKubeletImageMatches(t *testing.T) {
+	tests := []struct {
+		key        string
+		repository string
+		want       bool
+	}{
+		{"registry.example.com", "registry.example.com/foo/bar", true},
+		{"*.example.com", "registry.example.com/foo/bar", true},
+		{"*.example.com", "example.com/foo/bar", false},
+		{"*.*.example.com", "registry.example.com/foo/bar", false},
+		{"*.dkr.ecr.*.amazonaws.com", "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo", true},
+		{"https://registry.example.com/foo", "registry.example.com/foo/bar", true},
+		{"registry.example.com/baz", "registry.example.com/foo/bar", false},
+		{"registry.example.com:5000", "registry.example.com:5000/foo", true},
+		{"registry.example.com:5000", "registry.example.com/foo", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+" "+tt.repository, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(kubeletImageMatches(tt.key, tt.repository)).To(Equal(tt.want))
+		})
+	}
+}
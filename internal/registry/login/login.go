@@ -0,0 +1,1049 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/aws"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/azure"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+// exactHosts maps the registry hosts known to belong to a provider to
+// that provider.
+var exactHosts = map[string]registry.Provider{
+	"gcr.io":               registry.ProviderGCP,
+	aws.PublicRegistryHost: registry.ProviderAWS,
+}
+
+// hostMatchers recognize the registry hosts of the providers by their
+// form, e.g. their suffix, in order of precedence.
+var hostMatchers = []struct {
+	provider registry.Provider
+	match    func(host string) bool
+}{
+	{registry.ProviderAWS, aws.ValidHost},
+	{registry.ProviderGCP, gcp.ValidHost},
+	{registry.ProviderAzure, azure.ValidHost},
+}
+
+// DetectProvider returns the registry provider hosting the registry at
+// the given host. Detection is deterministic: a host listed as
+// belonging to a provider is detected as such, before the hosts are
+// matched by form, in the order AWS, GCP, Azure; any other host is
+// detected as generic. Host overrides of the Manager take precedence
+// over detection.
+func DetectProvider(host string) registry.Provider {
+	if provider, ok := exactHosts[host]; ok {
+		return provider
+	}
+	for _, m := range hostMatchers {
+		if m.match(host) {
+			return m.provider
+		}
+	}
+	return registry.ProviderGeneric
+}
+
+// ImageRegistryProvider analyzes the image and returns the registry
+// provider it is hosted by, as detected by DetectProvider. The parsed
+// reference is used for the host, so that references carrying both a
+// tag and a digest (e.g. `gcr.io/foo/bar:v1@sha256:...`) are routed the
+// same as their tag-only or digest-only forms, and the path of the
+// image can't influence detection.
+func ImageRegistryProvider(image string, ref name.Reference) registry.Provider {
+	return DetectProvider(ref.Context().RegistryStr())
+}
+
+// ProviderOptions contains options for registry provider login.
+type ProviderOptions struct {
+	// AwsAutoLogin enables automatic attempt to get credentials for
+	// images in ECR.
+	AwsAutoLogin bool
+	// GcpAutoLogin enables automatic attempt to get credentials for
+	// images in GCP.
+	GcpAutoLogin bool
+	// AzureAutoLogin enables automatic attempt to get credentials for
+	// images in ACR.
+	AzureAutoLogin bool
+	// PullSecrets are image pull secrets to look up credentials in
+	// before trying automatic login with the provider. They are merged
+	// into one keychain by registry host, with later secrets
+	// overriding earlier ones.
+	PullSecrets []corev1.Secret
+	// SkipLoginIfAnonymous makes the Manager probe the registry host
+	// before logging in with the provider, and skip the login when
+	// the registry allows anonymous access. A failed probe is logged,
+	// and the login made anyway.
+	SkipLoginIfAnonymous bool
+	// ProbeAnonymousToken makes the probe of SkipLoginIfAnonymous
+	// also skip the login when the registry host requires a bearer
+	// token, but issues one without credentials which lets the
+	// repository be read, as Docker Hub and Quay do for public
+	// repositories.
+	ProbeAnonymousToken bool
+	// ProviderHint, when set to other than registry.ProviderGeneric,
+	// is the provider to log in with, in place of the one the Manager
+	// would detect from the image or find in its host overrides.
+	ProviderHint registry.Provider
+	// OverrideRealm, when set, is the token endpoint used for the
+	// bearer authentication of the registry, in place of the realm it
+	// announces. It applies to the transports the Manager builds (see
+	// AuthenticatedTransport and ListTags).
+	OverrideRealm string
+	// TrustForwardedRealm tells whether the bearer authentication of
+	// the registry follows the realm it announces as is, which is what
+	// happens when it's nil. When false, the realm is rewritten to the
+	// scheme and host of the registry, keeping its path, for registries
+	// behind a reverse proxy announcing a realm built from the forwarded
+	// headers of the proxy, or from their own address. OverrideRealm
+	// takes precedence. It applies to the transports the Manager builds
+	// (see AuthenticatedTransport and ListTags).
+	TrustForwardedRealm *bool
+	// ExtraHeaders are added to the requests made by the transports
+	// the Manager builds, for both the registry API and its token
+	// endpoint (see AuthenticatedTransport and ListTags). They don't
+	// override the headers the requests already carry, in particular
+	// their Authorization header.
+	ExtraHeaders map[string]string
+	// UserAgent, when set, is the User-Agent of the requests made for
+	// the login and by the transports the Manager builds, in place of
+	// the default of the Manager (see WithUserAgent).
+	UserAgent string
+	// ExecPlugin, when set, is run to resolve the credentials for the
+	// registry host after the pull secrets, and before any provider
+	// login. The Manager must be allowed to run its command (see
+	// WithExecPlugins).
+	ExecPlugin *ExecPlugin
+	// KubeletCredentialProvider, when set, is run to resolve the
+	// credentials for the image after the exec plugin, and before any
+	// provider login. The Manager must be allowed to run its command
+	// (see WithExecPlugins).
+	KubeletCredentialProvider *KubeletCredentialProvider
+	// Timeout, when positive, bounds the time a provider login may
+	// take, including the token exchanges with the provider.
+	Timeout time.Duration
+	// AwsTimeout, GcpTimeout and AzureTimeout, when positive, bound
+	// the time a login with AWS, GCP and Azure respectively may take,
+	// in place of Timeout.
+	AwsTimeout   time.Duration
+	GcpTimeout   time.Duration
+	AzureTimeout time.Duration
+	// TLSMinVersion, when set, is the minimum TLS version (e.g.
+	// tls.VersionTLS13) of the connections of the transports the
+	// Manager builds (see AuthenticatedTransport and ListTags), in
+	// place of that of their base transport, or the Go default. The
+	// base transport, the one carried by the context if any, must then
+	// be an *http.Transport.
+	TLSMinVersion uint16
+	// TLSMinVersionByHost overrides TLSMinVersion for the registry
+	// hosts it has an entry for, e.g. for a legacy registry supporting
+	// TLS 1.2 only while TLS 1.3 is required elsewhere.
+	TLSMinVersionByHost map[string]uint16
+	// CaptureRawResponse makes the Manager capture the last response
+	// received from the provider during its login, e.g. that of its
+	// token endpoint, and return it in the RawResponse of the result,
+	// for troubleshooting. What looks like secret content is redacted
+	// from it.
+	CaptureRawResponse bool
+	// OfflineStatic forbids any network call for the login: the
+	// credentials may only come from static sources, i.e. those
+	// embedded in the image, the pull secrets, the exec plugin, the
+	// kubelet credential provider and the credential store of the
+	// Manager. A login which would otherwise be done with a provider
+	// whose auto-login is enabled fails with an error wrapping
+	// registry.ErrOnlineLoginRequired, and SkipLoginIfAnonymous is
+	// ignored.
+	OfflineStatic bool
+	// MinValidity, when positive, is how long the credentials of a
+	// provider login must remain valid: cached tokens expiring sooner
+	// are refreshed rather than handed out, e.g. for long operations.
+	// A fresh token is handed out whatever its lifetime.
+	MinValidity time.Duration
+	// ForceHTTP1 makes the requests of the login, to the provider and
+	// to the registry, use HTTP/1.1 only, as with
+	// registry.TransportBuilder.WithForceHTTP1. The clients with a
+	// transport of their own, such as the GCP metadata server one,
+	// and the transport carried by the context, are left as they are.
+	ForceHTTP1 bool
+	// IsRetryable, when set, marks the errors of the requests to the
+	// provider it returns true for as retryable, in addition to those
+	// the provider client retries of its own accord, e.g. for
+	// vendor-specific errors. Only the clients retrying their requests
+	// consult it, within their retry limit: the ECR ones, and the GCR
+	// one for the errors of its requests to the metadata server, but
+	// not for the statuses the server answers with.
+	IsRetryable func(error) bool
+}
+
+// CacheKey returns a hash of the options, which is the same for equal
+// options across runs. The auto-login flags, SkipLoginIfAnonymous,
+// ProbeAnonymousToken, the provider hint, the realm override, whether
+// to trust the forwarded realm, the extra headers, the minimum TLS
+// versions, the User-Agent, OfflineStatic, the minimum validity, the
+// exec plugin, the kubelet credential provider and the pull secrets
+// participate in it; a pull secret is accounted for by its namespace,
+// name, type and data, in order, but not by its other metadata (e.g.
+// resource version).
+func (o ProviderOptions) CacheKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "aws=%t;gcp=%t;azure=%t;skipanon=%t;hint=%s;realm=%q;ua=%q;",
+		o.AwsAutoLogin, o.GcpAutoLogin, o.AzureAutoLogin, o.SkipLoginIfAnonymous, o.ProviderHint, o.OverrideRealm, o.UserAgent)
+	headerKeys := make([]string, 0, len(o.ExtraHeaders))
+	for k := range o.ExtraHeaders {
+		headerKeys = append(headerKeys, k)
+	}
+	sort.Strings(headerKeys)
+	for _, k := range headerKeys {
+		fmt.Fprintf(h, "header=%q=%q;", k, o.ExtraHeaders[k])
+	}
+	if o.TLSMinVersion != 0 {
+		fmt.Fprintf(h, "tls=%d;", o.TLSMinVersion)
+	}
+	tlsHosts := make([]string, 0, len(o.TLSMinVersionByHost))
+	for host := range o.TLSMinVersionByHost {
+		tlsHosts = append(tlsHosts, host)
+	}
+	sort.Strings(tlsHosts)
+	for _, host := range tlsHosts {
+		fmt.Fprintf(h, "tls=%q=%d;", host, o.TLSMinVersionByHost[host])
+	}
+	if o.TrustForwardedRealm != nil {
+		fmt.Fprintf(h, "trustrealm=%t;", *o.TrustForwardedRealm)
+	}
+	if o.ProbeAnonymousToken {
+		fmt.Fprint(h, "anontoken=true;")
+	}
+	if o.OfflineStatic {
+		fmt.Fprint(h, "offline=true;")
+	}
+	if o.MinValidity > 0 {
+		fmt.Fprintf(h, "minvalidity=%s;", o.MinValidity)
+	}
+	if o.ExecPlugin != nil {
+		fmt.Fprintf(h, "exec=%q;args=%q;env=%q;", o.ExecPlugin.Command, o.ExecPlugin.Args, o.ExecPlugin.Env)
+	}
+	if p := o.KubeletCredentialProvider; p != nil {
+		fmt.Fprintf(h, "kubelet=%q;args=%q;env=%q;api=%q;", p.Command, p.Args, p.Env, p.APIVersion)
+	}
+	for _, secret := range o.PullSecrets {
+		fmt.Fprintf(h, "secret=%q/%q/%q;", secret.Namespace, secret.Name, secret.Type)
+		keys := make([]string, 0, len(secret.Data))
+		for k := range secret.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%q=%q;", k, secret.Data[k])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// autoLoginFor returns whether auto-login is enabled for the provider.
+func (o ProviderOptions) autoLoginFor(provider registry.Provider) bool {
+	switch provider {
+	case registry.ProviderAWS:
+		return o.AwsAutoLogin
+	case registry.ProviderGCP:
+		return o.GcpAutoLogin
+	case registry.ProviderAzure:
+		return o.AzureAutoLogin
+	}
+	return false
+}
+
+// timeoutFor returns the timeout of a login with the provider, zero if
+// there is none.
+func (o ProviderOptions) timeoutFor(provider registry.Provider) time.Duration {
+	var timeout time.Duration
+	switch provider {
+	case registry.ProviderAWS:
+		timeout = o.AwsTimeout
+	case registry.ProviderGCP:
+		timeout = o.GcpTimeout
+	case registry.ProviderAzure:
+		timeout = o.AzureTimeout
+	}
+	if timeout <= 0 {
+		timeout = o.Timeout
+	}
+	return timeout
+}
+
+// registryTransport returns the transport for the requests to the
+// registry, built on the given one, which may be nil to mean the
+// default one. It is nil if there is nothing to build on the default
+// transport.
+func (o ProviderOptions) registryTransport(rt http.RoundTripper) http.RoundTripper {
+	var wrappers []func(http.RoundTripper) http.RoundTripper
+	if len(o.ExtraHeaders) > 0 {
+		wrappers = append(wrappers, registry.ExtraHeaders(o.ExtraHeaders))
+	}
+	if o.OverrideRealm != "" {
+		wrappers = append(wrappers, registry.OverrideRealm(o.OverrideRealm))
+	} else if o.TrustForwardedRealm != nil && !*o.TrustForwardedRealm {
+		wrappers = append(wrappers, registry.RealmToRequestHost())
+	}
+	if len(wrappers) == 0 {
+		return rt
+	}
+	return registry.TransportChain(wrappers...)(rt)
+}
+
+// StoreOrder tells when the credential store of a Manager is
+// consulted, relative to the provider logins.
+type StoreOrder int
+
+const (
+	// StoreFirst makes the store be consulted before logging in with
+	// the provider, which is skipped when the store has credentials.
+	StoreFirst StoreOrder = iota
+	// StoreLast makes the store be consulted only when the provider
+	// login doesn't give any credentials: for generic registries, or
+	// when auto-login is not enabled for the provider.
+	StoreLast
+)
+
+// UnqualifiedPolicy tells how a Manager treats the image references
+// which don't name their registry host (see
+// registry.IsFullyQualified).
+type UnqualifiedPolicy int
+
+const (
+	// UnqualifiedAllow makes the Manager log into unqualified images
+	// as given.
+	UnqualifiedAllow UnqualifiedPolicy = iota
+	// UnqualifiedReject makes the Manager refuse to log into
+	// unqualified images, with an error wrapping
+	// registry.ErrInvalidImage.
+	UnqualifiedReject
+	// UnqualifiedNormalize makes the Manager log into unqualified
+	// images by their fully qualified name, e.g.
+	// "index.docker.io/library/nginx:latest" for "nginx".
+	UnqualifiedNormalize
+)
+
+// Manager is a login manager for various registry providers.
+type Manager struct {
+	ecr *aws.Client
+	gcr *gcp.Client
+	acr *azure.Client
+
+	// ecrFactory, gcrFactory and acrFactory, when set, build the
+	// clients on first use, in place of the ones above.
+	ecrFactory func() *aws.Client
+	gcrFactory func() *gcp.Client
+	acrFactory func() *azure.Client
+	ecrOnce    sync.Once
+	gcrOnce    sync.Once
+	acrOnce    sync.Once
+
+	// ecrCache and gcrCache are the token caches of the default ECR
+	// and GCR clients.
+	ecrCache *aws.TokenCache
+	gcrCache *gcp.TokenCache
+
+	// overrides holds the candidate providers of the overridden
+	// hosts, tried in the order of priority.
+	overridesMu sync.RWMutex
+	overrides   map[string][]registry.Provider
+	priority    []registry.Provider
+
+	guardsMu sync.RWMutex
+	guards   map[registry.Provider]func(context.Context) bool
+
+	// concurrency holds the semaphores bounding the number of logins
+	// in flight by provider.
+	concurrencyMu sync.RWMutex
+	concurrency   map[registry.Provider]chan struct{}
+
+	optionsResolver func(image string) ProviderOptions
+
+	// allowlist holds the patterns of the hosts which may be
+	// contacted; when empty, any host may be. denylist holds those of
+	// the hosts which may not be, and takes precedence.
+	allowlist []string
+	denylist  []string
+
+	// store holds credentials looked up for the hosts, before or after
+	// the provider login depending on storeOrder.
+	store      registry.CredentialStore
+	storeOrder StoreOrder
+
+	unqualifiedPolicy UnqualifiedPolicy
+
+	// defaultProvider is the provider of the hosts matched by no
+	// provider nor override.
+	defaultProvider registry.Provider
+
+	// execPlugins holds the commands of the exec plugins which may be
+	// run.
+	execPlugins map[string]bool
+
+	// userAgent is the default User-Agent of the requests, overridden
+	// by that of the options.
+	userAgent string
+
+	// flights deduplicates concurrent logins for the same host and
+	// options.
+	flights singleflight.Group
+
+	// tlsTransports holds the clones of the base transports with a
+	// minimum TLS version, by tlsTransportKey, so that their
+	// connections are reused across requests.
+	tlsTransports sync.Map
+}
+
+// NewManager returns a new Manager. Its default ECR and GCR clients
+// cache access tokens until they expire.
+func NewManager() *Manager {
+	ecrCache, gcrCache := aws.NewTokenCache(), gcp.NewTokenCache()
+	return &Manager{
+		ecr:         aws.NewClient().WithTokenCache(ecrCache),
+		gcr:         gcp.NewClient().WithTokenCache(gcrCache),
+		acr:         azure.NewClient(),
+		ecrCache:    ecrCache,
+		gcrCache:    gcrCache,
+		overrides:   map[string][]registry.Provider{},
+		guards:      map[registry.Provider]func(context.Context) bool{},
+		concurrency: map[registry.Provider]chan struct{}{},
+	}
+}
+
+// WithMaxCacheEntries bounds the number of tokens held by the caches
+// of the default ECR and GCR clients to n each, evicting the least
+// recently used ones, so that scanning many distinct registries
+// doesn't grow them without bound. The caches of clients set with
+// WithECRClient, WithGCRClient or WithACRClient are to be bounded with
+// their own WithMaxCacheEntries.
+func (m *Manager) WithMaxCacheEntries(n int) *Manager {
+	m.ecrCache.WithMaxCacheEntries(n)
+	m.gcrCache.WithMaxCacheEntries(n)
+	return m
+}
+
+// WithECRClockSkew sets how long before their expiry the tokens held
+// by the cache of the default ECR client stop being handed out, five
+// minutes by default. The cache of a client set with WithECRClient is
+// to be given the skew with its own WithClockSkew.
+func (m *Manager) WithECRClockSkew(d time.Duration) *Manager {
+	m.ecrCache.WithClockSkew(d)
+	return m
+}
+
+// WithCredentialExpiryMetrics makes the caches of the default ECR and
+// GCR clients record the expiry of the tokens they cache in the given
+// metrics. The caches of clients set with WithECRClient, WithGCRClient
+// or WithACRClient are to be given the metrics with their own
+// WithExpiryMetrics.
+func (m *Manager) WithCredentialExpiryMetrics(metrics *registry.CredentialExpiryMetrics) *Manager {
+	m.ecrCache.WithExpiryMetrics(metrics)
+	m.gcrCache.WithExpiryMetrics(metrics)
+	return m
+}
+
+// WithECRClient allows overriding the default ECR client.
+func (m *Manager) WithECRClient(c *aws.Client) *Manager {
+	m.ecr = c
+	m.ecrFactory = nil
+	return m
+}
+
+// WithGCRClient allows overriding the default GCR client.
+func (m *Manager) WithGCRClient(c *gcp.Client) *Manager {
+	m.gcr = c
+	m.gcrFactory = nil
+	return m
+}
+
+// WithACRClient allows overriding the default ACR client.
+func (m *Manager) WithACRClient(c *azure.Client) *Manager {
+	m.acr = c
+	m.acrFactory = nil
+	return m
+}
+
+// WithECRClientFactory is like WithECRClient, but the client is built
+// by the factory when first needed, i.e. on the first login with ECR,
+// rather than up front. The factory is called at most once, even under
+// concurrent logins.
+func (m *Manager) WithECRClientFactory(factory func() *aws.Client) *Manager {
+	m.ecrFactory = factory
+	return m
+}
+
+// WithGCRClientFactory is like WithGCRClient, but the client is built
+// by the factory when first needed, i.e. on the first login with GCR,
+// rather than up front. The factory is called at most once, even under
+// concurrent logins.
+func (m *Manager) WithGCRClientFactory(factory func() *gcp.Client) *Manager {
+	m.gcrFactory = factory
+	return m
+}
+
+// WithACRClientFactory is like WithACRClient, but the client is built
+// by the factory when first needed, i.e. on the first login with ACR,
+// rather than up front. The factory is called at most once, even under
+// concurrent logins.
+func (m *Manager) WithACRClientFactory(factory func() *azure.Client) *Manager {
+	m.acrFactory = factory
+	return m
+}
+
+// ecrClient returns the ECR client, building it with the factory on
+// first use if there is one.
+func (m *Manager) ecrClient() *aws.Client {
+	m.ecrOnce.Do(func() {
+		if m.ecrFactory != nil {
+			m.ecr = m.ecrFactory()
+		}
+	})
+	return m.ecr
+}
+
+// gcrClient returns the GCR client, building it with the factory on
+// first use if there is one.
+func (m *Manager) gcrClient() *gcp.Client {
+	m.gcrOnce.Do(func() {
+		if m.gcrFactory != nil {
+			m.gcr = m.gcrFactory()
+		}
+	})
+	return m.gcr
+}
+
+// acrClient returns the ACR client, building it with the factory on
+// first use if there is one.
+func (m *Manager) acrClient() *azure.Client {
+	m.acrOnce.Do(func() {
+		if m.acrFactory != nil {
+			m.acr = m.acrFactory()
+		}
+	})
+	return m.acr
+}
+
+// WithHostProviderOverride makes images hosted on the given host be
+// logged into with the given provider, instead of the provider
+// detected from the hostname. This is useful e.g. for an ECR-compatible
+// registry running on a non-ECR host. It is safe to call while logins
+// are in progress.
+func (m *Manager) WithHostProviderOverride(host string, provider registry.Provider) *Manager {
+	return m.WithHostProviderCandidates(host, provider)
+}
+
+// WithHostProviderCandidates makes images hosted on the given host be
+// logged into with the first of the given providers which succeeds,
+// instead of the provider detected from the hostname. The candidates
+// are tried in the order of the priority set with WithProviderPriority,
+// and those missing from it in the given order, after the others. This
+// is useful e.g. for a registry mirror accepting the credentials of
+// several providers. A failed login is logged before the next
+// candidate is tried; if all of them fail, the error of the last one is
+// returned. It is safe to call while logins are in progress.
+func (m *Manager) WithHostProviderCandidates(host string, providers ...registry.Provider) *Manager {
+	m.overridesMu.Lock()
+	defer m.overridesMu.Unlock()
+	m.overrides[host] = append([]registry.Provider(nil), providers...)
+	return m
+}
+
+// WithProviderPriority sets the order in which the candidate providers
+// of the hosts overridden with WithHostProviderCandidates are tried:
+// the providers listed come first, in the given order. It is safe to
+// call while logins are in progress.
+func (m *Manager) WithProviderPriority(providers []registry.Provider) *Manager {
+	m.overridesMu.Lock()
+	defer m.overridesMu.Unlock()
+	m.priority = append([]registry.Provider(nil), providers...)
+	return m
+}
+
+// WithDefaultProvider sets the provider of the hosts which are matched
+// by no provider nor host override, registry.ProviderGeneric by
+// default. With registry.ProviderNone, logging into such hosts fails
+// with an error wrapping registry.ErrProviderNotConfigured, so that
+// only the registries of known providers, or overridden hosts, may be
+// used.
+func (m *Manager) WithDefaultProvider(provider registry.Provider) *Manager {
+	m.defaultProvider = provider
+	return m
+}
+
+// WithProviderGuard sets a predicate which is consulted before logging
+// in with the given provider, e.g. to only log into ECR when running on
+// AWS. When it returns false, images hosted by the provider are still
+// detected as such, but treated like those of the generic provider. It
+// is safe to call while logins are in progress.
+func (m *Manager) WithProviderGuard(provider registry.Provider, guard func(ctx context.Context) bool) *Manager {
+	m.guardsMu.Lock()
+	defer m.guardsMu.Unlock()
+	m.guards[provider] = guard
+	return m
+}
+
+// WithOptionsResolver sets the function deriving the options to log
+// into an image with, used by LoginWithResolvedOptions. This allows
+// e.g. enabling auto-login for some repositories only.
+func (m *Manager) WithOptionsResolver(resolver func(image string) ProviderOptions) *Manager {
+	m.optionsResolver = resolver
+	return m
+}
+
+// WithCredentialStore makes the Manager look up credentials for the
+// registry hosts in the given store, before or after logging in with
+// the provider depending on the order. Pull secrets of the options
+// take precedence over the store either way.
+func (m *Manager) WithCredentialStore(store registry.CredentialStore, order StoreOrder) *Manager {
+	m.store = store
+	m.storeOrder = order
+	return m
+}
+
+// probeAnonymous returns whether the registry of ref can be read
+// without credentials, using the probes enabled in opts.
+func (m *Manager) probeAnonymous(ctx context.Context, ref name.Reference, opts ProviderOptions) (bool, error) {
+	requiresAuth, err := registry.RequiresAuth(ctx, ref.Context().RegistryStr(), registry.ProbeOptions{
+		Insecure: ref.Context().Registry.Scheme() == "http",
+	})
+	if err != nil {
+		return false, err
+	}
+	if !requiresAuth {
+		return true, nil
+	}
+	if !opts.ProbeAnonymousToken {
+		return false, nil
+	}
+	return registry.AnonymousPullAllowed(ctx, ref.Context())
+}
+
+// fromStore sets the Authenticator of the result to the credentials of
+// the store for the host, and returns whether the store had some.
+func (m *Manager) fromStore(ctx context.Context, host string, result *LoginResult) (bool, error) {
+	authConfig, ok, err := m.store.Get(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf("failed to get credentials for %s from the store: %w", host, err)
+	}
+	if !ok {
+		return false, nil
+	}
+	result.Authenticator = authn.FromConfig(authConfig)
+	result.CredentialSource = credentialStoreSource
+	return true, nil
+}
+
+// WithUnqualifiedPolicy sets how the Manager treats the image
+// references which don't name their registry host. They are logged
+// into as given by default.
+func (m *Manager) WithUnqualifiedPolicy(policy UnqualifiedPolicy) *Manager {
+	m.unqualifiedPolicy = policy
+	return m
+}
+
+// WithUserAgent sets the User-Agent of the requests made for logins,
+// and by the transports the Manager builds, unless the options of the
+// call set another one. Without one, the requests carry the User-Agent
+// of the clients making them.
+func (m *Manager) WithUserAgent(ua string) *Manager {
+	m.userAgent = ua
+	return m
+}
+
+// withClientOptions returns a copy of ctx carrying the User-Agent of
+// the options, or the default one of the Manager, and whether to
+// force HTTP/1.1, which the clients apply to their own transports (see
+// registry.TransportFor), so that the GCP metadata server requests
+// keep the dial timeout of the GCR client.
+func (m *Manager) withClientOptions(ctx context.Context, opts ProviderOptions) context.Context {
+	ua := opts.UserAgent
+	if ua == "" {
+		ua = m.userAgent
+	}
+	if ua != "" {
+		ctx = registry.ContextWithUserAgent(ctx, ua)
+	}
+	if opts.ForceHTTP1 {
+		ctx = registry.ContextWithForceHTTP1(ctx)
+	}
+	return ctx
+}
+
+// WithHostAllowlist restricts the registry hosts the Manager logs into
+// to those matching any of the given patterns: globs (e.g.
+// "*.example.com") or suffixes starting with a dot (e.g.
+// ".example.com"). Logging into any other host fails with an error
+// wrapping registry.ErrHostNotAllowed, before any request is made. An
+// empty allowlist allows all hosts.
+func (m *Manager) WithHostAllowlist(patterns []string) *Manager {
+	m.allowlist = patterns
+	return m
+}
+
+// WithHostDenylist prevents the Manager from logging into the registry
+// hosts matching any of the given patterns, in the same form as those
+// of WithHostAllowlist, e.g. to block the metadata endpoints of cloud
+// providers ("169.254.169.254") from being contacted for user-supplied
+// images. The denylist takes precedence over the allowlist.
+func (m *Manager) WithHostDenylist(patterns []string) *Manager {
+	m.denylist = patterns
+	return m
+}
+
+// checkHost returns an error wrapping registry.ErrHostNotAllowed if
+// the host may not be contacted.
+func (m *Manager) checkHost(host string) error {
+	if hostMatches(m.denylist, host) {
+		return fmt.Errorf("%w: %s is denylisted", registry.ErrHostNotAllowed, host)
+	}
+	if len(m.allowlist) > 0 && !hostMatches(m.allowlist, host) {
+		return fmt.Errorf("%w: %s", registry.ErrHostNotAllowed, host)
+	}
+	return nil
+}
+
+// guardAllows returns whether the guard of the provider, if any,
+// allows logging in with it.
+func (m *Manager) guardAllows(ctx context.Context, provider registry.Provider) bool {
+	m.guardsMu.RLock()
+	guard, ok := m.guards[provider]
+	m.guardsMu.RUnlock()
+	return !ok || guard(ctx)
+}
+
+// providersFor returns the providers to try logging into the image
+// with, in order: the candidates of the host override, by priority, or
+// else the detected provider alone (see DetectProvider), falling back
+// to the default provider of the Manager for hosts detection matches
+// with no provider.
+func (m *Manager) providersFor(image string, ref name.Reference) []registry.Provider {
+	m.overridesMu.RLock()
+	candidates, ok := m.overrides[ref.Context().RegistryStr()]
+	priority := m.priority
+	m.overridesMu.RUnlock()
+	if ok && len(candidates) > 0 {
+		rank := func(provider registry.Provider) int {
+			for i, p := range priority {
+				if p == provider {
+					return i
+				}
+			}
+			return len(priority)
+		}
+		providers := append([]registry.Provider(nil), candidates...)
+		sort.SliceStable(providers, func(i, j int) bool {
+			return rank(providers[i]) < rank(providers[j])
+		})
+		return providers
+	}
+	if provider := ImageRegistryProvider(image, ref); provider != registry.ProviderGeneric {
+		return []registry.Provider{provider}
+	}
+	return []registry.Provider{m.defaultProvider}
+}
+
+// Login performs authentication against a registry and returns the
+// Authenticator. Credentials for the registry host found in the pull
+// secrets of the options are used before any provider login. For
+// generic registry provider, it is otherwise no-op and returns a nil
+// Authenticator. If the image is hosted by a provider for which
+// auto-login is not enabled, the returned error wraps a
+// registry.AutoLoginDisabledError telling the controller flag enabling
+// it, which is a registry.ErrUnconfiguredProvider.
+//
+// A nil Authenticator means anonymous access, for which the
+// transports of go-containerregistry get anonymous bearer tokens from
+// the registries challenging for them, as Docker Hub and Quay do.
+//
+// With SkipLoginIfAnonymous set in the options, a nil Authenticator is
+// also returned when the registry host doesn't require
+// authentication, or, with ProbeAnonymousToken, when it issues
+// anonymous tokens reading the repository. Logging into a host which
+// is not allowed (see WithHostAllowlist and WithHostDenylist) fails
+// with an error wrapping registry.ErrHostNotAllowed, and logging into
+// a host matched by no provider when the default provider is
+// registry.ProviderNone (see WithDefaultProvider) with one wrapping
+// registry.ErrProviderNotConfigured. Malformed images (see
+// registry.ValidateImage) are rejected with an error wrapping
+// registry.ErrInvalidImage before anything else is done.
+//
+// Credentials embedded in the image, as in
+// `user:pass@registry.example.com/foo:v1`, are used for generic
+// registries ahead of any other source, and ignored for the others;
+// they are stripped from the image logged and reported in errors. The
+// reference is to be parsed from the image without them, e.g. with
+// registry.ParseReference. A leading "oci://", as in the references of
+// the other Flux controllers, is stripped from the image the same way.
+//
+// With OfflineStatic set in the options, no network call is made: a
+// login which would need one fails with an error wrapping
+// registry.ErrOnlineLoginRequired.
+func (m *Manager) Login(ctx context.Context, image string, ref name.Reference, opts ProviderOptions) (authn.Authenticator, error) {
+	result, err := m.Resolve(ctx, image, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Authenticator, nil
+}
+
+// Resolve is like Login, but returns the details of the login along
+// with the Authenticator.
+func (m *Manager) Resolve(ctx context.Context, image string, ref name.Reference, opts ProviderOptions) (LoginResult, error) {
+	image = registry.TrimOCIScheme(image)
+	if err := registry.ValidateImage(image); err != nil {
+		return LoginResult{}, err
+	}
+	ctx = m.withClientOptions(ctx, opts)
+	// The credentials embedded in the image, if any, must not make it
+	// to logs and errors.
+	image, embedded := registry.SplitCredentials(image)
+	if !registry.IsFullyQualified(image) {
+		switch m.unqualifiedPolicy {
+		case UnqualifiedReject:
+			return LoginResult{}, fmt.Errorf("%w: %s doesn't name its registry host", registry.ErrInvalidImage, image)
+		case UnqualifiedNormalize:
+			image = ref.Name()
+		}
+	}
+	candidates := []registry.Provider{opts.ProviderHint}
+	if opts.ProviderHint == registry.ProviderGeneric {
+		candidates = m.providersFor(image, ref)
+	}
+	result := LoginResult{Provider: candidates[0]}
+
+	host := ref.Context().RegistryStr()
+	if result.Provider == registry.ProviderNone {
+		return result, fmt.Errorf("%w: %s", registry.ErrProviderNotConfigured, host)
+	}
+	if err := m.checkHost(host); err != nil {
+		return result, err
+	}
+
+	if embedded != nil && result.Provider == registry.ProviderGeneric {
+		result.Authenticator = authn.FromConfig(*embedded)
+		result.CredentialSource = embeddedCredentialsSource
+		return result, nil
+	}
+
+	if len(opts.PullSecrets) > 0 {
+		keychain, err := KeychainFromSecrets(ctx, opts.PullSecrets)
+		if err != nil {
+			return result, err
+		}
+		auth, err := keychain.Resolve(ref.Context())
+		if err != nil {
+			return result, err
+		}
+		if auth != authn.Anonymous {
+			result.Authenticator = auth
+			result.CredentialSource = pullSecretSource
+			return result, nil
+		}
+	}
+
+	if opts.ExecPlugin != nil {
+		if ok, err := m.fromExecPlugin(ctx, opts.ExecPlugin, host, &result); ok || err != nil {
+			return result, err
+		}
+	}
+
+	if opts.KubeletCredentialProvider != nil {
+		if ok, err := m.fromKubeletCredentialProvider(ctx, opts.KubeletCredentialProvider, image, ref, &result); ok || err != nil {
+			return result, err
+		}
+	}
+
+	if m.store != nil && m.storeOrder == StoreFirst {
+		if ok, err := m.fromStore(ctx, host, &result); ok || err != nil {
+			return result, err
+		}
+	}
+
+	var providers []registry.Provider
+	for _, provider := range candidates {
+		if provider != registry.ProviderGeneric && !m.guardAllows(ctx, provider) {
+			ctrl.LoggerFrom(ctx).Info("login with provider " + provider.String() + " skipped by its guard")
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		providers = []registry.Provider{registry.ProviderGeneric}
+	}
+	result.Provider = providers[0]
+	if result.Provider != registry.ProviderGeneric && opts.SkipLoginIfAnonymous && !opts.OfflineStatic {
+		// The probe only saves a login, so when it fails the login is
+		// made as if the registry required it.
+		anonymous, err := m.probeAnonymous(ctx, ref, opts)
+		if err != nil {
+			ctrl.LoggerFrom(ctx).Info("anonymous access probe failed, logging in with provider "+result.Provider.String(),
+				"error", registry.Sanitize(err).Error())
+		} else if anonymous {
+			return result, nil
+		}
+	}
+
+	var err error
+	for i, provider := range providers {
+		if i > 0 {
+			ctrl.LoggerFrom(ctx).Info("login with provider "+providers[i-1].String()+" failed, trying "+provider.String(),
+				"error", registry.Sanitize(err).Error())
+		}
+		result.Provider = provider
+		if opts.OfflineStatic && opts.autoLoginFor(provider) {
+			result.Authenticator, result.CredentialSource, result.RawResponse, result.Partition = nil, "", "", ""
+			err = fmt.Errorf("%w: %s requires a login with provider %s", registry.ErrOnlineLoginRequired, image, provider)
+			continue
+		}
+		if err = m.providerLogin(ctx, image, ref, opts, &result); err == nil {
+			break
+		}
+	}
+	if m.store != nil && m.storeOrder == StoreLast && result.Authenticator == nil &&
+		(err == nil || errors.Is(err, registry.ErrUnconfiguredProvider) || errors.Is(err, registry.ErrOnlineLoginRequired)) {
+		if ok, storeErr := m.fromStore(ctx, host, &result); ok || storeErr != nil {
+			return result, storeErr
+		}
+	}
+	return result, err
+}
+
+// providerLogin logs into the image with the provider of the result,
+// setting its Authenticator, CredentialSource, RawResponse and
+// Partition.
+func (m *Manager) providerLogin(ctx context.Context, image string, ref name.Reference, opts ProviderOptions, result *LoginResult) error {
+	result.Authenticator, result.CredentialSource, result.RawResponse, result.Partition = nil, "", "", ""
+	if timeout := opts.timeoutFor(result.Provider); timeout > 0 && result.Provider != registry.ProviderGeneric {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if result.Provider != registry.ProviderGeneric {
+		release, err := m.acquireProviderSlot(ctx, result.Provider)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if opts.MinValidity > 0 {
+		ctx = registry.ContextWithMinValidity(ctx, opts.MinValidity)
+	}
+	if opts.IsRetryable != nil {
+		ctx = registry.ContextWithRetryable(ctx, opts.IsRetryable)
+	}
+	var capture *responseCapture
+	if opts.CaptureRawResponse && result.Provider != registry.ProviderGeneric {
+		capture = newResponseCapture(registry.TransportFromContext(ctx))
+		ctx = registry.ContextWithTransport(ctx, capture)
+	}
+	var err error
+	switch result.Provider {
+	case registry.ProviderAWS:
+		result.Partition = m.ecrClient().Partition(image)
+		result.Authenticator, result.CredentialSource, err = m.ecrClient().LoginWithSource(ctx, opts.AwsAutoLogin, image)
+	case registry.ProviderGCP:
+		result.Authenticator, result.CredentialSource, err = m.gcrClient().LoginWithSource(ctx, opts.GcpAutoLogin, image, ref)
+	case registry.ProviderAzure:
+		result.Authenticator, result.CredentialSource, err = m.acrClient().LoginWithSource(ctx, opts.AzureAutoLogin, image, ref)
+	}
+	if capture != nil {
+		result.RawResponse = capture.String()
+	}
+	return err
+}
+
+// LoginRepository is like Login, but for a repository rather than an
+// image, e.g. to list all its tags. See ResolveRepository.
+func (m *Manager) LoginRepository(ctx context.Context, repo name.Repository, opts ProviderOptions) (authn.Authenticator, error) {
+	result, err := m.ResolveRepository(ctx, repo, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Authenticator, nil
+}
+
+// ResolveRepository is like Resolve, but for a repository rather than
+// an image. Logins are scoped to the repository, so the reference used
+// for the login is that of its "latest" tag, which doesn't need to
+// exist; the repository itself is what is logged and reported in
+// errors.
+func (m *Manager) ResolveRepository(ctx context.Context, repo name.Repository, opts ProviderOptions) (LoginResult, error) {
+	return m.Resolve(ctx, repo.String(), repo.Tag(name.DefaultTag), opts)
+}
+
+// LoginWithResolvedOptions is like Login, but with the options derived
+// from the image by the resolver set with WithOptionsResolver. Without
+// a resolver, the zero options are used.
+func (m *Manager) LoginWithResolvedOptions(ctx context.Context, image string, ref name.Reference) (authn.Authenticator, error) {
+	var opts ProviderOptions
+	if m.optionsResolver != nil {
+		opts = m.optionsResolver(image)
+	}
+	return m.Login(ctx, image, ref, opts)
+}
+
+// LoginWithTransport is like Login, but makes all the requests needed
+// to obtain the credentials, including token exchanges with the
+// providers, through the given transport. The same transport is meant
+// to be used by the caller for the subsequent registry calls. A nil
+// transport means the default one.
+func (m *Manager) LoginWithTransport(ctx context.Context, image string, ref name.Reference, opts ProviderOptions, rt http.RoundTripper) (authn.Authenticator, error) {
+	return m.Login(registry.ContextWithTransport(ctx, rt), image, ref, opts)
+}
+
+// AuthenticatedTransport logs into the registry hosting the referenced
+// image, and returns a transport authenticating the requests it makes
+// to the repository with pull scope. The transport carried by the
+// context, if any, is used for logging in and as the base of the
+// returned transport. The realm override of the options applies to the
+// returned transport.
+func (m *Manager) AuthenticatedTransport(ctx context.Context, ref name.Reference, opts ProviderOptions) (http.RoundTripper, error) {
+	auth, err := m.Login(ctx, ref.String(), ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+	base, err := m.registryBase(ctx, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	scopes := []string{ref.Context().Scope(transport.PullScope)}
+	return transport.NewWithContext(ctx, ref.Context().Registry, auth, base, scopes)
+}
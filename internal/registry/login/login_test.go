@@ -0,0 +1,1824 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	awssdk "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/go-logr/logr/funcr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/aws"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/azure"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+	"github.com/fluxcd/image-reflector-controller/internal/test"
+)
+
+// fakeTokenCredential implements azcore.TokenCredential.
+type fakeTokenCredential struct {
+	token string
+	err   error
+}
+
+var _ azcore.TokenCredential = &fakeTokenCredential{}
+
+func (tc *fakeTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	if tc.err != nil {
+		return nil, tc.err
+	}
+	return &azcore.AccessToken{Token: tc.token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+const testDigest = "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+
+func TestImageRegistryProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		wantHost string
+		want     registry.Provider
+	}{
+		{
+			name:     "ecr",
+			image:    "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+			wantHost: "012345678901.dkr.ecr.us-east-1.amazonaws.com",
+			want:     registry.ProviderAWS,
+		},
+		{
+			name:     "ecr tag and digest",
+			image:    "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1@" + testDigest,
+			wantHost: "012345678901.dkr.ecr.us-east-1.amazonaws.com",
+			want:     registry.ProviderAWS,
+		},
+		{
+			name:     "gcr",
+			image:    "gcr.io/foo/bar:v1",
+			wantHost: "gcr.io",
+			want:     registry.ProviderGCP,
+		},
+		{
+			name:     "gcr tag and digest",
+			image:    "gcr.io/foo/bar:v1@" + testDigest,
+			wantHost: "gcr.io",
+			want:     registry.ProviderGCP,
+		},
+		{
+			name:     "gcr digest only",
+			image:    "gcr.io/foo/bar@" + testDigest,
+			wantHost: "gcr.io",
+			want:     registry.ProviderGCP,
+		},
+		{
+			name:     "artifact registry tag and digest",
+			image:    "us-central1-docker.pkg.dev/foo/bar/baz:v1@" + testDigest,
+			wantHost: "us-central1-docker.pkg.dev",
+			want:     registry.ProviderGCP,
+		},
+		{
+			name:     "acr",
+			image:    "foo.azurecr.io/bar:v1",
+			wantHost: "foo.azurecr.io",
+			want:     registry.ProviderAzure,
+		},
+		{
+			name:     "acr tag and digest",
+			image:    "foo.azurecr.io/bar:v1@" + testDigest,
+			wantHost: "foo.azurecr.io",
+			want:     registry.ProviderAzure,
+		},
+		{
+			name:     "docker hub",
+			image:    "stefanprodan/podinfo:v1",
+			wantHost: "index.docker.io",
+			want:     registry.ProviderGeneric,
+		},
+		{
+			name:     "docker hub tag and digest",
+			image:    "stefanprodan/podinfo:v1@" + testDigest,
+			wantHost: "index.docker.io",
+			want:     registry.ProviderGeneric,
+		},
+		{
+			name:     "registry with port tag and digest",
+			image:    "registry.me:8082/foo/bar:v1@" + testDigest,
+			wantHost: "registry.me:8082",
+			want:     registry.ProviderGeneric,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ref.Context().RegistryStr()).To(Equal(tt.wantHost))
+			g.Expect(ImageRegistryProvider(tt.image, ref)).To(Equal(tt.want))
+		})
+	}
+}
+
+// TestImageRegistryProvider_Corpus checks the provider detection
+// against the corpus of hosts in testdata/providers.txt.
+func TestImageRegistryProvider_Corpus(t *testing.T) {
+	g := NewWithT(t)
+
+	providers := map[string]registry.Provider{}
+	for _, p := range []registry.Provider{
+		registry.ProviderGeneric, registry.ProviderAWS, registry.ProviderGCP, registry.ProviderAzure,
+	} {
+		providers[p.String()] = p
+	}
+
+	f, err := os.Open("testdata/providers.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	var entries int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		g.Expect(fields).To(HaveLen(2), "line %d: want `<host> <provider>`", line)
+		host, providerName := fields[0], fields[1]
+		want, ok := providers[providerName]
+		g.Expect(ok).To(BeTrue(), "line %d: unknown provider %q", line, providerName)
+		entries++
+
+		t.Run(host, func(t *testing.T) {
+			g := NewWithT(t)
+
+			image := host + "/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ImageRegistryProvider(image, ref)).To(Equal(want), "provider for %s", host)
+		})
+	}
+	g.Expect(scanner.Err()).ToNot(HaveOccurred())
+	g.Expect(entries).ToNot(BeZero())
+}
+
+func TestDetectProvider_Precedence(t *testing.T) {
+	origExactHosts, origHostMatchers := exactHosts, hostMatchers
+	t.Cleanup(func() {
+		exactHosts, hostMatchers = origExactHosts, origHostMatchers
+	})
+	// Make the matchers overlap: an exact host also matching the
+	// Azure suffix, and a GCP matcher after the Azure one matching the
+	// same hosts.
+	exactHosts = map[string]registry.Provider{"exact.azurecr.io": registry.ProviderAWS}
+	hostMatchers = append(hostMatchers[:len(hostMatchers):len(hostMatchers)], struct {
+		provider registry.Provider
+		match    func(host string) bool
+	}{registry.ProviderGCP, func(host string) bool { return strings.HasSuffix(host, ".azurecr.io") }})
+
+	tests := []struct {
+		name     string
+		image    string
+		override registry.Provider
+		want     registry.Provider
+	}{
+		{
+			name:     "override over exact host",
+			image:    "exact.azurecr.io/foo/bar:v1",
+			override: registry.ProviderGCP,
+			want:     registry.ProviderGCP,
+		},
+		{
+			name:     "override over suffix",
+			image:    "foo.azurecr.io/bar:v1",
+			override: registry.ProviderAWS,
+			want:     registry.ProviderAWS,
+		},
+		{
+			name:  "exact host over suffix",
+			image: "exact.azurecr.io/foo/bar:v1",
+			want:  registry.ProviderAWS,
+		},
+		{
+			name:  "first suffix matcher",
+			image: "foo.azurecr.io/bar:v1",
+			want:  registry.ProviderAzure,
+		},
+		{
+			name:  "Google mirror",
+			image: "mirror.gcr.io/library/alpine:3",
+			want:  registry.ProviderGeneric,
+		},
+		{
+			name:  "provider host in the path",
+			image: "registry.example.com/012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+			want:  registry.ProviderGeneric,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			mgr := NewManager()
+			if tt.override != registry.ProviderGeneric {
+				mgr.WithHostProviderOverride(ref.Context().RegistryStr(), tt.override)
+			}
+			g.Expect(resolvedProvider(mgr, tt.image, ref)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestManager_WithHostProviderOverride(t *testing.T) {
+	g := NewWithT(t)
+
+	var ecrCalled bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ecrCalled = true
+		g.Expect(r.Header.Get("X-Amz-Target")).To(HaveSuffix("GetAuthorizationToken"))
+		w.WriteHeader(http.StatusOK)
+		// base64 encoding of "some-key:some-secret".
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+	}))
+	defer srv.Close()
+
+	ecrClient := aws.NewClient().WithConfig(awssdk.NewConfig().
+		WithEndpoint(srv.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))
+
+	image := "registry.example.com/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mgr := NewManager().WithECRClient(ecrClient)
+	g.Expect(resolvedProvider(mgr, image, ref)).To(Equal(registry.ProviderGeneric))
+
+	// Without the override, the generic provider does not log in.
+	auth, err := mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).To(BeNil())
+	g.Expect(ecrCalled).To(BeFalse())
+
+	mgr.WithHostProviderOverride("registry.example.com", registry.ProviderAWS)
+	g.Expect(resolvedProvider(mgr, image, ref)).To(Equal(registry.ProviderAWS))
+
+	auth, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ecrCalled).To(BeTrue())
+	authConfig, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authConfig.Username).To(Equal("some-key"))
+	g.Expect(authConfig.Password).To(Equal("some-secret"))
+
+	// Overrides of other hosts don't change the detection.
+	gcrRef, err := name.ParseReference("gcr.io/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resolvedProvider(mgr, "gcr.io/foo/bar:v1", gcrRef)).To(Equal(registry.ProviderGCP))
+}
+
+func TestManager_WithProviderPriority(t *testing.T) {
+	tests := []struct {
+		name         string
+		priority     []registry.Provider
+		gcpFails     bool
+		wantECRCalls int
+		wantErr      bool
+	}{
+		{
+			name:         "first candidate fails, second succeeds",
+			wantECRCalls: 1,
+		},
+		{
+			name:     "priority puts the second candidate first",
+			priority: []registry.Provider{registry.ProviderGCP},
+		},
+		{
+			name:         "all candidates fail",
+			gcpFails:     true,
+			wantECRCalls: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var ecrCalls int
+			ecrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ecrCalls++
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type": "AccessDeniedException", "message": "not authorized"}`))
+			}))
+			defer ecrSrv.Close()
+			gcpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.gcpFails {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte(`{"access_token": "some-token", "expires_in": 3600, "token_type": "Bearer"}`))
+			}))
+			defer gcpSrv.Close()
+
+			image := "mirror.example.com/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().
+				WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+					WithEndpoint(ecrSrv.URL).
+					WithRegion("us-east-1").
+					WithMaxRetries(0).
+					WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+				WithGCRClient(gcp.NewClient().WithTokenURL(gcpSrv.URL)).
+				WithHostProviderCandidates("mirror.example.com", registry.ProviderAWS, registry.ProviderGCP).
+				WithProviderPriority(tt.priority)
+
+			result, err := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true, GcpAutoLogin: true})
+			g.Expect(ecrCalls).To(Equal(tt.wantECRCalls))
+			g.Expect(result.Provider).To(Equal(registry.ProviderGCP))
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			authConfig, err := result.Authenticator.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(authConfig.Password).To(Equal("some-token"))
+		})
+	}
+}
+
+func TestManager_WithDefaultProvider(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultProvider *registry.Provider
+		image           string
+		override        *registry.Provider
+		wantProvider    registry.Provider
+		wantErr         error
+	}{
+		{
+			name:         "unmatched host is generic by default",
+			image:        "registry.example.com/foo/bar:v1",
+			wantProvider: registry.ProviderGeneric,
+		},
+		{
+			name:            "unmatched host rejected",
+			defaultProvider: providerPtr(registry.ProviderNone),
+			image:           "registry.example.com/foo/bar:v1",
+			wantProvider:    registry.ProviderNone,
+			wantErr:         registry.ErrProviderNotConfigured,
+		},
+		{
+			name:            "matched host not rejected",
+			defaultProvider: providerPtr(registry.ProviderNone),
+			image:           "gcr.io/foo/bar:v1",
+			wantProvider:    registry.ProviderGCP,
+			wantErr:         registry.ErrUnconfiguredProvider,
+		},
+		{
+			name:            "overridden host not rejected",
+			defaultProvider: providerPtr(registry.ProviderNone),
+			image:           "registry.example.com/foo/bar:v1",
+			override:        providerPtr(registry.ProviderGeneric),
+			wantProvider:    registry.ProviderGeneric,
+		},
+		{
+			name:            "explicit generic default",
+			defaultProvider: providerPtr(registry.ProviderGeneric),
+			image:           "registry.example.com/foo/bar:v1",
+			wantProvider:    registry.ProviderGeneric,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			mgr := NewManager()
+			if tt.defaultProvider != nil {
+				mgr.WithDefaultProvider(*tt.defaultProvider)
+			}
+			if tt.override != nil {
+				mgr.WithHostProviderOverride(ref.Context().RegistryStr(), *tt.override)
+			}
+
+			result, err := mgr.Resolve(context.TODO(), tt.image, ref, ProviderOptions{})
+			g.Expect(result.Provider).To(Equal(tt.wantProvider))
+			if tt.wantErr != nil {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.Authenticator).To(BeNil())
+		})
+	}
+}
+
+// resolvedProvider returns the provider Resolve logs into the image
+// with. Auto-login is disabled for all the providers, so that no login
+// is made.
+func resolvedProvider(mgr *Manager, image string, ref name.Reference) registry.Provider {
+	result, _ := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{})
+	return result.Provider
+}
+
+func providerPtr(p registry.Provider) *registry.Provider {
+	return &p
+}
+
+func TestManager_ClientFactories(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "some-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+
+	var ecrBuilds, gcrBuilds, acrBuilds int32
+	mgr := NewManager().
+		WithECRClientFactory(func() *aws.Client {
+			atomic.AddInt32(&ecrBuilds, 1)
+			return aws.NewClient()
+		}).
+		WithGCRClientFactory(func() *gcp.Client {
+			atomic.AddInt32(&gcrBuilds, 1)
+			// Give the other logins a chance to race for the client.
+			time.Sleep(10 * time.Millisecond)
+			return gcp.NewClient().WithTokenURL(srv.URL)
+		}).
+		WithACRClientFactory(func() *azure.Client {
+			atomic.AddInt32(&acrBuilds, 1)
+			return azure.NewClient()
+		})
+
+	image := "gcr.io/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = mgr.Login(context.TODO(), image, ref, ProviderOptions{GcpAutoLogin: true})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(atomic.LoadInt32(&gcrBuilds)).To(Equal(int32(1)))
+	// The clients of the providers which aren't logged into are never
+	// built.
+	g.Expect(atomic.LoadInt32(&ecrBuilds)).To(BeZero())
+	g.Expect(atomic.LoadInt32(&acrBuilds)).To(BeZero())
+}
+
+func TestManager_EmbeddedCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name         string
+		image        string
+		opts         ProviderOptions
+		wantAuth     *authn.AuthConfig
+		wantSource   string
+		wantErr      bool
+		wantLoggedAs string
+	}{
+		{
+			name:       "generic registry",
+			image:      "robot:s3cr3t@registry.example.com/foo/bar:v1",
+			wantAuth:   &authn.AuthConfig{Username: "robot", Password: "s3cr3t"},
+			wantSource: embeddedCredentialsSource,
+		},
+		{
+			name:         "provider registry",
+			image:        "robot:s3cr3t@gcr.io/foo/bar:v1",
+			opts:         ProviderOptions{GcpAutoLogin: true},
+			wantAuth:     &authn.AuthConfig{Username: "oauth2accesstoken", Password: "gcp-token"},
+			wantSource:   "metadata",
+			wantLoggedAs: "gcr.io/foo/bar:v1",
+		},
+		{
+			name:    "unconfigured provider registry",
+			image:   "robot:s3cr3t@foo.azurecr.io/bar:v1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			ref, err := registry.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ref.String()).ToNot(ContainSubstring("s3cr3t"))
+
+			mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+			result, err := mgr.Resolve(ctx, tt.image, ref, tt.opts)
+			for _, line := range logs {
+				g.Expect(line).ToNot(ContainSubstring("s3cr3t"))
+				g.Expect(line).ToNot(ContainSubstring("robot"))
+			}
+			if tt.wantLoggedAs != "" {
+				g.Expect(logs).To(ContainElement(ContainSubstring(tt.wantLoggedAs)))
+			}
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).ToNot(ContainSubstring("s3cr3t"))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.CredentialSource).To(Equal(tt.wantSource))
+			authConfig, err := result.Authenticator.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*authConfig).To(Equal(*tt.wantAuth))
+		})
+	}
+}
+
+func TestManager_OCIScheme(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name         string
+		image        string
+		wantProvider registry.Provider
+		wantLoggedAs string
+	}{
+		{
+			name:         "generic registry",
+			image:        "oci://ghcr.io/foo/bar:v1",
+			wantProvider: registry.ProviderGeneric,
+		},
+		{
+			name:         "provider registry",
+			image:        "oci://gcr.io/foo/bar:v1",
+			wantProvider: registry.ProviderGCP,
+			wantLoggedAs: "logging in to GCP GCR for gcr.io/foo/bar:v1",
+		},
+		{
+			name:         "uppercase scheme",
+			image:        "OCI://gcr.io/foo/bar:v1",
+			wantProvider: registry.ProviderGCP,
+			wantLoggedAs: "logging in to GCP GCR for gcr.io/foo/bar:v1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			ref, err := registry.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ref.String()).ToNot(ContainSubstring("://"))
+
+			mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+			result, err := mgr.Resolve(ctx, tt.image, ref, ProviderOptions{GcpAutoLogin: true})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.Provider).To(Equal(tt.wantProvider))
+			for _, line := range logs {
+				g.Expect(strings.ToLower(line)).ToNot(ContainSubstring("oci://"))
+			}
+			if tt.wantLoggedAs != "" {
+				g.Expect(logs).To(ContainElement(ContainSubstring(tt.wantLoggedAs)))
+			}
+		})
+	}
+}
+
+func TestManager_OfflineStatic(t *testing.T) {
+	const image = "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
+	secret := testPullSecret("creds", `{"auths": {"012345678901.dkr.ecr.us-east-1.amazonaws.com": {"username": "u", "password": "p"}}}`)
+
+	tests := []struct {
+		name       string
+		image      string
+		opts       ProviderOptions
+		wantSource string
+		wantErr    error
+	}{
+		{
+			name:    "ECR auto-login",
+			image:   image,
+			opts:    ProviderOptions{AwsAutoLogin: true, OfflineStatic: true},
+			wantErr: registry.ErrOnlineLoginRequired,
+		},
+		{
+			name:    "ECR auto-login with anonymous probe",
+			image:   image,
+			opts:    ProviderOptions{AwsAutoLogin: true, SkipLoginIfAnonymous: true, OfflineStatic: true},
+			wantErr: registry.ErrOnlineLoginRequired,
+		},
+		{
+			name:    "ECR without auto-login",
+			image:   image,
+			opts:    ProviderOptions{OfflineStatic: true},
+			wantErr: registry.ErrUnconfiguredProvider,
+		},
+		{
+			name:       "pull secret",
+			image:      image,
+			opts:       ProviderOptions{AwsAutoLogin: true, OfflineStatic: true, PullSecrets: []corev1.Secret{secret}},
+			wantSource: pullSecretSource,
+		},
+		{
+			name:  "generic registry",
+			image: "ghcr.io/foo/bar:v1",
+			opts:  ProviderOptions{AwsAutoLogin: true, OfflineStatic: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer srv.Close()
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+				WithEndpoint(srv.URL).
+				WithRegion("us-east-1").
+				WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))))
+			result, err := mgr.Resolve(context.TODO(), tt.image, ref, tt.opts)
+			g.Expect(requests).To(BeZero())
+			if tt.wantErr != nil {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue(), err.Error())
+				g.Expect(result.Authenticator).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.CredentialSource).To(Equal(tt.wantSource))
+		})
+	}
+}
+
+func TestManager_MinValidity(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// The token is near expiry, ten minutes beyond the default
+		// clock skew.
+		w.Write([]byte(fmt.Sprintf(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ=", "expiresAt": %d}]}`,
+			time.Now().Add(20*time.Minute).Unix())))
+	}))
+	defer srv.Close()
+
+	image := "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mgr := NewManager().WithECRClient(aws.NewClient().
+		WithConfig(awssdk.NewConfig().
+			WithEndpoint(srv.URL).
+			WithRegion("us-east-1").
+			WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))).
+		WithTokenCache(aws.NewTokenCache()))
+
+	_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+
+	_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true, MinValidity: 5 * time.Minute})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+
+	_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true, MinValidity: 15 * time.Minute})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(2))
+}
+
+func TestManager_IsRetryable(t *testing.T) {
+	tests := []struct {
+		name        string
+		isRetryable func(error) bool
+		wantErr     bool
+	}{
+		{
+			name:    "vendor error",
+			wantErr: true,
+		},
+		{
+			name: "vendor error made retryable",
+			isRetryable: func(err error) bool {
+				return strings.Contains(err.Error(), "VendorBusyException")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var calls int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"__type": "VendorBusyException", "message": "try again later"}`))
+					return
+				}
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer srv.Close()
+
+			image := "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+				WithEndpoint(srv.URL).
+				WithRegion("us-east-1").
+				WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))))
+			_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true, IsRetryable: tt.isRetryable})
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(calls).To(Equal(1))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(calls).To(Equal(2))
+		})
+	}
+}
+
+func TestManager_ResolvePartition(t *testing.T) {
+	tests := []struct {
+		name          string
+		image         string
+		region        string
+		wantPartition string
+	}{
+		{
+			name:          "commercial",
+			image:         "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+			region:        "us-east-1",
+			wantPartition: "aws",
+		},
+		{
+			name:          "GovCloud",
+			image:         "012345678901.dkr.ecr.us-gov-west-1.amazonaws.com/foo:v1",
+			region:        "us-gov-west-1",
+			wantPartition: "aws-us-gov",
+		},
+		{
+			name:          "China",
+			image:         "012345678901.dkr.ecr.cn-north-1.amazonaws.com.cn/foo:v1",
+			region:        "cn-north-1",
+			wantPartition: "aws-cn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer srv.Close()
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+				WithEndpoint(srv.URL).
+				WithRegion(tt.region).
+				WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))))
+			result, err := mgr.Resolve(ctx, tt.image, ref, ProviderOptions{AwsAutoLogin: true})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.Provider).To(Equal(registry.ProviderAWS))
+			g.Expect(result.Partition).To(Equal(tt.wantPartition))
+			g.Expect(logs).To(ContainElement(ContainSubstring(`"partition"="` + tt.wantPartition + `"`)))
+		})
+	}
+}
+
+func TestManager_WithProviderGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		guard      bool
+		wantCalled bool
+	}{
+		{
+			name:       "guard allows login",
+			guard:      true,
+			wantCalled: true,
+		},
+		{
+			name:       "guard falls through to generic",
+			guard:      false,
+			wantCalled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var ecrCalled bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ecrCalled = true
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer srv.Close()
+
+			image := "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			var guardCalled bool
+			mgr := NewManager().
+				WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+					WithEndpoint(srv.URL).
+					WithRegion("us-east-1").
+					WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+				WithProviderGuard(registry.ProviderAWS, func(context.Context) bool {
+					guardCalled = true
+					return tt.guard
+				})
+
+			result, err := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(guardCalled).To(BeTrue())
+			g.Expect(ecrCalled).To(Equal(tt.wantCalled))
+			g.Expect(result.Authenticator != nil).To(Equal(tt.wantCalled))
+			wantProvider := registry.ProviderAWS
+			if !tt.guard {
+				wantProvider = registry.ProviderGeneric
+			}
+			g.Expect(result.Provider).To(Equal(wantProvider))
+		})
+	}
+}
+
+func TestManager_WithOptionsResolver(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+	}))
+	defer srv.Close()
+
+	enabledHost := "012345678901.dkr.ecr.us-east-1.amazonaws.com"
+	mgr := NewManager().
+		WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+			WithEndpoint(srv.URL).
+			WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+		WithOptionsResolver(func(image string) ProviderOptions {
+			return ProviderOptions{AwsAutoLogin: strings.HasPrefix(image, enabledHost+"/")}
+		})
+
+	image := enabledHost + "/foo:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	auth, err := mgr.LoginWithResolvedOptions(context.TODO(), image, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).ToNot(BeNil())
+
+	image = "012345678901.dkr.ecr.eu-west-1.amazonaws.com/foo:v1"
+	ref, err = name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = mgr.LoginWithResolvedOptions(context.TODO(), image, ref)
+	g.Expect(err).To(MatchError(registry.ErrUnconfiguredProvider))
+
+	// Explicit options are used as given.
+	auth, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AwsAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).ToNot(BeNil())
+}
+
+func TestManager_ProviderHint(t *testing.T) {
+	g := NewWithT(t)
+
+	var ecrCalled bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ecrCalled = true
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+	}))
+	defer srv.Close()
+
+	image := "registry.example.com/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mgr := NewManager().
+		WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+			WithEndpoint(srv.URL).
+			WithRegion("us-east-1").
+			WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+		WithHostProviderOverride("registry.example.com", registry.ProviderGCP)
+
+	result, err := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{
+		AwsAutoLogin: true,
+		ProviderHint: registry.ProviderAWS,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.Provider).To(Equal(registry.ProviderAWS))
+	g.Expect(result.Authenticator).ToNot(BeNil())
+	g.Expect(ecrCalled).To(BeTrue())
+}
+
+func TestManager_SkipLoginIfAnonymous(t *testing.T) {
+	tests := []struct {
+		name           string
+		registryStatus int
+		wantLogin      bool
+	}{
+		{
+			name:           "anonymous registry",
+			registryStatus: http.StatusOK,
+			wantLogin:      false,
+		},
+		{
+			name:           "registry requiring auth",
+			registryStatus: http.StatusUnauthorized,
+			wantLogin:      true,
+		},
+		{
+			name:           "forbidden probe",
+			registryStatus: http.StatusForbidden,
+			wantLogin:      true,
+		},
+		{
+			name:           "failing registry",
+			registryStatus: http.StatusInternalServerError,
+			wantLogin:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var ecrCalled bool
+			ecrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ecrCalled = true
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer ecrSrv.Close()
+			registrySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.registryStatus)
+			}))
+			defer registrySrv.Close()
+
+			host := strings.TrimPrefix(registrySrv.URL, "http://")
+			image := host + "/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+				WithEndpoint(ecrSrv.URL).
+				WithRegion("us-east-1").
+				WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))))
+			mgr.WithHostProviderOverride(host, registry.ProviderAWS)
+
+			auth, err := mgr.Login(context.TODO(), image, ref, ProviderOptions{
+				AwsAutoLogin:         true,
+				SkipLoginIfAnonymous: true,
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ecrCalled).To(Equal(tt.wantLogin))
+			g.Expect(auth != nil).To(Equal(tt.wantLogin))
+		})
+	}
+}
+
+func TestManager_ProbeAnonymousToken(t *testing.T) {
+	tests := []struct {
+		name                string
+		repository          string
+		probeAnonymousToken bool
+		wantLogin           bool
+	}{
+		{
+			name:       "without the anonymous token probe",
+			repository: "convenient",
+			wantLogin:  true,
+		},
+		{
+			name:                "public repository",
+			repository:          "convenient",
+			probeAnonymousToken: true,
+			wantLogin:           false,
+		},
+		{
+			name:                "unknown repository",
+			repository:          "private",
+			probeAnonymousToken: true,
+			wantLogin:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var ecrCalled bool
+			ecrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ecrCalled = true
+				w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+			}))
+			defer ecrSrv.Close()
+			registrySrv := test.NewAnonymousTokenRegistryServer()
+			defer registrySrv.Close()
+
+			host := test.RegistryName(registrySrv)
+			image := host + "/" + tt.repository + ":v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+				WithEndpoint(ecrSrv.URL).
+				WithRegion("us-east-1").
+				WithCredentials(credentials.NewStaticCredentials("x", "y", "z"))))
+			mgr.WithHostProviderOverride(host, registry.ProviderAWS)
+
+			auth, err := mgr.Login(context.TODO(), image, ref, ProviderOptions{
+				AwsAutoLogin:         true,
+				SkipLoginIfAnonymous: true,
+				ProbeAnonymousToken:  tt.probeAnonymousToken,
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(ecrCalled).To(Equal(tt.wantLogin))
+			g.Expect(auth != nil).To(Equal(tt.wantLogin))
+		})
+	}
+}
+
+func TestManager_AutoLoginDisabled(t *testing.T) {
+	tests := []struct {
+		image        string
+		wantProvider registry.Provider
+		wantFlag     string
+	}{
+		{
+			image:        "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+			wantProvider: registry.ProviderAWS,
+			wantFlag:     "--aws-autologin-for-ecr",
+		},
+		{
+			image:        "gcr.io/foo/bar:v1",
+			wantProvider: registry.ProviderGCP,
+			wantFlag:     "--gcp-autologin-for-gcr",
+		},
+		{
+			image:        "foo.azurecr.io/bar:v1",
+			wantProvider: registry.ProviderAzure,
+			wantFlag:     "--azure-autologin-for-acr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantProvider.String(), func(t *testing.T) {
+			g := NewWithT(t)
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			result, err := NewManager().Resolve(ctx, tt.image, ref, ProviderOptions{})
+			g.Expect(result.Provider).To(Equal(tt.wantProvider))
+			g.Expect(errors.Is(err, registry.ErrAutoLoginDisabled)).To(BeTrue())
+			g.Expect(errors.Is(err, registry.ErrUnconfiguredProvider)).To(BeTrue())
+			var disabled *registry.AutoLoginDisabledError
+			g.Expect(errors.As(err, &disabled)).To(BeTrue())
+			g.Expect(disabled.Provider).To(Equal(tt.wantProvider))
+			g.Expect(disabled.Flag).To(Equal(tt.wantFlag))
+			g.Expect(err.Error()).To(ContainSubstring("set the controller flag " + tt.wantFlag))
+			g.Expect(logs).To(ContainElement(ContainSubstring(tt.wantFlag)))
+		})
+	}
+}
+
+func TestManager_RepositoryOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "gcp-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	const image = "gcr.io/foo/bar"
+	tests := []struct {
+		name    string
+		resolve func(context.Context, *Manager) (LoginResult, error)
+	}{
+		{
+			name: "image without tag",
+			resolve: func(ctx context.Context, mgr *Manager) (LoginResult, error) {
+				ref, err := name.ParseReference(image)
+				if err != nil {
+					return LoginResult{}, err
+				}
+				return mgr.Resolve(ctx, image, ref, ProviderOptions{GcpAutoLogin: true})
+			},
+		},
+		{
+			name: "repository",
+			resolve: func(ctx context.Context, mgr *Manager) (LoginResult, error) {
+				repo, err := name.NewRepository(image)
+				if err != nil {
+					return LoginResult{}, err
+				}
+				return mgr.ResolveRepository(ctx, repo, ProviderOptions{GcpAutoLogin: true})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var logs []string
+			logger := funcr.New(func(prefix, args string) {
+				logs = append(logs, args)
+			}, funcr.Options{})
+			ctx := ctrl.LoggerInto(context.TODO(), logger)
+
+			mgr := NewManager().WithGCRClient(gcp.NewClient().WithTokenURL(srv.URL))
+			result, err := tt.resolve(ctx, mgr)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.Provider).To(Equal(registry.ProviderGCP))
+			g.Expect(result.CredentialSource).To(Equal("metadata"))
+			authConfig, err := result.Authenticator.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*authConfig).To(Equal(authn.AuthConfig{Username: "oauth2accesstoken", Password: "gcp-token"}))
+			g.Expect(logs).To(ContainElement(ContainSubstring("logging in to GCP GCR for " + image)))
+			g.Expect(logs).ToNot(ContainElement(ContainSubstring(image + ":latest")))
+		})
+	}
+}
+
+func TestManager_WithHostProviderOverrideConcurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	mgr := NewManager()
+	ref, err := name.ParseReference("registry.example.com/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mgr.WithHostProviderOverride("registry.example.com", registry.ProviderGCP)
+		}()
+		go func() {
+			defer wg.Done()
+			resolvedProvider(mgr, "registry.example.com/foo/bar:v1", ref)
+		}()
+	}
+	wg.Wait()
+	g.Expect(resolvedProvider(mgr, "registry.example.com/foo/bar:v1", ref)).To(Equal(registry.ProviderGCP))
+}
+
+// recordingTransport records the hosts of the requests going through
+// it.
+type recordingTransport struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.hosts = append(rt.hosts, req.URL.Host)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestManager_LoginWithTransport(t *testing.T) {
+	g := NewWithT(t)
+	// A custom CA bundle can only be applied to an *http.Transport.
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	ecrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`))
+	}))
+	defer ecrSrv.Close()
+	gcpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "some-token", "expires_in": 10, "token_type": "foo"}`))
+	}))
+	defer gcpSrv.Close()
+	acrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	defer acrSrv.Close()
+
+	mgr := NewManager().
+		WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+			WithEndpoint(ecrSrv.URL).
+			WithRegion("us-east-1").
+			WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+		WithGCRClient(gcp.NewClient().WithTokenURL(gcpSrv.URL)).
+		WithACRClient(azure.NewClient().WithTokenCredential(&fakeTokenCredential{token: "foo"}).WithScheme("http"))
+	opts := ProviderOptions{AwsAutoLogin: true, GcpAutoLogin: true, AzureAutoLogin: true}
+
+	acrHost := strings.TrimPrefix(acrSrv.URL, "http://")
+	mgr.WithHostProviderOverride(acrHost, registry.ProviderAzure)
+
+	rt := &recordingTransport{}
+	for _, image := range []string{
+		"012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+		"gcr.io/foo/bar:v1",
+		acrHost + "/foo/bar:v1",
+	} {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		auth, err := mgr.LoginWithTransport(context.TODO(), image, ref, opts, rt)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(auth).ToNot(BeNil())
+	}
+
+	g.Expect(rt.hosts).To(ConsistOf(
+		strings.TrimPrefix(ecrSrv.URL, "http://"),
+		strings.TrimPrefix(gcpSrv.URL, "http://"),
+		acrHost,
+	))
+}
+
+func TestManager_ProviderTimeouts(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	slow := func(body string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	ecrSrv := slow(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ="}]}`)
+	gcpSrv := slow(`{"access_token": "some-token", "expires_in": 10, "token_type": "foo"}`)
+	acrSrv := slow(`{"refresh_token": "bbbbb"}`)
+	acrHost := strings.TrimPrefix(acrSrv.URL, "http://")
+
+	images := map[registry.Provider]string{
+		registry.ProviderAWS:   "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1",
+		registry.ProviderGCP:   "gcr.io/foo/bar:v1",
+		registry.ProviderAzure: acrHost + "/foo/bar:v1",
+	}
+	const short, long = 50 * time.Millisecond, 10 * time.Second
+
+	tests := []struct {
+		name        string
+		opts        ProviderOptions
+		wantTimeout map[registry.Provider]bool
+	}{
+		{
+			name: "no timeout",
+		},
+		{
+			name:        "general timeout",
+			opts:        ProviderOptions{Timeout: short},
+			wantTimeout: map[registry.Provider]bool{registry.ProviderAWS: true, registry.ProviderGCP: true, registry.ProviderAzure: true},
+		},
+		{
+			name:        "AWS timeout",
+			opts:        ProviderOptions{AwsTimeout: short},
+			wantTimeout: map[registry.Provider]bool{registry.ProviderAWS: true},
+		},
+		{
+			name:        "GCP timeout",
+			opts:        ProviderOptions{GcpTimeout: short},
+			wantTimeout: map[registry.Provider]bool{registry.ProviderGCP: true},
+		},
+		{
+			name:        "Azure timeout",
+			opts:        ProviderOptions{AzureTimeout: short},
+			wantTimeout: map[registry.Provider]bool{registry.ProviderAzure: true},
+		},
+		{
+			name:        "provider timeouts over the general one",
+			opts:        ProviderOptions{Timeout: short, AwsTimeout: long, AzureTimeout: long},
+			wantTimeout: map[registry.Provider]bool{registry.ProviderGCP: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := NewManager().
+				WithECRClient(aws.NewClient().WithConfig(awssdk.NewConfig().
+					WithEndpoint(ecrSrv.URL).
+					WithRegion("us-east-1").
+					WithCredentials(credentials.NewStaticCredentials("x", "y", "z")))).
+				WithGCRClient(gcp.NewClient().WithTokenURL(gcpSrv.URL)).
+				WithACRClient(azure.NewClient().WithTokenCredential(&fakeTokenCredential{token: "foo"}).WithScheme("http")).
+				WithHostProviderOverride(acrHost, registry.ProviderAzure)
+			opts := tt.opts
+			opts.AwsAutoLogin, opts.GcpAutoLogin, opts.AzureAutoLogin = true, true, true
+
+			for provider, image := range images {
+				t.Run(provider.String(), func(t *testing.T) {
+					g := NewWithT(t)
+
+					ref, err := name.ParseReference(image)
+					g.Expect(err).ToNot(HaveOccurred())
+					start := time.Now()
+					_, err = mgr.Login(context.TODO(), image, ref, opts)
+					if tt.wantTimeout[provider] {
+						g.Expect(err).To(HaveOccurred())
+						g.Expect(time.Since(start)).To(BeNumerically("<", delay))
+						return
+					}
+					g.Expect(err).ToNot(HaveOccurred())
+				})
+			}
+		})
+	}
+}
+
+func TestManager_AuthenticatedTransport(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/bar/tags/list":
+			w.Write([]byte(`{"name": "foo/bar", "tags": ["v1"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	ref, err := name.ParseReference(host+"/foo/bar:v1", name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	secret := corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths": {"` + host + `": {"username": "user", "password": "pass"}}}`),
+		},
+	}
+	rt, err := NewManager().AuthenticatedTransport(context.TODO(), ref, ProviderOptions{
+		PullSecrets: []corev1.Secret{secret},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	resp, err := (&http.Client{Transport: rt}).Get(srv.URL + "/v2/foo/bar/tags/list")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+	g.Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	// Without credentials, the registry refuses the request.
+	rt, err = NewManager().AuthenticatedTransport(context.TODO(), ref, ProviderOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	resp, err = (&http.Client{Transport: rt}).Get(srv.URL + "/v2/foo/bar/tags/list")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+	g.Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+}
+
+func TestProviderOptions_CacheKey(t *testing.T) {
+	secret := testPullSecret("creds", `{"auths": {"registry.example.com": {"username": "u", "password": "p"}}}`)
+	otherSecret := testPullSecret("creds", `{"auths": {"registry.example.com": {"username": "u", "password": "q"}}}`)
+
+	tests := []struct {
+		name      string
+		a, b      ProviderOptions
+		wantEqual bool
+	}{
+		{
+			name:      "empty options",
+			wantEqual: true,
+		},
+		{
+			name:      "equal options",
+			a:         ProviderOptions{AwsAutoLogin: true, PullSecrets: []corev1.Secret{secret}},
+			b:         ProviderOptions{AwsAutoLogin: true, PullSecrets: []corev1.Secret{*secret.DeepCopy()}},
+			wantEqual: true,
+		},
+		{
+			name: "secret metadata not participating",
+			a:    ProviderOptions{PullSecrets: []corev1.Secret{secret}},
+			b: func() ProviderOptions {
+				s := secret.DeepCopy()
+				s.ResourceVersion = "42"
+				return ProviderOptions{PullSecrets: []corev1.Secret{*s}}
+			}(),
+			wantEqual: true,
+		},
+		{
+			name: "different auto-login",
+			a:    ProviderOptions{AwsAutoLogin: true},
+			b:    ProviderOptions{GcpAutoLogin: true},
+		},
+		{
+			name: "different skip of anonymous login",
+			a:    ProviderOptions{AzureAutoLogin: true},
+			b:    ProviderOptions{AzureAutoLogin: true, SkipLoginIfAnonymous: true},
+		},
+		{
+			name: "different provider hint",
+			a:    ProviderOptions{AwsAutoLogin: true},
+			b:    ProviderOptions{AwsAutoLogin: true, ProviderHint: registry.ProviderAWS},
+		},
+		{
+			name:      "same extra headers",
+			a:         ProviderOptions{ExtraHeaders: map[string]string{"X-Meta-Tenant": "a", "X-Meta-Team": "b"}},
+			b:         ProviderOptions{ExtraHeaders: map[string]string{"X-Meta-Team": "b", "X-Meta-Tenant": "a"}},
+			wantEqual: true,
+		},
+		{
+			name: "different extra headers",
+			a:    ProviderOptions{ExtraHeaders: map[string]string{"X-Meta-Tenant": "a"}},
+			b:    ProviderOptions{ExtraHeaders: map[string]string{"X-Meta-Tenant": "b"}},
+		},
+		{
+			name: "different User-Agent",
+			a:    ProviderOptions{AzureAutoLogin: true},
+			b:    ProviderOptions{AzureAutoLogin: true, UserAgent: "scanner"},
+		},
+		{
+			name: "realm not trusted",
+			a:    ProviderOptions{},
+			b:    ProviderOptions{TrustForwardedRealm: new(bool)},
+		},
+		{
+			name: "different minimum TLS version of a host",
+			a:    ProviderOptions{TLSMinVersionByHost: map[string]uint16{"legacy.example.com": tls.VersionTLS12}},
+			b:    ProviderOptions{TLSMinVersionByHost: map[string]uint16{"legacy.example.com": tls.VersionTLS13}},
+		},
+		{
+			name: "different minimum validity",
+			a:    ProviderOptions{MinValidity: 5 * time.Minute},
+			b:    ProviderOptions{MinValidity: 10 * time.Minute},
+		},
+		{
+			name: "different anonymous token probe",
+			a:    ProviderOptions{SkipLoginIfAnonymous: true},
+			b:    ProviderOptions{SkipLoginIfAnonymous: true, ProbeAnonymousToken: true},
+		},
+		{
+			name: "different offline mode",
+			a:    ProviderOptions{AwsAutoLogin: true},
+			b:    ProviderOptions{AwsAutoLogin: true, OfflineStatic: true},
+		},
+		{
+			name: "different exec plugin args",
+			a:    ProviderOptions{ExecPlugin: &ExecPlugin{Command: "/usr/bin/creds", Args: []string{"--profile", "a"}}},
+			b:    ProviderOptions{ExecPlugin: &ExecPlugin{Command: "/usr/bin/creds", Args: []string{"--profile", "b"}}},
+		},
+		{
+			name: "different kubelet credential provider version",
+			a:    ProviderOptions{KubeletCredentialProvider: &KubeletCredentialProvider{Command: "/usr/bin/ecr-credential-provider"}},
+			b: ProviderOptions{KubeletCredentialProvider: &KubeletCredentialProvider{
+				Command:    "/usr/bin/ecr-credential-provider",
+				APIVersion: "credentialprovider.kubelet.k8s.io/v1beta1",
+			}},
+		},
+		{
+			name: "different secret data",
+			a:    ProviderOptions{PullSecrets: []corev1.Secret{secret}},
+			b:    ProviderOptions{PullSecrets: []corev1.Secret{otherSecret}},
+		},
+		{
+			name: "different secret order",
+			a:    ProviderOptions{PullSecrets: []corev1.Secret{secret, otherSecret}},
+			b:    ProviderOptions{PullSecrets: []corev1.Secret{otherSecret, secret}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(tt.a.CacheKey() == tt.b.CacheKey()).To(Equal(tt.wantEqual))
+			g.Expect(tt.a.CacheKey()).To(Equal(tt.a.CacheKey()))
+		})
+	}
+}
+
+func TestManager_ResolveCredentialSource(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mgr := NewManager().WithACRClient(azure.NewClient().WithScheme("http").WithCredentialChain(
+		azure.NamedCredential{Name: "env", Credential: &fakeTokenCredential{err: errors.New("no environment")}},
+		azure.NamedCredential{Name: "managed-identity", Credential: &fakeTokenCredential{token: "foo"}},
+	))
+	mgr.WithHostProviderOverride(host, registry.ProviderAzure)
+
+	result, err := mgr.Resolve(context.TODO(), image, ref, ProviderOptions{AzureAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.Provider).To(Equal(registry.ProviderAzure))
+	g.Expect(result.CredentialSource).To(Equal("managed-identity"))
+	g.Expect(result.Authenticator).ToNot(BeNil())
+
+	// Credentials from pull secrets are reported as such.
+	secret := testPullSecret("creds", `{"auths": {"`+host+`": {"username": "u", "password": "p"}}}`)
+	result, err = mgr.Resolve(context.TODO(), image, ref, ProviderOptions{
+		AzureAutoLogin: true,
+		PullSecrets:    []corev1.Secret{secret},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.CredentialSource).To(Equal(pullSecretSource))
+}
+
+// fakeCredentialStore implements registry.CredentialStore.
+type fakeCredentialStore struct {
+	creds map[string]authn.AuthConfig
+	err   error
+	gets  int
+}
+
+var _ registry.CredentialStore = &fakeCredentialStore{}
+
+func (s *fakeCredentialStore) Get(ctx context.Context, host string) (authn.AuthConfig, bool, error) {
+	s.gets++
+	if s.err != nil {
+		return authn.AuthConfig{}, false, s.err
+	}
+	authConfig, ok := s.creds[host]
+	return authConfig, ok, nil
+}
+
+func TestManager_WithCredentialStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	defer srv.Close()
+	acrHost := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name       string
+		order      StoreOrder
+		host       string
+		opts       ProviderOptions
+		storeErr   error
+		wantSource string
+		wantGets   int
+		wantAuth   bool
+		wantErr    bool
+	}{
+		{
+			name:       "store first over provider login",
+			order:      StoreFirst,
+			host:       acrHost,
+			opts:       ProviderOptions{AzureAutoLogin: true},
+			wantSource: credentialStoreSource,
+			wantGets:   1,
+			wantAuth:   true,
+		},
+		{
+			name:       "store last after provider login",
+			order:      StoreLast,
+			host:       acrHost,
+			opts:       ProviderOptions{AzureAutoLogin: true},
+			wantSource: "managed-identity",
+			wantAuth:   true,
+		},
+		{
+			name:       "store last with provider login disabled",
+			order:      StoreLast,
+			host:       acrHost,
+			wantSource: credentialStoreSource,
+			wantGets:   1,
+			wantAuth:   true,
+		},
+		{
+			name:       "store last for a generic registry",
+			order:      StoreLast,
+			host:       "registry.example.com",
+			wantSource: credentialStoreSource,
+			wantGets:   1,
+			wantAuth:   true,
+		},
+		{
+			name:     "host not in the store",
+			order:    StoreFirst,
+			host:     "other.example.com",
+			wantGets: 1,
+		},
+		{
+			name:     "store error",
+			order:    StoreFirst,
+			host:     "registry.example.com",
+			storeErr: errors.New("vault sealed"),
+			wantGets: 1,
+			wantErr:  true,
+		},
+		{
+			name:  "pull secrets over the store",
+			order: StoreFirst,
+			host:  "registry.example.com",
+			opts: ProviderOptions{PullSecrets: []corev1.Secret{
+				testPullSecret("creds", `{"auths": {"registry.example.com": {"username": "u", "password": "p"}}}`),
+			}},
+			wantSource: pullSecretSource,
+			wantAuth:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			store := &fakeCredentialStore{
+				creds: map[string]authn.AuthConfig{
+					acrHost:                {Username: "store-user", Password: "store-pass"},
+					"registry.example.com": {Username: "store-user", Password: "store-pass"},
+				},
+				err: tt.storeErr,
+			}
+			mgr := NewManager().
+				WithACRClient(azure.NewClient().WithScheme("http").WithCredentialChain(
+					azure.NamedCredential{Name: "managed-identity", Credential: &fakeTokenCredential{token: "foo"}},
+				)).
+				WithCredentialStore(store, tt.order)
+			mgr.WithHostProviderOverride(acrHost, registry.ProviderAzure)
+
+			image := tt.host + "/foo/bar:v1"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			result, err := mgr.Resolve(context.TODO(), image, ref, tt.opts)
+			g.Expect(store.gets).To(Equal(tt.wantGets))
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(ContainSubstring("vault sealed")))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.CredentialSource).To(Equal(tt.wantSource))
+			if !tt.wantAuth {
+				g.Expect(result.Authenticator).To(BeNil())
+				return
+			}
+			g.Expect(result.Authenticator).ToNot(BeNil())
+			if tt.wantSource == credentialStoreSource {
+				authConfig, err := result.Authenticator.Authorization()
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(authConfig.Username).To(Equal("store-user"))
+			}
+		})
+	}
+}
+
+func TestManager_UserAgent(t *testing.T) {
+	g := NewWithT(t)
+
+	var userAgents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refresh_token": "bbbbb"}`))
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mgr := NewManager().
+		WithACRClient(azure.NewClient().WithScheme("http").WithTokenCredential(&fakeTokenCredential{token: "foo"})).
+		WithUserAgent("image-reflector-controller")
+	mgr.WithHostProviderOverride(host, registry.ProviderAzure)
+
+	_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AzureAutoLogin: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = mgr.Login(context.TODO(), image, ref, ProviderOptions{AzureAutoLogin: true, UserAgent: "image-reflector-controller/scan"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(userAgents).To(Equal([]string{"image-reflector-controller", "image-reflector-controller/scan"}))
+}
+
+func TestManager_WithUnqualifiedPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  UnqualifiedPolicy
+		image   string
+		wantErr bool
+	}{
+		{name: "allowed", policy: UnqualifiedAllow, image: "nginx"},
+		{name: "rejected", policy: UnqualifiedReject, image: "nginx", wantErr: true},
+		{name: "qualified not rejected", policy: UnqualifiedReject, image: "docker.io/library/nginx"},
+		{name: "normalized", policy: UnqualifiedNormalize, image: "nginx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			mgr := NewManager().WithUnqualifiedPolicy(tt.policy)
+			result, err := mgr.Resolve(context.TODO(), tt.image, ref, ProviderOptions{})
+			if tt.wantErr {
+				g.Expect(errors.Is(err, registry.ErrInvalidImage)).To(BeTrue())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(result.Provider).To(Equal(registry.ProviderGeneric))
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// probeRepository is the repository of the reference credentials are
+// resolved for when probing a registry, which names only its host.
+const probeRepository = "probe"
+
+// Probe logs into the registry at the host, the same as Login, and
+// checks that the registry accepts the resolved credentials with an
+// authenticated GET of its /v2/ endpoint, without listing or pulling
+// anything. The challenge of the registry, if any, is answered the
+// same way as for other requests, so cached tokens are exchanged or
+// presented as they would be. It returns nil when the registry answers
+// 200, and otherwise an error ReasonFor can classify. Requests go
+// through the transport carried by the context, if any, honoring the
+// realm override of the options.
+func (m *Manager) Probe(ctx context.Context, host string, opts ProviderOptions) error {
+	ref, err := name.NewTag(host + "/" + probeRepository)
+	if err != nil {
+		return err
+	}
+	rt, err := m.AuthenticatedTransport(ctx, ref, opts)
+	if err != nil {
+		return err
+	}
+
+	reg := ref.Context().Registry
+
+	u := fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return transport.CheckError(resp, http.StatusOK)
+}
+
+// ValidateAccess logs into the registry hosting the image, the same as
+// Login, and checks that the repository of the image can be read with
+// the resolved credentials, by asking the registry for a single tag of
+// it. A repository the registry doesn't know is reported as
+// registry.ErrRepositoryNotFound, and one the registry reports as
+// deleted, with a 410 Gone response, as registry.ErrRepositoryGone.
+// Requests go through the transport carried by the context, if any,
+// honoring the realm override of the options.
+func (m *Manager) ValidateAccess(ctx context.Context, ref name.Reference, opts ProviderOptions) error {
+	rt, err := m.AuthenticatedTransport(ctx, ref, opts)
+	if err != nil {
+		return err
+	}
+
+	repo := ref.Context()
+	u := fmt.Sprintf("%s://%s/v2/%s/tags/list?n=1", repo.Scheme(), repo.RegistryStr(), repo.RepositoryStr())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", registry.ErrRepositoryNotFound, repo)
+	case http.StatusGone:
+		return fmt.Errorf("%w: %s", registry.ErrRepositoryGone, repo)
+	}
+	return transport.CheckError(resp, http.StatusOK)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestManager_Probe(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "tok"}`))
+		case "/v2/":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name       string
+		password   string
+		wantReason string
+	}{
+		{
+			name:     "token accepted",
+			password: "pass",
+		},
+		{
+			name:       "credentials refused",
+			password:   "wrong",
+			wantReason: registry.AuthenticationFailedReason,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			opts := ProviderOptions{
+				PullSecrets: []corev1.Secret{testPullSecret("creds", `{"auths": {"`+host+`": {"username": "user", "password": "`+tt.password+`"}}}`)},
+			}
+			err := NewManager().Probe(context.TODO(), host, opts)
+			if tt.wantReason != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(registry.ReasonFor(err)).To(Equal(tt.wantReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestManager_ValidateAccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/bar/tags/list":
+			w.Write([]byte(`{"name": "foo/bar", "tags": ["v1.0.0"]}`))
+		case "/v2/foo/deleted/tags/list":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": [{"code": "NAME_UNKNOWN", "message": "repository name not known to registry"}]}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name    string
+		image   string
+		opts    ProviderOptions
+		wantErr error
+	}{
+		{
+			name:  "readable repository",
+			image: host + "/foo/bar",
+			opts:  testTagsOptions(host),
+		},
+		{
+			name:    "deleted repository",
+			image:   host + "/foo/deleted",
+			opts:    testTagsOptions(host),
+			wantErr: registry.ErrRepositoryGone,
+		},
+		{
+			name:    "unknown repository",
+			image:   host + "/foo/unknown",
+			opts:    testTagsOptions(host),
+			wantErr: registry.ErrRepositoryNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ref, err := name.ParseReference(tt.image, name.Insecure)
+			g.Expect(err).ToNot(HaveOccurred())
+			err = NewManager().ValidateAccess(context.TODO(), ref, tt.opts)
+			if tt.wantErr != nil {
+				g.Expect(errors.Is(err, tt.wantErr)).To(BeTrue(), fmt.Sprint(err))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+
+	// Without credentials, the repository can't be read.
+	ref, err := name.ParseReference(host+"/foo/bar", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewManager().ValidateAccess(context.TODO(), ref, ProviderOptions{}); registry.ReasonFor(err) != registry.AuthenticationFailedReason {
+		t.Errorf("expected an authentication failure, got %v", err)
+	}
+}
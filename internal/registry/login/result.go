@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// minHintLength is the minimum length of a secret for its last
+// characters to be shown as a hint; shorter secrets are fully masked.
+const minHintLength = 16
+
+// hintLength is the number of trailing characters of a secret shown as
+// a hint.
+const hintLength = 4
+
+// pullSecretSource is the credential source of logins done with
+// credentials from image pull secrets.
+const pullSecretSource = "pull-secret"
+
+// embeddedCredentialsSource is the credential source of logins done
+// with the credentials embedded in the image, as in
+// `user:pass@registry.example.com/foo:v1`.
+const embeddedCredentialsSource = "embedded-credentials"
+
+// credentialStoreSource is the credential source of logins done with
+// credentials from the credential store of the Manager.
+const credentialStoreSource = "credential-store"
+
+// LoginResult holds the outcome of a login.
+type LoginResult struct {
+	// Provider is the provider the image was logged into with, or
+	// registry.ProviderGeneric if no provider login happened.
+	Provider registry.Provider
+	// Authenticator is the resolved Authenticator, nil if the
+	// registry is to be accessed anonymously.
+	Authenticator authn.Authenticator
+	// CredentialSource tells where the credentials come from: for a
+	// provider login, which link of the provider's credential chain
+	// supplied them (e.g. "env", "managed-identity", "web-identity");
+	// "embedded-credentials" for those embedded in the image of a
+	// generic registry; "pull-secret" for credentials from image pull
+	// secrets; "exec-plugin" for those resolved by the exec plugin of
+	// the options; "kubelet-credential-provider" for those given by the
+	// kubelet credential provider of the options; "credential-store"
+	// for those from the store of the Manager. It is empty for
+	// anonymous access.
+	CredentialSource string
+	// RawResponse is the last response received from the provider
+	// during its login, status line then body, with what looks like
+	// secret content redacted. It is only set with the
+	// CaptureRawResponse option, and empty when the login made no
+	// request, e.g. when its credentials were cached.
+	RawResponse string
+	// Partition is the ID of the AWS partition of an AWS login, e.g.
+	// "aws" or "aws-us-gov", empty for the other providers or when the
+	// region isn't known to be one of those of the known partitions.
+	Partition string
+	// Err is the error of the login of the image in a LoginBatch, in
+	// which the other fields are unset. It is always nil for results
+	// returned with their own error, e.g. by Resolve.
+	Err error
+}
+
+// MaskedSummary describes the resolved credentials for status and
+// logs, e.g. "provider=aws source=env username=AWS password=****wxyz".
+// The secret part of the credentials is masked: at most its last four
+// characters are shown, and only when it is long enough that they
+// don't give much of it away.
+func (r LoginResult) MaskedSummary() string {
+	summary := "provider=" + r.Provider.String()
+	if r.CredentialSource != "" {
+		summary += " source=" + r.CredentialSource
+	}
+	if r.Authenticator == nil || r.Authenticator == authn.Anonymous {
+		return summary + " anonymous"
+	}
+	authConfig, err := r.Authenticator.Authorization()
+	if err != nil {
+		return summary + " credentials unavailable"
+	}
+
+	switch {
+	case authConfig.Username != "" || authConfig.Password != "":
+		summary += fmt.Sprintf(" username=%s password=%s", authConfig.Username, mask(authConfig.Password))
+	case authConfig.RegistryToken != "":
+		summary += " token=" + mask(authConfig.RegistryToken)
+	case authConfig.IdentityToken != "":
+		summary += " identity-token=" + mask(authConfig.IdentityToken)
+	case authConfig.Auth != "":
+		summary += " auth=" + mask(authConfig.Auth)
+	}
+	return summary
+}
+
+// DockerConfigJSON returns the resolved credentials as the content of
+// a Docker config file, as found in the `.dockerconfigjson` key of
+// image pull secrets, with an entry for the given host. Basic
+// credentials also populate the `auth` field, which some readers
+// require; registry and identity tokens go in their own fields. An
+// error is returned for anonymous access.
+func (r LoginResult) DockerConfigJSON(host string) ([]byte, error) {
+	if r.Authenticator == nil || r.Authenticator == authn.Anonymous {
+		return nil, errors.New("no credentials to write for anonymous access")
+	}
+	authConfig, err := r.Authenticator.Authorization()
+	if err != nil {
+		return nil, err
+	}
+	if authConfig.Auth == "" && (authConfig.Username != "" || authConfig.Password != "") {
+		authConfig.Auth = base64.StdEncoding.EncodeToString([]byte(authConfig.Username + ":" + authConfig.Password))
+	}
+	return json.Marshal(map[string]map[string]*authn.AuthConfig{
+		"auths": {host: authConfig},
+	})
+}
+
+// mask hides a secret, keeping its last characters as a hint if it is
+// long enough.
+func mask(secret string) string {
+	if len(secret) < minHintLength {
+		return "****"
+	}
+	return "****" + secret[len(secret)-hintLength:]
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestLoginResult_MaskedSummary(t *testing.T) {
+	const longSecret = "eyJwYXlsb2FkIjoic2VjcmV0LXN0dWZmIn0"
+
+	tests := []struct {
+		name        string
+		result      LoginResult
+		want        string
+		wantNoLeaks []string
+	}{
+		{
+			name:   "anonymous",
+			result: LoginResult{Provider: registry.ProviderGeneric},
+			want:   "provider=generic anonymous",
+		},
+		{
+			name: "long password",
+			result: LoginResult{
+				Provider:         registry.ProviderAWS,
+				Authenticator:    authn.FromConfig(authn.AuthConfig{Username: "AWS", Password: longSecret}),
+				CredentialSource: "web-identity",
+			},
+			want:        "provider=aws source=web-identity username=AWS password=****mIn0",
+			wantNoLeaks: []string{longSecret[:len(longSecret)-4]},
+		},
+		{
+			name: "short password",
+			result: LoginResult{
+				Provider:      registry.ProviderGCP,
+				Authenticator: authn.FromConfig(authn.AuthConfig{Username: "oauth2accesstoken", Password: "hunter2"}),
+			},
+			want:        "provider=gcp username=oauth2accesstoken password=****",
+			wantNoLeaks: []string{"hunter2", "er2"},
+		},
+		{
+			name: "registry token",
+			result: LoginResult{
+				Provider:      registry.ProviderAzure,
+				Authenticator: authn.FromConfig(authn.AuthConfig{RegistryToken: longSecret}),
+			},
+			want:        "provider=azure token=****mIn0",
+			wantNoLeaks: []string{longSecret[:len(longSecret)-4]},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			summary := tt.result.MaskedSummary()
+			g.Expect(summary).To(Equal(tt.want))
+			for _, leak := range tt.wantNoLeaks {
+				g.Expect(summary).ToNot(ContainSubstring(leak))
+			}
+		})
+	}
+}
+
+func TestLoginResult_DockerConfigJSON(t *testing.T) {
+	const host = "012345678901.dkr.ecr.us-east-1.amazonaws.com"
+
+	tests := []struct {
+		name       string
+		authConfig authn.AuthConfig
+		want       authn.AuthConfig
+	}{
+		{
+			name:       "basic credentials",
+			authConfig: authn.AuthConfig{Username: "AWS", Password: "secret"},
+			want:       authn.AuthConfig{Username: "AWS", Password: "secret"},
+		},
+		{
+			name:       "registry token",
+			authConfig: authn.AuthConfig{RegistryToken: "token"},
+			want:       authn.AuthConfig{RegistryToken: "token"},
+		},
+		{
+			name:       "identity token",
+			authConfig: authn.AuthConfig{Username: "00000000-0000-0000-0000-000000000000", IdentityToken: "refresh"},
+			want:       authn.AuthConfig{Username: "00000000-0000-0000-0000-000000000000", IdentityToken: "refresh"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			result := LoginResult{Authenticator: authn.FromConfig(tt.authConfig)}
+			config, err := result.DockerConfigJSON(host)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			dir := t.TempDir()
+			g.Expect(os.WriteFile(filepath.Join(dir, "config.json"), config, 0o600)).To(Succeed())
+			t.Setenv("DOCKER_CONFIG", dir)
+
+			repo, err := name.NewRepository(host + "/foo")
+			g.Expect(err).ToNot(HaveOccurred())
+			auth, err := authn.DefaultKeychain.Resolve(repo)
+			g.Expect(err).ToNot(HaveOccurred())
+			got, err := auth.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestLoginResult_DockerConfigJSONAnonymous(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := LoginResult{}.DockerConfigJSON("ghcr.io")
+	g.Expect(err).To(HaveOccurred())
+	_, err = LoginResult{Authenticator: authn.Anonymous}.DockerConfigJSON("ghcr.io")
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/authn/k8schain"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type dockerConfig struct {
+	Auths map[string]authn.AuthConfig
+}
+
+// AuthConfigsFromSecret returns the credentials in a
+// `kubernetes.io/dockerconfigjson` secret, keyed by registry host. If
+// the secret doesn't have the right format or data, it returns an
+// error.
+func AuthConfigsFromSecret(secret corev1.Secret) (map[string]authn.AuthConfig, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var dockerconfig dockerConfig
+		configData := secret.Data[corev1.DockerConfigJsonKey]
+		if err := json.NewDecoder(bytes.NewBuffer(configData)).Decode(&dockerconfig); err != nil {
+			return nil, err
+		}
+		return parseAuthMap(dockerconfig)
+	default:
+		return nil, fmt.Errorf("unknown secret type %q", secret.Type)
+	}
+}
+
+// KeychainFromSecrets returns a keychain with the credentials of the
+// given image pull secrets. The `kubernetes.io/dockerconfigjson`
+// secrets are merged into one, by registry host, with later secrets
+// overriding earlier ones for the same host. Secrets of other types
+// are passed along as they are.
+func KeychainFromSecrets(ctx context.Context, secrets []corev1.Secret) (authn.Keychain, error) {
+	merged := map[string]authn.AuthConfig{}
+	var others []corev1.Secret
+	for _, secret := range secrets {
+		if secret.Type != corev1.SecretTypeDockerConfigJson {
+			others = append(others, secret)
+			continue
+		}
+		authMap, err := AuthConfigsFromSecret(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image pull secret '%s': %w", secret.GetName(), err)
+		}
+		for host, auth := range authMap {
+			merged[host] = auth
+		}
+	}
+
+	configData, err := json.Marshal(dockerConfig{Auths: merged})
+	if err != nil {
+		return nil, err
+	}
+	mergedSecret := corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: configData,
+		},
+	}
+	return k8schain.NewFromPullSecrets(ctx, append([]corev1.Secret{mergedSecret}, others...))
+}
+
+func parseAuthMap(config dockerConfig) (map[string]authn.AuthConfig, error) {
+	auth := map[string]authn.AuthConfig{}
+	for url, entry := range config.Auths {
+		host, err := getURLHost(url)
+		if err != nil {
+			return nil, err
+		}
+
+		auth[host] = entry
+	}
+
+	return auth, nil
+}
+
+func getURLHost(urlStr string) (string, error) {
+	if urlStr == "http://" || urlStr == "https://" {
+		return "", errors.New("Empty url")
+	}
+
+	// ensure url has https:// or http:// prefix
+	// url.Parse won't parse the ip:port format very well without the prefix.
+	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
+		urlStr = fmt.Sprintf("https://%s/", urlStr)
+	}
+
+	// Some users were passing in credentials in the form of
+	// http://docker.io and http://docker.io/v1/, etc.
+	// So strip everything down to the host.
+	// Also, the registry might be local and on a different port.
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Host == "" {
+		return "", errors.New(fmt.Sprintf(
+			"Invalid registry auth key: %s. Expected an HTTPS URL (e.g. 'https://index.docker.io/v2/' or 'https://index.docker.io'), or the same without the 'https://' (e.g., 'index.docker.io/v2/' or 'index.docker.io')",
+			urlStr))
+	}
+
+	return u.Host, nil
+}
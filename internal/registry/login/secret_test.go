@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPullSecret(name, config string) corev1.Secret {
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(config),
+		},
+	}
+}
+
+func TestKeychainFromSecrets(t *testing.T) {
+	g := NewWithT(t)
+
+	first := testPullSecret("first", `{"auths": {
+	"https://index.docker.io/v1/": {"username": "hub-user", "password": "hub-pass"},
+	"registry.example.com": {"username": "old-user", "password": "old-pass"}
+}}`)
+	second := testPullSecret("second", `{"auths": {
+	"ghcr.io": {"username": "gh-user", "password": "gh-pass"},
+	"https://registry.example.com/v2/": {"username": "new-user", "password": "new-pass"}
+}}`)
+
+	keychain, err := KeychainFromSecrets(context.TODO(), []corev1.Secret{first, second})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		image        string
+		wantUsername string
+		wantPassword string
+	}{
+		{image: "stefanprodan/podinfo", wantUsername: "hub-user", wantPassword: "hub-pass"},
+		{image: "ghcr.io/foo/bar", wantUsername: "gh-user", wantPassword: "gh-pass"},
+		// The later secret overrides the earlier one for the same host.
+		{image: "registry.example.com/foo/bar", wantUsername: "new-user", wantPassword: "new-pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			g := NewWithT(t)
+
+			repo, err := name.NewRepository(tt.image)
+			g.Expect(err).ToNot(HaveOccurred())
+			auth, err := keychain.Resolve(repo)
+			g.Expect(err).ToNot(HaveOccurred())
+			authConfig, err := auth.Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(authConfig.Username).To(Equal(tt.wantUsername))
+			g.Expect(authConfig.Password).To(Equal(tt.wantPassword))
+		})
+	}
+
+	repo, err := name.NewRepository("quay.io/foo/bar")
+	g.Expect(err).ToNot(HaveOccurred())
+	auth, err := keychain.Resolve(repo)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).To(Equal(authn.Anonymous))
+}
+
+func TestKeychainFromSecrets_InvalidSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := KeychainFromSecrets(context.TODO(), []corev1.Secret{testPullSecret("invalid", `{`)})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("invalid"))
+}
+
+func TestManager_LoginWithPullSecrets(t *testing.T) {
+	g := NewWithT(t)
+
+	secrets := []corev1.Secret{
+		testPullSecret("first", `{"auths": {"registry.example.com": {"username": "old-user", "password": "old-pass"}}}`),
+		testPullSecret("second", `{"auths": {"registry.example.com": {"username": "new-user", "password": "new-pass"}}}`),
+	}
+
+	image := "registry.example.com/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	auth, err := NewManager().Login(context.TODO(), image, ref, ProviderOptions{PullSecrets: secrets})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).ToNot(BeNil())
+	authConfig, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authConfig.Username).To(Equal("new-user"))
+	g.Expect(authConfig.Password).To(Equal("new-pass"))
+
+	// Without credentials for the host, the generic provider is no-op.
+	otherRef, err := name.ParseReference("ghcr.io/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	auth, err = NewManager().Login(context.TODO(), "ghcr.io/foo/bar:v1", otherRef, ProviderOptions{PullSecrets: secrets})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).To(BeNil())
+}
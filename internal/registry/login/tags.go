@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ListTagsOptions filters the tags returned by ListTags.
+type ListTagsOptions struct {
+	// IncludeRegex, when set, keeps only the tags matching it.
+	IncludeRegex string
+	// ExcludeRegex, when set, drops the tags matching it.
+	ExcludeRegex string
+	// Limit, when positive, is the maximum number of tags returned,
+	// counted after filtering.
+	Limit int
+	// PostProcess, when set, is given the tags once filtered and
+	// limited, and returns those ListTags returns, e.g. sorted or
+	// deduplicated. It runs last, and may modify the slice it is given.
+	PostProcess func([]string) []string
+}
+
+// tagFilter is the compiled form of ListTagsOptions.
+type tagFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	limit   int
+	post    func([]string) []string
+}
+
+// compile returns the filter for the options, or an error if either
+// regex is invalid.
+func (o ListTagsOptions) compile() (*tagFilter, error) {
+	f := &tagFilter{limit: o.Limit, post: o.PostProcess}
+	var err error
+	if o.IncludeRegex != "" {
+		if f.include, err = regexp.Compile(o.IncludeRegex); err != nil {
+			return nil, fmt.Errorf("failed to compile include regex %s: %w", o.IncludeRegex, err)
+		}
+	}
+	if o.ExcludeRegex != "" {
+		if f.exclude, err = regexp.Compile(o.ExcludeRegex); err != nil {
+			return nil, fmt.Errorf("failed to compile exclude regex %s: %w", o.ExcludeRegex, err)
+		}
+	}
+	return f, nil
+}
+
+// apply returns the tags kept by the filter, in order, then
+// post-processed if the filter has a post-processor.
+func (f *tagFilter) apply(tags []string) []string {
+	filtered := []string{}
+	for _, tag := range tags {
+		if f.limit > 0 && len(filtered) == f.limit {
+			break
+		}
+		if f.include != nil && !f.include.MatchString(tag) {
+			continue
+		}
+		if f.exclude != nil && f.exclude.MatchString(tag) {
+			continue
+		}
+		filtered = append(filtered, tag)
+	}
+	if f.post != nil {
+		return f.post(filtered)
+	}
+	return filtered
+}
+
+// ListTags logs into the registry hosting the image, the same as Login,
+// and lists the tags of its repository with the resolved credentials,
+// filtered and post-processed according to listOpts. The requests are made with the
+// context, so that its deadline bounds the whole operation, and through
+// the transport it carries, if any, honoring the realm override of the
+// options. Invalid regexes in listOpts are
+// reported before any request is made.
+func (m *Manager) ListTags(ctx context.Context, image string, ref name.Reference, opts ProviderOptions, listOpts ListTagsOptions) ([]string, error) {
+	filter, err := listOpts.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := m.Login(ctx, image, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := m.registryBase(ctx, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	options := []remote.Option{remote.WithContext(ctx)}
+	if auth != nil {
+		options = append(options, remote.WithAuth(auth))
+	}
+	if rt != nil {
+		options = append(options, remote.WithTransport(rt))
+	}
+	tags, err := remote.List(ref.Context(), options...)
+	if err != nil {
+		return nil, err
+	}
+	return filter.apply(tags), nil
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/fluxcd/image-reflector-controller/internal/test"
+)
+
+// fakeTagsRegistry serves the given tags for the repository foo/bar to
+// clients authenticating as user:pass, after the given delay.
+func fakeTagsRegistry(t *testing.T, tags string, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/bar/tags/list":
+			w.Write([]byte(`{"name": "foo/bar", "tags": ` + tags + `}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testTagsOptions returns options with a pull secret holding the
+// credentials of the fake registry at host.
+func testTagsOptions(host string) ProviderOptions {
+	return ProviderOptions{
+		PullSecrets: []corev1.Secret{{
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"` + host + `": {"username": "user", "password": "pass"}}}`),
+			},
+		}},
+	}
+}
+
+func TestManager_ListTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := fakeTagsRegistry(t, `["v1.0.0", "v1.1.0", "latest"]`, 0)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar"
+	ref, err := name.ParseReference(image, name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := NewManager().ListTags(context.TODO(), image, ref, testTagsOptions(host), ListTagsOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"v1.0.0", "v1.1.0", "latest"}))
+
+	// Without credentials, listing is refused.
+	_, err = NewManager().ListTags(context.TODO(), image, ref, ProviderOptions{}, ListTagsOptions{})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestManager_ListTagsAnonymousToken(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := test.NewAnonymousTokenRegistryServer()
+	t.Cleanup(srv.Close)
+	image := test.RegistryName(srv) + "/convenient"
+	ref, err := name.ParseReference(image, name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := NewManager().ListTags(context.TODO(), image, ref, ProviderOptions{}, ListTagsOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"tag1", "tag2"}))
+}
+
+func TestManager_ListTagsTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := fakeTagsRegistry(t, `["v1.0.0"]`, 500*time.Millisecond)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar"
+	ref, err := name.ParseReference(image, name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	_, err = NewManager().ListTags(ctx, image, ref, testTagsOptions(host), ListTagsOptions{})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring(context.DeadlineExceeded.Error()))
+}
+
+func TestManager_ListTagsFiltered(t *testing.T) {
+	srv := fakeTagsRegistry(t, `["v1.0.0", "v1.1.0", "v1.1.0-rc.1", "v2.0.0", "latest", "sha256-abc.sig"]`, 0)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar"
+	ref, err := name.ParseReference(image, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		listOpts ListTagsOptions
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "include only",
+			listOpts: ListTagsOptions{IncludeRegex: `^v1\.`},
+			want:     []string{"v1.0.0", "v1.1.0", "v1.1.0-rc.1"},
+		},
+		{
+			name:     "exclude only",
+			listOpts: ListTagsOptions{ExcludeRegex: `^.*\.sig$`},
+			want:     []string{"v1.0.0", "v1.1.0", "v1.1.0-rc.1", "v2.0.0", "latest"},
+		},
+		{
+			name:     "include and exclude",
+			listOpts: ListTagsOptions{IncludeRegex: `^v`, ExcludeRegex: `-rc`},
+			want:     []string{"v1.0.0", "v1.1.0", "v2.0.0"},
+		},
+		{
+			name:     "limit after filtering",
+			listOpts: ListTagsOptions{IncludeRegex: `^v`, ExcludeRegex: `^v1\.0`, Limit: 2},
+			want:     []string{"v1.1.0", "v1.1.0-rc.1"},
+		},
+		{
+			name:     "no match",
+			listOpts: ListTagsOptions{IncludeRegex: `^v3`},
+			want:     []string{},
+		},
+		{
+			name:     "invalid include regex",
+			listOpts: ListTagsOptions{IncludeRegex: `v(`},
+			wantErr:  "failed to compile include regex v(",
+		},
+		{
+			name:     "invalid exclude regex",
+			listOpts: ListTagsOptions{ExcludeRegex: `[`},
+			wantErr:  "failed to compile exclude regex [",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			tags, err := NewManager().ListTags(context.TODO(), image, ref, testTagsOptions(host), tt.listOpts)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(tags).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestManager_ListTagsPostProcess(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := fakeTagsRegistry(t, `["v2", "v1", "v2", "v10", "v1", "latest"]`, 0)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/foo/bar"
+	ref, err := name.ParseReference(image, name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var given []string
+	sortAndDedupe := func(tags []string) []string {
+		given = append([]string(nil), tags...)
+		sort.Strings(tags)
+		deduped := tags[:0]
+		for i, tag := range tags {
+			if i == 0 || tag != tags[i-1] {
+				deduped = append(deduped, tag)
+			}
+		}
+		return deduped
+	}
+
+	tags, err := NewManager().ListTags(context.TODO(), image, ref, testTagsOptions(host), ListTagsOptions{
+		ExcludeRegex: `^latest$`,
+		PostProcess:  sortAndDedupe,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"v1", "v10", "v2"}))
+	// The post-processor runs on the filtered tags.
+	g.Expect(given).To(Equal([]string{"v2", "v1", "v2", "v10", "v1"}))
+}
+
+func TestManager_ListTagsBearerRealm(t *testing.T) {
+	var tokenRequests int
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		w.Write([]byte(`{"token": "tok"}`))
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	tests := []struct {
+		name          string
+		realm         string
+		overrideRealm string
+		wantErr       bool
+	}{
+		{
+			name:  "realm on another host",
+			realm: tokenSrv.URL + "/token",
+		},
+		{
+			name:          "unreachable realm overridden",
+			realm:         "http://upstream.invalid/token",
+			overrideRealm: tokenSrv.URL + "/token",
+		},
+		{
+			name:    "unreachable realm",
+			realm:   "http://upstream.invalid/token",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			tokenRequests = 0
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer tok" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+tt.realm+`",service="registry.example.com"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"name": "foo/bar", "tags": ["v1.0.0"]}`))
+			}))
+			defer srv.Close()
+
+			image := strings.TrimPrefix(srv.URL, "http://") + "/foo/bar"
+			ref, err := name.ParseReference(image, name.Insecure)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			tags, err := NewManager().ListTags(context.TODO(), image, ref,
+				ProviderOptions{OverrideRealm: tt.overrideRealm}, ListTagsOptions{})
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(tokenRequests).To(BeZero())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(tags).To(Equal([]string{"v1.0.0"}))
+			g.Expect(tokenRequests).To(Equal(1))
+		})
+	}
+}
+
+func TestManager_ListTagsTrustForwardedRealm(t *testing.T) {
+	// The proxy answers token requests for the realm announced by the
+	// registry behind it; the registry answers them on its own host.
+	var proxyTokenRequests, registryTokenRequests int
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyTokenRequests++
+		w.Write([]byte(`{"token": "tok"}`))
+	}))
+	t.Cleanup(proxySrv.Close)
+
+	trust, distrust := true, false
+	tests := []struct {
+		name                 string
+		trust                *bool
+		wantProxyRequests    int
+		wantRegistryRequests int
+	}{
+		{
+			name:              "realm followed by default",
+			wantProxyRequests: 1,
+		},
+		{
+			name:              "realm trusted",
+			trust:             &trust,
+			wantProxyRequests: 1,
+		},
+		{
+			name:                 "realm rewritten to the registry host",
+			trust:                &distrust,
+			wantRegistryRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			proxyTokenRequests, registryTokenRequests = 0, 0
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/token" {
+					registryTokenRequests++
+					w.Write([]byte(`{"token": "tok"}`))
+					return
+				}
+				if r.Header.Get("Authorization") != "Bearer tok" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+proxySrv.URL+`/token",service="registry.example.com"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"name": "foo/bar", "tags": ["v1.0.0"]}`))
+			}))
+			defer srv.Close()
+
+			image := strings.TrimPrefix(srv.URL, "http://") + "/foo/bar"
+			ref, err := name.ParseReference(image, name.Insecure)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			tags, err := NewManager().ListTags(context.TODO(), image, ref,
+				ProviderOptions{TrustForwardedRealm: tt.trust}, ListTagsOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(tags).To(Equal([]string{"v1.0.0"}))
+			g.Expect(proxyTokenRequests).To(Equal(tt.wantProxyRequests))
+			g.Expect(registryTokenRequests).To(Equal(tt.wantRegistryRequests))
+		})
+	}
+}
+
+func TestManager_ListTagsExtraHeaders(t *testing.T) {
+	g := NewWithT(t)
+
+	var tokenTenants, apiTenants []string
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenTenants = append(tokenTenants, r.Header.Get("X-Meta-Tenant"))
+		w.Write([]byte(`{"token": "tok"}`))
+	}))
+	defer tokenSrv.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiTenants = append(apiTenants, r.Header.Get("X-Meta-Tenant"))
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenSrv.URL+`/token",service="registry.example.com"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"name": "foo/bar", "tags": ["v1.0.0"]}`))
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/foo/bar"
+	ref, err := name.ParseReference(image, name.Insecure)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := NewManager().ListTags(context.TODO(), image, ref, ProviderOptions{
+		ExtraHeaders: map[string]string{
+			"X-Meta-Tenant": "team-a",
+			// Not applied over the bearer token.
+			"Authorization": "Basic Zm9vOmJhcg==",
+		},
+	}, ListTagsOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"v1.0.0"}))
+	g.Expect(tokenTenants).To(ConsistOf("team-a"))
+	g.Expect(apiTenants).ToNot(BeEmpty())
+	for _, tenant := range apiTenants {
+		g.Expect(tenant).To(Equal("team-a"))
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+// tlsTransportKey identifies a clone of a base transport with a
+// minimum TLS version.
+type tlsTransportKey struct {
+	base    *http.Transport
+	version uint16
+}
+
+// tlsMinVersionFor returns the minimum TLS version of the connections
+// to the host, zero if the options set none.
+func (o ProviderOptions) tlsMinVersionFor(host string) uint16 {
+	if version, ok := o.TLSMinVersionByHost[host]; ok {
+		return version
+	}
+	return o.TLSMinVersion
+}
+
+// registryBase returns the transport for the requests to the registry
+// of ref, built on the one carried by ctx, if any: with the minimum TLS
+// version, the User-Agent, HTTP/1.1 only if forced and the wrappers of
+// the options. It is nil
+// if there is nothing to build on the default transport.
+func (m *Manager) registryBase(ctx context.Context, ref name.Reference, opts ProviderOptions) (http.RoundTripper, error) {
+	if version := opts.tlsMinVersionFor(ref.Context().RegistryStr()); version != 0 {
+		rt, err := m.withTLSMinVersion(registry.TransportFromContext(ctx), version)
+		if err != nil {
+			return nil, err
+		}
+		ctx = registry.ContextWithTransport(ctx, rt)
+	}
+	return opts.registryTransport(registry.TransportFor(m.withClientOptions(ctx, opts), nil)), nil
+}
+
+// withTLSMinVersion returns a clone of the transport, nil meaning
+// http.DefaultTransport, with the given minimum TLS version. The clones
+// are kept, to be reused for the same transport and version.
+func (m *Manager) withTLSMinVersion(rt http.RoundTripper, version uint16) (http.RoundTripper, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	base, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("cannot set the minimum TLS version of a transport of type %T", rt)
+	}
+	key := tlsTransportKey{base: base, version: version}
+	if t, ok := m.tlsTransports.Load(key); ok {
+		return t.(*http.Transport), nil
+	}
+	t := base.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.MinVersion = version
+	actual, _ := m.tlsTransports.LoadOrStore(key, t)
+	return actual.(*http.Transport), nil
+}
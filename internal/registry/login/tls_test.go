@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+)
+
+func TestManager_ListTagsTLSMinVersion(t *testing.T) {
+	// The registry only speaks TLS 1.2. Since it is on localhost, the
+	// client falls back to plain HTTP when the handshake fails, which
+	// fails as well.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/foo/bar/tags/list":
+			w.Write([]byte(`{"name": "foo/bar", "tags": ["v1.0.0"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	image := host + "/foo/bar"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		opts      ProviderOptions
+		wantErr   bool
+		errMsg    string
+	}{
+		{
+			name:      "Go default",
+			transport: srv.Client().Transport,
+		},
+		{
+			name:      "minimum version above that of the registry",
+			transport: srv.Client().Transport,
+			opts:      ProviderOptions{TLSMinVersion: tls.VersionTLS13},
+			wantErr:   true,
+		},
+		{
+			name:      "host override",
+			transport: srv.Client().Transport,
+			opts: ProviderOptions{
+				TLSMinVersion:       tls.VersionTLS13,
+				TLSMinVersionByHost: map[string]uint16{host: tls.VersionTLS12},
+			},
+		},
+		{
+			name:      "override of another host",
+			transport: srv.Client().Transport,
+			opts: ProviderOptions{
+				TLSMinVersion:       tls.VersionTLS13,
+				TLSMinVersionByHost: map[string]uint16{"legacy.example.com": tls.VersionTLS12},
+			},
+			wantErr: true,
+		},
+		{
+			name:      "unsupported base transport",
+			transport: registry.TransportChain(registry.UserAgent("test"))(srv.Client().Transport),
+			opts:      ProviderOptions{TLSMinVersion: tls.VersionTLS12},
+			wantErr:   true,
+			errMsg:    "cannot set the minimum TLS version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			ctx := registry.ContextWithTransport(context.TODO(), tt.transport)
+			tags, err := NewManager().ListTags(ctx, image, ref, tt.opts, ListTagsOptions{})
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.errMsg))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(tags).To(Equal([]string{"v1.0.0"}))
+		})
+	}
+}
+
+func TestManager_withTLSMinVersion(t *testing.T) {
+	g := NewWithT(t)
+
+	base := &http.Transport{TLSClientConfig: &tls.Config{ServerName: "registry.example.com"}}
+	mgr := NewManager()
+
+	rt, err := mgr.withTLSMinVersion(base, tls.VersionTLS13)
+	g.Expect(err).ToNot(HaveOccurred())
+	t13 := rt.(*http.Transport)
+	g.Expect(t13).ToNot(BeIdenticalTo(base))
+	g.Expect(t13.TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+	g.Expect(t13.TLSClientConfig.ServerName).To(Equal("registry.example.com"))
+	// The base transport is left alone.
+	g.Expect(base.TLSClientConfig.MinVersion).To(BeZero())
+
+	// The clones are reused.
+	rt, err = mgr.withTLSMinVersion(base, tls.VersionTLS13)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(rt).To(BeIdenticalTo(t13))
+	rt, err = mgr.withTLSMinVersion(base, tls.VersionTLS12)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(rt).ToNot(BeIdenticalTo(t13))
+
+	// The default transport is cloned too.
+	rt, err = mgr.withTLSMinVersion(nil, tls.VersionTLS12)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(rt).ToNot(BeIdenticalTo(http.DefaultTransport))
+	g.Expect(rt.(*http.Transport).TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a map of entries which, when bounded, evicts the least
+// recently used entry to make room for a new one. It is safe for
+// concurrent use. The zero value is an unbounded, empty LRU.
+type LRU struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+	onRemove   func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// SetMaxEntries bounds the number of entries to n, evicting the least
+// recently used ones in excess. Zero or less means no bound.
+func (c *LRU) SetMaxEntries(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = n
+	c.evict()
+}
+
+// SetOnRemove sets a function called with each entry removed from the
+// LRU, whether deleted, pruned or evicted, but not with the values
+// replaced by Set. It is called with the LRU locked, and so must not
+// use the LRU.
+func (c *LRU) SetOnRemove(fn func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRemove = fn
+}
+
+// Get returns the value of the entry for the key, if any, and marks
+// the entry as the most recently used.
+func (c *LRU) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Set sets the value of the entry for the key, which becomes the most
+// recently used, evicting the least recently used entry if needed.
+func (c *LRU) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.order = list.New()
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	c.evict()
+}
+
+// Delete removes the entry for the key, if any.
+func (c *LRU) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Prune removes the entries whose value the function returns true for.
+func (c *LRU) Prune(fn func(value interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries {
+		if fn(elem.Value.(*lruEntry).value) {
+			c.remove(elem)
+		}
+	}
+}
+
+// Len returns the number of entries.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// evict removes the least recently used entries in excess of the
+// bound. It must be called with the lock held.
+func (c *LRU) evict() {
+	if c.maxEntries <= 0 || c.order == nil {
+		return
+	}
+	for len(c.entries) > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the entry of the element. It must be called with the
+// lock held.
+func (c *LRU) remove(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	if c.onRemove != nil {
+		c.onRemove(entry.key, entry.value)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestLRU(t *testing.T) {
+	g := NewWithT(t)
+
+	var c LRU
+	c.SetMaxEntries(3)
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	g.Expect(c.Len()).To(Equal(3))
+
+	// The oldest entry was evicted.
+	_, ok := c.Get("key-0")
+	g.Expect(ok).To(BeFalse())
+	value, ok := c.Get("key-1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(value).To(Equal(1))
+
+	// Getting key-1 made key-2 the least recently used entry.
+	c.Set("key-4", 4)
+	_, ok = c.Get("key-2")
+	g.Expect(ok).To(BeFalse())
+	_, ok = c.Get("key-1")
+	g.Expect(ok).To(BeTrue())
+
+	// Setting an existing entry doesn't evict any.
+	c.Set("key-3", 33)
+	g.Expect(c.Len()).To(Equal(3))
+	value, _ = c.Get("key-3")
+	g.Expect(value).To(Equal(33))
+
+	c.Delete("key-3")
+	g.Expect(c.Len()).To(Equal(2))
+
+	// Lowering the bound evicts the entries in excess.
+	c.SetMaxEntries(1)
+	g.Expect(c.Len()).To(Equal(1))
+	_, ok = c.Get("key-1")
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestLRU_Unbounded(t *testing.T) {
+	g := NewWithT(t)
+
+	var c LRU
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	g.Expect(c.Len()).To(Equal(100))
+}
+
+func TestLRU_OnRemove(t *testing.T) {
+	g := NewWithT(t)
+
+	var c LRU
+	var removed []string
+	c.SetOnRemove(func(key string, value interface{}) {
+		removed = append(removed, fmt.Sprintf("%s=%d", key, value))
+	})
+	c.SetMaxEntries(2)
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	g.Expect(removed).To(Equal([]string{"key-0=0", "key-1=1"}))
+
+	// Replacing a value doesn't remove the entry.
+	c.Set("key-3", 33)
+	g.Expect(removed).To(HaveLen(2))
+
+	c.Delete("key-2")
+	c.Delete("key-2")
+	g.Expect(removed).To(Equal([]string{"key-0=0", "key-1=1", "key-2=2"}))
+
+	c.SetMaxEntries(0)
+	c.Set("key-4", 4)
+	c.Set("key-5", 5)
+	c.Prune(func(value interface{}) bool { return value.(int) > 4 })
+	g.Expect(c.Len()).To(Equal(1))
+	g.Expect(removed).To(ConsistOf("key-0=0", "key-1=1", "key-2=2", "key-3=33", "key-5=5"))
+}
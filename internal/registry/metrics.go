@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CredentialExpiryMetrics is a Prometheus collector of the gauge
+// registry_credential_expiry_seconds{provider,host}, which reports the
+// seconds until the credentials last cached for each registry host
+// expire, so that operators can alert before they lapse. The gauge
+// goes negative once they have, until the cache drops them. It is
+// updated by the token caches of the providers when they cache, drop
+// or evict credentials, and is safe for concurrent use.
+type CredentialExpiryMetrics struct {
+	desc *prometheus.Desc
+	now  func() time.Time
+
+	mu       sync.Mutex
+	expiries map[credentialKey]time.Time
+}
+
+type credentialKey struct {
+	provider Provider
+	host     string
+}
+
+var _ prometheus.Collector = &CredentialExpiryMetrics{}
+
+// NewCredentialExpiryMetrics returns a collector without credentials,
+// to be registered in a metrics registry.
+func NewCredentialExpiryMetrics() *CredentialExpiryMetrics {
+	return &CredentialExpiryMetrics{
+		desc: prometheus.NewDesc(
+			"registry_credential_expiry_seconds",
+			"The number of seconds until the credentials cached for a registry host expire.",
+			[]string{"provider", "host"}, nil,
+		),
+		now:      time.Now,
+		expiries: map[credentialKey]time.Time{},
+	}
+}
+
+// RecordExpiry records that the credentials cached for the host by
+// the provider expire at the given time.
+func (m *CredentialExpiryMetrics) RecordExpiry(provider Provider, host string, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiries[credentialKey{provider: provider, host: host}] = expiresAt
+}
+
+// DeleteExpiry removes the expiry recorded for the host by the
+// provider, once the credentials expiring at the given time are no
+// longer cached. It is kept if other credentials have been recorded
+// for the host since, which another cache entry may hold.
+func (m *CredentialExpiryMetrics) DeleteExpiry(provider Provider, host string, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := credentialKey{provider: provider, host: host}
+	if recorded, ok := m.expiries[key]; ok && recorded.Equal(expiresAt) {
+		delete(m.expiries, key)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *CredentialExpiryMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.desc
+}
+
+// Collect implements prometheus.Collector, reporting the time left
+// until the credentials expire as of now.
+func (m *CredentialExpiryMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for key, expiresAt := range m.expiries {
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue,
+			expiresAt.Sub(now).Seconds(), key.provider.String(), key.host)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCredentialExpiryMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	m := NewCredentialExpiryMetrics()
+	m.now = func() time.Time { return now }
+
+	m.RecordExpiry(ProviderAWS, "012345678901.dkr.ecr.us-east-1.amazonaws.com", now.Add(12*time.Hour))
+	m.RecordExpiry(ProviderAzure, "foo.azurecr.io", now.Add(time.Hour))
+	g.Expect(testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP registry_credential_expiry_seconds The number of seconds until the credentials cached for a registry host expire.
+# TYPE registry_credential_expiry_seconds gauge
+registry_credential_expiry_seconds{host="012345678901.dkr.ecr.us-east-1.amazonaws.com",provider="aws"} 43200
+registry_credential_expiry_seconds{host="foo.azurecr.io",provider="azure"} 3600
+`))).To(Succeed())
+
+	// The gauge reflects the time left as the clock advances, and the
+	// latest credentials cached for a host.
+	now = now.Add(90 * time.Minute)
+	m.RecordExpiry(ProviderAWS, "012345678901.dkr.ecr.us-east-1.amazonaws.com", now.Add(12*time.Hour))
+	g.Expect(testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP registry_credential_expiry_seconds The number of seconds until the credentials cached for a registry host expire.
+# TYPE registry_credential_expiry_seconds gauge
+registry_credential_expiry_seconds{host="012345678901.dkr.ecr.us-east-1.amazonaws.com",provider="aws"} 43200
+registry_credential_expiry_seconds{host="foo.azurecr.io",provider="azure"} -1800
+`))).To(Succeed())
+}
+
+func TestCredentialExpiryMetrics_DeleteExpiry(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+	m := NewCredentialExpiryMetrics()
+	m.now = func() time.Time { return now }
+
+	m.RecordExpiry(ProviderGCP, "gcr.io", now.Add(time.Hour))
+	m.RecordExpiry(ProviderGCP, "gcr.io", now.Add(2*time.Hour))
+	m.RecordExpiry(ProviderAzure, "foo.azurecr.io", now.Add(time.Hour))
+
+	// The credentials expiring first were replaced by later ones, which
+	// are still reported.
+	m.DeleteExpiry(ProviderGCP, "gcr.io", now.Add(time.Hour))
+	m.DeleteExpiry(ProviderAzure, "foo.azurecr.io", now.Add(time.Hour))
+	g.Expect(testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP registry_credential_expiry_seconds The number of seconds until the credentials cached for a registry host expire.
+# TYPE registry_credential_expiry_seconds gauge
+registry_credential_expiry_seconds{host="gcr.io",provider="gcp"} 7200
+`))).To(Succeed())
+
+	m.DeleteExpiry(ProviderGCP, "gcr.io", now.Add(2*time.Hour))
+	g.Expect(testutil.CollectAndCount(m)).To(BeZero())
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ProbeOptions contains options for probing a registry host.
+type ProbeOptions struct {
+	// Insecure makes the probe use plain HTTP instead of HTTPS.
+	Insecure bool
+}
+
+// RequiresAuth probes the `/v2/` endpoint of the registry host and
+// returns whether it requires authentication, that is whether it
+// answers 401 rather than 200. Any other response is an error. The
+// request goes through the transport carried by ctx, if any.
+func RequiresAuth(ctx context.Context, host string, opts ProbeOptions) (bool, error) {
+	scheme := "https"
+	if opts.Insecure {
+		scheme = "http"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+host+"/v2/", nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := (&http.Client{Transport: TransportFor(ctx, nil)}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusUnauthorized:
+		return true, nil
+	}
+	return false, fmt.Errorf("unexpected status code %d probing %s", resp.StatusCode, host)
+}
+
+// AnonymousPullAllowed returns whether the repository can be read
+// without credentials, by listing its tags anonymously. Registries
+// answering with a bearer challenge, as Docker Hub and Quay do even
+// for public repositories, are asked for an anonymous token first.
+// The scheme is chosen as go-containerregistry does, and the requests
+// go through the transport carried by ctx, if any.
+func AnonymousPullAllowed(ctx context.Context, repo name.Repository) (bool, error) {
+	base := TransportFor(ctx, http.DefaultTransport)
+	rt, err := transport.NewWithContext(ctx, repo.Registry, authn.Anonymous, base, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return false, err
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/tags/list", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr())
+	resp, err := probe(ctx, &http.Client{Transport: rt}, http.MethodGet, url)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code %d listing the tags of %s", resp.StatusCode, repo)
+}
+
+// HostCapabilities describes the API features a registry host
+// advertises.
+type HostCapabilities struct {
+	// APIVersion is the value of the Docker-Distribution-API-Version
+	// header, e.g. "registry/2.0".
+	APIVersion string
+	// Extensions lists the API extensions advertised in the
+	// OCI-Extensions headers.
+	Extensions []string
+	// AllowedMethods lists the methods in the Allow header of the
+	// OPTIONS response.
+	AllowedMethods []string
+	// Referrers is true if the referrers API extension is advertised.
+	Referrers bool
+	// ChunkedUpload is true if PATCH is allowed, which chunked blob
+	// uploads rely on.
+	ChunkedUpload bool
+}
+
+// Capabilities probes the `/v2/` endpoint of the registry host with
+// GET and OPTIONS requests, and reports the API features it
+// advertises. A nil Authenticator means anonymous access. The scheme
+// is chosen as go-containerregistry does, i.e. plain HTTP for
+// localhost and private addresses. The requests go through the
+// transport carried by ctx, if any.
+func Capabilities(ctx context.Context, host string, auth authn.Authenticator) (*HostCapabilities, error) {
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+	base := TransportFor(ctx, http.DefaultTransport)
+	rt, err := transport.NewWithContext(ctx, reg, auth, base, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: rt}
+	url := reg.Scheme() + "://" + reg.RegistryStr() + "/v2/"
+
+	get, err := probe(ctx, client, http.MethodGet, url)
+	if err != nil {
+		return nil, err
+	}
+	if get.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d probing %s", get.StatusCode, host)
+	}
+	caps := &HostCapabilities{
+		APIVersion: get.Header.Get("Docker-Distribution-API-Version"),
+		Extensions: headerList(get.Header, "OCI-Extensions"),
+	}
+
+	// Not all registries answer OPTIONS; that only means nothing
+	// more is advertised.
+	options, err := probe(ctx, client, http.MethodOptions, url)
+	if err != nil {
+		return nil, err
+	}
+	if options.StatusCode < 300 {
+		caps.AllowedMethods = headerList(options.Header, "Allow")
+		caps.Extensions = append(caps.Extensions, headerList(options.Header, "OCI-Extensions")...)
+	}
+
+	for _, ext := range caps.Extensions {
+		if ext == "referrers" {
+			caps.Referrers = true
+		}
+	}
+	for _, method := range caps.AllowedMethods {
+		if method == http.MethodPatch {
+			caps.ChunkedUpload = true
+		}
+	}
+	return caps, nil
+}
+
+// probe makes a request without a body and returns the response,
+// with the body already drained and closed.
+func probe(ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// headerList returns the comma-separated values of all the header
+// fields with the given key.
+func headerList(header http.Header, key string) []string {
+	var values []string
+	for _, field := range header.Values(key) {
+		for _, v := range strings.Split(field, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/test"
+)
+
+func TestRequiresAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		want       bool
+		wantErr    bool
+	}{
+		{
+			name:       "anonymous access",
+			statusCode: http.StatusOK,
+			want:       false,
+		},
+		{
+			name:       "auth required",
+			statusCode: http.StatusUnauthorized,
+			want:       true,
+		},
+		{
+			name:       "unexpected status",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var path string
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(tt.statusCode)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			t.Cleanup(func() {
+				srv.Close()
+			})
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			got, err := RequiresAuth(context.TODO(), host, ProbeOptions{Insecure: true})
+			g.Expect(err != nil).To(Equal(tt.wantErr))
+			g.Expect(got).To(Equal(tt.want))
+			g.Expect(path).To(Equal("/v2/"))
+		})
+	}
+}
+
+func TestAnonymousPullAllowed(t *testing.T) {
+	srv := test.NewAnonymousTokenRegistryServer()
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		repository string
+		want       bool
+	}{
+		{repository: "convenient", want: true},
+		{repository: "private", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repository, func(t *testing.T) {
+			g := NewWithT(t)
+
+			repo, err := name.NewRepository(test.RegistryName(srv) + "/" + tt.repository)
+			g.Expect(err).ToNot(HaveOccurred())
+			got, err := AnonymousPullAllowed(context.TODO(), repo)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	g := NewWithT(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.URL.Path).To(Equal("/v2/"))
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("OCI-Extensions", "referrers")
+		case http.MethodOptions:
+			w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	caps, err := Capabilities(context.TODO(), host, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(caps.APIVersion).To(Equal("registry/2.0"))
+	g.Expect(caps.Extensions).To(ConsistOf("referrers"))
+	g.Expect(caps.Referrers).To(BeTrue())
+	g.Expect(caps.ChunkedUpload).To(BeTrue())
+}
+
+func TestCapabilities_NoOptions(t *testing.T) {
+	g := NewWithT(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	caps, err := Capabilities(context.TODO(), strings.TrimPrefix(srv.URL, "http://"), nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(caps.Referrers).To(BeFalse())
+	g.Expect(caps.ChunkedUpload).To(BeFalse())
+	g.Expect(caps.AllowedMethods).To(BeEmpty())
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	imagev1 "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+// Status reasons for registry errors.
+const (
+	// UnconfiguredProviderReason represents the fact that the image is
+	// hosted by a provider for which automatic login is not enabled.
+	UnconfiguredProviderReason = "UnconfiguredProvider"
+	// ProviderNotConfiguredReason represents the fact that the image
+	// is hosted on a host matched by no provider, which are rejected.
+	ProviderNotConfiguredReason = "ProviderNotConfigured"
+	// AuthenticationFailedReason represents the fact that the
+	// credentials were missing, invalid or rejected by the registry.
+	AuthenticationFailedReason = "AuthenticationFailed"
+	// RepositoryNotFoundReason represents the fact that the registry
+	// doesn't know the repository.
+	RepositoryNotFoundReason = "RepositoryNotFound"
+	// RepositoryGoneReason represents the fact that the registry
+	// reports the repository as deleted.
+	RepositoryGoneReason = "RepositoryGone"
+	// HostNotAllowedReason represents the fact that the registry host
+	// is not one the controller may contact.
+	HostNotAllowedReason = "HostNotAllowed"
+	// InvalidImageReason represents the fact that the image is
+	// malformed, which is a configuration error.
+	InvalidImageReason = "InvalidImage"
+	// MetadataUnreachableReason represents the fact that the metadata
+	// server of the provider couldn't be reached, e.g. because the
+	// controller isn't running on that provider.
+	MetadataUnreachableReason = "MetadataUnreachable"
+	// InteractiveRequiredReason represents the fact that the login
+	// can't complete without a user taking some steps.
+	InteractiveRequiredReason = "InteractiveRequired"
+)
+
+// ReasonFor returns the status reason for the given error. It
+// recognizes the sentinel errors of this package and the errors
+// returned by registries, and falls back to the generic
+// ReconciliationFailed reason.
+func ReasonFor(err error) string {
+	switch {
+	case errors.Is(err, ErrUnconfiguredProvider):
+		return UnconfiguredProviderReason
+	case errors.Is(err, ErrProviderNotConfigured):
+		return ProviderNotConfiguredReason
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrEmptyToken),
+		errors.Is(err, ErrAuthenticationFailed):
+		return AuthenticationFailedReason
+	case errors.Is(err, ErrRepositoryNotFound):
+		return RepositoryNotFoundReason
+	case errors.Is(err, ErrRepositoryGone):
+		return RepositoryGoneReason
+	case errors.Is(err, ErrHostNotAllowed):
+		return HostNotAllowedReason
+	case errors.Is(err, ErrInvalidImage):
+		return InvalidImageReason
+	case errors.Is(err, ErrMetadataUnreachable):
+		return MetadataUnreachableReason
+	case errors.Is(err, ErrInteractiveRequired):
+		return InteractiveRequiredReason
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return AuthenticationFailedReason
+		case http.StatusNotFound:
+			return RepositoryNotFoundReason
+		case http.StatusGone:
+			return RepositoryGoneReason
+		}
+		for _, diag := range terr.Errors {
+			switch diag.Code {
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return AuthenticationFailedReason
+			case transport.NameUnknownErrorCode:
+				return RepositoryNotFoundReason
+			}
+		}
+	}
+	return imagev1.ReconciliationFailedReason
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	. "github.com/onsi/gomega"
+
+	imagev1 "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+func TestReasonFor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "unconfigured provider",
+			err:  fmt.Errorf("ECR authentication failed: %w", ErrUnconfiguredProvider),
+			want: UnconfiguredProviderReason,
+		},
+		{
+			name: "auto-login disabled",
+			err:  fmt.Errorf("GCR authentication failed: %w", &AutoLoginDisabledError{Provider: ProviderGCP, Flag: "--gcp-autologin-for-gcr"}),
+			want: UnconfiguredProviderReason,
+		},
+		{
+			name: "no provider for the host",
+			err:  fmt.Errorf("%w: registry.example.com", ErrProviderNotConfigured),
+			want: ProviderNotConfiguredReason,
+		},
+		{
+			name: "unauthorized",
+			err:  fmt.Errorf("login failed: %w", ErrUnauthorized),
+			want: AuthenticationFailedReason,
+		},
+		{
+			name: "invalid token",
+			err:  fmt.Errorf("%w: bad padding", ErrInvalidToken),
+			want: AuthenticationFailedReason,
+		},
+		{
+			name: "empty token",
+			err:  fmt.Errorf("%w: no credentials", ErrEmptyToken),
+			want: AuthenticationFailedReason,
+		},
+		{
+			name: "repository not found",
+			err:  ErrRepositoryNotFound,
+			want: RepositoryNotFoundReason,
+		},
+		{
+			name: "repository gone",
+			err:  fmt.Errorf("%w: foo/bar", ErrRepositoryGone),
+			want: RepositoryGoneReason,
+		},
+		{
+			name: "host not allowed",
+			err:  fmt.Errorf("%w: evil.example.com", ErrHostNotAllowed),
+			want: HostNotAllowedReason,
+		},
+		{
+			name: "invalid image",
+			err:  fmt.Errorf("%w: malformed registry ID", ErrInvalidImage),
+			want: InvalidImageReason,
+		},
+		{
+			name: "authentication failed",
+			err:  fmt.Errorf("%w: 403 Forbidden", ErrAuthenticationFailed),
+			want: AuthenticationFailedReason,
+		},
+		{
+			name: "metadata unreachable",
+			err:  fmt.Errorf("%w: connection refused", ErrMetadataUnreachable),
+			want: MetadataUnreachableReason,
+		},
+		{
+			name: "interactive login required",
+			err:  &InteractiveRequiredError{Challenge: AuthChallenge{URL: "https://example.com/device", Code: "ABCD"}},
+			want: InteractiveRequiredReason,
+		},
+		{
+			name: "registry 401",
+			err:  &transport.Error{StatusCode: http.StatusUnauthorized},
+			want: AuthenticationFailedReason,
+		},
+		{
+			name: "registry 410",
+			err:  &transport.Error{StatusCode: http.StatusGone},
+			want: RepositoryGoneReason,
+		},
+		{
+			name: "registry name unknown",
+			err: &transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors:     []transport.Diagnostic{{Code: transport.NameUnknownErrorCode}},
+			},
+			want: RepositoryNotFoundReason,
+		},
+		{
+			name: "other error",
+			err:  errors.New("connection refused"),
+			want: imagev1.ReconciliationFailedReason,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(ReasonFor(tt.err)).To(Equal(tt.want))
+		})
+	}
+}
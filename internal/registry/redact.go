@@ -0,0 +1,120 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// redacted replaces the secrets in the messages of SafeErrors.
+const redacted = "REDACTED"
+
+// minOpaqueLength is the length from which an opaque string of mixed
+// case letters and digits is taken to be a secret, e.g. an access key.
+const minOpaqueLength = 32
+
+// secretKey matches the names of parameters and fields holding secrets.
+const secretKey = `[A-Za-z0-9_-]*(?i:token|password|passwd|secret|signature|assertion|api[_-]?key)[A-Za-z0-9_-]*`
+
+var (
+	// secretParamRe matches secret parameters of queries and forms,
+	// e.g. "access_token=...".
+	secretParamRe = regexp.MustCompile(`\b(` + secretKey + `=)[^&\s,;"']+`)
+	// secretFieldRe matches secret fields of JSON documents, e.g.
+	// `"password": "..."`.
+	secretFieldRe = regexp.MustCompile(`("` + secretKey + `"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// secretElementRe matches secret elements of XML documents, e.g.
+	// "<SessionToken>...</SessionToken>".
+	secretElementRe = regexp.MustCompile(`(<` + secretKey + `>)[^<]+`)
+	// authSchemeRe matches the credentials of Authorization headers.
+	authSchemeRe = regexp.MustCompile(`\b((?i:bearer|basic)\s+)[A-Za-z0-9._~+/=-]+`)
+	// jwtRe matches JSON web tokens.
+	jwtRe = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// opaqueRe matches the strings which may be opaque secrets.
+	opaqueRe = regexp.MustCompile(`[A-Za-z0-9+=_-]+`)
+)
+
+// SafeError is an error whose message has been stripped of what looks
+// like secret content (tokens, passwords, keys, signatures), so that
+// it may be logged or shown in a status. It wraps the original error,
+// so that errors.Is and errors.As see through it; the messages of the
+// errors it wraps aren't safe.
+type SafeError struct {
+	msg string
+	err error
+}
+
+// Error returns the redacted message of the original error.
+func (e *SafeError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error.
+func (e *SafeError) Unwrap() error {
+	return e.err
+}
+
+// Sanitize returns a SafeError wrapping err, or err itself if it is
+// nil or already a SafeError.
+func Sanitize(err error) error {
+	if err == nil {
+		return nil
+	}
+	if safe, ok := err.(*SafeError); ok {
+		return safe
+	}
+	return &SafeError{msg: Redact(err.Error()), err: err}
+}
+
+// Redact returns the message with what looks like secret content
+// replaced by "REDACTED".
+func Redact(msg string) string {
+	msg = jwtRe.ReplaceAllString(msg, redacted)
+	msg = authSchemeRe.ReplaceAllString(msg, "${1}"+redacted)
+	msg = secretFieldRe.ReplaceAllString(msg, `${1}"`+redacted+`"`)
+	msg = secretElementRe.ReplaceAllString(msg, "${1}"+redacted)
+	msg = secretParamRe.ReplaceAllString(msg, "${1}"+redacted)
+	return opaqueRe.ReplaceAllStringFunc(msg, func(s string) string {
+		if isOpaqueSecret(s) {
+			return redacted
+		}
+		return s
+	})
+}
+
+// isOpaqueSecret returns whether the string mixes upper and lower case
+// letters and digits, as random keys do while the names of hosts,
+// repositories and digests don't.
+func isOpaqueSecret(s string) bool {
+	if len(s) < minOpaqueLength || strings.Contains(s, redacted) {
+		return false
+	}
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	return upper && lower && digit
+}
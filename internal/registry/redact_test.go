@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			name: "form parameter",
+			msg:  "POST /oauth2/exchange: grant_type=access_token&access_token=abc.def&service=foo.azurecr.io",
+			want: "POST /oauth2/exchange: grant_type=access_token&access_token=REDACTED&service=foo.azurecr.io",
+		},
+		{
+			name: "JSON field",
+			msg:  `invalid response {"username": "robot", "password": "hunter2", "refresh_token": "a\"b"}`,
+			want: `invalid response {"username": "robot", "password": "REDACTED", "refresh_token": "REDACTED"}`,
+		},
+		{
+			name: "XML element",
+			msg:  `<Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>hunter2</SecretAccessKey><SessionToken>abc</SessionToken></Credentials>`,
+			want: `<Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>REDACTED</SecretAccessKey><SessionToken>REDACTED</SessionToken></Credentials>`,
+		},
+		{
+			name: "authorization header",
+			msg:  "request with Authorization: Bearer abc.def-ghi rejected",
+			want: "request with Authorization: Bearer REDACTED rejected",
+		},
+		{
+			name: "JWT",
+			msg:  "token eyJhbGciOiJub25lIn0.eyJzdWIiOiJmb28ifQ.sig expired",
+			want: "token REDACTED expired",
+		},
+		{
+			name: "opaque key",
+			msg:  "signing with wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY2bPxRfiCYEXAMPLEKEY failed",
+			want: "signing with wJalrXUtnFEMI/K7MDENG/REDACTED failed",
+		},
+		{
+			name: "nothing secret",
+			msg:  "no GCP credential source provided a token: metadata: Get \"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token\": dial tcp: lookup failed; registry 012345678901.dkr.ecr.us-east-1.amazonaws.com/team-1-very-long-repository-name-2@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b not found",
+			want: "no GCP credential source provided a token: metadata: Get \"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token\": dial tcp: lookup failed; registry 012345678901.dkr.ecr.us-east-1.amazonaws.com/team-1-very-long-repository-name-2@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(Redact(tt.msg)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(Sanitize(nil)).To(BeNil())
+
+	underlying := fmt.Errorf("%w: token request failed: access_token=s3cr3t-value", ErrAuthenticationFailed)
+	err := fmt.Errorf("login failed: %w", Sanitize(underlying))
+	g.Expect(err.Error()).To(Equal("login failed: authentication failed: token request failed: access_token=REDACTED"))
+	g.Expect(err.Error()).ToNot(ContainSubstring("s3cr3t-value"))
+
+	var safe *SafeError
+	g.Expect(errors.As(err, &safe)).To(BeTrue())
+	g.Expect(safe.Error()).ToNot(ContainSubstring("s3cr3t-value"))
+	// The original error is still seen through.
+	g.Expect(errors.Is(err, ErrAuthenticationFailed)).To(BeTrue())
+	g.Expect(errors.Unwrap(safe)).To(Equal(underlying))
+
+	// Sanitizing is idempotent.
+	g.Expect(Sanitize(safe)).To(BeIdenticalTo(safe))
+}
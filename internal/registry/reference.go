@@ -0,0 +1,213 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// defaultReferenceCacheSize is the number of references held by the
+// cache used by ParseReference.
+const defaultReferenceCacheSize = 1024
+
+var defaultReferenceCache = NewReferenceCache(defaultReferenceCacheSize)
+
+// ociScheme is the scheme prefixing the OCI artifact references of the
+// other Flux controllers, e.g. "oci://ghcr.io/foo/bar".
+const ociScheme = "oci://"
+
+// maxImageLength bounds the length of the images accepted by
+// ValidateImage, well above that of the longest valid reference.
+const maxImageLength = 1024
+
+// maxRepositoryNameLength bounds the length of the name of the
+// repository, host included, as in the distribution specification.
+const maxRepositoryNameLength = 255
+
+var (
+	// tagRe matches the valid tags.
+	tagRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// digestRe matches the form of digests, "algorithm:hex".
+	digestRe = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+	// digestLengths are the lengths of the encoded digests of the
+	// known algorithms.
+	digestLengths = map[string]int{"sha256": 64, "sha384": 96, "sha512": 128}
+)
+
+// ReferenceCache holds the references parsed from images, so that an
+// image seen again isn't parsed again. It is bounded, evicting the
+// least recently used references, and safe for concurrent use.
+type ReferenceCache struct {
+	refs LRU
+}
+
+// NewReferenceCache creates an empty cache holding up to maxEntries
+// references. Zero or less means no bound.
+func NewReferenceCache(maxEntries int) *ReferenceCache {
+	c := &ReferenceCache{}
+	c.refs.SetMaxEntries(maxEntries)
+	return c
+}
+
+// ParseReference returns the reference parsed from the image with the
+// default options of name.ParseReference, from the cache if the image
+// has been parsed before. Credentials embedded in the image are
+// stripped before parsing (see SplitCredentials). Images which fail to
+// parse aren't cached. A leading "oci://" is stripped as well (see
+// TrimOCIScheme).
+func (c *ReferenceCache) ParseReference(image string) (name.Reference, error) {
+	image, _ = SplitCredentials(TrimOCIScheme(image))
+	if ref, ok := c.refs.Get(image); ok {
+		return ref.(name.Reference), nil
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	c.refs.Set(image, ref)
+	return ref, nil
+}
+
+// ParseReference is like name.ParseReference with the default options,
+// but caches the references parsed, up to 1024 of them; see
+// ReferenceCache.
+func ParseReference(image string) (name.Reference, error) {
+	return defaultReferenceCache.ParseReference(image)
+}
+
+// TrimOCIScheme returns the image without its leading "oci://", in
+// any case, if any, as in the OCI artifact references of the other Flux
+// controllers.
+func TrimOCIScheme(image string) string {
+	if len(image) >= len(ociScheme) && strings.EqualFold(image[:len(ociScheme)], ociScheme) {
+		return image[len(ociScheme):]
+	}
+	return image
+}
+
+// SplitCredentials returns the image without the credentials embedded
+// in front of its host, as in `user:pass@registry.example.com/foo:v1`,
+// along with those credentials, nil when there are none. The username
+// and password may be percent-encoded, as in URLs, and must be when
+// they contain a `/`. Only an `@` before the first `/` of the image
+// delimits credentials, so that digests, as in
+// `registry.example.com/foo@sha256:...` or `foo@sha256:...`, are never
+// taken for them.
+func SplitCredentials(image string) (string, *authn.AuthConfig) {
+	slash := strings.Index(image, "/")
+	if slash < 0 {
+		return image, nil
+	}
+	at := strings.LastIndex(image[:slash], "@")
+	if at < 0 {
+		return image, nil
+	}
+
+	userinfo := image[:at]
+	username, password := userinfo, ""
+	if i := strings.Index(userinfo, ":"); i >= 0 {
+		username, password = userinfo[:i], userinfo[i+1:]
+	}
+	if u, err := url.PathUnescape(username); err == nil {
+		username = u
+	}
+	if p, err := url.PathUnescape(password); err == nil {
+		password = p
+	}
+	return image[at+1:], &authn.AuthConfig{Username: username, Password: password}
+}
+
+// ValidateImage checks that the image is a well-formed reference, to
+// reject invalid input early, e.g. in admission webhooks: it must not
+// be empty nor too long, nor contain whitespace or control characters;
+// its repository name must be at most 255 characters long; its tag, if
+// any, must be at most 128 characters of letters, digits, `_`, `.` and
+// `-`, not starting with `.` or `-`; its digest, if any, must be of the
+// form "algorithm:hex", with as many lowercase hexadecimal characters as
+// the algorithm requires. A leading "oci://" and credentials embedded in
+// the image are allowed, the credentials not being reported. The error
+// wraps ErrInvalidImage and tells what is wrong with the image.
+func ValidateImage(image string) error {
+	if image == "" {
+		return fmt.Errorf("%w: image is empty", ErrInvalidImage)
+	}
+	if len(image) > maxImageLength {
+		return fmt.Errorf("%w: image is %d characters long, more than the maximum of %d",
+			ErrInvalidImage, len(image), maxImageLength)
+	}
+	image, _ = SplitCredentials(TrimOCIScheme(image))
+	if i := strings.IndexFunc(image, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }); i >= 0 {
+		return fmt.Errorf("%w: %q contains whitespace or control characters", ErrInvalidImage, image)
+	}
+
+	repository := image
+	if i := strings.Index(repository, "@"); i >= 0 {
+		digest := repository[i+1:]
+		repository = repository[:i]
+		if err := validateDigest(digest); err != nil {
+			return fmt.Errorf("%w: digest %q of %s is malformed: %s", ErrInvalidImage, digest, image, err)
+		}
+	}
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		tag := repository[i+1:]
+		repository = repository[:i]
+		if !tagRe.MatchString(tag) {
+			return fmt.Errorf("%w: tag %q of %s is malformed: it must be 1 to 128 letters, digits, '_', '.' and '-', not starting with '.' or '-'",
+				ErrInvalidImage, tag, image)
+		}
+	}
+	if len(repository) > maxRepositoryNameLength {
+		return fmt.Errorf("%w: repository name of %s is %d characters long, more than the maximum of %d",
+			ErrInvalidImage, image, len(repository), maxRepositoryNameLength)
+	}
+	if _, err := name.NewRepository(repository); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+	if _, err := name.ParseReference(image); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+	return nil
+}
+
+// validateDigest checks that the digest is of the form "algorithm:hex",
+// with an encoded part of the length of the algorithm if it is known.
+func validateDigest(digest string) error {
+	if !digestRe.MatchString(digest) {
+		return errors.New("it must be of the form algorithm:hex")
+	}
+	i := strings.Index(digest, ":")
+	algorithm, encoded := digest[:i], digest[i+1:]
+	length, ok := digestLengths[algorithm]
+	if !ok {
+		return nil
+	}
+	if len(encoded) != length {
+		return fmt.Errorf("a %s digest has %d hexadecimal characters, not %d", algorithm, length, len(encoded))
+	}
+	if strings.Trim(encoded, "0123456789abcdef") != "" {
+		return fmt.Errorf("a %s digest has lowercase hexadecimal characters only", algorithm)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+)
+
+func TestReferenceCache(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := NewReferenceCache(2)
+	image := "gcr.io/foo/bar:v1@" + "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+
+	want, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	first, err := cache.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(first).To(Equal(want))
+
+	// A hit returns the reference parsed the first time.
+	second, err := cache.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(second).To(BeIdenticalTo(first))
+	g.Expect(second).To(Equal(want))
+
+	// Images which fail to parse aren't cached.
+	_, err = cache.ParseReference("Invalid:Image")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(cache.refs.Len()).To(Equal(1))
+
+	// The cache is bounded.
+	for _, image := range []string{"foo/bar", "foo/baz", "foo/qux"} {
+		_, err := cache.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(cache.refs.Len()).To(Equal(2))
+}
+
+func TestReferenceCache_EmbeddedCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := NewReferenceCache(0)
+	ref, err := cache.ParseReference("user:s3cr3t@registry.example.com/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ref.String()).To(Equal("registry.example.com/foo/bar:v1"))
+	g.Expect(ref.Context().RegistryStr()).To(Equal("registry.example.com"))
+	// The reference is cached under the image without credentials.
+	g.Expect(cache.refs.Len()).To(Equal(1))
+	_, ok := cache.refs.Get("registry.example.com/foo/bar:v1")
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestTrimOCIScheme(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "oci://ghcr.io/foo/bar:v1", want: "ghcr.io/foo/bar:v1"},
+		{image: "OCI://ghcr.io/foo/bar:v1", want: "ghcr.io/foo/bar:v1"},
+		{image: "ghcr.io/foo/bar:v1", want: "ghcr.io/foo/bar:v1"},
+		{image: "oci:/ghcr.io/foo/bar", want: "oci:/ghcr.io/foo/bar"},
+		{image: "oci", want: "oci"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(TrimOCIScheme(tt.image)).To(Equal(tt.want))
+		})
+	}
+
+	g := NewWithT(t)
+	ref, err := NewReferenceCache(0).ParseReference("oci://ghcr.io/foo/bar:v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ref.String()).To(Equal("ghcr.io/foo/bar:v1"))
+	g.Expect(ValidateImage("oci://ghcr.io/foo/bar:v1")).To(Succeed())
+}
+
+func TestSplitCredentials(t *testing.T) {
+	digest := "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+	tests := []struct {
+		image     string
+		wantImage string
+		wantAuth  *authn.AuthConfig
+	}{
+		{
+			image:     "user:pass@registry.example.com/foo/bar:v1",
+			wantImage: "registry.example.com/foo/bar:v1",
+			wantAuth:  &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			image:     "user:pass@registry.example.com:5000/foo/bar:v1",
+			wantImage: "registry.example.com:5000/foo/bar:v1",
+			wantAuth:  &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			image:     "token@registry.example.com/foo/bar",
+			wantImage: "registry.example.com/foo/bar",
+			wantAuth:  &authn.AuthConfig{Username: "token"},
+		},
+		{
+			image:     "robot%24ci:p%40ss:word@registry.example.com/foo/bar",
+			wantImage: "registry.example.com/foo/bar",
+			wantAuth:  &authn.AuthConfig{Username: "robot$ci", Password: "p@ss:word"},
+		},
+		{
+			image:     "user:pass@registry.example.com/foo/bar@" + digest,
+			wantImage: "registry.example.com/foo/bar@" + digest,
+			wantAuth:  &authn.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			image:     "registry.example.com/foo/bar@" + digest,
+			wantImage: "registry.example.com/foo/bar@" + digest,
+		},
+		{
+			image:     "foo@" + digest,
+			wantImage: "foo@" + digest,
+		},
+		{
+			image:     "registry.example.com/foo/bar:v1",
+			wantImage: "registry.example.com/foo/bar:v1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			g := NewWithT(t)
+
+			image, auth := SplitCredentials(tt.image)
+			g.Expect(image).To(Equal(tt.wantImage))
+			g.Expect(auth).To(Equal(tt.wantAuth))
+		})
+	}
+}
+
+func BenchmarkParseReference(b *testing.B) {
+	images := make([]string, 100)
+	for i := range images {
+		images[i] = fmt.Sprintf("012345678901.dkr.ecr.us-east-1.amazonaws.com/team-%d/app:v1.%d.0", i, i)
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := name.ParseReference(images[i%len(images)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		cache := NewReferenceCache(len(images))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.ParseReference(images[i%len(images)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestValidateImage(t *testing.T) {
+	digest := "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+	tests := []struct {
+		name    string
+		image   string
+		wantErr string
+	}{
+		{
+			name:  "tag",
+			image: "registry.example.com/foo/bar:v1.0.0",
+		},
+		{
+			name:  "digest",
+			image: "registry.example.com:5000/foo/bar@" + digest,
+		},
+		{
+			name:  "tag and digest",
+			image: "gcr.io/foo/bar:v1@" + digest,
+		},
+		{
+			name:  "unqualified",
+			image: "nginx",
+		},
+		{
+			name:  "embedded credentials",
+			image: "user:pass@registry.example.com/foo/bar:v1",
+		},
+		{
+			name:    "empty",
+			image:   "",
+			wantErr: "image is empty",
+		},
+		{
+			name:    "oversized",
+			image:   "registry.example.com/" + strings.Repeat("a", 1100),
+			wantErr: "image is 1121 characters long, more than the maximum of 1024",
+		},
+		{
+			name:    "oversized repository name",
+			image:   "registry.example.com/" + strings.Repeat("a", 300) + ":v1",
+			wantErr: "is 321 characters long, more than the maximum of 255",
+		},
+		{
+			name:    "whitespace",
+			image:   "registry.example.com/foo/bar:v1\n",
+			wantErr: "contains whitespace or control characters",
+		},
+		{
+			name:    "empty tag",
+			image:   "registry.example.com/foo/bar:",
+			wantErr: `tag "" of registry.example.com/foo/bar: is malformed`,
+		},
+		{
+			name:    "malformed tag",
+			image:   "registry.example.com/foo/bar:-v1",
+			wantErr: `tag "-v1" of registry.example.com/foo/bar:-v1 is malformed`,
+		},
+		{
+			name:    "oversized tag",
+			image:   "registry.example.com/foo/bar:" + strings.Repeat("v", 129),
+			wantErr: "is malformed: it must be 1 to 128 letters",
+		},
+		{
+			name:    "digest without algorithm",
+			image:   "registry.example.com/foo/bar@6c3c624b",
+			wantErr: "it must be of the form algorithm:hex",
+		},
+		{
+			name:    "truncated digest",
+			image:   "registry.example.com/foo/bar@sha256:6c3c624b",
+			wantErr: "a sha256 digest has 64 hexadecimal characters, not 8",
+		},
+		{
+			name:    "uppercase digest",
+			image:   "registry.example.com/foo/bar@" + digest[:7] + strings.ToUpper(digest[7:]),
+			wantErr: "a sha256 digest has lowercase hexadecimal characters only",
+		},
+		{
+			name:    "non-hexadecimal digest",
+			image:   "registry.example.com/foo/bar@sha256:" + strings.Repeat("z", 64),
+			wantErr: "a sha256 digest has lowercase hexadecimal characters only",
+		},
+		{
+			name:    "uppercase repository",
+			image:   "registry.example.com/Foo/bar:v1",
+			wantErr: "repository can only contain",
+		},
+		{
+			name:    "credentials not reported",
+			image:   "user:s3cr3t@registry.example.com/foo/bar:-v1",
+			wantErr: `tag "-v1" of registry.example.com/foo/bar:-v1 is malformed`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := ValidateImage(tt.image)
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(errors.Is(err, ErrInvalidImage)).To(BeTrue())
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+			g.Expect(err.Error()).ToNot(ContainSubstring("s3cr3t"))
+		})
+	}
+}
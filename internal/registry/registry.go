@@ -0,0 +1,195 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnconfiguredProvider is returned when the image is hosted by a
+// known provider, but automatic login for that provider is not
+// enabled.
+var ErrUnconfiguredProvider = errors.New("provider not configured")
+
+// ErrAutoLoginDisabled is wrapped by the errors returned when the image
+// is hosted by a known provider whose automatic login is not enabled.
+// See AutoLoginDisabledError.
+var ErrAutoLoginDisabled = errors.New("auto-login disabled")
+
+// AutoLoginDisabledError is returned when the image is hosted by the
+// provider, but its automatic login is not enabled. It tells the flag
+// of the controller enabling it. It is both an ErrAutoLoginDisabled
+// and an ErrUnconfiguredProvider.
+type AutoLoginDisabledError struct {
+	Provider Provider
+	// Flag is the controller flag enabling the automatic login, e.g.
+	// "--aws-autologin-for-ecr".
+	Flag string
+}
+
+// Error returns the provider and the flag enabling its automatic
+// login.
+func (e *AutoLoginDisabledError) Error() string {
+	return fmt.Sprintf("%s for %s: set the controller flag %s to enable it", ErrAutoLoginDisabled, e.Provider, e.Flag)
+}
+
+// Is returns whether the target is ErrAutoLoginDisabled or
+// ErrUnconfiguredProvider.
+func (e *AutoLoginDisabledError) Is(target error) bool {
+	return target == ErrAutoLoginDisabled || target == ErrUnconfiguredProvider
+}
+
+// ErrProviderNotConfigured is returned when the image is hosted on a
+// host matched by no provider, and unmatched hosts are rejected rather
+// than treated as generic registries (see ProviderNone).
+var ErrProviderNotConfigured = errors.New("no provider configured for host")
+
+// ErrInvalidToken is returned when a token obtained from a provider
+// can't be decoded into credentials.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrEmptyToken is returned when a provider answers with a token
+// which is empty, or which decodes into empty credentials.
+var ErrEmptyToken = errors.New("empty token")
+
+// ErrUnauthorized is returned when the credentials are rejected.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrRepositoryNotFound is returned when the registry doesn't know the
+// repository.
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// ErrRepositoryGone is returned when the registry reports the
+// repository as deleted, with a 410 Gone response.
+var ErrRepositoryGone = errors.New("repository gone")
+
+// ErrHostNotAllowed is returned when the registry host is not one the
+// controller may contact.
+var ErrHostNotAllowed = errors.New("registry host not allowed")
+
+// ErrAuthenticationFailed is returned when a provider refuses to give
+// credentials.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// ErrExecPluginNotAllowed is returned when the options call for an
+// exec plugin the controller isn't allowed to run.
+var ErrExecPluginNotAllowed = errors.New("exec plugin not allowed")
+
+// ErrMetadataUnreachable is returned when the metadata server of a
+// cloud provider can't be reached, which suggests that the controller
+// isn't running on that provider.
+var ErrMetadataUnreachable = errors.New("metadata server unreachable")
+
+// ErrUnexpectedResponse is returned when a provider or registry
+// answers with a response which can't be made sense of, e.g. an HTML
+// error page from a gateway in place of JSON.
+var ErrUnexpectedResponse = errors.New("unexpected response")
+
+// ErrOnlineLoginRequired is returned when the options forbid any
+// network call for the login, but the image requires a login with a
+// cloud provider.
+var ErrOnlineLoginRequired = errors.New("online login required")
+
+// ErrInteractiveRequired is wrapped by the errors returned when a
+// login can't complete without a user taking some steps, e.g. entering
+// a device code. See InteractiveRequiredError.
+var ErrInteractiveRequired = errors.New("interactive login required")
+
+// AuthChallenge tells what a user has to do for a login to complete,
+// e.g. enter the code at the URL.
+type AuthChallenge struct {
+	// URL is where the user has to go.
+	URL string
+	// Code is what the user has to enter there, if anything.
+	Code string
+	// Message is the instructions for the user, as given by the
+	// provider.
+	Message string
+}
+
+// InteractiveRequiredError is returned when a login can't complete
+// without a user meeting the challenge. It wraps
+// ErrInteractiveRequired.
+type InteractiveRequiredError struct {
+	Challenge AuthChallenge
+}
+
+// Error returns the instructions of the challenge, or its URL and code
+// when there are none.
+func (e *InteractiveRequiredError) Error() string {
+	if e.Challenge.Message != "" {
+		return ErrInteractiveRequired.Error() + ": " + e.Challenge.Message
+	}
+	return fmt.Sprintf("%s: enter code %q at %s", ErrInteractiveRequired, e.Challenge.Code, e.Challenge.URL)
+}
+
+// Unwrap returns ErrInteractiveRequired.
+func (e *InteractiveRequiredError) Unwrap() error {
+	return ErrInteractiveRequired
+}
+
+// ErrInvalidImage is returned when the image, or a part of it such as
+// the registry ID it is parsed into, is rejected as malformed.
+var ErrInvalidImage = errors.New("invalid image")
+
+// Provider is used to categorize the registry providers.
+type Provider int
+
+// Registry providers.
+const (
+	ProviderGeneric Provider = iota
+	ProviderAWS
+	ProviderGCP
+	ProviderAzure
+	// ProviderNone is no provider at all. It is only meaningful as the
+	// provider of the hosts matched by no other provider, to have them
+	// rejected.
+	ProviderNone
+)
+
+// String returns the name of the provider, as used in logs and
+// flags.
+func (p Provider) String() string {
+	switch p {
+	case ProviderAWS:
+		return "aws"
+	case ProviderGCP:
+		return "gcp"
+	case ProviderAzure:
+		return "azure"
+	case ProviderNone:
+		return "none"
+	default:
+		return "generic"
+	}
+}
+
+// IsFullyQualified returns whether the image reference names its
+// registry host, e.g. "docker.io/library/nginx" does while "nginx" and
+// "library/nginx" don't and are taken to be on Docker Hub. As with the
+// Docker CLI, the first component of the path names a host when it
+// contains a dot or a port, or is "localhost".
+func IsFullyQualified(image string) bool {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return false
+	}
+	host := image[:i]
+	return strings.ContainsAny(host, ".:") || host == "localhost"
+}
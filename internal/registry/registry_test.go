@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestIsFullyQualified(t *testing.T) {
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{"nginx", false},
+		{"nginx:1.21", false},
+		{"library/nginx", false},
+		{"docker.io/library/nginx", true},
+		{"gcr.io/foo/bar:v1", true},
+		{"localhost/foo", true},
+		{"registry:5000/foo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(IsFullyQualified(tt.image)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestInteractiveRequiredError(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge AuthChallenge
+		want      string
+	}{
+		{
+			name:      "with message",
+			challenge: AuthChallenge{URL: "https://example.com/device", Code: "ABCD", Message: "Enter ABCD at https://example.com/device"},
+			want:      "interactive login required: Enter ABCD at https://example.com/device",
+		},
+		{
+			name:      "without message",
+			challenge: AuthChallenge{URL: "https://example.com/device", Code: "ABCD"},
+			want:      `interactive login required: enter code "ABCD" at https://example.com/device`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := fmt.Errorf("login failed: %w", &InteractiveRequiredError{Challenge: tt.challenge})
+			g.Expect(err.Error()).To(Equal("login failed: " + tt.want))
+			g.Expect(errors.Is(err, ErrInteractiveRequired)).To(BeTrue())
+			var ierr *InteractiveRequiredError
+			g.Expect(errors.As(err, &ierr)).To(BeTrue())
+			g.Expect(ierr.Challenge).To(Equal(tt.challenge))
+		})
+	}
+}
+
+func TestAutoLoginDisabledError(t *testing.T) {
+	g := NewWithT(t)
+
+	err := fmt.Errorf("ECR authentication failed: %w", &AutoLoginDisabledError{Provider: ProviderAWS, Flag: "--aws-autologin-for-ecr"})
+	g.Expect(err.Error()).To(Equal("ECR authentication failed: auto-login disabled for aws: set the controller flag --aws-autologin-for-ecr to enable it"))
+	g.Expect(errors.Is(err, ErrAutoLoginDisabled)).To(BeTrue())
+	g.Expect(errors.Is(err, ErrUnconfiguredProvider)).To(BeTrue())
+	g.Expect(errors.Is(err, ErrProviderNotConfigured)).To(BeFalse())
+	var derr *AutoLoginDisabledError
+	g.Expect(errors.As(err, &derr)).To(BeTrue())
+	g.Expect(derr.Flag).To(Equal("--aws-autologin-for-ecr"))
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import "context"
+
+type retryableKey struct{}
+
+// ContextWithRetryable returns a copy of ctx carrying a classifier of
+// the errors to retry, which the provider clients consult in addition
+// to their own classification for the requests they make with that
+// context: an error is retried when either deems it retryable.
+func ContextWithRetryable(ctx context.Context, isRetryable func(error) bool) context.Context {
+	return context.WithValue(ctx, retryableKey{}, isRetryable)
+}
+
+// RetryableFromContext returns the classifier of the errors to retry
+// carried by ctx, or nil if there is none.
+func RetryableFromContext(ctx context.Context) func(error) bool {
+	isRetryable, _ := ctx.Value(retryableKey{}).(func(error) bool)
+	return isRetryable
+}
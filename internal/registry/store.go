@@ -0,0 +1,33 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// CredentialStore holds registry credentials outside of Kubernetes
+// secrets, e.g. in Vault or a store synced by the External Secrets
+// Operator.
+type CredentialStore interface {
+	// Get returns the credentials for the registry host, and whether
+	// the store has any. An error is returned when the store can't be
+	// consulted.
+	Get(ctx context.Context, host string) (authn.AuthConfig, bool, error)
+}
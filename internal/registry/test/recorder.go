@@ -0,0 +1,228 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package test provides helpers for testing registry logins, such as a
+// transport recording the auth interactions with registries and
+// providers to a fixture file, and replaying them.
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+// record makes the recorders created with NewForTest record rather than
+// replay, e.g. `go test ./... -record`.
+var record = flag.Bool("record", false, "record the registry auth interactions to the fixtures rather than replaying them")
+
+// Mode tells whether a Recorder records or replays interactions.
+type Mode int
+
+const (
+	// ModeReplay makes the Recorder answer requests with the recorded
+	// responses, without sending them.
+	ModeReplay Mode = iota
+	// ModeRecord makes the Recorder send requests, and record them
+	// along with their responses.
+	ModeRecord
+)
+
+// Interaction is a request and the response it got.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a recorded request. Its headers aren't recorded,
+// so that the credentials the request is sent with don't end up in the
+// fixture.
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+// RecordedResponse is a recorded response. It is recorded as is, so
+// fixtures should only be recorded with throwaway credentials.
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// Recorder is a transport which records the requests it sends and the
+// responses it gets, or replays them. Requests are replayed in the
+// order they were recorded, and must match the recorded ones by method
+// and URL.
+type Recorder struct {
+	fixture string
+	mode    Mode
+	next    http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+	replayed     int
+}
+
+// NewRecorder returns a Recorder for the given fixture file. When
+// replaying, the fixture is loaded; when recording, requests are sent
+// with the given transport, or the default one if nil, and the fixture
+// is written by Save.
+func NewRecorder(fixture string, mode Mode, next http.RoundTripper) (*Recorder, error) {
+	r := &Recorder{
+		fixture: fixture,
+		mode:    mode,
+		next:    next,
+	}
+	if r.next == nil {
+		r.next = http.DefaultTransport
+	}
+	if mode == ModeReplay {
+		data, err := os.ReadFile(fixture)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixture: %w", err)
+		}
+		if err := json.Unmarshal(data, &r.interactions); err != nil {
+			return nil, fmt.Errorf("failed to parse fixture %s: %w", fixture, err)
+		}
+	}
+	return r, nil
+}
+
+// NewForTest returns a Recorder for the fixture, which records when the
+// tests are run with the -record flag and replays otherwise. A
+// recording Recorder saves the fixture when the test completes.
+func NewForTest(t testing.TB, fixture string, next http.RoundTripper) *Recorder {
+	t.Helper()
+	mode := ModeReplay
+	if *record {
+		mode = ModeRecord
+	}
+	r, err := NewRecorder(fixture, mode, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode == ModeRecord {
+		t.Cleanup(func() {
+			if err := r.Save(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	return r
+}
+
+// RoundTrip records or replays the request.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := RecordedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		recorded.Body = string(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if r.mode == ModeReplay {
+		return r.replay(req, recorded)
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, Interaction{
+		Request: recorded,
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       string(body),
+		},
+	})
+	return resp, nil
+}
+
+// replay returns the response recorded for the next interaction, which
+// must be for the request.
+func (r *Recorder) replay(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replayed >= len(r.interactions) {
+		return nil, fmt.Errorf("no recorded interaction left for %s %s", recorded.Method, recorded.URL)
+	}
+	interaction := r.interactions[r.replayed]
+	if interaction.Request.Method != recorded.Method || interaction.Request.URL != recorded.URL {
+		return nil, fmt.Errorf("request %s %s doesn't match the recorded %s %s", recorded.Method, recorded.URL,
+			interaction.Request.Method, interaction.Request.URL)
+	}
+	r.replayed++
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+		StatusCode:    interaction.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(interaction.Response.Body))),
+		ContentLength: int64(len(interaction.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Interactions returns the interactions recorded, or loaded for
+// replaying.
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Interaction(nil), r.interactions...)
+}
+
+// Save writes the recorded interactions to the fixture. It does nothing
+// when replaying.
+func (r *Recorder) Save() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.fixture, append(data, '\n'), 0o644)
+}
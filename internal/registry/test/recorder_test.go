@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/gcp"
+)
+
+func TestRecorder_RecordReplay(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		g.Expect(r.Header.Get("Metadata-Flavor")).To(Equal("Google"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "recorded-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	tokenURL := srv.URL + "/computeMetadata/v1/instance/service-accounts/default/token"
+	fixture := filepath.Join(t.TempDir(), "gcp-login.json")
+
+	image := "gcr.io/foo/bar:v1"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	login := func(rt http.RoundTripper) (string, error) {
+		ctx := registry.ContextWithTransport(context.TODO(), rt)
+		auth, err := gcp.NewClient().WithTokenURL(tokenURL).Login(ctx, true, image, ref)
+		if err != nil {
+			return "", err
+		}
+		authConfig, err := auth.Authorization()
+		if err != nil {
+			return "", err
+		}
+		return authConfig.Password, nil
+	}
+
+	recorder, err := NewRecorder(fixture, ModeRecord, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	password, err := login(recorder)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(password).To(Equal("recorded-token"))
+	g.Expect(recorder.Save()).To(Succeed())
+	g.Expect(recorder.Interactions()).To(HaveLen(1))
+
+	// The request headers aren't recorded.
+	data, err := os.ReadFile(fixture)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(data)).ToNot(ContainSubstring("Metadata-Flavor"))
+
+	// Replaying doesn't need the server.
+	srv.Close()
+	replayer, err := NewRecorder(fixture, ModeReplay, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	password, err = login(replayer)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(password).To(Equal("recorded-token"))
+	g.Expect(calls).To(Equal(1))
+
+	// There is nothing left to replay.
+	_, err = login(replayer)
+	g.Expect(err).To(MatchError(ContainSubstring("no recorded interaction left")))
+}
+
+func TestRecorder_ReplayMismatch(t *testing.T) {
+	g := NewWithT(t)
+
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+	g.Expect(os.WriteFile(fixture, []byte(`[{
+  "request": {"method": "GET", "url": "https://gcr.io/v2/"},
+  "response": {"statusCode": 200}
+}]`), 0o644)).To(Succeed())
+
+	replayer, err := NewRecorder(fixture, ModeReplay, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	client := &http.Client{Transport: replayer}
+
+	_, err = client.Get("https://docker.io/v2/")
+	g.Expect(err).To(MatchError(ContainSubstring("doesn't match the recorded GET https://gcr.io/v2/")))
+
+	resp, err := client.Get("https://gcr.io/v2/")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resp.StatusCode).To(Equal(http.StatusOK))
+}
+
+func TestNewRecorder_MissingFixture(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := NewRecorder(filepath.Join(t.TempDir(), "missing.json"), ModeReplay, nil)
+	g.Expect(err).To(HaveOccurred())
+}
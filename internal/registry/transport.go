@@ -0,0 +1,358 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type transportKey struct{}
+
+// ContextWithTransport returns a copy of ctx carrying the given
+// transport, which the provider clients then use for all the
+// requests they make with that context (in the same manner as
+// `oauth2.HTTPClient`).
+func ContextWithTransport(ctx context.Context, rt http.RoundTripper) context.Context {
+	return context.WithValue(ctx, transportKey{}, rt)
+}
+
+// TransportFromContext returns the transport carried by ctx, or nil if
+// there is none.
+func TransportFromContext(ctx context.Context) http.RoundTripper {
+	rt, _ := ctx.Value(transportKey{}).(http.RoundTripper)
+	return rt
+}
+
+type userAgentKey struct{}
+
+// ContextWithUserAgent returns a copy of ctx carrying the given
+// User-Agent, which the provider clients then set on the requests they
+// make with that context, on top of the transport they use for them
+// (see TransportFor).
+func ContextWithUserAgent(ctx context.Context, ua string) context.Context {
+	return context.WithValue(ctx, userAgentKey{}, ua)
+}
+
+// UserAgentFromContext returns the User-Agent carried by ctx, or an
+// empty string if there is none.
+func UserAgentFromContext(ctx context.Context) string {
+	ua, _ := ctx.Value(userAgentKey{}).(string)
+	return ua
+}
+
+type forceHTTP1Key struct{}
+
+// ContextWithForceHTTP1 returns a copy of ctx making the provider
+// clients use HTTP/1.1 only for the requests they make with that
+// context, when they have no transport of their own (see
+// TransportFor).
+func ContextWithForceHTTP1(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceHTTP1Key{}, true)
+}
+
+// ForceHTTP1FromContext returns whether ctx was made by
+// ContextWithForceHTTP1.
+func ForceHTTP1FromContext(ctx context.Context) bool {
+	force, _ := ctx.Value(forceHTTP1Key{}).(bool)
+	return force
+}
+
+var (
+	http1TransportOnce sync.Once
+	http1Transport     *http.Transport
+)
+
+// defaultHTTP1Transport returns the transport used in place of
+// http.DefaultTransport with HTTP/1.1 only. It is shared, so that its
+// connections are reused across logins.
+func defaultHTTP1Transport() *http.Transport {
+	http1TransportOnce.Do(func() {
+		http1Transport = NewTransportBuilder(nil).WithForceHTTP1(true).Build()
+	})
+	return http1Transport
+}
+
+// TransportFor returns the transport for the requests made with ctx
+// by a client using the given transport of its own, nil meaning
+// http.DefaultTransport: the transport carried by ctx, if any, else
+// the client's own, setting the User-Agent carried by ctx, if any.
+// With a ctx made by ContextWithForceHTTP1, a client without a
+// transport of its own gets a shared one using HTTP/1.1 only; the
+// transports of the context and of the client are used as they are.
+// It is nil when there is neither a transport nor a User-Agent, for
+// the client to go with its defaults.
+func TransportFor(ctx context.Context, own http.RoundTripper) http.RoundTripper {
+	rt := TransportFromContext(ctx)
+	if rt == nil {
+		rt = own
+	}
+	if rt == nil && ForceHTTP1FromContext(ctx) {
+		rt = defaultHTTP1Transport()
+	}
+	ua := UserAgentFromContext(ctx)
+	if ua == "" {
+		return rt
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return UserAgent(ua)(rt)
+}
+
+// TransportChain returns a function composing the given wrappers
+// around a base transport, e.g. to layer proxying, tracing and
+// retries. The wrappers apply in order: the first one is the
+// outermost, and sees requests first. A nil base transport means
+// http.DefaultTransport.
+func TransportChain(wrappers ...func(http.RoundTripper) http.RoundTripper) func(http.RoundTripper) http.RoundTripper {
+	return func(base http.RoundTripper) http.RoundTripper {
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		rt := base
+		for i := len(wrappers) - 1; i >= 0; i-- {
+			rt = wrappers[i](rt)
+		}
+		return rt
+	}
+}
+
+// TransportBuilder builds the transports used for the requests made to
+// registries, and to providers for logging in.
+type TransportBuilder struct {
+	base           *http.Transport
+	forceHTTP1     bool
+	resolver       *net.Resolver
+	idleConnMaxAge time.Duration
+}
+
+// NewTransportBuilder returns a builder of transports configured like
+// the given base transport, which isn't modified. A nil base means
+// http.DefaultTransport.
+func NewTransportBuilder(base *http.Transport) *TransportBuilder {
+	return &TransportBuilder{base: base}
+}
+
+// WithForceHTTP1 makes the built transports use HTTP/1.1 only, for
+// registries which misbehave with HTTP/2 multiplexing.
+func (b *TransportBuilder) WithForceHTTP1(force bool) *TransportBuilder {
+	b.forceHTTP1 = force
+	return b
+}
+
+// WithResolver makes the built transports resolve the hosts they dial
+// with the given resolver, e.g. for split-horizon DNS. The dialer of the
+// base transport is then replaced by one with the same timeouts as
+// that of http.DefaultTransport.
+func (b *TransportBuilder) WithResolver(resolver *net.Resolver) *TransportBuilder {
+	b.resolver = resolver
+	return b
+}
+
+// WithIdleConnMaxAge makes the built transports close their
+// connections once they have been idle in their pool for longer than
+// the age, so that a long-lived controller doesn't accumulate idle
+// connections to the many registries it has talked to, including
+// through transports it no longer uses. A connection is only idle
+// while no request uses it: one waiting for a slow registry to answer
+// isn't. The idle connection timeout of the base transport still
+// applies when shorter. Zero or less means no other timeout than that
+// of the base transport, the default.
+func (b *TransportBuilder) WithIdleConnMaxAge(age time.Duration) *TransportBuilder {
+	b.idleConnMaxAge = age
+	return b
+}
+
+// Build returns a new transport with the configuration of the builder.
+func (b *TransportBuilder) Build() *http.Transport {
+	base := b.base
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	if b.resolver != nil {
+		t.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Resolver:  b.resolver,
+		}).DialContext
+	}
+	if age := b.idleConnMaxAge; age > 0 && (t.IdleConnTimeout <= 0 || age < t.IdleConnTimeout) {
+		// The transport tracks the connections returned to its pool,
+		// and closes those which stay there for longer than the
+		// timeout.
+		t.IdleConnTimeout = age
+	}
+	if b.forceHTTP1 {
+		// A non-nil, empty TLSNextProto disables HTTP/2; see the
+		// documentation of net/http.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if t.TLSClientConfig != nil {
+			// The base may offer h2 through ALPN, which the server
+			// would then pick.
+			t.TLSClientConfig = t.TLSClientConfig.Clone()
+			var protos []string
+			for _, proto := range t.TLSClientConfig.NextProtos {
+				if proto != "h2" {
+					protos = append(protos, proto)
+				}
+			}
+			t.TLSClientConfig.NextProtos = protos
+		}
+	}
+	return t
+}
+
+// realmRe matches the realm parameter of an authentication challenge.
+var realmRe = regexp.MustCompile(`realm="[^"]*"`)
+
+// OverrideRealm returns a wrapper making the bearer challenges of the
+// responses, in their WWW-Authenticate header, point at the given
+// realm, whatever the realm the registry announces. The bearer flow
+// otherwise follows the announced realm, which is what's needed e.g.
+// behind a reverse proxy rewriting the Host header; this is for
+// registries announcing a realm the client can't reach.
+func OverrideRealm(realm string) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return realmOverrideTransport{realm: realm, next: rt}
+	}
+}
+
+type realmOverrideTransport struct {
+	realm string
+	next  http.RoundTripper
+}
+
+func (t realmOverrideTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	challenges := resp.Header.Values("WWW-Authenticate")
+	if len(challenges) == 0 {
+		return resp, nil
+	}
+	resp.Header.Del("WWW-Authenticate")
+	for _, challenge := range challenges {
+		if strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			challenge = realmRe.ReplaceAllLiteralString(challenge, `realm="`+t.realm+`"`)
+		}
+		resp.Header.Add("WWW-Authenticate", challenge)
+	}
+	return resp, nil
+}
+
+// RealmToRequestHost returns a wrapper making the bearer challenges of
+// the responses point at a realm on the scheme and host the request was
+// sent to, keeping the path and query of the realm the registry
+// announces. This is for registries behind a reverse proxy which build
+// their realm from the forwarded headers of the proxy, or from their own
+// address, which the client can't be trusted to follow.
+func RealmToRequestHost() func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return realmToRequestHostTransport{next: rt}
+	}
+}
+
+type realmToRequestHostTransport struct {
+	next http.RoundTripper
+}
+
+func (t realmToRequestHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	challenges := resp.Header.Values("WWW-Authenticate")
+	if len(challenges) == 0 {
+		return resp, nil
+	}
+	resp.Header.Del("WWW-Authenticate")
+	for _, challenge := range challenges {
+		if strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			challenge = realmRe.ReplaceAllStringFunc(challenge, func(param string) string {
+				realm, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(param, `realm="`), `"`))
+				if err != nil {
+					return param
+				}
+				realm.Scheme, realm.Host = req.URL.Scheme, req.URL.Host
+				return `realm="` + realm.String() + `"`
+			})
+		}
+		resp.Header.Add("WWW-Authenticate", challenge)
+	}
+	return resp, nil
+}
+
+// UserAgent returns a wrapper setting the User-Agent header of the
+// requests to the given value.
+func UserAgent(ua string) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return userAgentTransport{ua: ua, next: rt}
+	}
+}
+
+type userAgentTransport struct {
+	ua   string
+	next http.RoundTripper
+}
+
+// RoundTrip sets the User-Agent header of a copy of the request, and
+// sends it.
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.ua)
+	return t.next.RoundTrip(req)
+}
+
+// ExtraHeaders returns a wrapper adding the given headers to the
+// requests, e.g. the tenant identifiers some registries require. The
+// headers the requests already carry are left as is, and the
+// Authorization and Proxy-Authorization headers are never set.
+func ExtraHeaders(headers map[string]string) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return extraHeadersTransport{headers: headers, next: rt}
+	}
+}
+
+type extraHeadersTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+// RoundTrip adds the extra headers to a copy of the request, and sends
+// it.
+func (t extraHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		key = http.CanonicalHeaderKey(key)
+		if key == "Authorization" || key == "Proxy-Authorization" || req.Header.Get(key) != "" {
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+	return t.next.RoundTrip(req)
+}
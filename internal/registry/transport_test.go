@@ -0,0 +1,518 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestAnonymousTokenRefresh checks that an anonymous bearer token
+// which expires in the middle of a scan, as those of Docker Hub do, is
+// refreshed once and the request retried, using the same remote
+// options as the scan.
+func TestAnonymousTokenRefresh(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var issued int
+	var srv *httptest.Server
+	challenge := func(w http.ResponseWriter) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="registry.docker.io",scope="repository:library/nginx:pull"`, srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/token":
+			issued++
+			json.NewEncoder(w).Encode(map[string]string{"token": fmt.Sprintf("token-%d", issued)})
+		case r.URL.Path == "/v2/":
+			challenge(w)
+		case strings.HasSuffix(r.URL.Path, "/tags/list"):
+			// Only the latest token is valid; the first one has
+			// expired by the time it's used.
+			if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", issued) || issued < 2 {
+				challenge(w)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name": "library/nginx",
+				"tags": []string{"1.21", "1.22"},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/library/nginx")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := remote.List(repo, remote.WithContext(context.TODO()))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(ConsistOf("1.21", "1.22"))
+	g.Expect(issued).To(Equal(2))
+}
+
+// roundTripperFunc implements http.RoundTripper with a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportChain(t *testing.T) {
+	g := NewWithT(t)
+
+	var calls []string
+	wrapper := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls = append(calls, name+" before")
+				resp, err := next.RoundTrip(req)
+				calls = append(calls, name+" after")
+				return resp, err
+			})
+		}
+	}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls = append(calls, "base")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := TransportChain(wrapper("proxy"), wrapper("tracing"), wrapper("retry"))(base)
+	resp, err := (&http.Client{Transport: rt}).Get("http://registry.example.com/v2/")
+	g.Expect(err).ToNot(HaveOccurred())
+	resp.Body.Close()
+	g.Expect(calls).To(Equal([]string{
+		"proxy before", "tracing before", "retry before",
+		"base",
+		"retry after", "tracing after", "proxy after",
+	}))
+}
+
+func TestTransportChain_DefaultBase(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(TransportChain()(nil)).To(Equal(http.DefaultTransport))
+}
+
+func TestUserAgent(t *testing.T) {
+	g := NewWithT(t)
+
+	var userAgent string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		userAgent = req.Header.Get("User-Agent")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("User-Agent", "go-containerregistry")
+	resp, err := UserAgent("image-reflector-controller")(base).RoundTrip(req)
+	g.Expect(err).ToNot(HaveOccurred())
+	resp.Body.Close()
+	g.Expect(userAgent).To(Equal("image-reflector-controller"))
+	// The request of the caller is left as is.
+	g.Expect(req.Header.Get("User-Agent")).To(Equal("go-containerregistry"))
+}
+
+func TestTransportFor(t *testing.T) {
+	g := NewWithT(t)
+
+	var seen []string
+	recorder := func(name string) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			seen = append(seen, name+" "+req.Header.Get("User-Agent"))
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		})
+	}
+	roundTrip := func(rt http.RoundTripper) {
+		req, err := http.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		resp, err := rt.RoundTrip(req)
+		g.Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+	}
+
+	// Without a transport nor a User-Agent, the client goes with its
+	// defaults.
+	g.Expect(TransportFor(context.TODO(), nil)).To(BeNil())
+
+	// The User-Agent is set on top of the client's own transport...
+	ctx := ContextWithUserAgent(context.TODO(), "image-reflector-controller")
+	roundTrip(TransportFor(ctx, recorder("own")))
+	// ...or of the transport of the context, which takes precedence.
+	roundTrip(TransportFor(ContextWithTransport(ctx, recorder("context")), recorder("own")))
+	roundTrip(TransportFor(ContextWithTransport(context.TODO(), recorder("context")), recorder("own")))
+	g.Expect(seen).To(Equal([]string{
+		"own image-reflector-controller",
+		"context image-reflector-controller",
+		"context ",
+	}))
+
+	// Forcing HTTP/1.1 replaces the default transport only.
+	ctx = ContextWithForceHTTP1(context.TODO())
+	rt, ok := TransportFor(ctx, nil).(*http.Transport)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rt.TLSNextProto).ToNot(BeNil())
+	g.Expect(rt.TLSNextProto).To(BeEmpty())
+	g.Expect(TransportFor(ctx, nil)).To(BeIdenticalTo(rt))
+	seen = nil
+	roundTrip(TransportFor(ctx, recorder("own")))
+	roundTrip(TransportFor(ContextWithTransport(ctx, recorder("context")), nil))
+	g.Expect(seen).To(Equal([]string{"own ", "context "}))
+}
+
+func TestExtraHeaders(t *testing.T) {
+	g := NewWithT(t)
+
+	var header http.Header
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	rt := ExtraHeaders(map[string]string{
+		"x-meta-tenant":       "team-a",
+		"X-Meta-Region":       "eu",
+		"Authorization":       "Basic Zm9vOmJhcg==",
+		"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+	})(base)
+
+	req, err := http.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("X-Meta-Region", "us")
+	resp, err := rt.RoundTrip(req)
+	g.Expect(err).ToNot(HaveOccurred())
+	resp.Body.Close()
+	g.Expect(header.Get("X-Meta-Tenant")).To(Equal("team-a"))
+	g.Expect(header.Get("X-Meta-Region")).To(Equal("us"))
+	g.Expect(header.Get("Authorization")).To(BeEmpty())
+	g.Expect(header.Get("Proxy-Authorization")).To(BeEmpty())
+}
+
+func TestTransportBuilder(t *testing.T) {
+	tlsConfig := &tls.Config{ServerName: "registry.example.com", NextProtos: []string{"h2", "http/1.1"}}
+
+	tests := []struct {
+		name       string
+		base       *http.Transport
+		forceHTTP1 bool
+		wantHTTP2  bool
+	}{
+		{
+			name:      "default base",
+			wantHTTP2: true,
+		},
+		{
+			name:       "default base forcing HTTP/1.1",
+			forceHTTP1: true,
+		},
+		{
+			name:       "custom base forcing HTTP/1.1",
+			base:       &http.Transport{TLSClientConfig: tlsConfig.Clone(), ForceAttemptHTTP2: true},
+			forceHTTP1: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			tr := NewTransportBuilder(tt.base).WithForceHTTP1(tt.forceHTTP1).Build()
+			g.Expect(tr.ForceAttemptHTTP2).To(Equal(tt.wantHTTP2))
+			if tt.forceHTTP1 {
+				g.Expect(tr.TLSNextProto).ToNot(BeNil())
+				g.Expect(tr.TLSNextProto).To(BeEmpty())
+			}
+			if tt.base != nil {
+				g.Expect(tr).ToNot(BeIdenticalTo(tt.base))
+				g.Expect(tr.TLSClientConfig.ServerName).To(Equal(tlsConfig.ServerName))
+				g.Expect(tr.TLSClientConfig.NextProtos).To(Equal([]string{"http/1.1"}))
+				g.Expect(tt.base.TLSClientConfig.NextProtos).To(Equal(tlsConfig.NextProtos))
+				// The base transport is left as it is.
+				g.Expect(tt.base.ForceAttemptHTTP2).To(BeTrue())
+			}
+		})
+	}
+}
+
+func TestTransportBuilder_ForceHTTP1(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, force := range []bool{false, true} {
+		base := srv.Client().Transport.(*http.Transport)
+		tr := NewTransportBuilder(base).WithForceHTTP1(force).Build()
+
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		g.Expect(err).ToNot(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		g.Expect(err).ToNot(HaveOccurred())
+		if force {
+			g.Expect(string(body)).To(Equal("HTTP/1.1"))
+		} else {
+			g.Expect(string(body)).To(Equal("HTTP/2.0"))
+		}
+	}
+}
+
+// fakeDNSServer answers the A queries for host with 127.0.0.1, and
+// the other queries with NXDOMAIN.
+func fakeDNSServer(t *testing.T, host string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+				ID:            header.ID,
+				Response:      true,
+				Authoritative: true,
+			})
+			b.EnableCompression()
+			known := q.Name.String() == host+"."
+			if !known {
+				b = dnsmessage.NewBuilder(nil, dnsmessage.Header{
+					ID:       header.ID,
+					Response: true,
+					RCode:    dnsmessage.RCodeNameError,
+				})
+			}
+			b.StartQuestions()
+			b.Question(q)
+			if known && q.Type == dnsmessage.TypeA {
+				b.StartAnswers()
+				b.AResource(dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// closeRecordingConn records whether it was closed.
+type closeRecordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *closeRecordingConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *closeRecordingConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestTransportBuilder_WithIdleConnMaxAge(t *testing.T) {
+	g := NewWithT(t)
+
+	const age = 200 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// The request is in flight for longer than the age.
+			time.Sleep(3 * age)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// The base transport hooks into the dialing of connections, to
+	// tell when they are closed.
+	var mu sync.Mutex
+	var dialed []*closeRecordingConn
+	base := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			c := &closeRecordingConn{Conn: conn}
+			mu.Lock()
+			dialed = append(dialed, c)
+			mu.Unlock()
+			return c, nil
+		},
+	}
+	dialedConns := func() []*closeRecordingConn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*closeRecordingConn{}, dialed...)
+	}
+
+	tr := NewTransportBuilder(base).WithIdleConnMaxAge(age).Build()
+	g.Expect(tr.IdleConnTimeout).To(Equal(age))
+	client := &http.Client{Transport: tr}
+	get := func(path string) {
+		resp, err := client.Get(srv.URL + path)
+		g.Expect(err).ToNot(HaveOccurred())
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(body)).To(Equal("ok"))
+	}
+
+	// A request waiting for a slow answer keeps its connection.
+	get("/slow")
+	conns := dialedConns()
+	g.Expect(conns).To(HaveLen(1))
+	g.Expect(conns[0].isClosed()).To(BeFalse())
+
+	// The connection is closed once it has been idle in the pool for
+	// the age.
+	g.Eventually(conns[0].isClosed, 5*age, age/10).Should(BeTrue())
+
+	// The transport dials a new connection for the next request.
+	get("/")
+	g.Expect(dialedConns()).To(HaveLen(2))
+
+	// A shorter idle timeout of the base transport still applies.
+	base.IdleConnTimeout = age / 2
+	g.Expect(NewTransportBuilder(base).WithIdleConnMaxAge(age).Build().IdleConnTimeout).To(Equal(age / 2))
+}
+
+func TestTransportBuilder_WithResolver(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	dnsAddr := fakeDNSServer(t, "registry.fake")
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", dnsAddr)
+		},
+	}
+	tr := NewTransportBuilder(nil).WithResolver(resolver).Build()
+
+	fakeURL := "http://registry.fake:" + u.Port() + "/v2/"
+	resp, err := (&http.Client{Transport: tr}).Get(fakeURL)
+	g.Expect(err).ToNot(HaveOccurred())
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(body)).To(Equal("registry.fake:" + u.Port()))
+}
+
+func TestOverrideRealm(t *testing.T) {
+	g := NewWithT(t)
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Add("WWW-Authenticate", `Bearer realm="https://upstream.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull"`)
+		header.Add("WWW-Authenticate", `Basic realm="upstream"`)
+		return &http.Response{StatusCode: http.StatusUnauthorized, Header: header, Body: http.NoBody}, nil
+	})
+	rt := TransportChain(OverrideRealm("https://proxy.example.com/token"))(base)
+
+	req, err := http.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	resp, err := rt.RoundTrip(req)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resp.Header.Values("WWW-Authenticate")).To(Equal([]string{
+		`Bearer realm="https://proxy.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull"`,
+		`Basic realm="upstream"`,
+	}))
+}
+
+func TestRealmToRequestHost(t *testing.T) {
+	g := NewWithT(t)
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Add("WWW-Authenticate", `Bearer realm="http://registry.internal:5000/token?account=flux",service="registry.example.com"`)
+		header.Add("WWW-Authenticate", `Basic realm="upstream"`)
+		return &http.Response{StatusCode: http.StatusUnauthorized, Header: header, Body: http.NoBody}, nil
+	})
+	rt := TransportChain(RealmToRequestHost())(base)
+
+	req, err := http.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	resp, err := rt.RoundTrip(req)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resp.Header.Values("WWW-Authenticate")).To(Equal([]string{
+		`Bearer realm="https://registry.example.com/token?account=flux",service="registry.example.com"`,
+		`Basic realm="upstream"`,
+	}))
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2022 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+type minValidityKey struct{}
+
+// ContextWithMinValidity returns a copy of ctx carrying the minimum
+// validity of the credentials obtained with it: the provider clients
+// then only hand out cached tokens which remain valid for at least that
+// long, and get new ones otherwise.
+func ContextWithMinValidity(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, minValidityKey{}, d)
+}
+
+// MinValidityFromContext returns the minimum validity carried by ctx,
+// or zero if there is none.
+func MinValidityFromContext(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(minValidityKey{}).(time.Duration)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
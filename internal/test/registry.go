@@ -3,6 +3,7 @@ package test
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -31,6 +32,23 @@ func NewRegistryServer() *httptest.Server {
 	return srv
 }
 
+// NewAnonymousTokenRegistryServer sets up a local registry which, like
+// Docker Hub and Quay for public images, requires a bearer token even
+// for anonymous pulls, issued without credentials by its token
+// endpoint.
+func NewAnonymousTokenRegistryServer() *httptest.Server {
+	regHandler := registry.New()
+	regHandler = &TagListHandler{
+		RegistryHandler: regHandler,
+		Imagetags:       convenientTags,
+	}
+	regHandler = &AnonymousTokenHandler{
+		registryHandler: regHandler,
+		token:           "anonymous-token",
+	}
+	return httptest.NewServer(regHandler)
+}
+
 func NewAuthenticatedRegistryServer(username, pass string) *httptest.Server {
 	regHandler := registry.New()
 	regHandler = &TagListHandler{
@@ -170,3 +188,31 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	h.registryHandler.ServeHTTP(w, r)
 }
+
+// AnonymousTokenHandler wraps a registry handler so that requests need
+// a bearer token, which its /token endpoint issues to anyone asking
+// without credentials.
+type AnonymousTokenHandler struct {
+	token           string
+	registryHandler http.Handler
+}
+
+// ServeHTTP serves a request which needs the anonymous token, or a
+// request for the token.
+func (h *AnonymousTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": h.token})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+h.token {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry"`, r.Host))
+		w.WriteHeader(401)
+		return
+	}
+	h.registryHandler.ServeHTTP(w, r)
+}
@@ -42,6 +42,8 @@ import (
 	// +kubebuilder:scaffold:imports
 	"github.com/fluxcd/image-reflector-controller/controllers"
 	"github.com/fluxcd/image-reflector-controller/internal/database"
+	"github.com/fluxcd/image-reflector-controller/internal/registry"
+	"github.com/fluxcd/image-reflector-controller/internal/registry/login"
 )
 
 const controllerName = "image-reflector-controller"
@@ -73,6 +75,7 @@ func main() {
 		awsAutoLogin            bool
 		gcpAutoLogin            bool
 		azureAutoLogin          bool
+		forceHTTP1              bool
 		aclOptions              acl.Options
 	)
 
@@ -84,9 +87,12 @@ func main() {
 	flag.StringVar(&storagePath, "storage-path", "/data", "Where to store the persistent database of image metadata")
 	flag.Int64Var(&storageValueLogFileSize, "storage-value-log-file-size", 1<<28, "Set the database's memory mapped value log file size in bytes. Effective memory usage is about two times this size.")
 	flag.IntVar(&concurrent, "concurrent", 4, "The number of concurrent resource reconciles.")
-	flag.BoolVar(&awsAutoLogin, "aws-autologin-for-ecr", false, "(AWS) Attempt to get credentials for images in Elastic Container Registry, when no secret is referenced")
-	flag.BoolVar(&gcpAutoLogin, "gcp-autologin-for-gcr", false, "(GCP) Attempt to get credentials for images in Google Container Registry, when no secret is referenced")
-	flag.BoolVar(&azureAutoLogin, "azure-autologin-for-acr", false, "(Azure) Attempt to get credentials for images in Azure Container Registry, when no secret is referenced")
+	// The environment provides the defaults of the auto-login flags.
+	envLoginOptions := login.ProviderOptionsFromEnv()
+	flag.BoolVar(&awsAutoLogin, "aws-autologin-for-ecr", envLoginOptions.AwsAutoLogin, "(AWS) Attempt to get credentials for images in Elastic Container Registry, when no secret is referenced")
+	flag.BoolVar(&gcpAutoLogin, "gcp-autologin-for-gcr", envLoginOptions.GcpAutoLogin, "(GCP) Attempt to get credentials for images in Google Container Registry, when no secret is referenced")
+	flag.BoolVar(&azureAutoLogin, "azure-autologin-for-acr", envLoginOptions.AzureAutoLogin, "(Azure) Attempt to get credentials for images in Azure Container Registry, when no secret is referenced")
+	flag.BoolVar(&forceHTTP1, "force-http1", false, "Use HTTP/1.1 only when talking to registries and to cloud providers for logging in, for registries misbehaving with HTTP/2")
 
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
@@ -109,6 +115,8 @@ func main() {
 
 	metricsRecorder := metrics.NewRecorder()
 	crtlmetrics.Registry.MustRegister(metricsRecorder.Collectors()...)
+	credentialExpiryMetrics := registry.NewCredentialExpiryMetrics()
+	crtlmetrics.Registry.MustRegister(credentialExpiryMetrics)
 
 	watchNamespace := ""
 	if !watchAllNamespaces {
@@ -152,8 +160,10 @@ func main() {
 		AwsAutoLogin:    awsAutoLogin,
 		GcpAutoLogin:    gcpAutoLogin,
 		AzureAutoLogin:  azureAutoLogin,
+		ForceHTTP1:      forceHTTP1,
 	}).SetupWithManager(mgr, controllers.ImageRepositoryReconcilerOptions{
 		MaxConcurrentReconciles: concurrent,
+		CredentialExpiryMetrics: credentialExpiryMetrics,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", imagev1.ImageRepositoryKind)
 		os.Exit(1)